@@ -0,0 +1,677 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+const (
+	approvalAllow = "allow"
+	approvalAsk   = "ask"
+	approvalDeny  = "deny"
+
+	defaultAgentApprovalTimeout = 10 * time.Minute
+	agentAuditListLimit         = 100
+
+	// agentRunAwaitingApproval is a live run's status while it waits for an
+	// answer.
+	agentRunAwaitingApproval = "awaiting_approval"
+	agentEventApproval       = "approval"
+)
+
+// defaultAgentAskCommands need a human's approval unless
+// AGENT_ASK_COMMANDS says otherwise: deletions, pushes, network tools and
+// privilege escalation.
+var defaultAgentAskCommands = []string{
+	"rm", "git push", "curl", "wget", "nc", "ncat", "ssh", "scp", "rsync", "sudo",
+}
+
+// maxShellNesting bounds how deep sh -c, eval, wrappers and substitutions
+// are unwrapped; anything deeper is matched as written.
+const maxShellNesting = 8
+
+var (
+	errApprovalNotFound = errors.New("no such pending approval")
+
+	envAssignment = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*=`)
+
+	// shellKeywords may precede a command without being one.
+	shellKeywords = map[string]bool{
+		"!": true, "{": true, "}": true, "if": true, "then": true, "else": true, "elif": true,
+		"fi": true, "do": true, "done": true, "while": true, "until": true, "esac": true,
+	}
+)
+
+// agentPolicy decides whether an agent's command runs, needs approval, or is
+// refused. Patterns are matched against every simple command the line runs
+// (see splitShellCommands), after dropping leading VAR=value assignments and
+// any directory from the program name. A pattern matches a command that
+// equals it or starts with it followed by arguments, and "*" matches
+// anything: "git push" matches "git push origin main", "rm *.log" matches
+// "rm a.log". The strictest match wins: deny, then ask, then allow, then
+// Default.
+//
+// This is a guard against mistakes, not a sandbox: a command can still hide
+// what it runs behind variables, scripts or interpreters (python -c, make).
+type agentPolicy struct {
+	Default string
+	Allow   []string
+	Ask     []string
+	Deny    []string
+}
+
+// evaluate returns the action for a command line and the rule that decided it.
+func (p agentPolicy) evaluate(command string) (action, rule string) {
+	action, rule = approvalAllow, ""
+	rank := map[string]int{approvalAllow: 0, approvalAsk: 1, approvalDeny: 2}
+	for _, segment := range splitShellCommands(command) {
+		a, r := p.evaluateSimple(segment)
+		if rank[a] > rank[action] || (rank[a] == rank[action] && rule == "" && r != "") {
+			action, rule = a, r
+		}
+	}
+	return action, rule
+}
+
+func (p agentPolicy) evaluateSimple(segment string) (string, string) {
+	for _, list := range []struct {
+		action   string
+		patterns []string
+	}{{approvalDeny, p.Deny}, {approvalAsk, p.Ask}, {approvalAllow, p.Allow}} {
+		for _, pattern := range list.patterns {
+			if matchCommandPattern(pattern, segment) {
+				return list.action, list.action + ": " + pattern
+			}
+		}
+	}
+	return firstNonEmpty(p.Default, approvalAllow), ""
+}
+
+// evaluateWrite gates write_file. Writing ordinary files is allowed, but a
+// script, a git hook or a shell startup file is a command that runs later
+// without passing evaluate, so it needs approval (or is refused when the
+// default is deny).
+func (p agentPolicy) evaluateWrite(filePath, content string) (action, rule string) {
+	reason := executableWriteReason(filePath, content)
+	if reason == "" {
+		return approvalAllow, ""
+	}
+	if p.Default == approvalDeny {
+		return approvalDeny, "deny: " + reason
+	}
+	return approvalAsk, "ask: " + reason
+}
+
+// executableWriteReason says why writing content to filePath (absolute and
+// clean) amounts to running code, or returns "".
+func executableWriteReason(filePath, content string) string {
+	dir, base := path.Dir(filePath), path.Base(filePath)
+	switch {
+	case strings.HasPrefix(content, "#!"):
+		return "writes a script"
+	case strings.Contains(filePath, "/.git/hooks/") || strings.Contains(filePath, "/.husky/") || strings.HasSuffix(filePath, "/.git/config"):
+		return "writes a git hook or git config"
+	case path.Base(dir) == "bin" || strings.HasPrefix(filePath, "/etc/"):
+		return "writes into " + dir
+	}
+	switch base {
+	case ".bashrc", ".bash_profile", ".bash_login", ".bash_logout", ".profile", ".zshrc", ".zshenv", ".zprofile":
+		return "writes a shell startup file"
+	}
+	return ""
+}
+
+// splitShellCommands returns the simple commands a line runs, each as its
+// words joined by single spaces. It follows quoting and escapes, descends
+// into $(...) and `...` (inside double quotes too), and unwraps commands
+// that run other commands: sh/bash -c, eval, env, xargs, exec, command,
+// nice, time, nohup, timeout, sudo, doas and find -exec. find -delete
+// counts as rm. The wrapper is kept as a command of its own, so a rule for
+// "sudo" still applies.
+func splitShellCommands(command string) []string {
+	var out []string
+	for _, words := range shellCommands(command, 0) {
+		out = append(out, strings.Join(words, " "))
+	}
+	return out
+}
+
+// shellCommands lexes a command line into unwrapped simple commands.
+func shellCommands(line string, depth int) [][]string {
+	if depth > maxShellNesting {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			return [][]string{fields}
+		}
+		return nil
+	}
+	var (
+		out    [][]string
+		words  []string
+		word   strings.Builder
+		inWord bool
+	)
+	endWord := func() {
+		if inWord {
+			words = append(words, word.String())
+			word.Reset()
+			inWord = false
+		}
+	}
+	endCommand := func() {
+		endWord()
+		out = append(out, unwrapCommand(words, depth)...)
+		words = nil
+	}
+	// substitute records the commands of $(...) or `...` starting at
+	// line[i] and returns the index of its last byte.
+	substitute := func(i int) int {
+		var inner string
+		end := len(line) - 1
+		if line[i] == '`' {
+			if j := strings.IndexByte(line[i+1:], '`'); j >= 0 {
+				end = i + 1 + j
+			}
+			inner = line[i+1 : min(end+1, len(line))]
+			inner = strings.TrimSuffix(inner, "`")
+		} else {
+			end = closingParen(line, i+2)
+			inner = line[i+2 : min(end, len(line))]
+		}
+		out = append(out, shellCommands(inner, depth+1)...)
+		word.WriteString(line[i:min(end+1, len(line))])
+		inWord = true
+		return end
+	}
+
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == '\\' && i+1 < len(line):
+			i++
+			if line[i] != '\n' {
+				word.WriteByte(line[i])
+				inWord = true
+			}
+		case c == '\'':
+			j := strings.IndexByte(line[i+1:], '\'')
+			if j < 0 {
+				j = len(line) - i - 1
+			}
+			word.WriteString(line[i+1 : i+1+j])
+			inWord = true
+			i += j + 1
+		case c == '"':
+			inWord = true
+			for i++; i < len(line) && line[i] != '"'; i++ {
+				switch {
+				case line[i] == '\\' && i+1 < len(line) && strings.IndexByte("$`\"\\\n", line[i+1]) >= 0:
+					i++
+					word.WriteByte(line[i])
+				case line[i] == '`' || strings.HasPrefix(line[i:], "$("):
+					i = substitute(i)
+				default:
+					word.WriteByte(line[i])
+				}
+			}
+		case c == '`' || strings.HasPrefix(line[i:], "$("):
+			i = substitute(i)
+		case c == '&' && (i > 0 && (line[i-1] == '>' || line[i-1] == '<') || i+1 < len(line) && line[i+1] == '>'):
+			word.WriteByte(c) // 2>&1, &>file
+			inWord = true
+		case c == ' ' || c == '\t':
+			endWord()
+		case strings.IndexByte(";&|\n()", c) >= 0:
+			endCommand()
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	endCommand()
+	return out
+}
+
+// closingParen returns the index of the ) matching an already opened (,
+// searching from start, or len(line) if there is none.
+func closingParen(line string, start int) int {
+	depth := 1
+	for i := start; i < len(line); i++ {
+		switch line[i] {
+		case '(':
+			depth++
+		case ')':
+			if depth--; depth == 0 {
+				return i
+			}
+		}
+	}
+	return len(line)
+}
+
+// unwrapCommand normalizes a simple command and adds the commands it runs
+// on its behalf.
+func unwrapCommand(words []string, depth int) [][]string {
+	for len(words) > 0 && (envAssignment.MatchString(words[0]) || shellKeywords[words[0]]) {
+		words = words[1:]
+	}
+	if len(words) == 0 {
+		return nil
+	}
+	words = append([]string{path.Base(words[0])}, words[1:]...)
+	out := [][]string{words}
+	if depth >= maxShellNesting {
+		return out
+	}
+	args := words[1:]
+	var inner []string
+	switch words[0] {
+	case "sh", "bash", "dash", "zsh", "ksh", "ash":
+		if script, ok := shellScriptArg(args); ok {
+			return append(out, shellCommands(script, depth+1)...)
+		}
+	case "eval":
+		return append(out, shellCommands(strings.Join(args, " "), depth+1)...)
+	case "env":
+		inner = skipOptions(args, "-u", "-C", "--unset", "--chdir")
+		if len(args) > 0 && (args[0] == "-S" || args[0] == "--split-string") {
+			return append(out, shellCommands(strings.Join(args[1:], " "), depth+1)...)
+		}
+		for len(inner) > 0 && envAssignment.MatchString(inner[0]) {
+			inner = inner[1:]
+		}
+	case "xargs":
+		inner = skipOptions(args, "-I", "-L", "-n", "-P", "-s", "-d", "-E", "-a",
+			"--arg-file", "--delimiter", "--max-args", "--max-procs", "--max-chars", "--max-lines", "--replace", "--eof")
+		if len(inner) == 0 {
+			inner = []string{"echo"}
+		}
+	case "exec":
+		inner = skipOptions(args, "-a")
+	case "command", "builtin":
+		if !slices.Contains(args, "-v") && !slices.Contains(args, "-V") {
+			inner = skipOptions(args)
+		}
+	case "nice":
+		inner = skipOptions(args, "-n", "--adjustment")
+	case "time":
+		inner = skipOptions(args, "-f", "-o", "--format", "--output")
+	case "nohup", "setsid", "stdbuf":
+		inner = skipOptions(args, "-i", "-o", "-e")
+	case "timeout":
+		if inner = skipOptions(args, "-s", "-k", "--signal", "--kill-after"); len(inner) > 0 {
+			inner = inner[1:] // the duration
+		}
+	case "sudo", "doas":
+		inner = skipOptions(args, "-u", "-g", "-h", "-p", "-C", "-D", "-r", "-t", "-U", "-T", "-R",
+			"--user", "--group", "--host", "--prompt", "--close-from", "--chdir", "--role", "--type", "--other-user", "--command-timeout", "--chroot")
+	case "find":
+		for i := 0; i < len(args); i++ {
+			switch args[i] {
+			case "-delete":
+				out = append(out, []string{"rm"})
+			case "-exec", "-execdir", "-ok", "-okdir":
+				j := i + 1
+				for j < len(args) && args[j] != ";" && args[j] != "+" {
+					j++
+				}
+				out = append(out, unwrapCommand(args[i+1:j], depth+1)...)
+				i = j
+			}
+		}
+	}
+	if len(inner) > 0 {
+		out = append(out, unwrapCommand(inner, depth+1)...)
+	}
+	return out
+}
+
+// skipOptions drops leading options (and the values of those listed in
+// withValue) and returns the command that follows.
+func skipOptions(args []string, withValue ...string) []string {
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") && args[0] != "-" {
+		opt := args[0]
+		args = args[1:]
+		if opt == "--" {
+			break
+		}
+		if slices.Contains(withValue, opt) && len(args) > 0 {
+			args = args[1:]
+		}
+	}
+	return args
+}
+
+// shellScriptArg finds the script of "sh -c script" among a shell's
+// arguments, including combined flags like -ec and options before it.
+func shellScriptArg(args []string) (string, bool) {
+	sawC := false
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		switch {
+		case a == "-o" || a == "+o" || a == "-O" || a == "+O" || a == "--rcfile" || a == "--init-file":
+			i++
+		case strings.HasPrefix(a, "--"):
+		case len(a) > 1 && (a[0] == '-' || a[0] == '+'):
+			sawC = sawC || a[0] == '-' && strings.Contains(a[1:], "c")
+		default:
+			return a, sawC
+		}
+	}
+	return "", false
+}
+
+func matchCommandPattern(pattern, segment string) bool {
+	pattern = strings.Join(strings.Fields(pattern), " ")
+	if pattern == "" {
+		return false
+	}
+	expr := strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, `.*`)
+	ok, _ := regexp.MatchString(`^`+expr+`( .*)?$`, segment)
+	return ok
+}
+
+// agentApproval is a tool call waiting for the run owner's decision.
+type agentApproval struct {
+	Id        string    `json:"id"`
+	RunId     string    `json:"runId"`
+	CallId    string    `json:"callId"`
+	Tool      string    `json:"tool"`
+	Command   string    `json:"command"`
+	Rule      string    `json:"rule"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+
+	answer chan approvalAnswer
+}
+
+type approvalAnswer struct {
+	Approve bool
+	By      string
+	Reason  string
+}
+
+// agentApprovalEvent is the data of an approval event: one when the request
+// is made (state "pending") and one when it is resolved.
+type agentApprovalEvent struct {
+	Approval  agentApproval `json:"approval"`
+	State     string        `json:"state"` // pending, approved, denied or expired
+	DecidedBy string        `json:"decidedBy,omitempty"`
+	Reason    string        `json:"reason,omitempty"`
+}
+
+// agentAuditEntry records who allowed or refused what.
+type agentAuditEntry struct {
+	Id        int64     `json:"id"`
+	RunId     string    `json:"runId"`
+	Tool      string    `json:"tool"`
+	Command   string    `json:"command"`
+	Decision  string    `json:"decision"` // approved or denied
+	DecidedBy string    `json:"decidedBy"`
+	Rule      string    `json:"rule,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// errApprovalDenied aborts a run whose owner refused a command.
+type errApprovalDenied struct {
+	by, reason string
+}
+
+func (e *errApprovalDenied) Error() string {
+	msg := "command denied by " + e.by
+	if e.reason != "" {
+		msg += ": " + e.reason
+	}
+	return msg
+}
+
+// gateToolCall applies the policy to a command or file write before it runs
+// (a write is shown as "write_file <path>" in approvals and the audit log).
+// It returns ok=false with a message for the model when the policy refuses
+// the call, and an error (ending the run) when the owner denies it or the
+// run stops.
+func (s *AgentService) gateToolCall(ctx context.Context, live *liveAgentRun, call agentToolCall) (ok bool, refusal string, err error) {
+	var args agentToolArgs
+	_ = json.Unmarshal(call.Arguments, &args)
+	var action, rule string
+	switch call.Name {
+	case "run_command":
+		action, rule = s.cfg.AgentPolicy.evaluate(args.Command)
+	case "write_file":
+		p, err := resolveFilePath(args.Path)
+		if err != nil {
+			return true, "", nil // the tool reports the bad path
+		}
+		action, rule = s.cfg.AgentPolicy.evaluateWrite(p, args.Content)
+		args.Command = "write_file " + p
+	default:
+		return true, "", nil
+	}
+	run := live.snapshot()
+
+	switch action {
+	case approvalAllow:
+		return true, "", nil
+	case approvalDeny:
+		s.audit(run, agentAuditEntry{Tool: call.Name, Command: args.Command, Decision: "denied", DecidedBy: "policy", Rule: rule})
+		return false, "refused by policy (" + rule + "); do not retry this command", nil
+	}
+
+	now := time.Now().UTC()
+	approval := &agentApproval{
+		Id:        newShellSessionID(),
+		RunId:     run.Id,
+		CallId:    call.Id,
+		Tool:      call.Name,
+		Command:   args.Command,
+		Rule:      rule,
+		CreatedAt: now,
+		ExpiresAt: now.Add(s.cfg.AgentApprovalTimeout),
+		answer:    make(chan approvalAnswer, 1),
+	}
+	live.mu.Lock()
+	live.pending = approval
+	live.run.Status = agentRunAwaitingApproval
+	live.mu.Unlock()
+	s.record(live, agentEventApproval, agentApprovalEvent{Approval: *approval, State: "pending"})
+	defer func() {
+		live.mu.Lock()
+		live.pending = nil
+		live.run.Status = agentRunRunning
+		live.mu.Unlock()
+	}()
+
+	timer := time.NewTimer(s.cfg.AgentApprovalTimeout)
+	defer timer.Stop()
+	var answer approvalAnswer
+	state := "expired"
+	select {
+	case answer = <-approval.answer:
+		state = "denied"
+		if answer.Approve {
+			state = "approved"
+		}
+	case <-timer.C:
+		answer = approvalAnswer{By: "timeout", Reason: fmt.Sprintf("no answer within %s", s.cfg.AgentApprovalTimeout)}
+	case <-ctx.Done():
+		return false, "", ctx.Err()
+	}
+	s.record(live, agentEventApproval, agentApprovalEvent{Approval: *approval, State: state, DecidedBy: answer.By, Reason: answer.Reason})
+	decision := "denied"
+	if answer.Approve {
+		decision = "approved"
+	}
+	s.audit(run, agentAuditEntry{Tool: call.Name, Command: args.Command, Decision: decision, DecidedBy: answer.By, Rule: rule, Reason: answer.Reason})
+	if !answer.Approve {
+		return false, "", &errApprovalDenied{by: answer.By, reason: answer.Reason}
+	}
+	return true, "", nil
+}
+
+// answerApproval delivers the owner's decision to a waiting run.
+func (s *AgentService) answerApproval(owner, runID, approvalID string, answer approvalAnswer) error {
+	live := s.liveRun(runID)
+	if live == nil {
+		return errApprovalNotFound
+	}
+	live.mu.Lock()
+	defer live.mu.Unlock()
+	if live.run.Owner != owner || live.pending == nil || live.pending.Id != approvalID {
+		return errApprovalNotFound
+	}
+	select {
+	case live.pending.answer <- answer:
+		return nil
+	default:
+		return errApprovalNotFound // already answered
+	}
+}
+
+func (s *AgentService) audit(run agentRun, entry agentAuditEntry) {
+	entry.RunId = run.Id
+	entry.CreatedAt = time.Now().UTC()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s.store.appendAudit(ctx, run.Owner, entry); err != nil {
+		log.Printf("[agent] run %s: storing audit entry: %v", run.Id, err)
+	}
+}
+
+// POST /agent/runs/{id}/approvals/{approval} {"approve": true, "reason": "..."}
+func (s *AgentService) handleAnswerApproval(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJson(w, http.StatusMethodNotAllowed, dockerActionResponse{Ok: false, Message: "method not allowed"})
+		return
+	}
+	owner, ok := s.docker.requireOwner(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Approve bool   `json:"approve"`
+		Reason  string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJson(w, http.StatusBadRequest, dockerActionResponse{Ok: false, Message: "invalid json body"})
+		return
+	}
+	err := s.answerApproval(owner, r.PathValue("id"), r.PathValue("approval"), approvalAnswer{Approve: req.Approve, By: owner, Reason: req.Reason})
+	if err != nil {
+		writeJson(w, http.StatusNotFound, dockerActionResponse{Ok: false, Message: err.Error()})
+		return
+	}
+	writeJson(w, http.StatusOK, dockerActionResponse{Ok: true, Message: "answered"})
+}
+
+// GET /agent/approvals
+// Lists the caller's pending approvals across all runs.
+func (s *AgentService) handleListApprovals(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJson(w, http.StatusMethodNotAllowed, dockerActionResponse{Ok: false, Message: "method not allowed"})
+		return
+	}
+	owner, ok := s.docker.requireOwner(w, r)
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	runs := make([]*liveAgentRun, 0, len(s.live))
+	for _, live := range s.live {
+		runs = append(runs, live)
+	}
+	s.mu.Unlock()
+
+	pending := []agentApproval{}
+	for _, live := range runs {
+		live.mu.Lock()
+		if live.run.Owner == owner && live.pending != nil {
+			pending = append(pending, *live.pending)
+		}
+		live.mu.Unlock()
+	}
+	writeJson(w, http.StatusOK, map[string]any{"approvals": pending})
+}
+
+// GET /agent/audit
+// Returns the caller's most recent approval decisions.
+func (s *AgentService) handleAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJson(w, http.StatusMethodNotAllowed, dockerActionResponse{Ok: false, Message: "method not allowed"})
+		return
+	}
+	owner, ok := s.docker.requireOwner(w, r)
+	if !ok {
+		return
+	}
+	entries, err := s.store.listAudit(r.Context(), owner, agentAuditListLimit)
+	if err != nil {
+		writeJson(w, http.StatusInternalServerError, dockerActionResponse{Ok: false, Message: err.Error()})
+		return
+	}
+	if entries == nil {
+		entries = []agentAuditEntry{}
+	}
+	writeJson(w, http.StatusOK, map[string]any{"entries": entries})
+}
+
+// readPolicySection reads approval rules from an INI section.
+func readPolicySection(sec *ini.Section) agentPolicy {
+	p := agentPolicy{
+		Default: sec.Key("AGENT_APPROVAL_DEFAULT").String(),
+		Allow:   parseCommandPatterns(sec.Key("AGENT_ALLOW_COMMANDS").String()),
+		Deny:    parseCommandPatterns(sec.Key("AGENT_DENY_COMMANDS").String()),
+	}
+	if sec.HasKey("AGENT_ASK_COMMANDS") {
+		p.Ask = parseCommandPatterns(sec.Key("AGENT_ASK_COMMANDS").String())
+	}
+	return p
+}
+
+// policyFromEnv applies approval env vars on top of the INI rules. A list
+// that is set (even to "") replaces the INI one; asks default to
+// defaultAgentAskCommands when neither sets them.
+func policyFromEnv(base agentPolicy) agentPolicy {
+	p := base
+	p.Default = firstNonEmpty(getEnvOptional("AGENT_APPROVAL_DEFAULT"), base.Default, approvalAllow)
+	if v, ok := os.LookupEnv("AGENT_ALLOW_COMMANDS"); ok {
+		p.Allow = parseCommandPatterns(v)
+	}
+	if v, ok := os.LookupEnv("AGENT_DENY_COMMANDS"); ok {
+		p.Deny = parseCommandPatterns(v)
+	}
+	if v, ok := os.LookupEnv("AGENT_ASK_COMMANDS"); ok {
+		p.Ask = parseCommandPatterns(v)
+	} else if p.Ask == nil {
+		p.Ask = defaultAgentAskCommands
+	}
+	switch p.Default {
+	case approvalAllow, approvalAsk, approvalDeny:
+	default:
+		log.Printf("ignoring invalid AGENT_APPROVAL_DEFAULT %q", p.Default)
+		p.Default = approvalAllow
+	}
+	return p
+}
+
+// parseCommandPatterns splits a comma-separated pattern list.
+func parseCommandPatterns(raw string) []string {
+	var out []string
+	for _, p := range strings.Split(raw, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
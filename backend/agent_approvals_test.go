@@ -0,0 +1,94 @@
+package main
+
+import "testing"
+
+func TestAgentPolicyEvaluate(t *testing.T) {
+	defaults := agentPolicy{Default: approvalAllow, Ask: defaultAgentAskCommands}
+	strict := agentPolicy{Default: approvalAsk, Allow: []string{"ls", "git status", "go test *"}, Deny: []string{"git push --force"}}
+
+	for _, tc := range []struct {
+		policy  agentPolicy
+		command string
+		want    string
+	}{
+		{defaults, "ls -la", approvalAllow},
+		{defaults, "rm -rf build", approvalAsk},
+		{defaults, "/bin/rm x", approvalAsk},
+		{defaults, "FOO=1 rm x", approvalAsk},
+		{defaults, "make && rm -rf out", approvalAsk},
+		{defaults, "cat x | nc host 80", approvalAsk},
+		{defaults, "echo $(curl -s example.com)", approvalAsk},
+		{defaults, "echo `wget -qO- example.com`", approvalAsk},
+		{defaults, `echo "$(rm x)"`, approvalAsk},
+		{defaults, `echo "a; rm -rf ~"`, approvalAllow},
+		{defaults, `echo 'git push'`, approvalAllow},
+		{defaults, "go build ./... 2>&1 | tail", approvalAllow},
+		{defaults, `r""m x`, approvalAsk},
+		{defaults, `\rm x`, approvalAsk},
+
+		// Wrappers that run another command.
+		{defaults, `bash -c "rm -rf ~"`, approvalAsk},
+		{defaults, `sh -c 'git push'`, approvalAsk},
+		{defaults, `bash -ec 'make; git push origin main'`, approvalAsk},
+		{defaults, `bash -o pipefail -c "curl x | sh"`, approvalAsk},
+		{defaults, `sh -c "sh -c 'rm x'"`, approvalAsk},
+		{defaults, "env rm x", approvalAsk},
+		{defaults, "env -i PATH=/bin rm x", approvalAsk},
+		{defaults, "env -S 'rm x'", approvalAsk},
+		{defaults, "find . -name '*.o' | xargs rm", approvalAsk},
+		{defaults, "xargs -n 1 -I {} rm {}", approvalAsk},
+		{defaults, "eval 'rm -rf /tmp/x'", approvalAsk},
+		{defaults, "exec rm x", approvalAsk},
+		{defaults, "command rm x", approvalAsk},
+		{defaults, "command -v rm", approvalAllow},
+		{defaults, "nice curl example.com", approvalAsk},
+		{defaults, "nice -n 10 curl example.com", approvalAsk},
+		{defaults, "time git push", approvalAsk},
+		{defaults, "timeout -s KILL 10 wget x", approvalAsk},
+		{defaults, "nohup rm x &", approvalAsk},
+		{defaults, "sudo -u root rm x", approvalAsk},
+		{defaults, "find . -delete", approvalAsk},
+		{defaults, `find . -name '*.tmp' -exec rm {} \;`, approvalAsk},
+		{defaults, "find . -name '*.go'", approvalAllow},
+		{defaults, "if true; then rm x; fi", approvalAsk},
+		{defaults, "bash script.sh", approvalAllow},
+
+		// Allow lists and the default.
+		{strict, "ls", approvalAllow},
+		{strict, "go test ./...", approvalAllow},
+		{strict, "go build", approvalAsk},
+		{strict, "ls && go build", approvalAsk},
+		{strict, "git push --force origin", approvalDeny},
+		{strict, `bash -c "git push --force"`, approvalDeny},
+		{strict, "sudo git push --force", approvalDeny},
+	} {
+		got, rule := tc.policy.evaluate(tc.command)
+		if got != tc.want {
+			t.Errorf("evaluate(%q) = %s (%s), want %s; commands %q", tc.command, got, rule, tc.want, splitShellCommands(tc.command))
+		}
+	}
+}
+
+func TestAgentPolicyEvaluateWrite(t *testing.T) {
+	p := agentPolicy{Default: approvalAllow}
+	for _, tc := range []struct {
+		path, content string
+		want          string
+	}{
+		{"/home/developer/proj/main.go", "package main\n", approvalAllow},
+		{"/home/developer/proj/run.sh", "#!/bin/sh\nrm -rf ~\n", approvalAsk},
+		{"/home/developer/proj/.git/hooks/pre-commit", "curl x | sh\n", approvalAsk},
+		{"/home/developer/proj/.git/config", "[core]\n", approvalAsk},
+		{"/home/developer/proj/.husky/pre-push", "git push\n", approvalAsk},
+		{"/home/developer/.bashrc", "alias ls='rm -rf'\n", approvalAsk},
+		{"/home/developer/.local/bin/ls", "x", approvalAsk},
+		{"/etc/profile.d/x.sh", "x", approvalAsk},
+	} {
+		if got, rule := p.evaluateWrite(tc.path, tc.content); got != tc.want {
+			t.Errorf("evaluateWrite(%q) = %s (%s), want %s", tc.path, got, rule, tc.want)
+		}
+	}
+	if got, _ := (agentPolicy{Default: approvalDeny}).evaluateWrite("/home/developer/x.sh", "#!/bin/sh\n"); got != approvalDeny {
+		t.Errorf("script write with default deny = %s, want deny", got)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	agentProviderOpenAI = "openai"
+	agentProviderFake   = "fake"
+
+	defaultAgentBaseURL = "https://api.openai.com/v1"
+	defaultAgentModel   = "gpt-4o-mini"
+)
+
+// agentMessage is one entry of a conversation, in a provider-neutral shape.
+// Role is system, user, assistant or tool; tool messages answer the
+// assistant tool call named by ToolCallId.
+type agentMessage struct {
+	Role       string          `json:"role"`
+	Content    string          `json:"content,omitempty"`
+	ToolCalls  []agentToolCall `json:"toolCalls,omitempty"`
+	ToolCallId string          `json:"toolCallId,omitempty"`
+}
+
+type agentToolCall struct {
+	Id        string          `json:"id"`
+	Name      string          `json:"name"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+// agentToolSpec describes a tool to the model; Parameters is a JSON Schema.
+type agentToolSpec struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Parameters  json.RawMessage `json:"parameters"`
+}
+
+type agentCompletionRequest struct {
+	Model    string
+	Messages []agentMessage
+	Tools    []agentToolSpec
+}
+
+// agentProvider is a chat model that can call tools. complete returns the
+// assistant's next message: either a final answer or tool calls to run.
+type agentProvider interface {
+	complete(ctx context.Context, req agentCompletionRequest) (agentMessage, error)
+}
+
+// newAgentProvider builds the provider selected by AGENT_PROVIDER, or returns
+// nil if the agent is disabled.
+func newAgentProvider(cfg *Config) (agentProvider, error) {
+	switch cfg.AgentProvider {
+	case "":
+		return nil, nil
+	case agentProviderOpenAI:
+		return &openAIProvider{
+			baseURL:    cfg.AgentBaseURL,
+			apiKey:     cfg.AgentAPIKey,
+			httpClient: &http.Client{Timeout: 5 * time.Minute},
+		}, nil
+	case agentProviderFake:
+		return loadFakeProvider(cfg.AgentFakeScript)
+	default:
+		return nil, fmt.Errorf("unknown AGENT_PROVIDER %q", cfg.AgentProvider)
+	}
+}
+
+// openAIProvider talks to any server implementing OpenAI's chat completions
+// API with function calling (OpenAI, Azure-style gateways, vLLM, Ollama...).
+type openAIProvider struct {
+	baseURL    string
+	apiKey     string
+	httpClient *http.Client
+}
+
+type openAIMessage struct {
+	Role       string           `json:"role"`
+	Content    *string          `json:"content"`
+	ToolCalls  []openAIToolCall `json:"tool_calls,omitempty"`
+	ToolCallId string           `json:"tool_call_id,omitempty"`
+}
+
+type openAIToolCall struct {
+	Id       string `json:"id"`
+	Type     string `json:"type"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+type openAITool struct {
+	Type     string        `json:"type"`
+	Function agentToolSpec `json:"function"`
+}
+
+func (p *openAIProvider) complete(ctx context.Context, req agentCompletionRequest) (agentMessage, error) {
+	body := struct {
+		Model    string          `json:"model"`
+		Messages []openAIMessage `json:"messages"`
+		Tools    []openAITool    `json:"tools,omitempty"`
+	}{Model: req.Model}
+	for _, msg := range req.Messages {
+		out := openAIMessage{Role: msg.Role, ToolCallId: msg.ToolCallId}
+		if msg.Content != "" || len(msg.ToolCalls) == 0 {
+			content := msg.Content
+			out.Content = &content
+		}
+		for _, call := range msg.ToolCalls {
+			tc := openAIToolCall{Id: call.Id, Type: "function"}
+			tc.Function.Name = call.Name
+			tc.Function.Arguments = string(call.Arguments)
+			out.ToolCalls = append(out.ToolCalls, tc)
+		}
+		body.Messages = append(body.Messages, out)
+	}
+	for _, tool := range req.Tools {
+		body.Tools = append(body.Tools, openAITool{Type: "function", Function: tool})
+	}
+	raw, err := json.Marshal(body)
+	if err != nil {
+		return agentMessage{}, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(p.baseURL, "/")+"/chat/completions", bytes.NewReader(raw))
+	if err != nil {
+		return agentMessage{}, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if p.apiKey != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+p.apiKey)
+	}
+	resp, err := p.httpClient.Do(httpReq)
+	if err != nil {
+		return agentMessage{}, fmt.Errorf("model request: %w", err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	if err != nil {
+		return agentMessage{}, fmt.Errorf("model request: %w", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var payload struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		message := strings.TrimSpace(string(respBody))
+		if json.Unmarshal(respBody, &payload) == nil && payload.Error.Message != "" {
+			message = payload.Error.Message
+		}
+		return agentMessage{}, fmt.Errorf("model request: %s: %s", resp.Status, message)
+	}
+
+	var parsed struct {
+		Choices []struct {
+			Message openAIMessage `json:"message"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal(respBody, &parsed); err != nil {
+		return agentMessage{}, fmt.Errorf("model response: %w", err)
+	}
+	if len(parsed.Choices) == 0 {
+		return agentMessage{}, errors.New("model response has no choices")
+	}
+	choice := parsed.Choices[0].Message
+	msg := agentMessage{Role: "assistant"}
+	if choice.Content != nil {
+		msg.Content = *choice.Content
+	}
+	for _, tc := range choice.ToolCalls {
+		args := json.RawMessage(tc.Function.Arguments)
+		if !json.Valid(args) {
+			// Keep malformed arguments as a string so the tool can report it.
+			args, _ = json.Marshal(tc.Function.Arguments)
+		}
+		msg.ToolCalls = append(msg.ToolCalls, agentToolCall{Id: tc.Id, Name: tc.Function.Name, Arguments: args})
+	}
+	return msg, nil
+}
+
+// fakeProvider replays a fixed script of assistant messages, for tests and
+// demos without a model. It is stateless: the reply to a conversation is the
+// script entry after the assistant messages already in it, so concurrent runs
+// each see the whole script. Past the end it answers "done".
+type fakeProvider struct {
+	script []agentMessage
+}
+
+func newFakeProvider(script []agentMessage) *fakeProvider {
+	return &fakeProvider{script: script}
+}
+
+// loadFakeProvider reads a JSON array of assistant messages, e.g.
+// [{"toolCalls":[{"name":"list_dir","arguments":{"path":"."}}]},{"content":"ok"}].
+func loadFakeProvider(path string) (*fakeProvider, error) {
+	if path == "" {
+		return newFakeProvider(nil), nil
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading AGENT_FAKE_SCRIPT: %w", err)
+	}
+	var script []agentMessage
+	if err := json.Unmarshal(raw, &script); err != nil {
+		return nil, fmt.Errorf("parsing AGENT_FAKE_SCRIPT: %w", err)
+	}
+	return newFakeProvider(script), nil
+}
+
+func (p *fakeProvider) complete(ctx context.Context, req agentCompletionRequest) (agentMessage, error) {
+	if err := ctx.Err(); err != nil {
+		return agentMessage{}, err
+	}
+	step := 0
+	for _, msg := range req.Messages {
+		if msg.Role == "assistant" {
+			step++
+		}
+	}
+	if step >= len(p.script) {
+		return agentMessage{Role: "assistant", Content: "done"}, nil
+	}
+	msg := p.script[step]
+	msg.Role = "assistant"
+	msg.ToolCalls = append([]agentToolCall(nil), msg.ToolCalls...)
+	for i := range msg.ToolCalls {
+		if msg.ToolCalls[i].Id == "" {
+			msg.ToolCalls[i].Id = fmt.Sprintf("call_%d_%d", step, i)
+		}
+		if len(msg.ToolCalls[i].Arguments) == 0 {
+			msg.ToolCalls[i].Arguments = json.RawMessage("{}")
+		}
+	}
+	return msg, nil
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	agentRunRunning   = "running"
+	agentRunSucceeded = "succeeded"
+	agentRunFailed    = "failed"
+	agentRunCanceled  = "canceled"
+
+	// Event kinds: a transcript message, a tool call with its result, and
+	// the run's final status.
+	agentEventMessage = "message"
+	agentEventTool    = "tool"
+	agentEventStatus  = "status"
+)
+
+var errAgentRunNotFound = errors.New("run not found")
+
+type agentRun struct {
+	Id         string     `json:"id"`
+	Owner      string     `json:"-"`
+	Prompt     string     `json:"prompt"`
+	Model      string     `json:"model"`
+	Status     string     `json:"status"`
+	Error      string     `json:"error,omitempty"`
+	Steps      int        `json:"steps"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+}
+
+// agentEvent is one entry of a run's log. Seq numbers start at 0 and have no
+// gaps, so watchers resume with "everything after seq N".
+type agentEvent struct {
+	Seq  int             `json:"seq"`
+	Kind string          `json:"kind"`
+	Data json.RawMessage `json:"data"`
+	At   time.Time       `json:"at"`
+}
+
+// agentToolEvent is the data of a tool event.
+type agentToolEvent struct {
+	Call       agentToolCall `json:"call"`
+	Output     string        `json:"output"`
+	IsError    bool          `json:"isError,omitempty"`
+	DurationMs int64         `json:"durationMs"`
+}
+
+// agentRunStore persists runs and their events.
+type agentRunStore interface {
+	createRun(ctx context.Context, run agentRun) error
+	updateRun(ctx context.Context, run agentRun) error
+	appendEvent(ctx context.Context, runID string, ev agentEvent) error
+	getRun(ctx context.Context, owner, id string) (agentRun, error)
+	listRuns(ctx context.Context, owner string, limit int) ([]agentRun, error)
+	eventsAfter(ctx context.Context, runID string, after int) ([]agentEvent, error)
+	// failInterrupted marks runs left "running" by a previous process.
+	failInterrupted(ctx context.Context) error
+	appendAudit(ctx context.Context, owner string, entry agentAuditEntry) error
+	listAudit(ctx context.Context, owner string, limit int) ([]agentAuditEntry, error)
+}
+
+// newAgentRunStore uses Postgres when a database is configured and falls
+// back to memory (runs are lost on restart) otherwise.
+func newAgentRunStore(db *DB) agentRunStore {
+	if db == nil {
+		return newMemoryRunStore()
+	}
+	return &sqlRunStore{db: db.SQL}
+}
+
+type memoryRunStore struct {
+	mu     sync.Mutex
+	runs   map[string]agentRun
+	events map[string][]agentEvent
+	audit  map[string][]agentAuditEntry // by owner, oldest first
+}
+
+func newMemoryRunStore() *memoryRunStore {
+	return &memoryRunStore{
+		runs:   make(map[string]agentRun),
+		events: make(map[string][]agentEvent),
+		audit:  make(map[string][]agentAuditEntry),
+	}
+}
+
+func (s *memoryRunStore) createRun(ctx context.Context, run agentRun) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.runs[run.Id] = run
+	return nil
+}
+
+func (s *memoryRunStore) updateRun(ctx context.Context, run agentRun) error {
+	return s.createRun(ctx, run)
+}
+
+func (s *memoryRunStore) appendEvent(ctx context.Context, runID string, ev agentEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events[runID] = append(s.events[runID], ev)
+	return nil
+}
+
+func (s *memoryRunStore) getRun(ctx context.Context, owner, id string) (agentRun, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	run, ok := s.runs[id]
+	if !ok || run.Owner != owner {
+		return agentRun{}, errAgentRunNotFound
+	}
+	return run, nil
+}
+
+func (s *memoryRunStore) listRuns(ctx context.Context, owner string, limit int) ([]agentRun, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []agentRun
+	for _, run := range s.runs {
+		if run.Owner == owner {
+			out = append(out, run)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.After(out[j].CreatedAt) })
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
+
+func (s *memoryRunStore) eventsAfter(ctx context.Context, runID string, after int) ([]agentEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	events := s.events[runID]
+	if after+1 >= len(events) {
+		return nil, nil
+	}
+	return append([]agentEvent(nil), events[max(after+1, 0):]...), nil
+}
+
+func (s *memoryRunStore) failInterrupted(ctx context.Context) error { return nil }
+
+func (s *memoryRunStore) appendAudit(ctx context.Context, owner string, entry agentAuditEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry.Id = int64(len(s.audit[owner]) + 1)
+	s.audit[owner] = append(s.audit[owner], entry)
+	return nil
+}
+
+func (s *memoryRunStore) listAudit(ctx context.Context, owner string, limit int) ([]agentAuditEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries := s.audit[owner]
+	var out []agentAuditEntry
+	for i := len(entries) - 1; i >= 0 && len(out) < limit; i-- {
+		out = append(out, entries[i])
+	}
+	return out, nil
+}
+
+type sqlRunStore struct {
+	db *sql.DB
+}
+
+const agentRunColumns = `id, owner, prompt, model, status, error, steps, created_at, finished_at`
+
+func scanAgentRun(row interface{ Scan(...any) error }) (agentRun, error) {
+	var run agentRun
+	var finished sql.NullTime
+	err := row.Scan(&run.Id, &run.Owner, &run.Prompt, &run.Model, &run.Status, &run.Error, &run.Steps, &run.CreatedAt, &finished)
+	if finished.Valid {
+		run.FinishedAt = &finished.Time
+	}
+	return run, err
+}
+
+func (s *sqlRunStore) createRun(ctx context.Context, run agentRun) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO agent_runs (`+agentRunColumns+`) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		run.Id, run.Owner, run.Prompt, run.Model, run.Status, run.Error, run.Steps, run.CreatedAt, run.FinishedAt)
+	return err
+}
+
+func (s *sqlRunStore) updateRun(ctx context.Context, run agentRun) error {
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE agent_runs SET status = $2, error = $3, steps = $4, finished_at = $5 WHERE id = $1`,
+		run.Id, run.Status, run.Error, run.Steps, run.FinishedAt)
+	return err
+}
+
+func (s *sqlRunStore) appendEvent(ctx context.Context, runID string, ev agentEvent) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO agent_run_events (run_id, seq, kind, data, created_at) VALUES ($1, $2, $3, $4, $5)`,
+		runID, ev.Seq, ev.Kind, []byte(ev.Data), ev.At)
+	return err
+}
+
+func (s *sqlRunStore) getRun(ctx context.Context, owner, id string) (agentRun, error) {
+	run, err := scanAgentRun(s.db.QueryRowContext(ctx,
+		`SELECT `+agentRunColumns+` FROM agent_runs WHERE id = $1 AND owner = $2`, id, owner))
+	if errors.Is(err, sql.ErrNoRows) {
+		return run, errAgentRunNotFound
+	}
+	return run, err
+}
+
+func (s *sqlRunStore) listRuns(ctx context.Context, owner string, limit int) ([]agentRun, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT `+agentRunColumns+` FROM agent_runs WHERE owner = $1 ORDER BY created_at DESC LIMIT $2`, owner, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []agentRun
+	for rows.Next() {
+		run, err := scanAgentRun(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, run)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqlRunStore) eventsAfter(ctx context.Context, runID string, after int) ([]agentEvent, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT seq, kind, data, created_at FROM agent_run_events WHERE run_id = $1 AND seq > $2 ORDER BY seq`, runID, after)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []agentEvent
+	for rows.Next() {
+		var ev agentEvent
+		var data []byte
+		if err := rows.Scan(&ev.Seq, &ev.Kind, &data, &ev.At); err != nil {
+			return nil, err
+		}
+		ev.Data = data
+		out = append(out, ev)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqlRunStore) failInterrupted(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE agent_runs SET status = $1, error = 'interrupted by a server restart', finished_at = now() WHERE status = $2`,
+		agentRunFailed, agentRunRunning)
+	return err
+}
+
+func (s *sqlRunStore) appendAudit(ctx context.Context, owner string, entry agentAuditEntry) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO agent_audit_log (owner, run_id, tool, command, decision, decided_by, rule, reason, created_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		owner, entry.RunId, entry.Tool, entry.Command, entry.Decision, entry.DecidedBy, entry.Rule, entry.Reason, entry.CreatedAt)
+	return err
+}
+
+func (s *sqlRunStore) listAudit(ctx context.Context, owner string, limit int) ([]agentAuditEntry, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT id, run_id, tool, command, decision, decided_by, rule, reason, created_at
+		 FROM agent_audit_log WHERE owner = $1 ORDER BY id DESC LIMIT $2`, owner, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []agentAuditEntry
+	for rows.Next() {
+		var e agentAuditEntry
+		if err := rows.Scan(&e.Id, &e.RunId, &e.Tool, &e.Command, &e.Decision, &e.DecidedBy, &e.Rule, &e.Reason, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,490 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	defaultAgentMaxSteps   = 30
+	defaultAgentRunTimeout = 30 * time.Minute
+	maxAgentPromptBytes    = 64 * 1024
+	agentRunListLimit      = 50
+	agentWatchPingInterval = 30 * time.Second
+
+	defaultAgentSystemPrompt = `You are a coding agent working inside the user's Linux dev container. ` +
+		`The user's home directory is /home/developer. Use the tools to inspect and change files ` +
+		`and to run commands; prefer small, verifiable steps. When the task is done, reply with a ` +
+		`short summary of what you changed and how you checked it.`
+)
+
+var (
+	errAgentDisabled  = errors.New("agent is not configured; set AGENT_PROVIDER")
+	errAgentRunActive = errors.New("an agent run is already in progress")
+)
+
+// AgentService runs LLM tool loops against users' dev containers. The model
+// sees the container through the tools in agent_tools.go; every message and
+// tool call is appended to the run's event log as it happens, which is what
+// watchers stream.
+type AgentService struct {
+	cfg      *Config
+	docker   *DockerManager
+	provider agentProvider
+	store    agentRunStore
+
+	mu     sync.Mutex
+	live   map[string]*liveAgentRun // by run id
+	active map[string]string        // owner -> running run id
+}
+
+// liveAgentRun is the in-process state of a run that is still executing.
+type liveAgentRun struct {
+	cancel context.CancelFunc
+	// recordMu keeps events stored in seq order without holding mu across
+	// the store write.
+	recordMu sync.Mutex
+
+	mu      sync.Mutex
+	run     agentRun
+	nextSeq int
+	changed chan struct{}  // closed and replaced whenever an event is added
+	pending *agentApproval // tool call waiting for the owner's answer
+}
+
+func NewAgentService(cfg *Config, docker *DockerManager, db *DB) (*AgentService, error) {
+	provider, err := newAgentProvider(cfg)
+	if err != nil {
+		return nil, err
+	}
+	s := &AgentService{
+		cfg:      cfg,
+		docker:   docker,
+		provider: provider,
+		store:    newAgentRunStore(db),
+		live:     make(map[string]*liveAgentRun),
+		active:   make(map[string]string),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s.store.failInterrupted(ctx); err != nil {
+		log.Printf("[agent] marking interrupted runs: %v", err)
+	}
+	if provider == nil {
+		log.Printf("[agent] disabled (AGENT_PROVIDER not set)")
+	} else if db == nil {
+		log.Printf("[agent] no database configured; runs are kept in memory only")
+	}
+	return s, nil
+}
+
+// start creates a run for owner and executes it in the background.
+func (s *AgentService) start(ctx context.Context, owner, prompt string) (agentRun, error) {
+	if s.provider == nil {
+		return agentRun{}, errAgentDisabled
+	}
+	s.mu.Lock()
+	if id, ok := s.active[owner]; ok {
+		s.mu.Unlock()
+		return agentRun{Id: id}, errAgentRunActive
+	}
+	run := agentRun{
+		Id:        newShellSessionID(),
+		Owner:     owner,
+		Prompt:    prompt,
+		Model:     s.cfg.AgentModel,
+		Status:    agentRunRunning,
+		CreatedAt: time.Now().UTC(),
+	}
+	s.active[owner] = run.Id
+	s.mu.Unlock()
+
+	if err := s.store.createRun(ctx, run); err != nil {
+		s.mu.Lock()
+		delete(s.active, owner)
+		s.mu.Unlock()
+		return agentRun{}, err
+	}
+	runCtx, cancel := context.WithTimeout(context.Background(), s.cfg.AgentRunTimeout)
+	live := &liveAgentRun{cancel: cancel, run: run, changed: make(chan struct{})}
+	s.mu.Lock()
+	s.live[run.Id] = live
+	s.mu.Unlock()
+
+	go func() {
+		defer cancel()
+		s.execute(runCtx, live)
+	}()
+	return run, nil
+}
+
+// execute is the tool loop: ask the model, run the tools it calls, feed the
+// results back, until it answers without tool calls or hits the step limit.
+func (s *AgentService) execute(ctx context.Context, live *liveAgentRun) {
+	run := live.snapshot()
+	// The run keeps the container from being reaped while the model thinks.
+	defer s.docker.activity.begin(run.Owner)()
+	messages := []agentMessage{
+		{Role: "system", Content: firstNonEmpty(s.cfg.AgentSystemPrompt, defaultAgentSystemPrompt)},
+		{Role: "user", Content: run.Prompt},
+	}
+	s.record(live, agentEventMessage, messages[1])
+
+	for step := 1; step <= s.cfg.AgentMaxSteps; step++ {
+		reply, err := s.provider.complete(ctx, agentCompletionRequest{
+			Model:    run.Model,
+			Messages: messages,
+			Tools:    agentToolSpecs,
+		})
+		if err != nil {
+			s.finish(ctx, live, err)
+			return
+		}
+		reply.Role = "assistant"
+		messages = append(messages, reply)
+		live.mu.Lock()
+		live.run.Steps = step
+		live.mu.Unlock()
+		s.record(live, agentEventMessage, reply)
+		if len(reply.ToolCalls) == 0 {
+			s.finish(ctx, live, nil)
+			return
+		}
+
+		for _, call := range reply.ToolCalls {
+			allowed, refusal, err := s.gateToolCall(ctx, live, call)
+			if err != nil {
+				s.finish(ctx, live, err)
+				return
+			}
+			started := time.Now()
+			output, isError := refusal, true
+			if allowed {
+				output, isError = s.docker.runAgentTool(ctx, run.Owner, call)
+			}
+			s.record(live, agentEventTool, agentToolEvent{
+				Call:       call,
+				Output:     output,
+				IsError:    isError,
+				DurationMs: time.Since(started).Milliseconds(),
+			})
+			result := agentMessage{Role: "tool", ToolCallId: call.Id, Content: output}
+			messages = append(messages, result)
+			s.record(live, agentEventMessage, result)
+			if ctx.Err() != nil {
+				s.finish(ctx, live, ctx.Err())
+				return
+			}
+		}
+	}
+	s.finish(ctx, live, fmt.Errorf("step limit of %d reached", s.cfg.AgentMaxSteps))
+}
+
+// record appends an event to the run's log and wakes its watchers.
+func (s *AgentService) record(live *liveAgentRun, kind string, data any) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		log.Printf("[agent] encoding %s event: %v", kind, err)
+		return
+	}
+	live.recordMu.Lock()
+	defer live.recordMu.Unlock()
+	live.mu.Lock()
+	runID := live.run.Id
+	ev := agentEvent{Seq: live.nextSeq, Kind: kind, Data: raw, At: time.Now().UTC()}
+	live.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s.store.appendEvent(ctx, runID, ev); err != nil {
+		log.Printf("[agent] run %s: storing event %d: %v", runID, ev.Seq, err)
+		return
+	}
+	live.mu.Lock()
+	live.nextSeq = ev.Seq + 1
+	close(live.changed)
+	live.changed = make(chan struct{})
+	live.mu.Unlock()
+}
+
+// finish stores the run's final status and retires it from the live set.
+func (s *AgentService) finish(ctx context.Context, live *liveAgentRun, runErr error) {
+	status, msg := agentRunSucceeded, ""
+	switch {
+	case runErr == nil:
+	case errors.Is(ctx.Err(), context.Canceled):
+		status, msg = agentRunCanceled, "canceled"
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		status, msg = agentRunFailed, fmt.Sprintf("timed out after %s", s.cfg.AgentRunTimeout)
+	default:
+		status, msg = agentRunFailed, runErr.Error()
+	}
+	s.record(live, agentEventStatus, map[string]string{"status": status, "error": msg})
+
+	live.mu.Lock()
+	now := time.Now().UTC()
+	live.run.Status, live.run.Error, live.run.FinishedAt = status, msg, &now
+	run := live.run
+	live.mu.Unlock()
+	storeCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s.store.updateRun(storeCtx, run); err != nil {
+		log.Printf("[agent] run %s: storing final status: %v", run.Id, err)
+	}
+
+	s.mu.Lock()
+	delete(s.live, run.Id)
+	if s.active[run.Owner] == run.Id {
+		delete(s.active, run.Owner)
+	}
+	s.mu.Unlock()
+	// Wake watchers once more so they notice the run is no longer live.
+	live.mu.Lock()
+	close(live.changed)
+	live.changed = make(chan struct{})
+	live.mu.Unlock()
+}
+
+func (l *liveAgentRun) snapshot() agentRun {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.run
+}
+
+// liveRun returns a still-executing run, or nil.
+func (s *AgentService) liveRun(id string) *liveAgentRun {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.live[id]
+}
+
+// getRun loads owner's run, preferring the live copy for running runs.
+func (s *AgentService) getRun(ctx context.Context, owner, id string) (agentRun, error) {
+	if live := s.liveRun(id); live != nil {
+		if run := live.snapshot(); run.Owner == owner {
+			return run, nil
+		}
+	}
+	return s.store.getRun(ctx, owner, id)
+}
+
+// POST /agent/runs {"prompt": "..."}  starts a run (202), or 409 if one is
+// already in progress.
+// GET  /agent/runs                    lists the caller's recent runs.
+func (s *AgentService) handleRuns(w http.ResponseWriter, r *http.Request) {
+	owner, ok := s.docker.requireOwner(w, r)
+	if !ok {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		runs, err := s.store.listRuns(r.Context(), owner, agentRunListLimit)
+		if err != nil {
+			writeJson(w, http.StatusInternalServerError, dockerActionResponse{Ok: false, Message: err.Error()})
+			return
+		}
+		for i := range runs {
+			if live := s.liveRun(runs[i].Id); live != nil {
+				runs[i] = live.snapshot()
+			}
+		}
+		if runs == nil {
+			runs = []agentRun{}
+		}
+		writeJson(w, http.StatusOK, map[string]any{"runs": runs})
+	case http.MethodPost:
+		var req struct {
+			Prompt string `json:"prompt"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAgentPromptBytes)).Decode(&req); err != nil {
+			writeJson(w, http.StatusBadRequest, dockerActionResponse{Ok: false, Message: "invalid json body"})
+			return
+		}
+		if strings.TrimSpace(req.Prompt) == "" {
+			writeJson(w, http.StatusBadRequest, dockerActionResponse{Ok: false, Message: "prompt is required"})
+			return
+		}
+		run, err := s.start(r.Context(), owner, req.Prompt)
+		switch {
+		case errors.Is(err, errAgentDisabled):
+			writeJson(w, http.StatusServiceUnavailable, dockerActionResponse{Ok: false, Message: err.Error()})
+		case errors.Is(err, errAgentRunActive):
+			writeJson(w, http.StatusConflict, map[string]any{"ok": false, "message": err.Error(), "runId": run.Id})
+		case err != nil:
+			writeJson(w, http.StatusInternalServerError, dockerActionResponse{Ok: false, Message: err.Error()})
+		default:
+			writeJson(w, http.StatusAccepted, run)
+		}
+	default:
+		writeJson(w, http.StatusMethodNotAllowed, dockerActionResponse{Ok: false, Message: "method not allowed"})
+	}
+}
+
+// GET /agent/runs/{id}
+// Returns the run and its full event log (transcript and tool calls).
+func (s *AgentService) handleRun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJson(w, http.StatusMethodNotAllowed, dockerActionResponse{Ok: false, Message: "method not allowed"})
+		return
+	}
+	run, ok := s.requireRun(w, r)
+	if !ok {
+		return
+	}
+	events, err := s.store.eventsAfter(r.Context(), run.Id, -1)
+	if err != nil {
+		writeJson(w, http.StatusInternalServerError, dockerActionResponse{Ok: false, Message: err.Error()})
+		return
+	}
+	if events == nil {
+		events = []agentEvent{}
+	}
+	writeJson(w, http.StatusOK, map[string]any{"run": run, "events": events})
+}
+
+// POST /agent/runs/{id}/cancel
+func (s *AgentService) handleCancelRun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJson(w, http.StatusMethodNotAllowed, dockerActionResponse{Ok: false, Message: "method not allowed"})
+		return
+	}
+	run, ok := s.requireRun(w, r)
+	if !ok {
+		return
+	}
+	live := s.liveRun(run.Id)
+	if live == nil {
+		writeJson(w, http.StatusConflict, dockerActionResponse{Ok: false, Message: "run already " + run.Status})
+		return
+	}
+	live.cancel()
+	writeJson(w, http.StatusAccepted, dockerActionResponse{Ok: true, Message: "canceling"})
+}
+
+// GET /agent/runs/{id}/ws[?after=<seq>]
+//
+// Streams a run over a WebSocket as JSON text frames: first
+// {"type":"run","run":{...}}, then {"type":"event","event":{...}} for every
+// event after seq (all of them by default) as they happen, and finally
+// {"type":"done","run":{...}} once the run has finished. The client answers
+// a pending approval event with
+// {"type":"approval","id":"<approval id>","approve":true,"reason":"..."}.
+func (s *AgentService) handleWatchRun(w http.ResponseWriter, r *http.Request) {
+	run, ok := s.requireRun(w, r)
+	if !ok {
+		return
+	}
+	after := -1
+	if raw := r.URL.Query().Get("after"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			writeJson(w, http.StatusBadRequest, dockerActionResponse{Ok: false, Message: "invalid after"})
+			return
+		}
+		after = n
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("agent websocket upgrade failed: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	// The client may answer approval requests; reading also notices when it
+	// goes away.
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go func() {
+		defer cancel()
+		for {
+			var msg struct {
+				Type    string `json:"type"`
+				Id      string `json:"id"`
+				Approve bool   `json:"approve"`
+				Reason  string `json:"reason"`
+			}
+			_, raw, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if json.Unmarshal(raw, &msg) == nil && msg.Type == "approval" {
+				err := s.answerApproval(run.Owner, run.Id, msg.Id, approvalAnswer{Approve: msg.Approve, By: run.Owner, Reason: msg.Reason})
+				if err != nil {
+					log.Printf("[agent] run %s: approval %s over websocket: %v", run.Id, msg.Id, err)
+				}
+			}
+		}
+	}()
+
+	if err := conn.WriteJSON(map[string]any{"type": "run", "run": run}); err != nil {
+		return
+	}
+	ping := time.NewTicker(agentWatchPingInterval)
+	defer ping.Stop()
+	for {
+		// Take the wakeup channel before reading, so an event stored in
+		// between still wakes us.
+		var changed chan struct{}
+		if live := s.liveRun(run.Id); live != nil {
+			live.mu.Lock()
+			changed = live.changed
+			live.mu.Unlock()
+		}
+		events, err := s.store.eventsAfter(ctx, run.Id, after)
+		if err != nil {
+			log.Printf("[agent] run %s: reading events: %v", run.Id, err)
+			return
+		}
+		for _, ev := range events {
+			if err := conn.WriteJSON(map[string]any{"type": "event", "event": ev}); err != nil {
+				return
+			}
+			after = ev.Seq
+		}
+		if changed == nil {
+			final, err := s.getRun(ctx, run.Owner, run.Id)
+			if err == nil {
+				_ = conn.WriteJSON(map[string]any{"type": "done", "run": final})
+			}
+			_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			return
+		}
+		select {
+		case <-changed:
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)); err != nil {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *AgentService) requireRun(w http.ResponseWriter, r *http.Request) (agentRun, bool) {
+	owner, ok := s.docker.requireOwner(w, r)
+	if !ok {
+		return agentRun{}, false
+	}
+	run, err := s.getRun(r.Context(), owner, r.PathValue("id"))
+	if errors.Is(err, errAgentRunNotFound) {
+		writeJson(w, http.StatusNotFound, dockerActionResponse{Ok: false, Message: err.Error()})
+		return run, false
+	}
+	if err != nil {
+		writeJson(w, http.StatusInternalServerError, dockerActionResponse{Ok: false, Message: err.Error()})
+		return run, false
+	}
+	return run, true
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestAgent returns an AgentService replaying script against a fake
+// Docker daemon with a running container for owner.
+func newTestAgent(t *testing.T, owner string, script []agentMessage) (*AgentService, *fakeDocker) {
+	t.Helper()
+	cfg := testConfig()
+	cfg.AgentMaxSteps = 10
+	cfg.AgentRunTimeout = time.Minute
+	cfg.AgentApprovalTimeout = time.Minute
+	cfg.AgentPolicy = agentPolicy{Default: approvalAllow}
+	m, docker := newTestManager(t, cfg, newTestAuth(t, cfg))
+	docker.add(managedContainer(owner, "127.0.0.1"))
+	return &AgentService{
+		cfg:      cfg,
+		docker:   m,
+		provider: newFakeProvider(script),
+		store:    newMemoryRunStore(),
+		live:     make(map[string]*liveAgentRun),
+		active:   make(map[string]string),
+	}, docker
+}
+
+func toolCall(name string, args any) agentToolCall {
+	raw, _ := json.Marshal(args)
+	return agentToolCall{Name: name, Arguments: raw}
+}
+
+// waitForRun waits until the run has finished and returns it with its
+// stored events.
+func waitForRun(t *testing.T, s *AgentService, owner, id string) (agentRun, []agentEvent) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for s.liveRun(id) != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("run did not finish")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	run, err := s.store.getRun(context.Background(), owner, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, err := s.store.eventsAfter(context.Background(), id, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return run, events
+}
+
+// transcript renders events as "kind role/tool: text" lines.
+func transcript(t *testing.T, events []agentEvent) []string {
+	t.Helper()
+	var out []string
+	for i, ev := range events {
+		if ev.Seq != i {
+			t.Errorf("event %d has seq %d", i, ev.Seq)
+		}
+		switch ev.Kind {
+		case agentEventMessage:
+			var msg agentMessage
+			_ = json.Unmarshal(ev.Data, &msg)
+			line := "message " + msg.Role + ": " + msg.Content
+			for _, c := range msg.ToolCalls {
+				line += " [" + c.Name + "]"
+			}
+			out = append(out, line)
+		case agentEventTool:
+			var te agentToolEvent
+			_ = json.Unmarshal(ev.Data, &te)
+			out = append(out, fmt.Sprintf("tool %s: error=%v %s", te.Call.Name, te.IsError, strings.TrimSpace(te.Output)))
+		case agentEventStatus:
+			var st map[string]string
+			_ = json.Unmarshal(ev.Data, &st)
+			out = append(out, "status "+st["status"]+": "+st["error"])
+		}
+	}
+	return out
+}
+
+func TestAgentExecuteToolLoop(t *testing.T) {
+	owner := "alice@example.com"
+	s, docker := newTestAgent(t, owner, []agentMessage{
+		{ToolCalls: []agentToolCall{toolCall("run_command", map[string]string{"command": "echo hi"})}},
+		{Content: "said hi"},
+	})
+	docker.exec = func(cfg dockerExecConfig, stdin io.Reader, stdout, stderr io.Writer) int {
+		if strings.Join(cfg.Cmd, " ") != "sh -c echo hi" {
+			fmt.Fprintf(stderr, "unexpected command %q", cfg.Cmd)
+			return 127
+		}
+		fmt.Fprintln(stdout, "hi")
+		return 0
+	}
+
+	started, err := s.start(context.Background(), owner, "say hi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	run, events := waitForRun(t, s, owner, started.Id)
+	if run.Status != agentRunSucceeded || run.Steps != 2 || run.FinishedAt == nil {
+		t.Errorf("run = %+v, want succeeded after 2 steps", run)
+	}
+	want := []string{
+		"message user: say hi",
+		"message assistant:  [run_command]",
+		"tool run_command: error=false exit code: 0\n--- stdout ---\nhi",
+		"message tool: exit code: 0\n--- stdout ---\nhi\n",
+		"message assistant: said hi",
+		"status succeeded: ",
+	}
+	if got := transcript(t, events); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("transcript:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// The tool result went back to the model with the call's id.
+	var result agentMessage
+	_ = json.Unmarshal(events[3].Data, &result)
+	if result.ToolCallId != "call_0_0" {
+		t.Errorf("tool result answers %q, want call_0_0", result.ToolCallId)
+	}
+	if _, err := s.start(context.Background(), owner, "again"); err != nil {
+		t.Errorf("starting a second run after the first finished: %v", err)
+	}
+}
+
+func TestAgentExecuteStepLimit(t *testing.T) {
+	owner := "alice@example.com"
+	runLs := agentMessage{ToolCalls: []agentToolCall{toolCall("run_command", map[string]string{"command": "ls"})}}
+	s, _ := newTestAgent(t, owner, []agentMessage{runLs, runLs, runLs, {Content: "never reached"}})
+	s.cfg.AgentMaxSteps = 2
+
+	started, err := s.start(context.Background(), owner, "loop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	run, events := waitForRun(t, s, owner, started.Id)
+	if run.Status != agentRunFailed || run.Error != "step limit of 2 reached" || run.Steps != 2 {
+		t.Errorf("run = %+v, want failed at the step limit", run)
+	}
+	got := transcript(t, events)
+	if last := got[len(got)-1]; last != "status failed: step limit of 2 reached" {
+		t.Errorf("last event %q", last)
+	}
+	tools := 0
+	for _, line := range got {
+		if strings.HasPrefix(line, "tool ") {
+			tools++
+		}
+	}
+	if tools != 2 {
+		t.Errorf("ran %d tools, want 2", tools)
+	}
+}
+
+func TestAgentExecuteCancel(t *testing.T) {
+	owner := "alice@example.com"
+	s, docker := newTestAgent(t, owner, []agentMessage{
+		{ToolCalls: []agentToolCall{toolCall("run_command", map[string]string{"command": "sleep 100"})}},
+		{Content: "never reached"},
+	})
+	running, release := make(chan struct{}), make(chan struct{})
+	docker.exec = func(cfg dockerExecConfig, stdin io.Reader, stdout, stderr io.Writer) int {
+		if strings.Contains(strings.Join(cfg.Cmd, " "), "sleep") {
+			close(running)
+			<-release
+			return 137
+		}
+		return 0 // the kill
+	}
+
+	started, err := s.start(context.Background(), owner, "wait")
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-running
+	if time.Since(s.docker.activity.lastFor(owner)) > time.Second {
+		t.Error("container counts as idle during the run")
+	}
+	s.liveRun(started.Id).cancel()
+	close(release)
+
+	run, events := waitForRun(t, s, owner, started.Id)
+	if run.Status != agentRunCanceled {
+		t.Errorf("run = %+v, want canceled", run)
+	}
+	got := transcript(t, events)
+	if last := got[len(got)-1]; last != "status canceled: canceled" {
+		t.Errorf("last event %q", last)
+	}
+	for _, line := range got {
+		if strings.Contains(line, "never reached") {
+			t.Error("the model was asked again after the run was canceled")
+		}
+	}
+	if s.liveRun(started.Id) != nil {
+		t.Error("canceled run is still live")
+	}
+}
+
+// blockingEventStore holds up appendEvent until release is closed.
+type blockingEventStore struct {
+	agentRunStore
+	arrived, release chan struct{}
+}
+
+func (s *blockingEventStore) appendEvent(ctx context.Context, runID string, ev agentEvent) error {
+	close(s.arrived)
+	<-s.release
+	return s.agentRunStore.appendEvent(ctx, runID, ev)
+}
+
+// TestAgentRecordDoesNotHoldRunLock checks that a slow event write leaves
+// the run's state readable and only wakes watchers once it is stored.
+func TestAgentRecordDoesNotHoldRunLock(t *testing.T) {
+	s, _ := newTestAgent(t, "alice@example.com", nil)
+	store := &blockingEventStore{agentRunStore: s.store, arrived: make(chan struct{}), release: make(chan struct{})}
+	s.store = store
+	live := &liveAgentRun{run: agentRun{Id: "run-1", Owner: "alice@example.com"}, changed: make(chan struct{})}
+	changed := live.changed
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.record(live, agentEventMessage, agentMessage{Role: "user", Content: "hi"})
+	}()
+	<-store.arrived
+	if !live.mu.TryLock() {
+		t.Fatal("run locked during the event write")
+	}
+	live.mu.Unlock()
+	select {
+	case <-changed:
+		t.Fatal("watchers woken before the event was stored")
+	default:
+	}
+
+	close(store.release)
+	<-done
+	select {
+	case <-changed:
+	default:
+		t.Error("watchers not woken after the event was stored")
+	}
+	if events, _ := s.store.eventsAfter(context.Background(), "run-1", -1); len(events) != 1 || live.nextSeq != 1 {
+		t.Errorf("stored %d events, next seq %d", len(events), live.nextSeq)
+	}
+}
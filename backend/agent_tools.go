@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Tool results are cut to this size before they go back to the model.
+const maxAgentToolOutput = 32 * 1024
+
+// agentToolSpecs are the container operations the model may call.
+var agentToolSpecs = []agentToolSpec{
+	{
+		Name:        "run_command",
+		Description: "Run a shell command in the dev container and return its exit code, stdout and stderr.",
+		Parameters: json.RawMessage(`{"type":"object","properties":{` +
+			`"command":{"type":"string","description":"Command line, run with sh -c"},` +
+			`"workdir":{"type":"string","description":"Working directory; relative paths are under /home/developer"},` +
+			`"timeoutSeconds":{"type":"integer","description":"Defaults to 60"}},` +
+			`"required":["command"]}`),
+	},
+	{
+		Name:        "read_file",
+		Description: "Read a text file from the dev container.",
+		Parameters: json.RawMessage(`{"type":"object","properties":{` +
+			`"path":{"type":"string","description":"File path; relative paths are under /home/developer"}},` +
+			`"required":["path"]}`),
+	},
+	{
+		Name:        "write_file",
+		Description: "Create or overwrite a file in the dev container. The parent directory must exist.",
+		Parameters: json.RawMessage(`{"type":"object","properties":{` +
+			`"path":{"type":"string","description":"File path; relative paths are under /home/developer"},` +
+			`"content":{"type":"string","description":"The complete new file content"}},` +
+			`"required":["path","content"]}`),
+	},
+	{
+		Name:        "list_dir",
+		Description: "List a directory in the dev container.",
+		Parameters: json.RawMessage(`{"type":"object","properties":{` +
+			`"path":{"type":"string","description":"Directory path; defaults to /home/developer"}}}`),
+	},
+}
+
+// agentToolArgs is the union of every tool's arguments.
+type agentToolArgs struct {
+	Command        string `json:"command"`
+	Workdir        string `json:"workdir"`
+	TimeoutSeconds int    `json:"timeoutSeconds"`
+	Path           string `json:"path"`
+	Content        string `json:"content"`
+}
+
+// runAgentTool executes one tool call in owner's container. Failures are
+// reported to the model as text rather than ending the run.
+func (m *DockerManager) runAgentTool(ctx context.Context, owner string, call agentToolCall) (output string, isError bool) {
+	var args agentToolArgs
+	if err := json.Unmarshal(call.Arguments, &args); err != nil {
+		return "invalid arguments: " + err.Error(), true
+	}
+	container, err := m.activeContainerFor(ctx, owner)
+	if err != nil {
+		return "container unavailable: " + err.Error(), true
+	}
+
+	switch call.Name {
+	case "run_command":
+		if strings.TrimSpace(args.Command) == "" {
+			return "command is required", true
+		}
+		req := execRequest{Argv: []string{"sh", "-c", args.Command}, TimeoutSeconds: args.TimeoutSeconds}
+		if args.Workdir != "" {
+			if req.Workdir, err = resolveFilePath(args.Workdir); err != nil {
+				return err.Error(), true
+			}
+		}
+		stdout := &limitedBuffer{max: maxAgentToolOutput}
+		stderr := &limitedBuffer{max: maxAgentToolOutput}
+		result := m.runExec(ctx, owner, container, req, stdout, stderr)
+		var b strings.Builder
+		switch {
+		case result.ExitCode != nil:
+			fmt.Fprintf(&b, "exit code: %d\n", *result.ExitCode)
+		case result.TimedOut:
+			b.WriteString("timed out; the command was killed\n")
+		default:
+			fmt.Fprintf(&b, "error: %s\n", result.Error)
+		}
+		writeToolStream(&b, "stdout", stdout)
+		writeToolStream(&b, "stderr", stderr)
+		return b.String(), result.ExitCode == nil || *result.ExitCode != 0
+
+	case "read_file":
+		p, err := resolveFilePath(args.Path)
+		if err != nil {
+			return err.Error(), true
+		}
+		content, truncated, size, err := m.readTextFile(ctx, container, p, maxAgentToolOutput)
+		if err != nil {
+			return err.Error(), true
+		}
+		if truncated {
+			return fmt.Sprintf("%s\n[truncated: showing %d of %d bytes]", content, len(content), size), false
+		}
+		return content, false
+
+	case "write_file":
+		p, err := resolveFilePath(args.Path)
+		if err != nil {
+			return err.Error(), true
+		}
+		if err := m.writeFile(ctx, container, p, strings.NewReader(args.Content)); err != nil {
+			return err.Error(), true
+		}
+		return fmt.Sprintf("wrote %d bytes to %s", len(args.Content), p), false
+
+	case "list_dir":
+		p, err := resolveFilePath(args.Path)
+		if err != nil {
+			return err.Error(), true
+		}
+		entries, err := m.listDir(ctx, container, p)
+		if err != nil {
+			return err.Error(), true
+		}
+		out := &limitedBuffer{max: maxAgentToolOutput}
+		fmt.Fprintf(out, "%s (%d entries)\n", p, len(entries))
+		for _, e := range entries {
+			name := e.Name
+			if e.Type == "dir" {
+				name += "/"
+			}
+			fmt.Fprintf(out, "%s %10d %s\n", e.Mode, e.Size, name)
+		}
+		if out.truncated {
+			out.WriteString("\n[truncated]")
+		}
+		return out.String(), false
+	}
+	return fmt.Sprintf("unknown tool %q", call.Name), true
+}
+
+func writeToolStream(b *strings.Builder, name string, out *limitedBuffer) {
+	if out.Len() == 0 {
+		return
+	}
+	fmt.Fprintf(b, "--- %s ---\n%s", name, out.String())
+	if !strings.HasSuffix(out.String(), "\n") {
+		b.WriteString("\n")
+	}
+	if out.truncated {
+		fmt.Fprintf(b, "[%s truncated]\n", name)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// loginCodeParam carries the one-time code in the redirect to the app.
+	loginCodeParam = "login_code"
+	loginCodeTTL   = time.Minute
+
+	csrfHeaderName = "X-CSRF-Token"
+	oauthStateName = "oauth_state"
+)
+
+var errLoginCodeInvalid = errors.New("invalid or expired login code")
+
+// pendingLogin is a finished OAuth login waiting for its code to be
+// exchanged. Binding, when set, must match the exchanging browser's
+// oauth_state cookie so a code can't be replayed from elsewhere.
+type pendingLogin struct {
+	Subject   string
+	UserId    int64
+	UserAgent string
+	Binding   string
+	expiresAt time.Time
+}
+
+// loginCodes holds pending logins in memory; codes live for a minute and
+// work once.
+type loginCodes struct {
+	mu      sync.Mutex
+	pending map[string]pendingLogin
+}
+
+func (c *loginCodes) put(code string, login pendingLogin) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pending == nil {
+		c.pending = make(map[string]pendingLogin)
+	}
+	now := time.Now()
+	for k, p := range c.pending {
+		if now.After(p.expiresAt) {
+			delete(c.pending, k)
+		}
+	}
+	login.expiresAt = now.Add(loginCodeTTL)
+	c.pending[code] = login
+}
+
+func (c *loginCodes) take(code string) (pendingLogin, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	login, ok := c.pending[code]
+	delete(c.pending, code)
+	if !ok || time.Now().After(login.expiresAt) {
+		return pendingLogin{}, false
+	}
+	return login, true
+}
+
+// issueLoginCode parks a login until the app exchanges the returned code.
+func (a *Authenticator) issueLoginCode(login pendingLogin) (string, error) {
+	code, err := newRefreshToken()
+	if err != nil {
+		return "", err
+	}
+	a.codes.put(hashRefreshToken(code), login)
+	return code, nil
+}
+
+// csrfTokenFor derives a session's CSRF token, so it survives refreshes
+// without being stored.
+func (a *Authenticator) csrfTokenFor(sessionID string) string {
+	mac := hmac.New(sha256.New, a.csrfKey)
+	mac.Write([]byte("csrf:" + sessionID))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// checkCookieRequest guards requests authenticated by the access cookie:
+// browsers attach it to cross-site requests too, so WebSocket upgrades must
+// come from our own origins and state-changing requests must carry the
+// session's CSRF token in X-CSRF-Token. Sandboxed documents (previews) send
+// Origin "null" and Sec-Fetch-Site "cross-site", and are rejected by both.
+func (a *Authenticator) checkCookieRequest(r *http.Request, user *authUser) error {
+	if origin := r.Header.Get("Origin"); origin != "" && !isOwnOrigin(a.cfg, origin) {
+		return errors.New("origin not allowed for cookie authentication")
+	}
+	if r.Header.Get("Sec-Fetch-Site") == "cross-site" {
+		return errors.New("cross-site request not allowed for cookie authentication")
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return nil
+	}
+	got := r.Header.Get(csrfHeaderName)
+	if got == "" || subtle.ConstantTimeCompare([]byte(got), []byte(a.csrfTokenFor(user.SessionId))) != 1 {
+		return errors.New("missing or invalid " + csrfHeaderName + " header")
+	}
+	return nil
+}
+
+// setAccessCookie stores the access token for cookie-authenticated clients.
+// The cookie outlives the token (it lasts as long as the session) so that
+// /auth/refresh can tell the client wants cookies back.
+func (a *Authenticator) setAccessCookie(w http.ResponseWriter, tokens authTokens) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     authCookieName,
+		Value:    tokens.Token,
+		Path:     "/",
+		Expires:  tokens.RefreshExpiresAt,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(a.cfg.BackendBaseURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (a *Authenticator) clearAccessCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     authCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(a.cfg.BackendBaseURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// sendBrowserTokens answers a login or refresh from a browser: the refresh
+// token always goes into its cookie, and with useCookie the access token
+// does too. The body keeps the access token only for bearer clients.
+func (a *Authenticator) sendBrowserTokens(w http.ResponseWriter, tokens authTokens, useCookie bool) {
+	a.setRefreshCookie(w, tokens)
+	tokens.RefreshToken = ""
+	if useCookie {
+		a.setAccessCookie(w, tokens)
+		tokens.Token = ""
+	}
+	writeJson(w, http.StatusOK, tokenResponse{authTokens: tokens, CsrfToken: a.csrfTokenFor(tokens.sessionId)})
+}
+
+// tokenResponse adds the CSRF token that cookie clients echo in X-CSRF-Token.
+type tokenResponse struct {
+	authTokens
+	CsrfToken string `json:"csrfToken"`
+}
+
+// POST /auth/token  {"code": "...", "cookie": false}
+//
+// Exchanges the one-time code from the login redirect for a session. The
+// refresh token is set as an HttpOnly cookie; the access token is returned
+// in the body, or with "cookie": true set as an HttpOnly cookie as well.
+func (a *Authenticator) handleExchangeCode(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJson(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	if origin := r.Header.Get("Origin"); origin != "" && !isOwnOrigin(a.cfg, origin) {
+		writeJson(w, http.StatusForbidden, map[string]string{"error": "origin not allowed"})
+		return
+	}
+	var body struct {
+		Code   string `json:"code"`
+		Cookie bool   `json:"cookie"`
+	}
+	if err := readAuthBody(w, r, &body); err != nil {
+		writeJson(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	login, ok := a.codes.take(hashRefreshToken(body.Code))
+	if !ok || body.Code == "" {
+		writeJson(w, http.StatusBadRequest, map[string]string{"error": errLoginCodeInvalid.Error()})
+		return
+	}
+	if login.Binding != "" {
+		c, err := r.Cookie(oauthStateName)
+		if err != nil || subtle.ConstantTimeCompare([]byte(c.Value), []byte(login.Binding)) != 1 {
+			writeJson(w, http.StatusBadRequest, map[string]string{"error": errLoginCodeInvalid.Error()})
+			return
+		}
+	}
+	http.SetCookie(w, &http.Cookie{Name: oauthStateName, Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+
+	tokens, err := a.startSession(r.Context(), login.Subject, login.UserId, login.UserAgent)
+	if err != nil {
+		log.Printf("[auth] starting session for %s: %v", login.Subject, err)
+		writeJson(w, http.StatusInternalServerError, map[string]string{"error": "failed to start session"})
+		return
+	}
+	a.sendBrowserTokens(w, tokens, body.Cookie)
+}
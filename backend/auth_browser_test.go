@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// exchangeCode posts a login code to /auth/token, with the oauth_state
+// cookie when state is set.
+func exchangeCode(t *testing.T, auth *Authenticator, code, state string, cookie bool) (*httptest.ResponseRecorder, tokenResponse) {
+	t.Helper()
+	body, _ := json.Marshal(map[string]any{"code": code, "cookie": cookie})
+	req := httptest.NewRequest(http.MethodPost, "/auth/token", strings.NewReader(string(body)))
+	req.Header.Set("Origin", "http://app.test")
+	if state != "" {
+		req.AddCookie(&http.Cookie{Name: oauthStateName, Value: state})
+	}
+	rec := httptest.NewRecorder()
+	auth.handleExchangeCode(rec, req)
+	var out tokenResponse
+	_ = json.Unmarshal(rec.Body.Bytes(), &out)
+	return rec, out
+}
+
+func TestExchangeLoginCode(t *testing.T) {
+	auth := newTestAuth(t, testConfig())
+	login := pendingLogin{Subject: "alice@example.com", UserId: 1, UserAgent: "test", Binding: "state-1"}
+	issue := func(t *testing.T) string {
+		t.Helper()
+		code, err := auth.issueLoginCode(login)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return code
+	}
+
+	t.Run("once", func(t *testing.T) {
+		code := issue(t)
+		rec, out := exchangeCode(t, auth, code, "state-1", false)
+		if rec.Code != http.StatusOK || out.Token == "" || out.CsrfToken == "" || out.RefreshToken != "" {
+			t.Fatalf("exchange: %d %s", rec.Code, rec.Body)
+		}
+		if user, err := auth.verify(context.Background(), out.Token); err != nil || user.Subject != login.Subject {
+			t.Errorf("issued token: %+v, %v", user, err)
+		}
+		var refresh bool
+		for _, c := range rec.Result().Cookies() {
+			refresh = refresh || (c.Name == refreshCookieName && c.Value != "" && c.HttpOnly)
+		}
+		if !refresh {
+			t.Error("no refresh cookie set")
+		}
+		if rec, _ := exchangeCode(t, auth, code, "state-1", false); rec.Code != http.StatusBadRequest {
+			t.Errorf("second use: %d %s", rec.Code, rec.Body)
+		}
+	})
+
+	t.Run("cookie", func(t *testing.T) {
+		rec, out := exchangeCode(t, auth, issue(t), "state-1", true)
+		if rec.Code != http.StatusOK || out.Token != "" {
+			t.Fatalf("exchange: %d %s", rec.Code, rec.Body)
+		}
+		var access bool
+		for _, c := range rec.Result().Cookies() {
+			access = access || (c.Name == authCookieName && c.Value != "" && c.HttpOnly)
+		}
+		if !access {
+			t.Error("no access cookie set")
+		}
+	})
+
+	t.Run("without the state cookie", func(t *testing.T) {
+		code := issue(t)
+		if rec, _ := exchangeCode(t, auth, code, "", false); rec.Code != http.StatusBadRequest {
+			t.Errorf("no cookie: %d %s", rec.Code, rec.Body)
+		}
+		// A failed attempt uses the code up.
+		if rec, _ := exchangeCode(t, auth, code, "state-1", false); rec.Code != http.StatusBadRequest {
+			t.Errorf("after a failed attempt: %d %s", rec.Code, rec.Body)
+		}
+	})
+
+	t.Run("wrong state cookie", func(t *testing.T) {
+		if rec, _ := exchangeCode(t, auth, issue(t), "state-2", false); rec.Code != http.StatusBadRequest {
+			t.Errorf("got %d %s", rec.Code, rec.Body)
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		code := issue(t)
+		auth.codes.mu.Lock()
+		p := auth.codes.pending[hashRefreshToken(code)]
+		p.expiresAt = time.Now().Add(-time.Second)
+		auth.codes.pending[hashRefreshToken(code)] = p
+		auth.codes.mu.Unlock()
+		if rec, _ := exchangeCode(t, auth, code, "state-1", false); rec.Code != http.StatusBadRequest {
+			t.Errorf("got %d %s", rec.Code, rec.Body)
+		}
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		if rec, _ := exchangeCode(t, auth, "made-up", "state-1", false); rec.Code != http.StatusBadRequest {
+			t.Errorf("got %d %s", rec.Code, rec.Body)
+		}
+		if rec, _ := exchangeCode(t, auth, "", "", false); rec.Code != http.StatusBadRequest {
+			t.Errorf("empty code: %d %s", rec.Code, rec.Body)
+		}
+	})
+}
+
+func TestCookieAuthentication(t *testing.T) {
+	auth := newTestAuth(t, testConfig())
+	tokens, err := auth.startSession(context.Background(), "alice@example.com", 1, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrf := auth.csrfTokenFor(tokens.sessionId)
+	other, err := auth.startSession(context.Background(), "alice@example.com", 1, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := auth.require(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) })
+
+	for _, tc := range []struct {
+		name   string
+		method string
+		bearer bool
+		header map[string]string
+		want   int
+	}{
+		{"get", http.MethodGet, false, nil, http.StatusNoContent},
+		{"post with csrf token", http.MethodPost, false, map[string]string{csrfHeaderName: csrf, "Origin": "http://app.test"}, http.StatusNoContent},
+		{"post without csrf token", http.MethodPost, false, nil, http.StatusForbidden},
+		{"post with wrong csrf token", http.MethodPost, false, map[string]string{csrfHeaderName: "nope"}, http.StatusForbidden},
+		{"post with another session's csrf token", http.MethodPost, false, map[string]string{csrfHeaderName: auth.csrfTokenFor(other.sessionId)}, http.StatusForbidden},
+		{"foreign origin", http.MethodPost, false, map[string]string{csrfHeaderName: csrf, "Origin": "https://evil.example.com"}, http.StatusForbidden},
+		{"foreign origin get", http.MethodGet, false, map[string]string{"Origin": "https://evil.example.com"}, http.StatusForbidden},
+		{"sandboxed origin", http.MethodGet, false, map[string]string{"Origin": "null"}, http.StatusForbidden},
+		{"cross-site", http.MethodPost, false, map[string]string{csrfHeaderName: csrf, "Sec-Fetch-Site": "cross-site"}, http.StatusForbidden},
+		{"same-site", http.MethodPost, false, map[string]string{csrfHeaderName: csrf, "Sec-Fetch-Site": "same-site"}, http.StatusNoContent},
+		{"bearer post", http.MethodPost, true, nil, http.StatusNoContent},
+		{"bearer from another origin", http.MethodPost, true, map[string]string{"Origin": "https://evil.example.com", "Sec-Fetch-Site": "cross-site"}, http.StatusNoContent},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, "/docker/start", nil)
+			if tc.bearer {
+				req.Header.Set("Authorization", "Bearer "+tokens.Token)
+			} else {
+				req.AddCookie(&http.Cookie{Name: authCookieName, Value: tokens.Token})
+			}
+			for k, v := range tc.header {
+				req.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			h(rec, req)
+			if rec.Code != tc.want {
+				t.Errorf("got %d %s, want %d", rec.Code, rec.Body, tc.want)
+			}
+		})
+	}
+}
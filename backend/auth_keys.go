@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// jwtKey is an asymmetric key tokens are signed or verified with. Its kid is
+// the RFC 7638 thumbprint, so it's stable across restarts and hosts.
+type jwtKey struct {
+	kid     string
+	method  jwt.SigningMethod
+	public  crypto.PublicKey
+	private crypto.Signer // nil for verify-only keys
+}
+
+// jwtKeys are the keys from JWT_SIGNING_KEY and JWT_VERIFY_KEYS. Without a
+// signing key, tokens are HS256 with JWT_SECRET as before.
+type jwtKeys struct {
+	signing *jwtKey
+	byKid   map[string]*jwtKey
+}
+
+// asymmetricMethods are the algorithms our own keys can have.
+var asymmetricMethods = []string{
+	jwt.SigningMethodRS256.Alg(),
+	jwt.SigningMethodES256.Alg(),
+	jwt.SigningMethodES384.Alg(),
+	jwt.SigningMethodES512.Alg(),
+	jwt.SigningMethodEdDSA.Alg(),
+}
+
+// loadJWTKeys reads the configured PEM files. Verify keys may be public or
+// private keys; the signing key is always trusted for verification too.
+func loadJWTKeys(cfg *Config) (*jwtKeys, error) {
+	keys := &jwtKeys{byKid: map[string]*jwtKey{}}
+	if cfg.JwtSigningKey == "" {
+		if len(cfg.JwtVerifyKeys) > 0 {
+			return nil, errors.New("JWT_VERIFY_KEYS needs JWT_SIGNING_KEY")
+		}
+		return keys, nil
+	}
+	signing, err := loadJWTKeyFile(cfg.JwtSigningKey)
+	if err != nil {
+		return nil, err
+	}
+	if signing.private == nil {
+		return nil, fmt.Errorf("JWT_SIGNING_KEY %s: not a private key", cfg.JwtSigningKey)
+	}
+	keys.signing = signing
+	keys.byKid[signing.kid] = signing
+	for _, path := range cfg.JwtVerifyKeys {
+		k, err := loadJWTKeyFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if _, dup := keys.byKid[k.kid]; !dup {
+			keys.byKid[k.kid] = k
+		}
+	}
+	return keys, nil
+}
+
+func loadJWTKeyFile(path string) (*jwtKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM block", path)
+	}
+	var parsed any
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		parsed, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		parsed, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("%s: unsupported PEM block %q", path, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	k, err := newJWTKey(parsed)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return k, nil
+}
+
+// newJWTKey picks the algorithm for a parsed key: RS256 for RSA, ES256/384/512
+// by curve, EdDSA for Ed25519.
+func newJWTKey(parsed any) (*jwtKey, error) {
+	k := &jwtKey{}
+	if signer, ok := parsed.(crypto.Signer); ok {
+		k.private = signer
+		parsed = signer.Public()
+	}
+	switch pub := parsed.(type) {
+	case *rsa.PublicKey:
+		if pub.N.BitLen() < 2048 {
+			return nil, errors.New("RSA keys must be at least 2048 bits")
+		}
+		k.method = jwt.SigningMethodRS256
+	case *ecdsa.PublicKey:
+		switch pub.Curve {
+		case elliptic.P256():
+			k.method = jwt.SigningMethodES256
+		case elliptic.P384():
+			k.method = jwt.SigningMethodES384
+		case elliptic.P521():
+			k.method = jwt.SigningMethodES512
+		default:
+			return nil, errors.New("unsupported EC curve")
+		}
+	case ed25519.PublicKey:
+		k.method = jwt.SigningMethodEdDSA
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", parsed)
+	}
+	k.public = parsed
+	jwk, err := jwkFromPublicKey(parsed)
+	if err != nil {
+		return nil, err
+	}
+	k.kid = jwk.thumbprint()
+	return k, nil
+}
+
+// csrfKey is the HMAC key for CSRF tokens: JWT_SECRET when set, otherwise
+// derived from the signing key so JWT_SECRET can be dropped entirely.
+func (k *jwtKeys) csrfKey(secret string) []byte {
+	if secret != "" || k.signing == nil {
+		return []byte(secret)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(k.signing.private)
+	if err != nil {
+		return nil
+	}
+	sum := sha256.Sum256(append([]byte("agent-thing csrf:"), der...))
+	return sum[:]
+}
+
+// GET /.well-known/jwks.json
+//
+// Publishes the public halves of the signing and verify keys so other
+// services can check our tokens. Empty when tokens are HS256.
+func (a *Authenticator) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeJson(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	set := jsonWebKeySet{Keys: []jsonWebKey{}}
+	for _, k := range a.keys.byKid {
+		jwk, err := jwkFromPublicKey(k.public)
+		if err != nil {
+			continue
+		}
+		jwk.Kid, jwk.Use, jwk.Alg = k.kid, "sig", k.method.Alg()
+		set.Keys = append(set.Keys, jwk)
+	}
+	// The signing key first, then the rest in a stable order.
+	slices.SortFunc(set.Keys, func(x, y jsonWebKey) int {
+		if a.keys.signing != nil && (x.Kid == a.keys.signing.kid) != (y.Kid == a.keys.signing.kid) {
+			if x.Kid == a.keys.signing.kid {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(x.Kid, y.Kid)
+	})
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeJson(w, http.StatusOK, set)
+}
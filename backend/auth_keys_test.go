@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// writePEM writes key to a file in dir, as its public half when public is
+// set, and returns the path.
+func writePEM(t *testing.T, dir, name string, key crypto.Signer, public bool) string {
+	t.Helper()
+	block := &pem.Block{Type: "PRIVATE KEY"}
+	var err error
+	if public {
+		block.Type = "PUBLIC KEY"
+		block.Bytes, err = x509.MarshalPKIXPublicKey(key.Public())
+	} else {
+		block.Bytes, err = x509.MarshalPKCS8PrivateKey(key)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func newRSAKey(t *testing.T, bits int) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// tokenHeader returns the alg and kid a token was signed with.
+func tokenHeader(t *testing.T, raw string) (alg, kid string) {
+	t.Helper()
+	token, _, err := jwt.NewParser().ParseUnverified(raw, jwt.MapClaims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kid, _ = token.Header["kid"].(string)
+	return token.Method.Alg(), kid
+}
+
+func TestJWTKeysRoundTrip(t *testing.T) {
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	p384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	for _, tc := range []struct {
+		alg string
+		key crypto.Signer
+	}{
+		{"RS256", newRSAKey(t, 2048)},
+		{"ES256", newECKey(t)},
+		{"ES384", p384},
+		{"EdDSA", edKey},
+	} {
+		t.Run(tc.alg, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.JwtSecret = ""
+			cfg.JwtSigningKey = writePEM(t, t.TempDir(), "signing.pem", tc.key, false)
+			auth := newTestAuth(t, cfg)
+
+			raw := loginToken(t, auth, "alice@example.com")
+			jwk, _ := jwkFromPublicKey(tc.key.Public())
+			if alg, kid := tokenHeader(t, raw); alg != tc.alg || kid != jwk.thumbprint() {
+				t.Errorf("token signed with %s/%s, want %s/%s", alg, kid, tc.alg, jwk.thumbprint())
+			}
+			user, err := auth.verify(context.Background(), raw)
+			if err != nil {
+				t.Fatalf("verify: %v", err)
+			}
+			if user.Subject != "alice@example.com" {
+				t.Errorf("subject = %q", user.Subject)
+			}
+			if len(auth.csrfKey) != 32 {
+				t.Errorf("CSRF key not derived from the signing key without JWT_SECRET")
+			}
+		})
+	}
+}
+
+func TestJWTKeysLegacyPEM(t *testing.T) {
+	dir := t.TempDir()
+	rsaKey := newRSAKey(t, 2048)
+	ecKey := newECKey(t)
+	ecDER, _ := x509.MarshalECPrivateKey(ecKey)
+	for name, block := range map[string]*pem.Block{
+		"rsa.pem":     {Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)},
+		"rsa.pub.pem": {Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&rsaKey.PublicKey)},
+		"ec.pem":      {Type: "EC PRIVATE KEY", Bytes: ecDER},
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), pem.EncodeToMemory(block), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	keys, err := loadJWTKeys(&Config{
+		JwtSigningKey: filepath.Join(dir, "ec.pem"),
+		JwtVerifyKeys: []string{filepath.Join(dir, "rsa.pem"), filepath.Join(dir, "rsa.pub.pem")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys.signing.method != jwt.SigningMethodES256 {
+		t.Errorf("EC key signs with %s", keys.signing.method.Alg())
+	}
+	// The RSA key in both formats has the same kid.
+	if len(keys.byKid) != 2 {
+		t.Errorf("got %d keys, want 2", len(keys.byKid))
+	}
+}
+
+func TestJWTKeysConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	key := newECKey(t)
+	private := writePEM(t, dir, "key.pem", key, false)
+	public := writePEM(t, dir, "key.pub.pem", key, true)
+	small := writePEM(t, dir, "small.pem", newRSAKey(t, 1024), false)
+	garbage := filepath.Join(dir, "garbage.pem")
+	_ = os.WriteFile(garbage, []byte("not a key"), 0o600)
+
+	for _, tc := range []struct {
+		name string
+		cfg  Config
+	}{
+		{"verify keys without a signing key", Config{JwtVerifyKeys: []string{public}}},
+		{"public signing key", Config{JwtSigningKey: public}},
+		{"short RSA key", Config{JwtSigningKey: small}},
+		{"not PEM", Config{JwtSigningKey: garbage}},
+		{"missing file", Config{JwtSigningKey: filepath.Join(dir, "missing.pem")}},
+		{"bad verify key", Config{JwtSigningKey: private, JwtVerifyKeys: []string{garbage}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := loadJWTKeys(&tc.cfg); err == nil {
+				t.Error("loaded")
+			}
+		})
+	}
+}
+
+// TestJWTKeysRotation moves signing from an old key to a new one while
+// tokens signed with the old key are still in circulation.
+func TestJWTKeysRotation(t *testing.T) {
+	dir := t.TempDir()
+	oldKey, newKey := newECKey(t), newRSAKey(t, 2048)
+	sessions := newAuthSessionStore(nil)
+
+	before := testConfig()
+	before.JwtSigningKey = writePEM(t, dir, "old.pem", oldKey, false)
+	oldAuth, err := NewAuthenticator(before, sessions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldToken := loginToken(t, oldAuth, "alice@example.com")
+
+	after := testConfig()
+	after.JwtSigningKey = writePEM(t, dir, "new.pem", newKey, false)
+	after.JwtVerifyKeys = []string{writePEM(t, dir, "old.pub.pem", oldKey, true)}
+	auth, err := NewAuthenticator(after, sessions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := auth.verify(context.Background(), oldToken); err != nil {
+		t.Errorf("token from the old key: %v", err)
+	}
+	newToken := loginToken(t, auth, "alice@example.com")
+	newJWK, _ := jwkFromPublicKey(newKey.Public())
+	if alg, kid := tokenHeader(t, newToken); alg != "RS256" || kid != newJWK.thumbprint() {
+		t.Errorf("new tokens signed with %s/%s, want the new key", alg, kid)
+	}
+	if _, err := oldAuth.parse(newToken); err == nil {
+		t.Error("old instance accepted a key it was never given")
+	}
+
+	// Once the old key is dropped its tokens stop working.
+	after.JwtVerifyKeys = nil
+	dropped, err := NewAuthenticator(after, sessions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dropped.parse(oldToken); err == nil {
+		t.Error("token from a removed key accepted")
+	}
+}
+
+func TestJWTKeysRejectForgedTokens(t *testing.T) {
+	dir := t.TempDir()
+	key := newECKey(t)
+	cfg := testConfig() // JWT_SECRET stays set, e.g. for CSRF
+	cfg.JwtSigningKey = writePEM(t, dir, "signing.pem", key, false)
+	auth := newTestAuth(t, cfg)
+	jwk, _ := jwkFromPublicKey(key.Public())
+	kid := jwk.thumbprint()
+	claims := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"sub": "alice@example.com", "sess": "s", "iss": cfg.BackendBaseURL,
+			"iat": time.Now().Unix(), "exp": time.Now().Add(time.Hour).Unix(),
+		}
+	}
+
+	hs256 := jwt.NewWithClaims(jwt.SigningMethodHS256, claims())
+	hs256Raw, _ := hs256.SignedString([]byte(cfg.JwtSecret))
+	// HS256 keyed with the public key's bytes, the classic confusion attack.
+	confused := jwt.NewWithClaims(jwt.SigningMethodHS256, claims())
+	confused.Header["kid"] = kid
+	pubDER, _ := x509.MarshalPKIXPublicKey(key.Public())
+	confusedRaw, _ := confused.SignedString(pubDER)
+	none := jwt.NewWithClaims(jwt.SigningMethodNone, claims())
+	none.Header["kid"] = kid
+	noneRaw, _ := none.SignedString(jwt.UnsafeAllowNoneSignatureType)
+	// A different algorithm than the kid's key has.
+	other := jwt.NewWithClaims(jwt.SigningMethodES384, claims())
+	other.Header["kid"] = kid
+	p384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	otherRaw, _ := other.SignedString(p384)
+	unknown := jwt.NewWithClaims(jwt.SigningMethodES256, claims())
+	unknown.Header["kid"] = "unknown"
+	unknownRaw, _ := unknown.SignedString(newECKey(t))
+	noExp := claims()
+	delete(noExp, "exp")
+	noExpToken := jwt.NewWithClaims(jwt.SigningMethodES256, noExp)
+	noExpToken.Header["kid"] = kid
+	noExpRaw, _ := noExpToken.SignedString(key)
+
+	for name, raw := range map[string]string{
+		"hs256 with JWT_SECRET":     hs256Raw,
+		"hs256 with the public key": confusedRaw,
+		"alg none":                  noneRaw,
+		"algorithm mismatch":        otherRaw,
+		"unknown kid":               unknownRaw,
+		"no expiry":                 noExpRaw,
+	} {
+		if _, err := auth.parse(raw); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	dir := t.TempDir()
+	signingKey, verifyKey := newECKey(t), newRSAKey(t, 2048)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	cfg := testConfig()
+	cfg.JwtSigningKey = writePEM(t, dir, "signing.pem", signingKey, false)
+	cfg.JwtVerifyKeys = []string{
+		writePEM(t, dir, "rsa.pub.pem", verifyKey, true),
+		writePEM(t, dir, "ed.pem", edKey, false),
+		cfg.JwtSigningKey, // listed twice, published once
+	}
+	auth := newTestAuth(t, cfg)
+
+	rec := httptest.NewRecorder()
+	auth.handleJWKS(rec, httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Cache-Control") != "public, max-age=300" {
+		t.Fatalf("got %d, Cache-Control %q", rec.Code, rec.Header().Get("Cache-Control"))
+	}
+	if strings.Contains(rec.Body.String(), `"d":`) {
+		t.Errorf("JWKS publishes a private key: %s", rec.Body)
+	}
+	var set jsonWebKeySet
+	if err := json.NewDecoder(rec.Body).Decode(&set); err != nil {
+		t.Fatal(err)
+	}
+	if len(set.Keys) != 3 {
+		t.Fatalf("published %d keys, want 3", len(set.Keys))
+	}
+	signingJWK, _ := jwkFromPublicKey(signingKey.Public())
+	if set.Keys[0].Kid != signingJWK.thumbprint() {
+		t.Errorf("first key %s is not the signing key", set.Keys[0].Kid)
+	}
+	if set.Keys[1].Kid > set.Keys[2].Kid {
+		t.Errorf("verify keys not sorted by kid")
+	}
+
+	want := map[string]crypto.PublicKey{"ES256": signingKey.Public(), "RS256": verifyKey.Public(), "EdDSA": edKey.Public()}
+	for _, jwk := range set.Keys {
+		if jwk.Use != "sig" {
+			t.Errorf("%s: use %q", jwk.Kid, jwk.Use)
+		}
+		pub, err := jwk.publicKey()
+		if err != nil {
+			t.Fatalf("%s: %v", jwk.Kid, err)
+		}
+		if !pub.(interface{ Equal(crypto.PublicKey) bool }).Equal(want[jwk.Alg]) {
+			t.Errorf("%s: published key does not match", jwk.Alg)
+		}
+		if jwk.Kid != jwk.thumbprint() {
+			t.Errorf("%s: kid %s is not the thumbprint", jwk.Alg, jwk.Kid)
+		}
+	}
+
+	// A token signed by us verifies against the published set alone.
+	raw := loginToken(t, auth, "alice@example.com")
+	_, err := jwt.Parse(raw, func(tok *jwt.Token) (any, error) {
+		for _, jwk := range set.Keys {
+			if jwk.Kid == tok.Header["kid"] {
+				return jwk.publicKey()
+			}
+		}
+		return nil, jwt.ErrTokenUnverifiable
+	}, jwt.WithValidMethods([]string{"ES256"}))
+	if err != nil {
+		t.Errorf("verifying against the JWKS: %v", err)
+	}
+
+	// Without a signing key the set is empty rather than null.
+	rec = httptest.NewRecorder()
+	newTestAuth(t, testConfig()).handleJWKS(rec, httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil))
+	if body := rec.Body.String(); body != "{\"keys\":[]}\n" {
+		t.Errorf("HS256 JWKS = %q", body)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	authCookieName          = "agent_thing_token"
+	bearerSubprotocolPrefix = "bearer."
+)
+
+type authContextKey struct{}
+
+// authUser is the identity the auth middleware attaches to the request context.
+type authUser struct {
+	Subject string
+	// UserId is the users row behind the token; 0 for older tokens.
+	UserId int64
+	// SessionId is the login session (see authSession) the token belongs to.
+	SessionId string
+	ExpiresAt time.Time
+}
+
+// Authenticator issues and validates the backend's tokens: signed with
+// JWT_SIGNING_KEY when configured, otherwise HS256 with JWT_SECRET. Access
+// tokens belong to a login session and are rejected once it is revoked.
+type Authenticator struct {
+	cfg      *Config
+	keys     *jwtKeys
+	csrfKey  []byte
+	sessions authSessionStore
+	codes    loginCodes
+}
+
+func NewAuthenticator(cfg *Config, sessions authSessionStore) (*Authenticator, error) {
+	keys, err := loadJWTKeys(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &Authenticator{cfg: cfg, keys: keys, csrfKey: keys.csrfKey(cfg.JwtSecret), sessions: sessions}, nil
+}
+
+// require rejects requests without a valid, unexpired token and otherwise
+// passes them on with the caller's authUser in the context.
+func (a *Authenticator) require(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		raw, viaCookie := credentialsFromRequest(r)
+		if raw == "" {
+			writeJson(w, http.StatusUnauthorized, map[string]string{"error": "missing bearer token"})
+			return
+		}
+		user, err := a.verify(r.Context(), raw)
+		if errors.Is(err, errSessionLookup) {
+			writeJson(w, http.StatusServiceUnavailable, map[string]string{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			writeJson(w, http.StatusUnauthorized, map[string]string{"error": "invalid token: " + err.Error()})
+			return
+		}
+		if viaCookie {
+			if err := a.checkCookieRequest(r, user); err != nil {
+				writeJson(w, http.StatusForbidden, map[string]string{"error": err.Error()})
+				return
+			}
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), authContextKey{}, user)))
+	}
+}
+
+// verify checks an access token, including that its session is still active.
+func (a *Authenticator) verify(ctx context.Context, raw string) (*authUser, error) {
+	claims, err := a.parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	// Purpose-specific tokens (share links etc.) carry a "typ" and must not
+	// be usable as logins.
+	if typ, _ := claims["typ"].(string); typ != "" {
+		return nil, fmt.Errorf("not an access token")
+	}
+	sub, err := claims.GetSubject()
+	if err != nil || sub == "" {
+		return nil, fmt.Errorf("token has no subject")
+	}
+	sess, _ := claims["sess"].(string)
+	if sess == "" {
+		return nil, fmt.Errorf("token predates login sessions; log in again")
+	}
+	if err := a.checkSession(ctx, sess); err != nil {
+		return nil, err
+	}
+	exp, _ := claims.GetExpirationTime()
+	uid, _ := claims["uid"].(float64)
+	return &authUser{Subject: sub, UserId: int64(uid), SessionId: sess, ExpiresAt: exp.Time}, nil
+}
+
+// sign issues a token with the backend's key, naming the backend as issuer.
+func (a *Authenticator) sign(claims jwt.MapClaims) (string, error) {
+	if _, ok := claims["iss"]; !ok {
+		claims["iss"] = a.cfg.BackendBaseURL
+	}
+	if k := a.keys.signing; k != nil {
+		token := jwt.NewWithClaims(k.method, claims)
+		token.Header["kid"] = k.kid
+		return token.SignedString(k.private)
+	}
+	if a.cfg.JwtSecret == "" {
+		return "", errors.New("JWT_SECRET not configured")
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(a.cfg.JwtSecret))
+}
+
+// parse validates a token's signature and expiry and returns its claims.
+// With signing keys configured, HS256 tokens are no longer accepted: whoever
+// held JWT_SECRET could otherwise still forge them.
+func (a *Authenticator) parse(raw string) (jwt.MapClaims, error) {
+	methods := asymmetricMethods
+	keyFunc := func(t *jwt.Token) (any, error) {
+		kid, _ := t.Header["kid"].(string)
+		k, ok := a.keys.byKid[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown key id %q", kid)
+		}
+		if t.Method.Alg() != k.method.Alg() {
+			return nil, fmt.Errorf("key %q does not sign %s", kid, t.Method.Alg())
+		}
+		return k.public, nil
+	}
+	if a.keys.signing == nil {
+		if a.cfg.JwtSecret == "" {
+			return nil, errors.New("JWT_SECRET not configured")
+		}
+		methods = []string{jwt.SigningMethodHS256.Alg()}
+		keyFunc = func(t *jwt.Token) (any, error) { return []byte(a.cfg.JwtSecret), nil }
+	}
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(raw, claims, keyFunc,
+		jwt.WithValidMethods(methods),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// tokenFromRequest looks for a token in, in order: the Authorization header,
+// a "bearer.<token>" WebSocket subprotocol (browsers can't set headers on
+// WebSocket upgrades), and the auth cookie.
+func tokenFromRequest(r *http.Request) string {
+	raw, _ := credentialsFromRequest(r)
+	return raw
+}
+
+// credentialsFromRequest is tokenFromRequest that also reports whether the
+// token came from the cookie, which browsers send on their own.
+func credentialsFromRequest(r *http.Request) (raw string, viaCookie bool) {
+	if h := r.Header.Get("Authorization"); len(h) > 7 && strings.EqualFold(h[:7], "Bearer ") {
+		return strings.TrimSpace(h[7:]), false
+	}
+	for _, proto := range websocket.Subprotocols(r) {
+		if strings.HasPrefix(proto, bearerSubprotocolPrefix) {
+			return strings.TrimPrefix(proto, bearerSubprotocolPrefix), false
+		}
+	}
+	if c, err := r.Cookie(authCookieName); err == nil && c.Value != "" {
+		return c.Value, true
+	}
+	return "", false
+}
+
+// currentUser returns the identity stored by Authenticator.require, or nil.
+func currentUser(r *http.Request) *authUser {
+	user, _ := r.Context().Value(authContextKey{}).(*authUser)
+	return user
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+)
+
+func TestRequire(t *testing.T) {
+	cfg := testConfig()
+	auth := newTestAuth(t, cfg)
+	tokens, err := auth.startSession(context.Background(), "alice@example.com", 1, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := func(change func(jwt.MapClaims)) jwt.MapClaims {
+		now := time.Now()
+		c := jwt.MapClaims{"sub": "alice@example.com", "sess": tokens.sessionId, "iat": now.Unix(), "exp": now.Add(time.Minute).Unix()}
+		change(c)
+		return c
+	}
+	signed := func(c jwt.MapClaims) string {
+		raw, err := auth.sign(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return raw
+	}
+	otherSecret := func() string {
+		raw, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, claims(func(jwt.MapClaims) {})).SignedString([]byte("other-secret"))
+		return raw
+	}
+	algNone := func() string {
+		raw, _ := jwt.NewWithClaims(jwt.SigningMethodNone, claims(func(jwt.MapClaims) {})).SignedString(jwt.UnsafeAllowNoneSignatureType)
+		return raw
+	}
+
+	h := auth.require(func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, http.StatusOK, map[string]string{"subject": currentUser(r).Subject})
+	})
+	for _, tc := range []struct {
+		name   string
+		header http.Header
+		want   int
+	}{
+		{"valid", http.Header{"Authorization": {"Bearer " + tokens.Token}}, http.StatusOK},
+		{"lower-case scheme", http.Header{"Authorization": {"bearer " + tokens.Token}}, http.StatusOK},
+		{"subprotocol", http.Header{"Sec-Websocket-Protocol": {"agent-thing, bearer." + tokens.Token}}, http.StatusOK},
+		{"missing", http.Header{}, http.StatusUnauthorized},
+		{"other scheme", http.Header{"Authorization": {"Basic " + tokens.Token}}, http.StatusUnauthorized},
+		{"garbage", http.Header{"Authorization": {"Bearer not.a.token"}}, http.StatusUnauthorized},
+		{"expired", http.Header{"Authorization": {"Bearer " + signed(claims(func(c jwt.MapClaims) {
+			c["iat"], c["exp"] = time.Now().Add(-time.Hour).Unix(), time.Now().Add(-time.Minute).Unix()
+		}))}}, http.StatusUnauthorized},
+		{"no expiry", http.Header{"Authorization": {"Bearer " + signed(claims(func(c jwt.MapClaims) { delete(c, "exp") }))}}, http.StatusUnauthorized},
+		{"wrong secret", http.Header{"Authorization": {"Bearer " + otherSecret()}}, http.StatusUnauthorized},
+		{"alg none", http.Header{"Authorization": {"Bearer " + algNone()}}, http.StatusUnauthorized},
+		{"expired subprotocol", http.Header{"Sec-Websocket-Protocol": {"agent-thing, bearer." + signed(claims(func(c jwt.MapClaims) {
+			c["iat"], c["exp"] = time.Now().Add(-time.Hour).Unix(), time.Now().Add(-time.Minute).Unix()
+		}))}}, http.StatusUnauthorized},
+		{"share token", http.Header{"Authorization": {"Bearer " + signed(claims(func(c jwt.MapClaims) { c["typ"] = "share" }))}}, http.StatusUnauthorized},
+		{"no session", http.Header{"Authorization": {"Bearer " + signed(claims(func(c jwt.MapClaims) { delete(c, "sess") }))}}, http.StatusUnauthorized},
+		{"unknown session", http.Header{"Authorization": {"Bearer " + signed(claims(func(c jwt.MapClaims) { c["sess"] = "made-up" }))}}, http.StatusUnauthorized},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/docker/status", nil)
+			req.Header = tc.header
+			rec := httptest.NewRecorder()
+			h(rec, req)
+			if rec.Code != tc.want {
+				t.Errorf("got %d %s, want %d", rec.Code, rec.Body, tc.want)
+			}
+			if tc.want == http.StatusOK && !strings.Contains(rec.Body.String(), "alice@example.com") {
+				t.Errorf("handler saw %s", rec.Body)
+			}
+		})
+	}
+}
+
+// TestRequireWebSocketSubprotocol dials a WebSocket the way browsers must,
+// with the token offered as a subprotocol next to the real one.
+func TestRequireWebSocketSubprotocol(t *testing.T) {
+	auth := newTestAuth(t, testConfig())
+	upgrader := websocket.Upgrader{Subprotocols: []string{"agent-thing"}}
+	srv := httptest.NewServer(auth.require(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_ = conn.WriteMessage(websocket.TextMessage, []byte(currentUser(r).Subject))
+	}))
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	dialer := websocket.Dialer{Subprotocols: []string{"agent-thing", bearerSubprotocolPrefix + loginToken(t, auth, "alice@example.com")}}
+	conn, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.Subprotocol() != "agent-thing" {
+		t.Errorf("negotiated %q, want agent-thing", conn.Subprotocol())
+	}
+	if _, msg, err := conn.ReadMessage(); err != nil || string(msg) != "alice@example.com" {
+		t.Errorf("got %q, %v", msg, err)
+	}
+
+	dialer.Subprotocols = []string{"agent-thing", bearerSubprotocolPrefix + "not.a.token"}
+	if _, resp, err := dialer.Dial(url, nil); err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("bad token: %v, %+v", err, resp)
+	}
+}
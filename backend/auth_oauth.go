@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// loginProviderConfig is one way to log in, from a [login:<name>] INI
+// section or, for "google", the GOOGLE_* settings.
+type loginProviderConfig struct {
+	Name string
+	// Type is "oidc" (any OpenID Connect issuer, the default) or "github".
+	Type         string
+	DisplayName  string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+	// APIURL is GitHub's REST API base (GitHub Enterprise only).
+	APIURL string
+	// AllowUnverifiedEmail accepts accounts whose address the provider
+	// hasn't verified. Sessions and containers are keyed by email, so only
+	// set this for a provider trusted to vouch for every address it issues.
+	AllowUnverifiedEmail bool
+}
+
+const (
+	loginProviderOIDC   = "oidc"
+	loginProviderGitHub = "github"
+
+	googleIssuer = "https://accounts.google.com"
+)
+
+// externalIdentity is who a provider says logged in.
+type externalIdentity struct {
+	Provider      string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+	Picture       string
+}
+
+// loginProvider runs the authorization code flow against one provider.
+type loginProvider interface {
+	settings() loginProviderConfig
+	// authCodeURL is where the browser is sent to log in.
+	authCodeURL(ctx context.Context, state, nonce string) (string, error)
+	// identify redeems the callback's code and returns the account.
+	identify(ctx context.Context, code, nonce string) (externalIdentity, error)
+}
+
+// newLoginProviders builds the configured providers, skipping (and
+// logging) incomplete ones.
+func newLoginProviders(cfg *Config) map[string]loginProvider {
+	client := &http.Client{Timeout: 15 * time.Second}
+	providers := make(map[string]loginProvider)
+	for name, pc := range cfg.LoginProviders {
+		if pc.ClientID == "" || pc.ClientSecret == "" {
+			log.Printf("[auth] login provider %s: CLIENT_ID and CLIENT_SECRET are required; skipped", name)
+			continue
+		}
+		switch pc.Type {
+		case "", loginProviderOIDC:
+			if pc.Issuer == "" {
+				log.Printf("[auth] login provider %s: ISSUER is required; skipped", name)
+				continue
+			}
+			providers[name] = newOIDCProvider(pc, client)
+		case loginProviderGitHub:
+			providers[name] = newGitHubProvider(pc, client)
+		default:
+			log.Printf("[auth] login provider %s: unknown TYPE %q; skipped", name, pc.Type)
+		}
+	}
+	return providers
+}
+
+// OAuthHandler serves the login redirect and callback for every provider.
+type OAuthHandler struct {
+	cfg       *Config
+	providers map[string]loginProvider
+	users     userStore
+	auth      *Authenticator
+}
+
+func NewOAuthHandler(cfg *Config, users userStore, auth *Authenticator) *OAuthHandler {
+	return &OAuthHandler{cfg: cfg, providers: newLoginProviders(cfg), users: users, auth: auth}
+}
+
+// provider resolves the {provider} path value, answering 404 if unknown.
+func (h *OAuthHandler) provider(w http.ResponseWriter, r *http.Request) (loginProvider, bool) {
+	name := r.PathValue("provider")
+	p, ok := h.providers[name]
+	if !ok {
+		writeJson(w, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("login provider %q not configured", name)})
+	}
+	return p, ok
+}
+
+type loginProviderInfo struct {
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+	LoginURL    string `json:"loginUrl"`
+}
+
+// GET /auth/providers
+func (h *OAuthHandler) handleListProviders(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJson(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	list := make([]loginProviderInfo, 0, len(h.providers))
+	for name, p := range h.providers {
+		list = append(list, loginProviderInfo{
+			Name:        name,
+			DisplayName: firstNonEmpty(p.settings().DisplayName, name),
+			LoginURL:    "/auth/" + name + "/login",
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	writeJson(w, http.StatusOK, list)
+}
+
+// GET /auth/{provider}/login
+func (h *OAuthHandler) handleLogin(w http.ResponseWriter, r *http.Request) {
+	p, ok := h.provider(w, r)
+	if !ok {
+		return
+	}
+
+	// The state names the provider so a callback can't be replayed
+	// against a different one.
+	random, err := randomState()
+	if err != nil {
+		writeJson(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	state := p.settings().Name + "." + random
+
+	target, err := p.authCodeURL(r.Context(), state, oidcNonce(state))
+	if err != nil {
+		log.Printf("[auth] %s login: %v", p.settings().Name, err)
+		writeJson(w, http.StatusBadGateway, map[string]string{"error": "login provider unavailable"})
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthStateName,
+		Value:    state,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   600,
+	})
+
+	// Optional return_to provided by frontend (typically window.location.origin).
+	// We validate it to avoid open redirects and store briefly in a cookie.
+	if rt := strings.TrimSpace(r.URL.Query().Get("return_to")); rt != "" {
+		if validated, ok := validateReturnTo(r, rt); ok {
+			http.SetCookie(w, &http.Cookie{
+				Name:     "oauth_return_to",
+				Value:    validated,
+				Path:     "/",
+				HttpOnly: true,
+				Secure:   r.TLS != nil,
+				SameSite: http.SameSiteLaxMode,
+				MaxAge:   600,
+			})
+		} else {
+			log.Printf("[auth] ignoring invalid return_to=%q", rt)
+		}
+	}
+
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// GET /callback/oauth/{provider}
+func (h *OAuthHandler) handleCallback(w http.ResponseWriter, r *http.Request) {
+	p, ok := h.provider(w, r)
+	if !ok {
+		return
+	}
+	name := p.settings().Name
+
+	log.Printf("[auth] %s callback hit; accept=%q app_base_url=%q", name, r.Header.Get("Accept"), h.cfg.AppBaseURL)
+
+	if e := r.URL.Query().Get("error"); e != "" {
+		writeJson(w, http.StatusBadRequest, map[string]string{"error": "login failed: " + e})
+		return
+	}
+	code := r.URL.Query().Get("code")
+	state := r.URL.Query().Get("state")
+
+	cookie, _ := r.Cookie(oauthStateName)
+	if cookie == nil || cookie.Value == "" || cookie.Value != state || !strings.HasPrefix(state, name+".") {
+		writeJson(w, http.StatusBadRequest, map[string]string{"error": "invalid oauth state"})
+		return
+	}
+
+	ident, err := p.identify(r.Context(), code, oidcNonce(state))
+	if err != nil {
+		log.Printf("[auth] %s login: %v", name, err)
+		writeJson(w, http.StatusBadRequest, map[string]string{"error": "login failed"})
+		return
+	}
+	if ident.Subject == "" || ident.Email == "" {
+		writeJson(w, http.StatusBadRequest, map[string]string{"error": name + " account has no id or email"})
+		return
+	}
+	if !ident.EmailVerified && !p.settings().AllowUnverifiedEmail {
+		writeJson(w, http.StatusForbidden, map[string]string{"error": name + " has not verified this account's email address"})
+		return
+	}
+
+	user, err := h.users.upsertIdentity(r.Context(), ident)
+	if err != nil {
+		log.Printf("[auth] saving user %s: %v", ident.Email, err)
+		writeJson(w, http.StatusInternalServerError, map[string]string{"error": "failed to save user"})
+		return
+	}
+
+	accept := r.Header.Get("Accept")
+	// If the caller expects JSON (API tools / curl), return JSON.
+	if strings.Contains(accept, "application/json") {
+		// The subject stays the email, since containers are keyed by it.
+		tokens, err := h.auth.startSession(r.Context(), user.Email, user.Id, r.UserAgent())
+		if err != nil {
+			log.Printf("[auth] starting session for %s: %v", user.Email, err)
+			writeJson(w, http.StatusInternalServerError, map[string]string{"error": "failed to issue jwt"})
+			return
+		}
+		log.Printf("[auth] returning JSON to caller; user=%s token_len=%d", user.Email, len(tokens.Token))
+		writeJson(w, http.StatusOK, map[string]any{
+			"token":            tokens.Token,
+			"expiresAt":        tokens.ExpiresAt,
+			"refreshToken":     tokens.RefreshToken,
+			"refreshExpiresAt": tokens.RefreshExpiresAt,
+			"user":             user,
+		})
+		return
+	}
+
+	// Otherwise redirect back to the frontend with a one-time code, which it
+	// exchanges at POST /auth/token; tokens never appear in a URL. The code
+	// only works from the browser holding this login's state cookie.
+	code, err = h.auth.issueLoginCode(pendingLogin{
+		Subject:   user.Email,
+		UserId:    user.Id,
+		UserAgent: r.UserAgent(),
+		Binding:   state,
+	})
+	if err != nil {
+		writeJson(w, http.StatusInternalServerError, map[string]string{"error": "failed to issue login code"})
+		return
+	}
+	redirectBase := ""
+	if rtCookie, _ := r.Cookie("oauth_return_to"); rtCookie != nil && rtCookie.Value != "" {
+		if validated, ok := validateReturnTo(r, rtCookie.Value); ok {
+			redirectBase = validated
+		} else {
+			log.Printf("[auth] invalid oauth_return_to cookie ignored")
+		}
+		// Clear cookie.
+		http.SetCookie(w, &http.Cookie{
+			Name:     "oauth_return_to",
+			Value:    "",
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+			MaxAge:   -1,
+		})
+	}
+	if redirectBase == "" {
+		redirectBase = strings.TrimRight(h.cfg.AppBaseURL, "/")
+	}
+	if redirectBase == "" {
+		// Last resort: derive from request host.
+		scheme := "http"
+		if r.TLS != nil || strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https") {
+			scheme = "https"
+		}
+		redirectBase = fmt.Sprintf("%s://%s", scheme, r.Host)
+	}
+	u, _ := url.Parse(redirectBase + "/")
+	q := u.Query()
+	q.Set(loginCodeParam, code)
+	u.RawQuery = q.Encode()
+
+	log.Printf("[auth] redirecting to frontend; user=%s redirect_base=%s", user.Email, redirectBase)
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+// oidcNonce derives the ID token nonce from the state, which the state
+// cookie already binds to this browser.
+func oidcNonce(state string) string {
+	sum := sha256.Sum256([]byte("nonce:" + state))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func randomState() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func logIfError(err error) {
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// validateReturnTo ensures return_to is a safe absolute http(s) URL that matches the
+// current request host. In dev we also allow localhost/127.0.0.1.
+func validateReturnTo(r *http.Request, raw string) (string, bool) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return "", false
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", false
+	}
+
+	hostOnly := strings.Split(r.Host, ":")[0]
+	rtHostOnly := strings.Split(u.Host, ":")[0]
+
+	// Same host is always allowed.
+	if strings.EqualFold(hostOnly, rtHostOnly) {
+		return strings.TrimRight(u.String(), "/"), true
+	}
+
+	// Dev convenience: allow localhost return_to when backend host is localhost-like.
+	if hostOnly == "localhost" || hostOnly == "127.0.0.1" {
+		if rtHostOnly == "localhost" || rtHostOnly == "127.0.0.1" {
+			return strings.TrimRight(u.String(), "/"), true
+		}
+	}
+
+	return "", false
+}
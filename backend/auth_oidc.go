@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// Discovery documents are refetched after this long; JWKS too, and
+	// earlier when a token names a key we haven't seen, at most once per
+	// oidcKeysMinRefresh so bad tokens can't make us hammer the issuer.
+	oidcDiscoveryTTL   = time.Hour
+	oidcKeysMinRefresh = time.Minute
+
+	maxOIDCResponseBytes = 1 << 20
+)
+
+// oidcSigningMethods are the ID token algorithms we accept. HS256 is left
+// out: it would make the client secret a verification key.
+var oidcSigningMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+// oidcDiscovery is the part of .well-known/openid-configuration we use.
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	JwksURI               string `json:"jwks_uri"`
+}
+
+// oidcProvider logs in against any OpenID Connect issuer. Endpoints come
+// from discovery and ID tokens are verified against the issuer's JWKS.
+type oidcProvider struct {
+	cfg    loginProviderConfig
+	client *http.Client
+
+	mu           sync.Mutex
+	discovery    *oidcDiscovery
+	discoveredAt time.Time
+	keys         map[string]crypto.PublicKey
+	keysAt       time.Time
+}
+
+func newOIDCProvider(cfg loginProviderConfig, client *http.Client) *oidcProvider {
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"openid", "email", "profile"}
+	}
+	return &oidcProvider{cfg: cfg, client: client}
+}
+
+func (p *oidcProvider) settings() loginProviderConfig { return p.cfg }
+
+func (p *oidcProvider) authCodeURL(ctx context.Context, state, nonce string) (string, error) {
+	oc, _, err := p.oauthConfig(ctx)
+	if err != nil {
+		return "", err
+	}
+	return oc.AuthCodeURL(state, oauth2.SetAuthURLParam("nonce", nonce)), nil
+}
+
+func (p *oidcProvider) identify(ctx context.Context, code, nonce string) (externalIdentity, error) {
+	oc, d, err := p.oauthConfig(ctx)
+	if err != nil {
+		return externalIdentity{}, err
+	}
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, p.client)
+	token, err := oc.Exchange(ctx, code)
+	if err != nil {
+		return externalIdentity{}, fmt.Errorf("token exchange: %w", err)
+	}
+	rawIDToken, _ := token.Extra("id_token").(string)
+	if rawIDToken == "" {
+		return externalIdentity{}, errors.New("token response has no id_token")
+	}
+	claims, err := p.verifyIDToken(ctx, d, rawIDToken, nonce)
+	if err != nil {
+		return externalIdentity{}, fmt.Errorf("id token: %w", err)
+	}
+	ident := externalIdentity{
+		Provider:      p.cfg.Name,
+		Subject:       claims.Subject,
+		Email:         claims.Email,
+		EmailVerified: bool(claims.EmailVerified),
+		Name:          claims.Name,
+		Picture:       claims.Picture,
+	}
+	// Some issuers keep profile claims out of the ID token.
+	if ident.Email == "" && d.UserinfoEndpoint != "" {
+		var info idTokenClaims
+		if err := getJSON(ctx, oc.Client(ctx, token), d.UserinfoEndpoint, &info); err != nil {
+			return externalIdentity{}, fmt.Errorf("userinfo: %w", err)
+		}
+		if info.Subject != claims.Subject {
+			return externalIdentity{}, errors.New("userinfo subject does not match id token")
+		}
+		ident.Email, ident.EmailVerified = info.Email, bool(info.EmailVerified)
+		ident.Name = firstNonEmpty(ident.Name, info.Name)
+		ident.Picture = firstNonEmpty(ident.Picture, info.Picture)
+	}
+	return ident, nil
+}
+
+// idTokenClaims are the ID token (and userinfo) claims we read.
+type idTokenClaims struct {
+	jwt.RegisteredClaims
+	Nonce           string    `json:"nonce"`
+	AuthorizedParty string    `json:"azp"`
+	Email           string    `json:"email"`
+	EmailVerified   claimBool `json:"email_verified"`
+	Name            string    `json:"name"`
+	Picture         string    `json:"picture"`
+}
+
+// claimBool accepts "true" as well as true; some issuers send strings.
+type claimBool bool
+
+func (b *claimBool) UnmarshalJSON(data []byte) error {
+	switch strings.Trim(string(data), `"`) {
+	case "true":
+		*b = true
+	default:
+		*b = false
+	}
+	return nil
+}
+
+// verifyIDToken checks the signature, issuer, audience, expiry and nonce.
+func (p *oidcProvider) verifyIDToken(ctx context.Context, d *oidcDiscovery, raw, nonce string) (*idTokenClaims, error) {
+	var claims idTokenClaims
+	_, err := jwt.ParseWithClaims(raw, &claims, func(t *jwt.Token) (any, error) {
+		kid, _ := t.Header["kid"].(string)
+		return p.publicKey(ctx, d, kid)
+	},
+		jwt.WithValidMethods(oidcSigningMethods),
+		jwt.WithIssuer(d.Issuer),
+		jwt.WithAudience(p.cfg.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("missing sub")
+	}
+	if len(claims.Audience) > 1 && claims.AuthorizedParty != p.cfg.ClientID {
+		return nil, errors.New("azp does not match client id")
+	}
+	if claims.Nonce != nonce {
+		return nil, errors.New("nonce mismatch")
+	}
+	return &claims, nil
+}
+
+// publicKey returns the issuer's key named kid. Tokens without a kid are
+// accepted only while the issuer publishes a single key.
+func (p *oidcProvider) publicKey(ctx context.Context, d *oidcDiscovery, kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	lookup := func() crypto.PublicKey {
+		if kid == "" && len(p.keys) == 1 {
+			for _, k := range p.keys {
+				return k
+			}
+		}
+		return p.keys[kid]
+	}
+	if key := lookup(); key != nil && time.Since(p.keysAt) < oidcDiscoveryTTL {
+		return key, nil
+	}
+	if time.Since(p.keysAt) >= oidcKeysMinRefresh {
+		var set jsonWebKeySet
+		if err := getJSON(ctx, p.client, d.JwksURI, &set); err != nil {
+			return nil, fmt.Errorf("fetching jwks: %w", err)
+		}
+		keys := make(map[string]crypto.PublicKey, len(set.Keys))
+		for _, k := range set.Keys {
+			if k.Use != "" && k.Use != "sig" {
+				continue
+			}
+			key, err := k.publicKey()
+			if err != nil {
+				continue // unsupported key types don't stop the others
+			}
+			keys[k.Kid] = key
+		}
+		p.keys, p.keysAt = keys, time.Now()
+	}
+	if key := lookup(); key != nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// oauthConfig discovers the issuer's endpoints, caching them for an hour.
+func (p *oidcProvider) oauthConfig(ctx context.Context) (*oauth2.Config, *oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery == nil || time.Since(p.discoveredAt) > oidcDiscoveryTTL {
+		issuer := strings.TrimRight(p.cfg.Issuer, "/")
+		var d oidcDiscovery
+		if err := getJSON(ctx, p.client, issuer+"/.well-known/openid-configuration", &d); err != nil {
+			return nil, nil, fmt.Errorf("oidc discovery for %s: %w", issuer, err)
+		}
+		// The document must describe the issuer we asked about (OIDC
+		// Discovery 4.3), or tokens could come from anywhere.
+		if strings.TrimRight(d.Issuer, "/") != issuer {
+			return nil, nil, fmt.Errorf("oidc discovery for %s returned issuer %q", issuer, d.Issuer)
+		}
+		if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JwksURI == "" {
+			return nil, nil, fmt.Errorf("oidc discovery for %s is missing endpoints", issuer)
+		}
+		p.discovery, p.discoveredAt = &d, time.Now()
+	}
+	d := p.discovery
+	return &oauth2.Config{
+		ClientID:     p.cfg.ClientID,
+		ClientSecret: p.cfg.ClientSecret,
+		RedirectURL:  p.cfg.RedirectURL,
+		Scopes:       p.cfg.Scopes,
+		Endpoint:     oauth2.Endpoint{AuthURL: d.AuthorizationEndpoint, TokenURL: d.TokenEndpoint},
+	}, d, nil
+}
+
+func getJSON(ctx context.Context, client *http.Client, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("GET %s: status %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, maxOIDCResponseBytes)).Decode(v)
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// fakeIssuer is an OpenID Connect provider serving discovery, a JWKS with
+// one ES256 key, a token endpoint returning idToken and a userinfo endpoint.
+type fakeIssuer struct {
+	srv *httptest.Server
+	key *ecdsa.PrivateKey
+	kid string
+
+	mu        sync.Mutex
+	issuer    string // in the discovery document; defaults to srv.URL
+	idToken   string
+	userinfo  map[string]any
+	jwksCalls int
+}
+
+func newFakeIssuer(t *testing.T) *fakeIssuer {
+	t.Helper()
+	f := &fakeIssuer{key: newECKey(t), kid: "key-1"}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		writeJson(w, http.StatusOK, oidcDiscovery{
+			Issuer:                firstNonEmpty(f.issuer, f.srv.URL),
+			AuthorizationEndpoint: f.srv.URL + "/authorize",
+			TokenEndpoint:         f.srv.URL + "/token",
+			UserinfoEndpoint:      f.srv.URL + "/userinfo",
+			JwksURI:               f.srv.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.jwksCalls++
+		jwk, _ := jwkFromPublicKey(&f.key.PublicKey)
+		jwk.Kid, jwk.Use, jwk.Alg = f.kid, "sig", "ES256"
+		writeJson(w, http.StatusOK, jsonWebKeySet{Keys: []jsonWebKey{jwk}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != "good-code" {
+			writeJson(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+			return
+		}
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		writeJson(w, http.StatusOK, map[string]any{
+			"access_token": "access", "token_type": "Bearer", "expires_in": 3600, "id_token": f.idToken,
+		})
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer access" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		writeJson(w, http.StatusOK, f.userinfo)
+	})
+	f.srv = httptest.NewServer(mux)
+	t.Cleanup(f.srv.Close)
+	return f
+}
+
+func newECKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func (f *fakeIssuer) provider() *oidcProvider {
+	return newOIDCProvider(loginProviderConfig{
+		Name:         "sso",
+		Issuer:       f.srv.URL,
+		ClientID:     "client-1",
+		ClientSecret: "client-secret",
+		RedirectURL:  "http://api.test/callback/oauth/sso",
+	}, f.srv.Client())
+}
+
+// claims are valid ID token claims for client-1 and nonce "n-1".
+func (f *fakeIssuer) claims() jwt.MapClaims {
+	now := time.Now()
+	return jwt.MapClaims{
+		"iss":            f.srv.URL,
+		"sub":            "user-1",
+		"aud":            "client-1",
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Hour).Unix(),
+		"nonce":          "n-1",
+		"email":          "alice@example.com",
+		"email_verified": true,
+		"name":           "Alice",
+	}
+}
+
+func (f *fakeIssuer) sign(t *testing.T, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["kid"] = f.kid
+	raw, err := token.SignedString(f.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func TestOIDCDiscovery(t *testing.T) {
+	f := newFakeIssuer(t)
+	p := f.provider()
+
+	raw, err := p.authCodeURL(context.Background(), "sso.state", "n-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(raw)
+	q := u.Query()
+	if u.Path != "/authorize" || q.Get("client_id") != "client-1" || q.Get("state") != "sso.state" ||
+		q.Get("nonce") != "n-1" || q.Get("scope") != "openid email profile" {
+		t.Errorf("auth URL %s", raw)
+	}
+
+	// A document naming another issuer is refused.
+	f.mu.Lock()
+	f.issuer = "https://evil.example.com"
+	f.mu.Unlock()
+	if _, err := f.provider().authCodeURL(context.Background(), "s", "n"); err == nil || !strings.Contains(err.Error(), "returned issuer") {
+		t.Errorf("issuer mismatch: err = %v", err)
+	}
+}
+
+func TestOIDCIdentify(t *testing.T) {
+	f := newFakeIssuer(t)
+	p := f.provider()
+	ctx := context.Background()
+	f.idToken = f.sign(t, f.claims())
+
+	ident, err := p.identify(ctx, "good-code", "n-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := externalIdentity{Provider: "sso", Subject: "user-1", Email: "alice@example.com", EmailVerified: true, Name: "Alice"}
+	if ident != want {
+		t.Errorf("identity = %+v, want %+v", ident, want)
+	}
+	if _, err := p.identify(ctx, "bad-code", "n-1"); err == nil {
+		t.Error("bad code accepted")
+	}
+	if _, err := p.identify(ctx, "good-code", "other-nonce"); err == nil {
+		t.Error("ID token for another login accepted")
+	}
+
+	// Issuers that keep the email out of the ID token: it comes from
+	// userinfo, which must describe the same subject.
+	claims := f.claims()
+	delete(claims, "email")
+	delete(claims, "email_verified")
+	f.idToken = f.sign(t, claims)
+	f.userinfo = map[string]any{"sub": "user-1", "email": "alice@example.com", "email_verified": "true"}
+	if ident, err := p.identify(ctx, "good-code", "n-1"); err != nil || ident.Email != "alice@example.com" || !ident.EmailVerified {
+		t.Errorf("userinfo fallback: %+v, %v", ident, err)
+	}
+	f.userinfo["sub"] = "user-2"
+	if _, err := p.identify(ctx, "good-code", "n-1"); err == nil {
+		t.Error("userinfo for another subject accepted")
+	}
+}
+
+func TestOIDCVerifyIDToken(t *testing.T) {
+	f := newFakeIssuer(t)
+	p := f.provider()
+	ctx := context.Background()
+	_, d, err := p.oauthConfig(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	with := func(change func(jwt.MapClaims)) string {
+		c := f.claims()
+		change(c)
+		return f.sign(t, c)
+	}
+	otherKey := func() string {
+		token := jwt.NewWithClaims(jwt.SigningMethodES256, f.claims())
+		token.Header["kid"] = f.kid
+		raw, _ := token.SignedString(newECKey(t))
+		return raw
+	}
+	algNone := func() string {
+		raw, _ := jwt.NewWithClaims(jwt.SigningMethodNone, f.claims()).SignedString(jwt.UnsafeAllowNoneSignatureType)
+		return raw
+	}
+	hs256 := func() string {
+		// Signed with the client secret, which the client also knows.
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, f.claims())
+		token.Header["kid"] = f.kid
+		raw, _ := token.SignedString([]byte("client-secret"))
+		return raw
+	}
+
+	for _, tc := range []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"valid", f.sign(t, f.claims()), true},
+		{"audience list with azp", with(func(c jwt.MapClaims) { c["aud"] = []string{"client-1", "other"}; c["azp"] = "client-1" }), true},
+		{"wrong issuer", with(func(c jwt.MapClaims) { c["iss"] = "https://evil.example.com" }), false},
+		{"wrong audience", with(func(c jwt.MapClaims) { c["aud"] = "client-2" }), false},
+		{"audience list without azp", with(func(c jwt.MapClaims) { c["aud"] = []string{"client-1", "other"} }), false},
+		{"wrong nonce", with(func(c jwt.MapClaims) { c["nonce"] = "n-2" }), false},
+		{"no nonce", with(func(c jwt.MapClaims) { delete(c, "nonce") }), false},
+		{"expired", with(func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-2 * time.Minute).Unix() }), false},
+		{"no exp", with(func(c jwt.MapClaims) { delete(c, "exp") }), false},
+		{"no subject", with(func(c jwt.MapClaims) { delete(c, "sub") }), false},
+		{"wrong key", otherKey(), false},
+		{"alg none", algNone(), false},
+		{"hs256 with client secret", hs256(), false},
+		{"garbage", "not.a.token", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			claims, err := p.verifyIDToken(ctx, d, tc.token, "n-1")
+			if tc.ok && (err != nil || claims.Subject != "user-1") {
+				t.Errorf("rejected: %v", err)
+			}
+			if !tc.ok && err == nil {
+				t.Error("accepted")
+			}
+		})
+	}
+}
+
+func TestOIDCUnknownKeyRefetchIsRateLimited(t *testing.T) {
+	f := newFakeIssuer(t)
+	p := f.provider()
+	ctx := context.Background()
+	_, d, err := p.oauthConfig(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.verifyIDToken(ctx, d, f.sign(t, f.claims()), "n-1"); err != nil {
+		t.Fatal(err)
+	}
+	for range 3 {
+		token := jwt.NewWithClaims(jwt.SigningMethodES256, f.claims())
+		token.Header["kid"] = "unknown"
+		raw, _ := token.SignedString(f.key)
+		if _, err := p.verifyIDToken(ctx, d, raw, "n-1"); err == nil {
+			t.Fatal("token with an unknown kid accepted")
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.jwksCalls != 1 {
+		t.Errorf("JWKS fetched %d times, want 1", f.jwksCalls)
+	}
+}
+
+// The issuer rotates its key: a token naming the new kid triggers a refetch
+// once the rate limit allows it.
+func TestOIDCKeyRotation(t *testing.T) {
+	f := newFakeIssuer(t)
+	p := f.provider()
+	ctx := context.Background()
+	_, d, err := p.oauthConfig(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.verifyIDToken(ctx, d, f.sign(t, f.claims()), "n-1"); err != nil {
+		t.Fatal(err)
+	}
+	f.mu.Lock()
+	f.key, f.kid = newECKey(t), "key-2"
+	f.mu.Unlock()
+	p.mu.Lock()
+	p.keysAt = time.Now().Add(-oidcKeysMinRefresh)
+	p.mu.Unlock()
+	if _, err := p.verifyIDToken(ctx, d, f.sign(t, f.claims()), "n-1"); err != nil {
+		t.Errorf("token from the rotated key: %v", err)
+	}
+}
@@ -0,0 +1,606 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	defaultAccessTokenTTL  = 15 * time.Minute
+	defaultRefreshTokenTTL = 30 * 24 * time.Hour
+
+	refreshCookieName = "agent_thing_refresh"
+	refreshCookiePath = "/auth"
+
+	// Two tabs refreshing at once present the same token; within this window
+	// the loser is told to retry instead of the session being revoked.
+	refreshReuseGrace = 30 * time.Second
+)
+
+var (
+	errRefreshInvalid = errors.New("invalid or expired refresh token")
+	errRefreshRaced   = errors.New("refresh token was just rotated; retry with the current one")
+	errSessionRevoked = errors.New("session has been logged out or has expired")
+	errSessionLookup  = errors.New("session lookup failed")
+)
+
+// authSession is one login. Access tokens name it in their "sess" claim and
+// stop working as soon as it is revoked; its refresh token rotates on every
+// use, and each use pushes ExpiresAt out by the refresh TTL.
+type authSession struct {
+	Id         string
+	Subject    string
+	UserId     int64
+	UserAgent  string
+	CreatedAt  time.Time
+	LastUsedAt time.Time
+	ExpiresAt  time.Time
+	RevokedAt  *time.Time
+}
+
+// authTokens is what a login or refresh returns. Tokens that travel in
+// cookies are left out of the body.
+type authTokens struct {
+	Token            string    `json:"token,omitempty"`
+	ExpiresAt        time.Time `json:"expiresAt"`
+	RefreshToken     string    `json:"refreshToken,omitempty"`
+	RefreshExpiresAt time.Time `json:"refreshExpiresAt"`
+	sessionId        string
+}
+
+// authSessionStore persists sessions and hashed refresh tokens.
+type authSessionStore interface {
+	createSession(ctx context.Context, sess authSession, refreshHash string) error
+	// rotateRefresh exchanges a refresh token for newHash and extends the
+	// session to expiresAt. Presenting an already rotated token revokes the
+	// session, since it means the token was copied.
+	rotateRefresh(ctx context.Context, oldHash, newHash string, expiresAt time.Time) (authSession, error)
+	sessionByRefresh(ctx context.Context, hash string) (authSession, error)
+	sessionActive(ctx context.Context, id string) (bool, error)
+	revokeSession(ctx context.Context, id string) error
+	revokeSubject(ctx context.Context, subject string) (int, error)
+}
+
+// newAuthSessionStore uses Postgres when a database is configured and falls
+// back to memory (everyone is logged out on restart) otherwise.
+func newAuthSessionStore(db *DB) authSessionStore {
+	if db == nil {
+		return newMemorySessionStore()
+	}
+	return &sqlSessionStore{db: db.SQL}
+}
+
+func hashRefreshToken(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+func newRefreshToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// startSession records a login and returns its first token pair.
+func (a *Authenticator) startSession(ctx context.Context, subject string, userID int64, userAgent string) (authTokens, error) {
+	refresh, err := newRefreshToken()
+	if err != nil {
+		return authTokens{}, err
+	}
+	now := time.Now().UTC()
+	sess := authSession{
+		Id:         newShellSessionID(),
+		Subject:    subject,
+		UserId:     userID,
+		UserAgent:  truncateString(userAgent, 256),
+		CreatedAt:  now,
+		LastUsedAt: now,
+		ExpiresAt:  now.Add(a.cfg.RefreshTokenTTL),
+	}
+	if err := a.sessions.createSession(ctx, sess, hashRefreshToken(refresh)); err != nil {
+		return authTokens{}, err
+	}
+	return a.tokensFor(sess, refresh)
+}
+
+// refresh rotates a refresh token and returns a new token pair.
+func (a *Authenticator) refresh(ctx context.Context, raw string) (authTokens, error) {
+	next, err := newRefreshToken()
+	if err != nil {
+		return authTokens{}, err
+	}
+	sess, err := a.sessions.rotateRefresh(ctx, hashRefreshToken(raw), hashRefreshToken(next), time.Now().UTC().Add(a.cfg.RefreshTokenTTL))
+	if err != nil {
+		return authTokens{}, err
+	}
+	return a.tokensFor(sess, next)
+}
+
+// tokensFor signs an access token for sess, never outliving the session.
+func (a *Authenticator) tokensFor(sess authSession, refresh string) (authTokens, error) {
+	now := time.Now()
+	expiresAt := now.Add(a.cfg.AccessTokenTTL)
+	if expiresAt.After(sess.ExpiresAt) {
+		expiresAt = sess.ExpiresAt
+	}
+	claims := jwt.MapClaims{
+		"sub":  sess.Subject,
+		"sess": sess.Id,
+		"jti":  newShellSessionID(),
+		"iat":  now.Unix(),
+		"exp":  expiresAt.Unix(),
+	}
+	if sess.UserId != 0 {
+		claims["uid"] = sess.UserId
+	}
+	token, err := a.sign(claims)
+	if err != nil {
+		return authTokens{}, err
+	}
+	return authTokens{Token: token, ExpiresAt: expiresAt.UTC(), RefreshToken: refresh, RefreshExpiresAt: sess.ExpiresAt, sessionId: sess.Id}, nil
+}
+
+// checkSession fails unless the login session id is still active.
+func (a *Authenticator) checkSession(ctx context.Context, id string) error {
+	active, err := a.sessions.sessionActive(ctx, id)
+	if err != nil {
+		log.Printf("[auth] checking session: %v", err)
+		return errSessionLookup
+	}
+	if !active {
+		return errSessionRevoked
+	}
+	return nil
+}
+
+// setRefreshCookie stores the refresh token where only /auth/* can read it.
+func (a *Authenticator) setRefreshCookie(w http.ResponseWriter, tokens authTokens) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     refreshCookieName,
+		Value:    tokens.RefreshToken,
+		Path:     refreshCookiePath,
+		Expires:  tokens.RefreshExpiresAt,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(a.cfg.BackendBaseURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (a *Authenticator) clearRefreshCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     refreshCookieName,
+		Value:    "",
+		Path:     refreshCookiePath,
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(a.cfg.BackendBaseURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// readAuthBody decodes an optional JSON body into v.
+func readAuthBody(w http.ResponseWriter, r *http.Request, v any) error {
+	if r.ContentLength == 0 {
+		return nil
+	}
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(v)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return errors.New("invalid json body")
+	}
+	return nil
+}
+
+// refreshCookie returns the refresh token from the cookie, if any. Cookies
+// are only honoured from our own origins.
+func (a *Authenticator) refreshCookie(r *http.Request) (string, error) {
+	c, err := r.Cookie(refreshCookieName)
+	if err != nil || c.Value == "" {
+		return "", nil
+	}
+	if origin := r.Header.Get("Origin"); origin != "" && !isOwnOrigin(a.cfg, origin) {
+		return "", errors.New("origin not allowed")
+	}
+	return c.Value, nil
+}
+
+// POST /auth/refresh
+//
+// Trades a refresh token (JSON body or cookie) for a new access token and a
+// new refresh token; the old one stops working. Cookie clients get their
+// tokens back as cookies.
+func (a *Authenticator) handleRefresh(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJson(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	var body struct {
+		RefreshToken string `json:"refreshToken"`
+	}
+	if err := readAuthBody(w, r, &body); err != nil {
+		writeJson(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	raw, fromCookie := body.RefreshToken, false
+	if raw == "" {
+		cookie, err := a.refreshCookie(r)
+		if err != nil {
+			writeJson(w, http.StatusForbidden, map[string]string{"error": err.Error()})
+			return
+		}
+		raw, fromCookie = cookie, cookie != ""
+	}
+	if raw == "" {
+		writeJson(w, http.StatusUnauthorized, map[string]string{"error": "missing refresh token"})
+		return
+	}
+	tokens, err := a.refresh(r.Context(), raw)
+	switch {
+	case errors.Is(err, errRefreshRaced):
+		writeJson(w, http.StatusConflict, map[string]string{"error": err.Error()})
+		return
+	case errors.Is(err, errRefreshInvalid):
+		if fromCookie {
+			a.clearRefreshCookie(w)
+		}
+		writeJson(w, http.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return
+	case err != nil:
+		log.Printf("[auth] refresh: %v", err)
+		writeJson(w, http.StatusInternalServerError, map[string]string{"error": "refresh failed"})
+		return
+	}
+	if fromCookie {
+		_, err := r.Cookie(authCookieName)
+		a.sendBrowserTokens(w, tokens, err == nil)
+		return
+	}
+	writeJson(w, http.StatusOK, tokens)
+}
+
+// POST /auth/logout  {"all": false}
+//
+// Revokes the session named by the refresh token (body or cookie) or, failing
+// that, by the bearer access token. With "all": true every session of the
+// same user is revoked, e.g. after losing a laptop.
+func (a *Authenticator) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJson(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	var body struct {
+		RefreshToken string `json:"refreshToken"`
+		All          bool   `json:"all"`
+	}
+	if err := readAuthBody(w, r, &body); err != nil {
+		writeJson(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	raw, fromCookie := body.RefreshToken, false
+	if raw == "" {
+		cookie, err := a.refreshCookie(r)
+		if err != nil {
+			writeJson(w, http.StatusForbidden, map[string]string{"error": err.Error()})
+			return
+		}
+		raw, fromCookie = cookie, cookie != ""
+	}
+	if fromCookie {
+		a.clearRefreshCookie(w)
+	}
+	if _, err := r.Cookie(authCookieName); err == nil {
+		a.clearAccessCookie(w)
+	}
+
+	var sess authSession
+	var err error
+	if raw != "" {
+		sess, err = a.sessions.sessionByRefresh(r.Context(), hashRefreshToken(raw))
+	} else if bearer := tokenFromRequest(r); bearer != "" {
+		var user *authUser
+		if user, err = a.verify(r.Context(), bearer); err == nil {
+			sess = authSession{Id: user.SessionId, Subject: user.Subject}
+		}
+	} else {
+		err = errRefreshInvalid
+	}
+	if err != nil {
+		if errors.Is(err, errSessionLookup) {
+			writeJson(w, http.StatusServiceUnavailable, map[string]string{"error": err.Error()})
+			return
+		}
+		// Already logged out as far as this client is concerned.
+		writeJson(w, http.StatusOK, map[string]any{"ok": true, "revoked": 0})
+		return
+	}
+
+	revoked := 1
+	if body.All {
+		revoked, err = a.sessions.revokeSubject(r.Context(), sess.Subject)
+	} else {
+		err = a.sessions.revokeSession(r.Context(), sess.Id)
+	}
+	if err != nil {
+		log.Printf("[auth] logout: %v", err)
+		writeJson(w, http.StatusInternalServerError, map[string]string{"error": "logout failed"})
+		return
+	}
+	writeJson(w, http.StatusOK, map[string]any{"ok": true, "revoked": revoked})
+}
+
+// isOwnOrigin reports whether a browser Origin is the app's or the backend's.
+func isOwnOrigin(cfg *Config, origin string) bool {
+	for _, base := range []string{cfg.AppBaseURL, cfg.BackendBaseURL} {
+		if u, err := url.Parse(base); err == nil && strings.EqualFold(origin, u.Scheme+"://"+u.Host) {
+			return true
+		}
+	}
+	return false
+}
+
+func truncateString(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+type refreshRecord struct {
+	sessionID string
+	usedAt    *time.Time
+}
+
+type memorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*authSession
+	tokens   map[string]*refreshRecord
+}
+
+func newMemorySessionStore() *memorySessionStore {
+	return &memorySessionStore{
+		sessions: make(map[string]*authSession),
+		tokens:   make(map[string]*refreshRecord),
+	}
+}
+
+func (s *memorySessionStore) createSession(ctx context.Context, sess authSession, refreshHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Forget sessions that can no longer be used.
+	now := time.Now()
+	for hash, rec := range s.tokens {
+		if old := s.sessions[rec.sessionID]; old == nil || now.After(old.ExpiresAt) {
+			delete(s.tokens, hash)
+		}
+	}
+	for id, old := range s.sessions {
+		if now.After(old.ExpiresAt) {
+			delete(s.sessions, id)
+		}
+	}
+	s.sessions[sess.Id] = &sess
+	s.tokens[refreshHash] = &refreshRecord{sessionID: sess.Id}
+	return nil
+}
+
+func (s *memorySessionStore) rotateRefresh(ctx context.Context, oldHash, newHash string, expiresAt time.Time) (authSession, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().UTC()
+	rec := s.tokens[oldHash]
+	if rec == nil {
+		return authSession{}, errRefreshInvalid
+	}
+	sess := s.sessions[rec.sessionID]
+	if sess == nil || sess.RevokedAt != nil || now.After(sess.ExpiresAt) {
+		return authSession{}, errRefreshInvalid
+	}
+	if rec.usedAt != nil {
+		if now.Sub(*rec.usedAt) < refreshReuseGrace {
+			return authSession{}, errRefreshRaced
+		}
+		log.Printf("[auth] refresh token reused; revoking session %s of %s", sess.Id, sess.Subject)
+		sess.RevokedAt = &now
+		return authSession{}, errRefreshInvalid
+	}
+	rec.usedAt = &now
+	s.tokens[newHash] = &refreshRecord{sessionID: sess.Id}
+	sess.LastUsedAt = now
+	sess.ExpiresAt = expiresAt
+	return *sess, nil
+}
+
+func (s *memorySessionStore) sessionByRefresh(ctx context.Context, hash string) (authSession, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec := s.tokens[hash]
+	if rec == nil || s.sessions[rec.sessionID] == nil {
+		return authSession{}, errRefreshInvalid
+	}
+	return *s.sessions[rec.sessionID], nil
+}
+
+func (s *memorySessionStore) sessionActive(ctx context.Context, id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess := s.sessions[id]
+	return sess != nil && sess.RevokedAt == nil && time.Now().Before(sess.ExpiresAt), nil
+}
+
+func (s *memorySessionStore) revokeSession(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sess := s.sessions[id]; sess != nil && sess.RevokedAt == nil {
+		now := time.Now().UTC()
+		sess.RevokedAt = &now
+	}
+	return nil
+}
+
+func (s *memorySessionStore) revokeSubject(ctx context.Context, subject string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().UTC()
+	n := 0
+	for _, sess := range s.sessions {
+		if sess.Subject == subject && sess.RevokedAt == nil {
+			sess.RevokedAt = &now
+			n++
+		}
+	}
+	return n, nil
+}
+
+type sqlSessionStore struct {
+	db *sql.DB
+}
+
+const authSessionColumns = `id, subject, coalesce(user_id, 0), user_agent, created_at, last_used_at, expires_at, revoked_at`
+
+func scanAuthSession(row interface{ Scan(...any) error }) (authSession, error) {
+	var sess authSession
+	var revoked sql.NullTime
+	err := row.Scan(&sess.Id, &sess.Subject, &sess.UserId, &sess.UserAgent, &sess.CreatedAt, &sess.LastUsedAt, &sess.ExpiresAt, &revoked)
+	if revoked.Valid {
+		sess.RevokedAt = &revoked.Time
+	}
+	return sess, err
+}
+
+func (s *sqlSessionStore) createSession(ctx context.Context, sess authSession, refreshHash string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var userID any
+	if sess.UserId != 0 {
+		userID = sess.UserId
+	}
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO auth_sessions (id, subject, user_id, user_agent, created_at, last_used_at, expires_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		sess.Id, sess.Subject, userID, sess.UserAgent, sess.CreatedAt, sess.LastUsedAt, sess.ExpiresAt); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO refresh_tokens (token_hash, session_id) VALUES ($1, $2)`, refreshHash, sess.Id); err != nil {
+		return err
+	}
+	// Forget sessions that expired a while ago.
+	if _, err := tx.ExecContext(ctx, `DELETE FROM auth_sessions WHERE expires_at < now() - interval '7 days'`); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlSessionStore) rotateRefresh(ctx context.Context, oldHash, newHash string, expiresAt time.Time) (authSession, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return authSession{}, err
+	}
+	defer tx.Rollback()
+
+	var sessionID string
+	var usedAt sql.NullTime
+	err = tx.QueryRowContext(ctx,
+		`SELECT session_id, used_at FROM refresh_tokens WHERE token_hash = $1 FOR UPDATE`, oldHash).Scan(&sessionID, &usedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return authSession{}, errRefreshInvalid
+	}
+	if err != nil {
+		return authSession{}, err
+	}
+	sess, err := scanAuthSession(tx.QueryRowContext(ctx,
+		`SELECT `+authSessionColumns+` FROM auth_sessions WHERE id = $1 FOR UPDATE`, sessionID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return authSession{}, errRefreshInvalid
+	}
+	if err != nil {
+		return authSession{}, err
+	}
+	now := time.Now()
+	if sess.RevokedAt != nil || now.After(sess.ExpiresAt) {
+		return authSession{}, errRefreshInvalid
+	}
+	if usedAt.Valid {
+		if now.Sub(usedAt.Time) < refreshReuseGrace {
+			return authSession{}, errRefreshRaced
+		}
+		log.Printf("[auth] refresh token reused; revoking session %s of %s", sess.Id, sess.Subject)
+		if _, err := tx.ExecContext(ctx, `UPDATE auth_sessions SET revoked_at = now() WHERE id = $1`, sess.Id); err != nil {
+			return authSession{}, err
+		}
+		if err := tx.Commit(); err != nil {
+			return authSession{}, err
+		}
+		return authSession{}, errRefreshInvalid
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE refresh_tokens SET used_at = now() WHERE token_hash = $1`, oldHash); err != nil {
+		return authSession{}, err
+	}
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO refresh_tokens (token_hash, session_id) VALUES ($1, $2)`, newHash, sess.Id); err != nil {
+		return authSession{}, err
+	}
+	sess, err = scanAuthSession(tx.QueryRowContext(ctx,
+		`UPDATE auth_sessions SET last_used_at = now(), expires_at = $2 WHERE id = $1 RETURNING `+authSessionColumns,
+		sess.Id, expiresAt))
+	if err != nil {
+		return authSession{}, err
+	}
+	return sess, tx.Commit()
+}
+
+func (s *sqlSessionStore) sessionByRefresh(ctx context.Context, hash string) (authSession, error) {
+	sess, err := scanAuthSession(s.db.QueryRowContext(ctx,
+		`SELECT `+authSessionColumns+` FROM auth_sessions
+		 WHERE id = (SELECT session_id FROM refresh_tokens WHERE token_hash = $1)`, hash))
+	if errors.Is(err, sql.ErrNoRows) {
+		return sess, errRefreshInvalid
+	}
+	return sess, err
+}
+
+func (s *sqlSessionStore) sessionActive(ctx context.Context, id string) (bool, error) {
+	var active bool
+	err := s.db.QueryRowContext(ctx,
+		`SELECT revoked_at IS NULL AND expires_at > now() FROM auth_sessions WHERE id = $1`, id).Scan(&active)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return active, err
+}
+
+func (s *sqlSessionStore) revokeSession(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE auth_sessions SET revoked_at = now() WHERE id = $1 AND revoked_at IS NULL`, id)
+	return err
+}
+
+func (s *sqlSessionStore) revokeSubject(ctx context.Context, subject string) (int, error) {
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE auth_sessions SET revoked_at = now() WHERE subject = $1 AND revoked_at IS NULL`, subject)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemorySessionStoreRotateRefresh(t *testing.T) {
+	ctx := context.Background()
+	later := func() time.Time { return time.Now().UTC().Add(time.Hour) }
+
+	for _, tc := range []struct {
+		name string
+		// before runs against a session "s-1" whose refresh token is "t-1".
+		before     func(t *testing.T, s *memorySessionStore)
+		present    string
+		want       error
+		wantActive bool
+	}{
+		{
+			name:       "rotate",
+			before:     func(t *testing.T, s *memorySessionStore) {},
+			present:    "t-1",
+			wantActive: true,
+		},
+		{
+			name: "rotate the rotated token",
+			before: func(t *testing.T, s *memorySessionStore) {
+				if _, err := s.rotateRefresh(ctx, "t-1", "t-2", later()); err != nil {
+					t.Fatal(err)
+				}
+			},
+			present:    "t-2",
+			wantActive: true,
+		},
+		{
+			name: "race within the grace window",
+			before: func(t *testing.T, s *memorySessionStore) {
+				if _, err := s.rotateRefresh(ctx, "t-1", "t-2", later()); err != nil {
+					t.Fatal(err)
+				}
+			},
+			present:    "t-1",
+			want:       errRefreshRaced,
+			wantActive: true,
+		},
+		{
+			name: "reuse after the grace window",
+			before: func(t *testing.T, s *memorySessionStore) {
+				if _, err := s.rotateRefresh(ctx, "t-1", "t-2", later()); err != nil {
+					t.Fatal(err)
+				}
+				usedAt := time.Now().Add(-refreshReuseGrace - time.Second)
+				s.tokens["t-1"].usedAt = &usedAt
+			},
+			present: "t-1",
+			want:    errRefreshInvalid,
+		},
+		{
+			name: "logged out",
+			before: func(t *testing.T, s *memorySessionStore) {
+				if err := s.revokeSession(ctx, "s-1"); err != nil {
+					t.Fatal(err)
+				}
+			},
+			present: "t-1",
+			want:    errRefreshInvalid,
+		},
+		{
+			name: "expired session",
+			before: func(t *testing.T, s *memorySessionStore) {
+				s.sessions["s-1"].ExpiresAt = time.Now().Add(-time.Second)
+			},
+			present: "t-1",
+			want:    errRefreshInvalid,
+		},
+		{
+			name:       "unknown token",
+			before:     func(t *testing.T, s *memorySessionStore) {},
+			present:    "t-unknown",
+			want:       errRefreshInvalid,
+			wantActive: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newMemorySessionStore()
+			now := time.Now().UTC()
+			sess := authSession{Id: "s-1", Subject: "alice@example.com", CreatedAt: now, LastUsedAt: now, ExpiresAt: now.Add(time.Minute)}
+			if err := s.createSession(ctx, sess, "t-1"); err != nil {
+				t.Fatal(err)
+			}
+			tc.before(t, s)
+
+			expiresAt := later()
+			got, err := s.rotateRefresh(ctx, tc.present, "t-next", expiresAt)
+			if !errors.Is(err, tc.want) {
+				t.Fatalf("rotate: err = %v, want %v", err, tc.want)
+			}
+			if tc.want == nil && (got.Id != "s-1" || !got.ExpiresAt.Equal(expiresAt)) {
+				t.Errorf("rotated session %+v, want s-1 extended to %s", got, expiresAt)
+			}
+			if active, _ := s.sessionActive(ctx, "s-1"); active != tc.wantActive {
+				t.Errorf("session active = %v, want %v", active, tc.wantActive)
+			}
+		})
+	}
+}
+
+// postAuth sends a JSON POST to an auth handler, with an optional bearer token.
+func postAuth(t *testing.T, h http.HandlerFunc, body, bearer string) (*httptest.ResponseRecorder, map[string]any) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	if bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+	rec := httptest.NewRecorder()
+	h(rec, req)
+	var out map[string]any
+	_ = json.Unmarshal(rec.Body.Bytes(), &out)
+	return rec, out
+}
+
+func TestRefreshEndpoint(t *testing.T) {
+	auth := newTestAuth(t, testConfig())
+	ctx := context.Background()
+	first, err := auth.startSession(ctx, "alice@example.com", 1, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec, out := postAuth(t, auth.handleRefresh, `{"refreshToken": "`+first.RefreshToken+`"}`, "")
+	if rec.Code != http.StatusOK || out["token"] == "" || out["refreshToken"] == first.RefreshToken {
+		t.Fatalf("refresh: %d %s", rec.Code, rec.Body)
+	}
+	user, err := auth.verify(ctx, out["token"].(string))
+	if err != nil || user.SessionId != first.sessionId {
+		t.Errorf("new access token: %+v, %v", user, err)
+	}
+
+	// Two tabs refreshing at once: the loser is told to retry, not logged out.
+	if rec, _ := postAuth(t, auth.handleRefresh, `{"refreshToken": "`+first.RefreshToken+`"}`, ""); rec.Code != http.StatusConflict {
+		t.Errorf("second use within the grace window: %d %s", rec.Code, rec.Body)
+	}
+	if err := auth.checkSession(ctx, first.sessionId); err != nil {
+		t.Errorf("session after a raced refresh: %v", err)
+	}
+
+	// The same token much later means it leaked: the whole session ends.
+	store := auth.sessions.(*memorySessionStore)
+	store.mu.Lock()
+	usedAt := time.Now().Add(-refreshReuseGrace - time.Second)
+	store.tokens[hashRefreshToken(first.RefreshToken)].usedAt = &usedAt
+	store.mu.Unlock()
+	if rec, _ := postAuth(t, auth.handleRefresh, `{"refreshToken": "`+first.RefreshToken+`"}`, ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("reuse after the grace window: %d %s", rec.Code, rec.Body)
+	}
+	if rec, _ := postAuth(t, auth.handleRefresh, `{"refreshToken": "`+out["refreshToken"].(string)+`"}`, ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("rotated token after reuse: %d %s", rec.Code, rec.Body)
+	}
+	if _, err := auth.verify(ctx, out["token"].(string)); !errors.Is(err, errSessionRevoked) {
+		t.Errorf("access token after reuse: err = %v, want errSessionRevoked", err)
+	}
+
+	if rec, _ := postAuth(t, auth.handleRefresh, `{}`, ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("no token: %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestRefreshExpiredSession(t *testing.T) {
+	auth := newTestAuth(t, testConfig())
+	ctx := context.Background()
+	tokens, err := auth.startSession(ctx, "alice@example.com", 1, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := auth.sessions.(*memorySessionStore)
+	store.mu.Lock()
+	store.sessions[tokens.sessionId].ExpiresAt = time.Now().Add(-time.Second)
+	store.mu.Unlock()
+
+	if rec, _ := postAuth(t, auth.handleRefresh, `{"refreshToken": "`+tokens.RefreshToken+`"}`, ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("refresh of an expired session: %d %s", rec.Code, rec.Body)
+	}
+	if _, err := auth.verify(ctx, tokens.Token); !errors.Is(err, errSessionRevoked) {
+		t.Errorf("access token of an expired session: err = %v", err)
+	}
+}
+
+func TestLogout(t *testing.T) {
+	ctx := context.Background()
+	start := func(t *testing.T, auth *Authenticator, subject string) authTokens {
+		t.Helper()
+		tokens, err := auth.startSession(ctx, subject, 1, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tokens
+	}
+
+	t.Run("refresh token", func(t *testing.T) {
+		auth := newTestAuth(t, testConfig())
+		laptop, phone := start(t, auth, "alice@example.com"), start(t, auth, "alice@example.com")
+		rec, out := postAuth(t, auth.handleLogout, `{"refreshToken": "`+laptop.RefreshToken+`"}`, "")
+		if rec.Code != http.StatusOK || out["revoked"] != float64(1) {
+			t.Fatalf("logout: %d %s", rec.Code, rec.Body)
+		}
+		if _, err := auth.verify(ctx, laptop.Token); !errors.Is(err, errSessionRevoked) {
+			t.Errorf("access token after logout: err = %v", err)
+		}
+		if _, err := auth.refresh(ctx, laptop.RefreshToken); !errors.Is(err, errRefreshInvalid) {
+			t.Errorf("refresh after logout: err = %v", err)
+		}
+		if _, err := auth.verify(ctx, phone.Token); err != nil {
+			t.Errorf("other session after logout: %v", err)
+		}
+	})
+
+	t.Run("bearer token", func(t *testing.T) {
+		auth := newTestAuth(t, testConfig())
+		tokens := start(t, auth, "alice@example.com")
+		if rec, out := postAuth(t, auth.handleLogout, `{}`, tokens.Token); rec.Code != http.StatusOK || out["revoked"] != float64(1) {
+			t.Fatalf("logout: %d %s", rec.Code, rec.Body)
+		}
+		if err := auth.checkSession(ctx, tokens.sessionId); !errors.Is(err, errSessionRevoked) {
+			t.Errorf("session after logout: err = %v", err)
+		}
+		// Logging out twice is fine.
+		if rec, out := postAuth(t, auth.handleLogout, `{}`, tokens.Token); rec.Code != http.StatusOK || out["revoked"] != float64(0) {
+			t.Errorf("second logout: %d %s", rec.Code, rec.Body)
+		}
+	})
+
+	t.Run("all", func(t *testing.T) {
+		auth := newTestAuth(t, testConfig())
+		laptop, phone := start(t, auth, "alice@example.com"), start(t, auth, "alice@example.com")
+		bob := start(t, auth, "bob@example.com")
+		rec, out := postAuth(t, auth.handleLogout, `{"refreshToken": "`+laptop.RefreshToken+`", "all": true}`, "")
+		if rec.Code != http.StatusOK || out["revoked"] != float64(2) {
+			t.Fatalf("logout: %d %s", rec.Code, rec.Body)
+		}
+		for _, tokens := range []authTokens{laptop, phone} {
+			if _, err := auth.verify(ctx, tokens.Token); !errors.Is(err, errSessionRevoked) {
+				t.Errorf("access token after logging out everywhere: err = %v", err)
+			}
+		}
+		if _, err := auth.verify(ctx, bob.Token); err != nil {
+			t.Errorf("another user's session: %v", err)
+		}
+	})
+}
+
+// TestRevokedSessionRejected checks the middleware turns away access tokens
+// of a revoked session even though they are still signed and unexpired.
+func TestRevokedSessionRejected(t *testing.T) {
+	auth := newTestAuth(t, testConfig())
+	tokens, err := auth.startSession(context.Background(), "alice@example.com", 1, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := auth.require(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) })
+	get := func() int {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer "+tokens.Token)
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		return rec.Code
+	}
+
+	if code := get(); code != http.StatusNoContent {
+		t.Fatalf("before revoking: %d", code)
+	}
+	if err := auth.sessions.revokeSession(context.Background(), tokens.sessionId); err != nil {
+		t.Fatal(err)
+	}
+	if code := get(); code != http.StatusUnauthorized {
+		t.Errorf("after revoking: %d, want 401", code)
+	}
+}
@@ -3,8 +3,12 @@ package main
 import (
 	"fmt"
 	"log"
+	"maps"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"gopkg.in/ini.v1"
 )
@@ -12,6 +16,10 @@ import (
 type Config struct {
 	AppBaseURL     string
 	BackendBaseURL string
+	// PreviewBaseURL is a separate origin (e.g. https://preview.example.com)
+	// serving only /preview/*, so previewed apps never share an origin with
+	// the API and its auth cookie. Empty serves previews from BackendBaseURL.
+	PreviewBaseURL string
 
 	// Persistence / Xata (PostgreSQL)
 	XataDatabaseURL string
@@ -24,6 +32,21 @@ type Config struct {
 	GoogleRedirectURL  string
 	JwtSecret          string
 
+	// Asymmetric token signing: a PEM private key (RSA, EC or Ed25519) that
+	// replaces JWT_SECRET, plus older keys still accepted during rotation.
+	// All of them are published at /.well-known/jwks.json.
+	JwtSigningKey string
+	JwtVerifyKeys []string
+
+	// Lifetimes of access tokens and of login sessions; each refresh
+	// extends a session by RefreshTokenTTL.
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+
+	// Login providers from [login:<name>] INI sections; "google" is added
+	// from the GOOGLE_* settings unless a section of that name exists.
+	LoginProviders map[string]loginProviderConfig
+
 	// Stripe
 	StripeSecretKey      string
 	StripePublishableKey string
@@ -32,6 +55,59 @@ type Config struct {
 
 	// Cloudflare (optional)
 	CloudflareAPIToken string
+
+	// Docker Engine API endpoint (unix:// or tcp://); defaults to the local socket.
+	DockerHost string
+
+	// Shell sessions: how long a detached shell keeps running, and how much
+	// output is kept for replay on reattach.
+	ShellSessionGrace    time.Duration
+	ShellScrollbackBytes int
+
+	// Asciicast recordings: stored under ShellRecordingDir (empty disables);
+	// sessions opt in with ?record=1 unless ShellRecordAll is set.
+	ShellRecordingDir string
+	ShellRecordAll    bool
+
+	// Container resource limits: global defaults, named plans ([plan:<name>]
+	// INI sections) and per-user overrides ([user:<sub>] sections), plus a
+	// host-wide cap on running containers.
+	ContainerLimits      resourceLimits
+	PlanLimits           map[string]resourceLimits
+	UserLimits           map[string]userLimits
+	DefaultPlan          string
+	MaxRunningContainers int
+
+	// Idle reaper: stop containers without activity for IdleStopAfter,
+	// remove containers stopped for RemoveStoppedAfterDays. Zero disables.
+	IdleStopAfter          time.Duration
+	RemoveStoppedAfterDays int
+	ReapInterval           time.Duration
+
+	// BuildTimeout bounds a rebuild job, image build included.
+	BuildTimeout time.Duration
+
+	// Environment templates from [template:<name>] INI sections, and the one
+	// used when a start request doesn't pick one.
+	Templates       map[string]envTemplate
+	DefaultTemplate string
+
+	// Agent runtime: AgentProvider is "openai" (any OpenAI-compatible chat
+	// completions API at AgentBaseURL) or "fake" (replays AgentFakeScript);
+	// empty disables the agent.
+	AgentProvider     string
+	AgentBaseURL      string
+	AgentAPIKey       string
+	AgentModel        string
+	AgentFakeScript   string
+	AgentSystemPrompt string
+	AgentMaxSteps     int
+	AgentRunTimeout   time.Duration
+
+	// Approval gates for agent commands (see agentPolicy) and how long a run
+	// waits for an answer before the command counts as denied.
+	AgentPolicy          agentPolicy
+	AgentApprovalTimeout time.Duration
 }
 
 func LoadConfig() (*Config, error) {
@@ -42,6 +118,7 @@ func LoadConfig() (*Config, error) {
 	c := &Config{
 		AppBaseURL:     strings.TrimRight(firstNonEmpty(getEnvOptional("APP_BASE_URL"), iniCfg.AppBaseURL, "http://localhost:18710"), "/"),
 		BackendBaseURL: strings.TrimRight(firstNonEmpty(getEnvOptional("BACKEND_BASE_URL"), iniCfg.BackendBaseURL, "http://localhost:18711"), "/"),
+		PreviewBaseURL: strings.TrimRight(firstNonEmpty(getEnvOptional("PREVIEW_BASE_URL"), iniCfg.PreviewBaseURL, ""), "/"),
 
 		XataDatabaseURL: firstNonEmpty(getEnvOptional("XATA_DATABASE_URL"), iniCfg.XataDatabaseURL, ""),
 		XataAPIKey:      firstNonEmpty(getEnvOptional("XATA_API_KEY"), iniCfg.XataAPIKey, ""),
@@ -52,29 +129,101 @@ func LoadConfig() (*Config, error) {
 		GoogleRedirectURL:  firstNonEmpty(getEnvOptional("GOOGLE_REDIRECT_URL"), iniCfg.GoogleRedirectURL, ""),
 		JwtSecret:          firstNonEmpty(getEnvOptional("JWT_SECRET"), iniCfg.JwtSecret, ""),
 
+		JwtSigningKey: firstNonEmpty(getEnvOptional("JWT_SIGNING_KEY"), iniCfg.JwtSigningKey, ""),
+		JwtVerifyKeys: splitList(firstNonEmpty(getEnvOptional("JWT_VERIFY_KEYS"), strings.Join(iniCfg.JwtVerifyKeys, ","))),
+
+		AccessTokenTTL:  firstDuration(getEnvOptional("ACCESS_TOKEN_TTL"), iniCfg.AccessTokenTTL, defaultAccessTokenTTL),
+		RefreshTokenTTL: firstDuration(getEnvOptional("REFRESH_TOKEN_TTL"), iniCfg.RefreshTokenTTL, defaultRefreshTokenTTL),
+
+		LoginProviders: iniCfg.LoginProviders,
+
 		StripeSecretKey:      firstNonEmpty(getEnvOptional("STRIPE_SECRET_KEY"), iniCfg.StripeSecretKey, ""),
 		StripePublishableKey: firstNonEmpty(getEnvOptional("STRIPE_PUBLISHABLE_KEY"), iniCfg.StripePublishableKey, ""),
 		StripeWebhookSecret:  firstNonEmpty(getEnvOptional("STRIPE_WEBHOOK_SECRET"), iniCfg.StripeWebhookSecret, ""),
 		StripeDefaultPriceID: firstNonEmpty(getEnvOptional("STRIPE_PRICE_ID"), iniCfg.StripeDefaultPriceID, ""),
 
 		CloudflareAPIToken: firstNonEmpty(getEnvOptional("CLOUDFLARE_API_TOKEN"), iniCfg.CloudflareAPIToken, ""),
+
+		DockerHost: firstNonEmpty(getEnvOptional("DOCKER_HOST"), iniCfg.DockerHost, defaultDockerHost),
+
+		ShellSessionGrace:    firstDuration(getEnvOptional("SHELL_SESSION_GRACE"), iniCfg.ShellSessionGrace, defaultShellSessionGrace),
+		ShellScrollbackBytes: firstInt(getEnvOptional("SHELL_SCROLLBACK_BYTES"), iniCfg.ShellScrollbackBytes, defaultShellScrollbackBytes),
+
+		ShellRecordingDir: firstNonEmpty(getEnvOptional("SHELL_RECORDING_DIR"), iniCfg.ShellRecordingDir, ""),
+		ShellRecordAll:    firstBool(getEnvOptional("SHELL_RECORD_ALL"), iniCfg.ShellRecordAll),
+
+		ContainerLimits:      limitsFromEnv(iniCfg.ContainerLimits),
+		PlanLimits:           iniCfg.PlanLimits,
+		UserLimits:           iniCfg.UserLimits,
+		DefaultPlan:          firstNonEmpty(getEnvOptional("DOCKER_DEFAULT_PLAN"), iniCfg.DefaultPlan, ""),
+		MaxRunningContainers: firstInt(getEnvOptional("DOCKER_MAX_RUNNING_CONTAINERS"), iniCfg.MaxRunningContainers, 0),
+
+		IdleStopAfter:          firstDuration(getEnvOptional("DOCKER_IDLE_STOP_AFTER"), iniCfg.IdleStopAfter, 0),
+		RemoveStoppedAfterDays: firstInt(getEnvOptional("DOCKER_REMOVE_STOPPED_AFTER_DAYS"), iniCfg.RemoveStoppedAfterDays, 0),
+		ReapInterval:           firstDuration(getEnvOptional("DOCKER_REAP_INTERVAL"), iniCfg.ReapInterval, defaultReapInterval),
+
+		BuildTimeout: firstDuration(getEnvOptional("DOCKER_BUILD_TIMEOUT"), iniCfg.BuildTimeout, defaultBuildTimeout),
+
+		Templates:       iniCfg.Templates,
+		DefaultTemplate: firstNonEmpty(getEnvOptional("DOCKER_DEFAULT_TEMPLATE"), iniCfg.DefaultTemplate, defaultTemplateName),
+
+		AgentProvider:     firstNonEmpty(getEnvOptional("AGENT_PROVIDER"), iniCfg.AgentProvider, ""),
+		AgentBaseURL:      firstNonEmpty(getEnvOptional("AGENT_BASE_URL"), iniCfg.AgentBaseURL, defaultAgentBaseURL),
+		AgentAPIKey:       firstNonEmpty(getEnvOptional("AGENT_API_KEY"), iniCfg.AgentAPIKey, ""),
+		AgentModel:        firstNonEmpty(getEnvOptional("AGENT_MODEL"), iniCfg.AgentModel, defaultAgentModel),
+		AgentFakeScript:   firstNonEmpty(getEnvOptional("AGENT_FAKE_SCRIPT"), iniCfg.AgentFakeScript, ""),
+		AgentSystemPrompt: firstNonEmpty(getEnvOptional("AGENT_SYSTEM_PROMPT"), iniCfg.AgentSystemPrompt, ""),
+		AgentMaxSteps:     firstInt(getEnvOptional("AGENT_MAX_STEPS"), iniCfg.AgentMaxSteps, defaultAgentMaxSteps),
+		AgentRunTimeout:   firstDuration(getEnvOptional("AGENT_RUN_TIMEOUT"), iniCfg.AgentRunTimeout, defaultAgentRunTimeout),
+
+		AgentPolicy:          policyFromEnv(iniCfg.AgentPolicy),
+		AgentApprovalTimeout: firstDuration(getEnvOptional("AGENT_APPROVAL_TIMEOUT"), iniCfg.AgentApprovalTimeout, defaultAgentApprovalTimeout),
+	}
+
+	if c.PreviewBaseURL != "" && hostOf(c.PreviewBaseURL) == hostOf(c.BackendBaseURL) {
+		log.Printf("PREVIEW_BASE_URL must be a different host from BACKEND_BASE_URL; ignoring it")
+		c.PreviewBaseURL = ""
 	}
 
 	if c.GoogleRedirectURL == "" && c.GoogleClientID != "" {
 		// Default callback under backend host (Google must redirect to backend).
 		c.GoogleRedirectURL = fmt.Sprintf("%s/callback/oauth/google", c.BackendBaseURL)
 	}
+	if c.LoginProviders == nil {
+		c.LoginProviders = map[string]loginProviderConfig{}
+	}
+	if _, ok := c.LoginProviders["google"]; !ok && c.GoogleClientID != "" {
+		c.LoginProviders["google"] = loginProviderConfig{
+			Name:         "google",
+			Type:         loginProviderOIDC,
+			DisplayName:  "Google",
+			Issuer:       googleIssuer,
+			ClientID:     c.GoogleClientID,
+			ClientSecret: c.GoogleClientSecret,
+			RedirectURL:  c.GoogleRedirectURL,
+		}
+	}
+	for name, p := range c.LoginProviders {
+		if p.RedirectURL == "" {
+			p.RedirectURL = fmt.Sprintf("%s/callback/oauth/%s", c.BackendBaseURL, name)
+			c.LoginProviders[name] = p
+		}
+	}
 
 	// Safe startup summary (no secrets).
 	log.Printf(
-		"config loaded: APP_BASE_URL=%s, BACKEND_BASE_URL=%s, GOOGLE_REDIRECT_URL=%s, DB_URL_set=%t, XATA_DB_URL_set=%t, GOOGLE_CLIENT_ID_set=%t, JWT_SECRET_set=%t, STRIPE_SECRET_KEY_set=%t, STRIPE_PRICE_ID_set=%t",
+		"config loaded: APP_BASE_URL=%s, BACKEND_BASE_URL=%s, PREVIEW_BASE_URL=%s, GOOGLE_REDIRECT_URL=%s, LOGIN_PROVIDERS=%s, DOCKER_HOST=%s, DB_URL_set=%t, XATA_DB_URL_set=%t, GOOGLE_CLIENT_ID_set=%t, JWT_SECRET_set=%t, JWT_SIGNING_KEY=%s, STRIPE_SECRET_KEY_set=%t, STRIPE_PRICE_ID_set=%t",
 		c.AppBaseURL,
 		c.BackendBaseURL,
+		c.PreviewBaseURL,
 		c.GoogleRedirectURL,
+		strings.Join(slices.Sorted(maps.Keys(c.LoginProviders)), ","),
+		c.DockerHost,
 		c.DatabaseURL != "",
 		c.XataDatabaseURL != "",
 		c.GoogleClientID != "",
 		c.JwtSecret != "",
+		c.JwtSigningKey,
 		c.StripeSecretKey != "",
 		c.StripeDefaultPriceID != "",
 	)
@@ -95,6 +244,60 @@ func firstNonEmpty(values ...string) string {
 	return ""
 }
 
+// splitList splits a comma-separated list, dropping empty items.
+func splitList(raw string) []string {
+	var out []string
+	for _, v := range strings.Split(raw, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// firstDuration parses an env value, falling back to the INI value and then
+// def. Invalid env values are logged and ignored.
+func firstDuration(envValue string, iniValue, def time.Duration) time.Duration {
+	if envValue != "" {
+		d, err := time.ParseDuration(envValue)
+		if err == nil && d > 0 {
+			return d
+		}
+		log.Printf("ignoring invalid duration %q", envValue)
+	}
+	if iniValue > 0 {
+		return iniValue
+	}
+	return def
+}
+
+// firstInt is firstDuration for integers.
+func firstInt(envValue string, iniValue, def int) int {
+	if envValue != "" {
+		n, err := strconv.Atoi(envValue)
+		if err == nil && n > 0 {
+			return n
+		}
+		log.Printf("ignoring invalid integer %q", envValue)
+	}
+	if iniValue > 0 {
+		return iniValue
+	}
+	return def
+}
+
+// firstBool parses an env value, falling back to the INI value.
+func firstBool(envValue string, iniValue bool) bool {
+	if envValue != "" {
+		b, err := strconv.ParseBool(envValue)
+		if err == nil {
+			return b
+		}
+		log.Printf("ignoring invalid boolean %q", envValue)
+	}
+	return iniValue
+}
+
 // loadIniConfig tries CONFIG_INI_PATH or /etc/agent-thing/config.ini.
 // Missing/invalid file is not fatal; we just log and continue with env defaults.
 func loadIniConfig() *Config {
@@ -116,20 +319,88 @@ func loadIniConfig() *Config {
 
 	sec := f.Section("")
 	c := &Config{
-		AppBaseURL:           sec.Key("APP_BASE_URL").String(),
-		BackendBaseURL:       sec.Key("BACKEND_BASE_URL").String(),
-		XataDatabaseURL:      sec.Key("XATA_DATABASE_URL").String(),
-		XataAPIKey:           sec.Key("XATA_API_KEY").String(),
-		DatabaseURL:          sec.Key("DATABASE_URL").String(),
-		GoogleClientID:       sec.Key("GOOGLE_CLIENT_ID").String(),
-		GoogleClientSecret:   sec.Key("GOOGLE_CLIENT_SECRET").String(),
-		GoogleRedirectURL:    sec.Key("GOOGLE_REDIRECT_URL").String(),
-		JwtSecret:            sec.Key("JWT_SECRET").String(),
-		StripeSecretKey:      sec.Key("STRIPE_SECRET_KEY").String(),
-		StripePublishableKey: sec.Key("STRIPE_PUBLISHABLE_KEY").String(),
-		StripeWebhookSecret:  sec.Key("STRIPE_WEBHOOK_SECRET").String(),
-		StripeDefaultPriceID: sec.Key("STRIPE_PRICE_ID").String(),
-		CloudflareAPIToken:   sec.Key("CLOUDFLARE_API_TOKEN").String(),
+		AppBaseURL:             sec.Key("APP_BASE_URL").String(),
+		BackendBaseURL:         sec.Key("BACKEND_BASE_URL").String(),
+		PreviewBaseURL:         sec.Key("PREVIEW_BASE_URL").String(),
+		XataDatabaseURL:        sec.Key("XATA_DATABASE_URL").String(),
+		XataAPIKey:             sec.Key("XATA_API_KEY").String(),
+		DatabaseURL:            sec.Key("DATABASE_URL").String(),
+		GoogleClientID:         sec.Key("GOOGLE_CLIENT_ID").String(),
+		GoogleClientSecret:     sec.Key("GOOGLE_CLIENT_SECRET").String(),
+		GoogleRedirectURL:      sec.Key("GOOGLE_REDIRECT_URL").String(),
+		JwtSecret:              sec.Key("JWT_SECRET").String(),
+		JwtSigningKey:          sec.Key("JWT_SIGNING_KEY").String(),
+		JwtVerifyKeys:          sec.Key("JWT_VERIFY_KEYS").Strings(","),
+		AccessTokenTTL:         sec.Key("ACCESS_TOKEN_TTL").MustDuration(0),
+		RefreshTokenTTL:        sec.Key("REFRESH_TOKEN_TTL").MustDuration(0),
+		LoginProviders:         map[string]loginProviderConfig{},
+		StripeSecretKey:        sec.Key("STRIPE_SECRET_KEY").String(),
+		StripePublishableKey:   sec.Key("STRIPE_PUBLISHABLE_KEY").String(),
+		StripeWebhookSecret:    sec.Key("STRIPE_WEBHOOK_SECRET").String(),
+		StripeDefaultPriceID:   sec.Key("STRIPE_PRICE_ID").String(),
+		CloudflareAPIToken:     sec.Key("CLOUDFLARE_API_TOKEN").String(),
+		DockerHost:             sec.Key("DOCKER_HOST").String(),
+		ShellSessionGrace:      sec.Key("SHELL_SESSION_GRACE").MustDuration(0),
+		ShellScrollbackBytes:   sec.Key("SHELL_SCROLLBACK_BYTES").MustInt(0),
+		ShellRecordingDir:      sec.Key("SHELL_RECORDING_DIR").String(),
+		ShellRecordAll:         sec.Key("SHELL_RECORD_ALL").MustBool(false),
+		ContainerLimits:        readLimitsSection(sec),
+		PlanLimits:             map[string]resourceLimits{},
+		UserLimits:             map[string]userLimits{},
+		DefaultPlan:            sec.Key("DOCKER_DEFAULT_PLAN").String(),
+		MaxRunningContainers:   sec.Key("DOCKER_MAX_RUNNING_CONTAINERS").MustInt(0),
+		IdleStopAfter:          sec.Key("DOCKER_IDLE_STOP_AFTER").MustDuration(0),
+		RemoveStoppedAfterDays: sec.Key("DOCKER_REMOVE_STOPPED_AFTER_DAYS").MustInt(0),
+		ReapInterval:           sec.Key("DOCKER_REAP_INTERVAL").MustDuration(0),
+		BuildTimeout:           sec.Key("DOCKER_BUILD_TIMEOUT").MustDuration(0),
+		Templates:              map[string]envTemplate{},
+		DefaultTemplate:        sec.Key("DOCKER_DEFAULT_TEMPLATE").String(),
+		AgentProvider:          sec.Key("AGENT_PROVIDER").String(),
+		AgentBaseURL:           sec.Key("AGENT_BASE_URL").String(),
+		AgentAPIKey:            sec.Key("AGENT_API_KEY").String(),
+		AgentModel:             sec.Key("AGENT_MODEL").String(),
+		AgentFakeScript:        sec.Key("AGENT_FAKE_SCRIPT").String(),
+		AgentSystemPrompt:      sec.Key("AGENT_SYSTEM_PROMPT").String(),
+		AgentMaxSteps:          sec.Key("AGENT_MAX_STEPS").MustInt(0),
+		AgentRunTimeout:        sec.Key("AGENT_RUN_TIMEOUT").MustDuration(0),
+		AgentPolicy:            readPolicySection(sec),
+		AgentApprovalTimeout:   sec.Key("AGENT_APPROVAL_TIMEOUT").MustDuration(0),
+	}
+	for _, s := range f.Sections() {
+		if name, ok := strings.CutPrefix(s.Name(), "plan:"); ok {
+			c.PlanLimits[name] = readLimitsSection(s)
+		} else if sub, ok := strings.CutPrefix(s.Name(), "user:"); ok {
+			c.UserLimits[sub] = userLimits{Plan: s.Key("PLAN").String(), Limits: readLimitsSection(s)}
+		} else if name, ok := strings.CutPrefix(s.Name(), "login:"); ok {
+			if !templateNamePattern.MatchString(name) {
+				log.Printf("ignoring login provider with invalid name %q", name)
+				continue
+			}
+			c.LoginProviders[name] = loginProviderConfig{
+				Name:                 name,
+				Type:                 s.Key("TYPE").String(),
+				DisplayName:          s.Key("DISPLAY_NAME").String(),
+				Issuer:               s.Key("ISSUER").String(),
+				ClientID:             s.Key("CLIENT_ID").String(),
+				ClientSecret:         s.Key("CLIENT_SECRET").String(),
+				RedirectURL:          s.Key("REDIRECT_URL").String(),
+				Scopes:               s.Key("SCOPES").Strings(" "),
+				APIURL:               s.Key("API_URL").String(),
+				AllowUnverifiedEmail: s.Key("ALLOW_UNVERIFIED_EMAIL").MustBool(false),
+			}
+		} else if name, ok := strings.CutPrefix(s.Name(), "template:"); ok {
+			if !templateNamePattern.MatchString(name) {
+				log.Printf("ignoring template with invalid name %q", name)
+				continue
+			}
+			c.Templates[name] = envTemplate{
+				Name:        name,
+				Description: s.Key("DESCRIPTION").String(),
+				Image:       s.Key("IMAGE").String(),
+				Dockerfile:  s.Key("DOCKERFILE").String(),
+				Context:     s.Key("CONTEXT").String(),
+			}
+		}
 	}
 	log.Printf("loaded ini config from %s", path)
 	return c
@@ -0,0 +1,499 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Dev container support: a workspace is a directory under /home/developer
+// (usually a cloned repository) whose .devcontainer/devcontainer.json
+// describes the container to run. The spec and build context are read from
+// the owner's current container, so the home volume is the source of truth.
+// See https://containers.dev/implementors/json_reference/.
+const (
+	devcontainerTemplateName = "devcontainer"
+	devcontainerImagePrefix  = "agent-thing-dc"
+	devcontainerVolumePrefix = "agent-thing-vol"
+	devcontainerMaxSpecBytes = 1 << 20
+
+	labelWorkspace  = "agent-thing.workspace"
+	labelRemoteUser = "agent-thing.remote-user"
+	labelPorts      = "agent-thing.ports"
+)
+
+var (
+	workspacePattern  = regexp.MustCompile(`^[A-Za-z0-9._/-]+$`)
+	devcontainerPaths = []string{".devcontainer/devcontainer.json", ".devcontainer.json"}
+)
+
+// devcontainerSpec is the subset of devcontainer.json we support.
+type devcontainerSpec struct {
+	Name  string `json:"name"`
+	Image string `json:"image"`
+	Build *struct {
+		Dockerfile string            `json:"dockerfile"`
+		Context    string            `json:"context"`
+		Args       map[string]string `json:"args"`
+		Target     string            `json:"target"`
+	} `json:"build"`
+	// Older top-level spellings of build.dockerfile and build.context.
+	DockerFile string `json:"dockerFile"`
+	Context    string `json:"context"`
+
+	ContainerEnv      map[string]string `json:"containerEnv"`
+	ContainerUser     string            `json:"containerUser"`
+	RemoteUser        string            `json:"remoteUser"`
+	WorkspaceFolder   string            `json:"workspaceFolder"`
+	Mounts            []json.RawMessage `json:"mounts"`
+	ForwardPorts      []json.RawMessage `json:"forwardPorts"`
+	OnCreateCommand   json.RawMessage   `json:"onCreateCommand"`
+	PostCreateCommand json.RawMessage   `json:"postCreateCommand"`
+}
+
+// lifecycleCommand is one command of a lifecycle hook.
+type lifecycleCommand struct {
+	Name string
+	Argv []string
+}
+
+// validWorkspace checks a workspace path relative to /home/developer.
+func validWorkspace(ws string) (string, error) {
+	clean := path.Clean(ws)
+	if !workspacePattern.MatchString(ws) || path.IsAbs(clean) || clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("invalid workspace %q: must be a directory under %s", ws, homeDir)
+	}
+	return clean, nil
+}
+
+// stripJSONC turns JSON with comments (as devcontainer.json allows) into
+// plain JSON: // and /* */ comments and trailing commas are removed.
+func stripJSONC(in []byte) []byte {
+	var out bytes.Buffer
+	inString, escaped := false, false
+	for i := 0; i < len(in); i++ {
+		c := in[i]
+		if inString {
+			out.WriteByte(c)
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				inString = false
+			}
+			continue
+		}
+		switch {
+		case c == '"':
+			inString = true
+			out.WriteByte(c)
+		case c == '/' && i+1 < len(in) && in[i+1] == '/':
+			for i < len(in) && in[i] != '\n' {
+				i++
+			}
+			out.WriteByte('\n')
+		case c == '/' && i+1 < len(in) && in[i+1] == '*':
+			end := bytes.Index(in[i+2:], []byte("*/"))
+			if end < 0 {
+				return out.Bytes()
+			}
+			i += end + 3
+		case c == ',':
+			// Drop the comma if the next significant byte closes the value.
+			j := i + 1
+			for j < len(in) && strings.IndexByte(" \t\r\n", in[j]) >= 0 {
+				j++
+			}
+			if j < len(in) && (in[j] == '}' || in[j] == ']') {
+				continue
+			}
+			out.WriteByte(c)
+		default:
+			out.WriteByte(c)
+		}
+	}
+	return out.Bytes()
+}
+
+// parseDevcontainer parses devcontainer.json, substituting the
+// ${containerWorkspaceFolder}-style variables we can resolve.
+func parseDevcontainer(raw []byte, workspace string) (*devcontainerSpec, error) {
+	plain := stripJSONC(raw)
+	var spec devcontainerSpec
+	if err := json.Unmarshal(plain, &spec); err != nil {
+		return nil, fmt.Errorf("devcontainer.json: %w", err)
+	}
+	folder := firstNonEmpty(spec.WorkspaceFolder, homeDir+"/"+workspace)
+	replacer := strings.NewReplacer(
+		"${containerWorkspaceFolder}", jsonEscape(folder),
+		"${containerWorkspaceFolderBasename}", jsonEscape(path.Base(folder)),
+		"${localWorkspaceFolderBasename}", jsonEscape(path.Base(workspace)),
+		"${localWorkspaceFolder}", jsonEscape(homeDir+"/"+workspace),
+	)
+	spec = devcontainerSpec{}
+	if err := json.Unmarshal([]byte(replacer.Replace(string(plain))), &spec); err != nil {
+		return nil, fmt.Errorf("devcontainer.json: %w", err)
+	}
+	spec.WorkspaceFolder = folder
+	return &spec, nil
+}
+
+// jsonEscape returns s escaped for use inside a JSON string literal.
+func jsonEscape(s string) string {
+	raw, _ := json.Marshal(s)
+	return string(raw[1 : len(raw)-1])
+}
+
+// lifecycleCommands parses a lifecycle hook: a string (run by /bin/sh), an
+// argv array, or an object of named commands of either form.
+func lifecycleCommands(hook string, raw json.RawMessage) ([]lifecycleCommand, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var str string
+	if json.Unmarshal(raw, &str) == nil {
+		return []lifecycleCommand{{Name: hook, Argv: []string{"/bin/sh", "-c", str}}}, nil
+	}
+	var argv []string
+	if json.Unmarshal(raw, &argv) == nil {
+		return []lifecycleCommand{{Name: hook, Argv: argv}}, nil
+	}
+	var named map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &named); err != nil {
+		return nil, fmt.Errorf("%s: expected a string, array or object", hook)
+	}
+	names := make([]string, 0, len(named))
+	for name := range named {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var out []lifecycleCommand
+	for _, name := range names {
+		cmds, err := lifecycleCommands(hook+" ("+name+")", named[name])
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, cmds...)
+	}
+	return out, nil
+}
+
+// forwardedPorts returns the container ports of forwardPorts entries, which
+// are numbers or "host:port" strings.
+func forwardedPorts(raw []json.RawMessage) []int {
+	var ports []int
+	for _, entry := range raw {
+		var n int
+		if json.Unmarshal(entry, &n) != nil {
+			var s string
+			if json.Unmarshal(entry, &s) != nil {
+				continue
+			}
+			n, _ = strconv.Atoi(s[strings.LastIndex(s, ":")+1:])
+		}
+		if n > 0 && n < 65536 {
+			ports = append(ports, n)
+		}
+	}
+	return ports
+}
+
+// parseDevcontainerMount reads a mounts entry, either the docker --mount
+// string form ("type=volume,source=x,target=/y") or an object.
+func parseDevcontainerMount(raw json.RawMessage) (dockerMount, error) {
+	var mount dockerMount
+	var str string
+	if json.Unmarshal(raw, &str) == nil {
+		for _, field := range strings.Split(str, ",") {
+			key, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+			switch key {
+			case "type":
+				mount.Type = value
+			case "source", "src":
+				mount.Source = value
+			case "target", "destination", "dst":
+				mount.Target = value
+			case "readonly", "ro":
+				mount.ReadOnly = value == "" || value == "true" || value == "1"
+			}
+		}
+	} else {
+		var obj struct {
+			Type   string `json:"type"`
+			Source string `json:"source"`
+			Target string `json:"target"`
+		}
+		if err := json.Unmarshal(raw, &obj); err != nil {
+			return mount, errors.New("mount must be a string or an object")
+		}
+		mount = dockerMount{Type: obj.Type, Source: obj.Source, Target: obj.Target}
+	}
+	if mount.Type == "" {
+		mount.Type = "volume"
+	}
+	if mount.Target == "" || !path.IsAbs(mount.Target) {
+		return mount, fmt.Errorf("mount %s: target must be an absolute path", raw)
+	}
+	return mount, nil
+}
+
+// devcontainerVolumeFor scopes a volume named in devcontainer.json to owner.
+func devcontainerVolumeFor(owner, source string) string {
+	return devcontainerVolumePrefix + "-" + ownerKey(owner) + "-" + ownerSlug(source)
+}
+
+// readContainerFile reads one file out of a (possibly stopped) container.
+func (m *DockerManager) readContainerFile(ctx context.Context, containerID, p string, max int64) ([]byte, error) {
+	archive, err := m.docker.containerArchive(ctx, containerID, p)
+	if err != nil {
+		return nil, err
+	}
+	defer archive.Close()
+	tr := tar.NewReader(archive)
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", p, err)
+	}
+	if hdr.Typeflag != tar.TypeReg {
+		return nil, fmt.Errorf("%s is not a regular file", p)
+	}
+	if hdr.Size > max {
+		return nil, fmt.Errorf("%s is larger than %d bytes", p, max)
+	}
+	return io.ReadAll(tr)
+}
+
+// containerBuildContext streams dir from the container as a build context:
+// entries are re-rooted at dir and filtered by its .dockerignore.
+func (m *DockerManager) containerBuildContext(ctx context.Context, containerID, dir, dockerfile string) (io.ReadCloser, error) {
+	var ignoreFile io.Reader
+	if raw, err := m.readContainerFile(ctx, containerID, dir+"/.dockerignore", devcontainerMaxSpecBytes); err == nil {
+		ignoreFile = bytes.NewReader(raw)
+	} else if !isDockerNotFound(err) {
+		return nil, err
+	}
+	ignore, err := parseDockerignore(ignoreFile, dockerfile)
+	if err != nil {
+		return nil, err
+	}
+	archive, err := m.docker.containerArchive(ctx, containerID, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := path.Base(dir) + "/"
+	pr, pw := io.Pipe()
+	go func() {
+		defer archive.Close()
+		pw.CloseWithError(func() error {
+			tr := tar.NewReader(archive)
+			tw := tar.NewWriter(pw)
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					return tw.Close()
+				}
+				if err != nil {
+					return err
+				}
+				rel, ok := strings.CutPrefix(hdr.Name, prefix)
+				rel = strings.TrimSuffix(rel, "/")
+				if !ok || rel == "" {
+					continue
+				}
+				if ignore.excludes(rel) {
+					continue
+				}
+				hdr.Name = rel
+				if err := tw.WriteHeader(hdr); err != nil {
+					return err
+				}
+				if _, err := io.Copy(tw, tr); err != nil {
+					return err
+				}
+			}
+		}())
+	}()
+	return pr, nil
+}
+
+// loadDevcontainer finds and parses the workspace's devcontainer.json. It
+// returns the spec and the directory holding it, relative to the workspace.
+func (m *DockerManager) loadDevcontainer(ctx context.Context, containerID, workspace string) (*devcontainerSpec, string, error) {
+	for _, candidate := range devcontainerPaths {
+		raw, err := m.readContainerFile(ctx, containerID, homeDir+"/"+workspace+"/"+candidate, devcontainerMaxSpecBytes)
+		if isDockerNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		spec, err := parseDevcontainer(raw, workspace)
+		if err != nil {
+			return nil, "", err
+		}
+		return spec, path.Dir(candidate), nil
+	}
+	return nil, "", fmt.Errorf("no devcontainer.json in %s/%s (looked for %s)", homeDir, workspace, strings.Join(devcontainerPaths, ", "))
+}
+
+// rebuildFromDevcontainer replaces the owner's container with one described
+// by the workspace's devcontainer.json, then runs its onCreateCommand and
+// postCreateCommand. Everything is logged to out.
+func (m *DockerManager) rebuildFromDevcontainer(ctx context.Context, owner string, status dockerStatusResponse, workspace string, out io.Writer) error {
+	if status.ContainerId == "" {
+		return fmt.Errorf("no container to read %s/%s from; start one and clone the workspace first", homeDir, workspace)
+	}
+	spec, configDir, err := m.loadDevcontainer(ctx, status.ContainerId, workspace)
+	if err != nil {
+		return err
+	}
+	logStep(out, "using %s/%s/%s/devcontainer.json", homeDir, workspace, configDir)
+
+	image := spec.Image
+	dockerfile := spec.DockerFile
+	contextRel := spec.Context
+	var buildOpts dockerBuildOptions
+	if spec.Build != nil {
+		dockerfile = firstNonEmpty(spec.Build.Dockerfile, dockerfile)
+		contextRel = firstNonEmpty(spec.Build.Context, contextRel)
+		buildOpts.BuildArgs = spec.Build.Args
+		buildOpts.Target = spec.Build.Target
+	}
+	switch {
+	case dockerfile != "":
+		// Paths in devcontainer.json are relative to the file itself.
+		contextDir := path.Join(configDir, firstNonEmpty(contextRel, "."))
+		dockerfilePath := path.Join(configDir, dockerfile)
+		if contextDir == ".." || strings.HasPrefix(contextDir, "../") {
+			return fmt.Errorf("build context %q is outside the workspace", contextRel)
+		}
+		inContext := dockerfilePath
+		if contextDir != "." {
+			var ok bool
+			if inContext, ok = strings.CutPrefix(dockerfilePath, contextDir+"/"); !ok {
+				return fmt.Errorf("Dockerfile %q must be inside the build context %q", dockerfile, contextRel)
+			}
+		}
+		image = devcontainerImagePrefix + "-" + ownerKey(owner)
+		buildOpts.Dockerfile = inContext
+		buildOpts.Tag = image
+		logStep(out, "building image %s from %s", image, dockerfilePath)
+		buildContext, err := m.containerBuildContext(ctx, status.ContainerId, path.Clean(homeDir+"/"+workspace+"/"+contextDir), inContext)
+		if err != nil {
+			return err
+		}
+		err = m.docker.imageBuild(ctx, buildContext, buildOpts, out)
+		buildContext.Close()
+		if err != nil {
+			return err
+		}
+	case image != "":
+		logStep(out, "pulling image %s", image)
+		if err := m.docker.imagePull(ctx, image, out); err != nil {
+			return err
+		}
+	default:
+		return errors.New("devcontainer.json has neither image nor build.dockerfile")
+	}
+
+	var mounts []dockerMount
+	for _, raw := range spec.Mounts {
+		mount, err := parseDevcontainerMount(raw)
+		if err != nil {
+			return err
+		}
+		if mount.Type != "volume" || mount.Source == "" {
+			// Bind mounts would expose the host; anonymous volumes aren't kept.
+			logStep(out, "skipping %s mount at %s: only named volumes are supported", mount.Type, mount.Target)
+			continue
+		}
+		if path.Clean(mount.Target) == homeDir {
+			logStep(out, "skipping mount at %s: the home volume is mounted there", mount.Target)
+			continue
+		}
+		mount.Source = devcontainerVolumeFor(owner, mount.Source)
+		if _, err := m.docker.volumeCreate(ctx, mount.Source, map[string]string{
+			labelManaged: "true",
+			labelOwner:   owner,
+			labelVolume:  devcontainerTemplateName,
+		}); err != nil {
+			return err
+		}
+		mounts = append(mounts, mount)
+	}
+
+	env := make([]string, 0, len(spec.ContainerEnv))
+	for k, v := range spec.ContainerEnv {
+		env = append(env, k+"="+v)
+	}
+	sort.Strings(env)
+	ports := forwardedPorts(spec.ForwardPorts)
+	portLabels := make([]string, len(ports))
+	for i, p := range ports {
+		portLabels[i] = strconv.Itoa(p)
+	}
+	remoteUser := firstNonEmpty(spec.RemoteUser, spec.ContainerUser)
+
+	if status.ContainerId != "" {
+		logStep(out, "removing container %s", containerNameFor(owner))
+		if err := m.docker.containerRemove(ctx, status.ContainerId, true); err != nil && !isDockerNotFound(err) {
+			return err
+		}
+	}
+	logStep(out, "starting container %s from %s", containerNameFor(owner), image)
+	cfg := dockerContainerConfig{
+		Image:      image,
+		Env:        env,
+		User:       spec.ContainerUser,
+		WorkingDir: spec.WorkspaceFolder,
+		Labels: map[string]string{
+			labelTemplate:   devcontainerTemplateName,
+			labelWorkspace:  workspace,
+			labelRemoteUser: remoteUser,
+			labelPorts:      strings.Join(portLabels, ","),
+		},
+	}
+	cfg.HostConfig.Mounts = mounts
+	containerID, err := m.createContainer(ctx, owner, cfg)
+	if err != nil {
+		return err
+	}
+
+	for _, hook := range []struct {
+		name string
+		raw  json.RawMessage
+	}{{"onCreateCommand", spec.OnCreateCommand}, {"postCreateCommand", spec.PostCreateCommand}} {
+		cmds, err := lifecycleCommands(hook.name, hook.raw)
+		if err != nil {
+			return err
+		}
+		for _, cmd := range cmds {
+			logStep(out, "running %s: %s", cmd.Name, strings.Join(cmd.Argv, " "))
+			code, err := m.docker.execRun(ctx, containerID, dockerExecConfig{
+				Cmd:        cmd.Argv,
+				User:       remoteUser,
+				WorkingDir: spec.WorkspaceFolder,
+			}, nil, out, out)
+			if err != nil {
+				return fmt.Errorf("%s: %w", cmd.Name, err)
+			}
+			if code != 0 {
+				return fmt.Errorf("%s exited with code %d", cmd.Name, code)
+			}
+		}
+	}
+	logStep(out, "container ready")
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestStripJSONC(t *testing.T) {
+	for _, tc := range []struct {
+		name, in, want string
+	}{
+		{"line comment", "{\"a\": 1 // one\n}", "{\"a\": 1 \n}"},
+		{"block comment", `{/* x */"a": 1}`, `{"a": 1}`},
+		{"trailing commas", "{\"a\": [1, 2,\n], \"b\": 3,\n}", "{\"a\": [1, 2\n], \"b\": 3\n}"},
+		{"comment markers in strings", `{"url": "http://x/*y*/", "c": "a // b"}`, `{"url": "http://x/*y*/", "c": "a // b"}`},
+		{"escaped quote", `{"a": "say \"//hi\"", "b": 1}`, `{"a": "say \"//hi\"", "b": 1}`},
+		{"comma in string", `{"a": ",]"}`, `{"a": ",]"}`},
+		{"unterminated block comment", `{"a": 1} /* x`, `{"a": 1} `},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := string(stripJSONC([]byte(tc.in))); got != tc.want {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseDevcontainer(t *testing.T) {
+	raw := []byte(`{
+		// Comments and trailing commas are allowed.
+		"name": "app",
+		"build": {"dockerfile": "Dockerfile", "context": ".."},
+		"containerEnv": {"PROJECT": "${containerWorkspaceFolderBasename}"},
+		"mounts": ["source=${localWorkspaceFolderBasename}-cache,target=/cache,type=volume"],
+		"postCreateCommand": "cd ${containerWorkspaceFolder} && make",
+	}`)
+	spec, err := parseDevcontainer(raw, "src/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec.Name != "app" || spec.Build == nil || spec.Build.Dockerfile != "Dockerfile" || spec.Build.Context != ".." {
+		t.Errorf("spec %+v", spec)
+	}
+	if spec.WorkspaceFolder != homeDir+"/src/app" || spec.ContainerEnv["PROJECT"] != "app" {
+		t.Errorf("workspace %q, env %v", spec.WorkspaceFolder, spec.ContainerEnv)
+	}
+	if len(spec.Mounts) != 1 || string(spec.Mounts[0]) != `"source=app-cache,target=/cache,type=volume"` {
+		t.Errorf("mounts %s", spec.Mounts)
+	}
+	var cmd string
+	_ = json.Unmarshal(spec.PostCreateCommand, &cmd)
+	if cmd != "cd "+homeDir+"/src/app && make" {
+		t.Errorf("postCreateCommand %q", cmd)
+	}
+
+	// A workspaceFolder is kept, and substituted values stay valid JSON.
+	spec, err = parseDevcontainer([]byte(`{"workspaceFolder": "/work/a\"b", "containerEnv": {"W": "${containerWorkspaceFolder}"}}`), "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec.WorkspaceFolder != `/work/a"b` || spec.ContainerEnv["W"] != `/work/a"b` {
+		t.Errorf("workspace %q, env %v", spec.WorkspaceFolder, spec.ContainerEnv)
+	}
+
+	if _, err := parseDevcontainer([]byte(`{"name": `), "app"); err == nil {
+		t.Error("truncated devcontainer.json accepted")
+	}
+}
+
+func TestParseDevcontainerMount(t *testing.T) {
+	for _, tc := range []struct {
+		raw     string
+		want    dockerMount
+		wantErr bool
+	}{
+		{raw: `"type=volume,source=cache,target=/cache"`, want: dockerMount{Type: "volume", Source: "cache", Target: "/cache"}},
+		{raw: `"src=cache, dst=/cache, readonly"`, want: dockerMount{Type: "volume", Source: "cache", Target: "/cache", ReadOnly: true}},
+		{raw: `"type=bind,source=/etc,destination=/host-etc,ro=false"`, want: dockerMount{Type: "bind", Source: "/etc", Target: "/host-etc"}},
+		{raw: `{"type": "volume", "source": "cache", "target": "/cache"}`, want: dockerMount{Type: "volume", Source: "cache", Target: "/cache"}},
+		{raw: `{"source": "cache", "target": "/home/developer/"}`, want: dockerMount{Type: "volume", Source: "cache", Target: "/home/developer/"}},
+		{raw: `"source=cache,target=relative"`, wantErr: true},
+		{raw: `"source=cache"`, wantErr: true},
+		{raw: `42`, wantErr: true},
+	} {
+		t.Run(tc.raw, func(t *testing.T) {
+			got, err := parseDevcontainerMount(json.RawMessage(tc.raw))
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("accepted as %+v", got)
+				}
+				return
+			}
+			if err != nil || got != tc.want {
+				t.Errorf("got %+v, %v; want %+v", got, err, tc.want)
+			}
+		})
+	}
+}
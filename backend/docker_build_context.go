@@ -0,0 +1,152 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/moby/patternmatcher"
+	"github.com/moby/patternmatcher/ignorefile"
+)
+
+// tarBuildContext streams dir as a tar archive suitable for POST /build,
+// filtered by a .dockerignore at its root (see dockerignore).
+func tarBuildContext(dir, dockerfile string) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeBuildContext(pw, dir, dockerfile))
+	}()
+	return pr
+}
+
+func writeBuildContext(w io.Writer, dir, dockerfile string) error {
+	ignore, err := readDockerignore(filepath.Join(dir, ".dockerignore"), dockerfile)
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	walkErr := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if ignore.excludes(rel) {
+			if d.IsDir() && ignore.canSkip(rel) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = rel
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if walkErr != nil {
+		return walkErr
+	}
+	return tw.Close()
+}
+
+// dockerignore filters a build context with the docker CLI's own matcher:
+// "**" matches any number of directories, a leading "!" re-includes and the
+// last matching pattern wins. The Dockerfile is always sent.
+type dockerignore struct {
+	pm *patternmatcher.PatternMatcher
+}
+
+func readDockerignore(file, dockerfile string) (*dockerignore, error) {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return parseDockerignore(nil, dockerfile)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseDockerignore(f, dockerfile)
+}
+
+// parseDockerignore reads .dockerignore patterns from r, which may be nil.
+func parseDockerignore(r io.Reader, dockerfile string) (*dockerignore, error) {
+	var patterns []string
+	if r != nil {
+		var err error
+		if patterns, err = ignorefile.ReadAll(r); err != nil {
+			return nil, fmt.Errorf("reading .dockerignore: %w", err)
+		}
+	}
+	patterns = append(patterns, "!"+path.Clean(filepath.ToSlash(dockerfile)))
+	pm, err := patternmatcher.New(patterns)
+	if err != nil {
+		return nil, fmt.Errorf("parsing .dockerignore: %w", err)
+	}
+	return &dockerignore{pm: pm}, nil
+}
+
+// excludes reports whether rel, a slash-separated path in the context, is
+// left out, either itself or through one of its parent directories.
+func (d *dockerignore) excludes(rel string) bool {
+	excluded, _, err := d.pm.MatchesUsingParentResults(rel, patternmatcher.MatchInfo{})
+	return err == nil && excluded
+}
+
+// canSkip reports whether no "!" pattern could re-include anything below the
+// excluded directory rel, so it needn't be walked at all. Patterns with
+// wildcards are compared up to the first one, erring on walking too much.
+func (d *dockerignore) canSkip(rel string) bool {
+	if !d.pm.Exclusions() {
+		return true
+	}
+	dir := rel + "/"
+	for _, p := range d.pm.Patterns() {
+		if !p.Exclusion() {
+			continue
+		}
+		prefix := filepath.ToSlash(p.String()) + "/"
+		if i := strings.IndexAny(prefix, `*?[\`); i >= 0 {
+			prefix = prefix[:i]
+			if strings.HasPrefix(dir, prefix) {
+				return false
+			}
+		}
+		if strings.HasPrefix(prefix, dir) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// buildContextFiles writes files under a fresh directory, builds its context
+// and returns the names of the regular files sent.
+func buildContextFiles(t *testing.T, dockerfile string, files ...string) []string {
+	t.Helper()
+	dir := t.TempDir()
+	for _, f := range files {
+		name, content, _ := strings.Cut(f, "=")
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	if err := writeBuildContext(&buf, dir, dockerfile); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			names = append(names, hdr.Name)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+func TestBuildContextDockerignore(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		ignore     string
+		dockerfile string
+		want       []string
+	}{
+		{
+			name:   "double star",
+			ignore: "**/*.log\n",
+			want: []string{".dockerignore", "Dockerfile", "main.go", "node_modules/drop/index.js", "node_modules/keep/index.js",
+				"src/app/main.go", "src/app/node_modules/left-pad/index.js"},
+		},
+		{
+			name:   "double star directory",
+			ignore: "**/node_modules\n",
+			want:   []string{".dockerignore", "Dockerfile", "build.log", "main.go", "src/app/debug.log", "src/app/main.go"},
+		},
+		{
+			name:   "re-include under an excluded directory",
+			ignore: "node_modules\n!node_modules/keep\n",
+			want: []string{".dockerignore", "Dockerfile", "build.log", "main.go", "node_modules/keep/index.js",
+				"src/app/debug.log", "src/app/main.go", "src/app/node_modules/left-pad/index.js"},
+		},
+		{
+			name:   "re-include with a wildcard",
+			ignore: "src\n!**/main.go\n",
+			want:   []string{".dockerignore", "Dockerfile", "build.log", "main.go", "node_modules/drop/index.js", "node_modules/keep/index.js", "src/app/main.go"},
+		},
+		{
+			name:   "comments and leading slashes",
+			ignore: "# build output\n/node_modules\n/src/**/node_modules\n*.log\n",
+			want:   []string{".dockerignore", "Dockerfile", "main.go", "src/app/debug.log", "src/app/main.go"},
+		},
+		{
+			name:       "ignored Dockerfile is still sent",
+			ignore:     "*\n",
+			dockerfile: "src/app/Dockerfile",
+			want:       []string{"src/app/Dockerfile"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dockerfile := firstNonEmpty(tc.dockerfile, "Dockerfile")
+			got := buildContextFiles(t, dockerfile,
+				".dockerignore="+tc.ignore,
+				dockerfile+"=FROM scratch",
+				"main.go",
+				"build.log",
+				"node_modules/keep/index.js",
+				"node_modules/drop/index.js",
+				"src/app/main.go",
+				"src/app/debug.log",
+				"src/app/node_modules/left-pad/index.js",
+			)
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("sent %q\nwant %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDockerignoreCanSkip(t *testing.T) {
+	ignore, err := parseDockerignore(strings.NewReader("node_modules\nvendor\ncache\n!node_modules/keep\n!cache/**/*.json\n"), "Dockerfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for dir, want := range map[string]bool{
+		"vendor":                 true,
+		"node_modules":           false,
+		"node_modules/keep":      false,
+		"node_modules/drop":      true,
+		"cache":                  false,
+		"cache/deep/down":        false,
+		"node_modules_old/other": true,
+	} {
+		if got := ignore.canSkip(dir); got != want {
+			t.Errorf("canSkip(%q) = %v, want %v", dir, got, want)
+		}
+	}
+}
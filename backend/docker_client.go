@@ -0,0 +1,563 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultDockerHost       = "unix:///var/run/docker.sock"
+	dockerAPIVersion        = "v1.41"
+	dockerStopTimeoutSecond = 10
+)
+
+// DockerAPIError is returned for any non-2xx response from the Engine API.
+// Message is the daemon's own error text, not scraped CLI output.
+type DockerAPIError struct {
+	Op         string
+	StatusCode int
+	Message    string
+}
+
+func (e *DockerAPIError) Error() string {
+	return fmt.Sprintf("docker %s: %s (status %d)", e.Op, e.Message, e.StatusCode)
+}
+
+func isDockerNotFound(err error) bool {
+	var apiErr *DockerAPIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+func isDockerConflict(err error) bool {
+	var apiErr *DockerAPIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusConflict
+}
+
+// dockerBuildError reports a failure emitted inside a build or pull stream;
+// the HTTP request itself succeeded.
+type dockerBuildError struct {
+	Message string
+}
+
+func (e *dockerBuildError) Error() string {
+	return "docker build failed: " + e.Message
+}
+
+// dockerClient is a minimal Docker Engine API client speaking HTTP over the
+// daemon socket (unix:// or tcp://, following DOCKER_HOST).
+type dockerClient struct {
+	dial       func(ctx context.Context) (net.Conn, error)
+	httpClient *http.Client
+	baseURL    string
+}
+
+func newDockerClient(host string) (*dockerClient, error) {
+	if host == "" {
+		host = defaultDockerHost
+	}
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DOCKER_HOST %q: %w", host, err)
+	}
+
+	var network, address string
+	switch u.Scheme {
+	case "unix":
+		network, address = "unix", u.Path
+	case "tcp":
+		network, address = "tcp", u.Host
+	default:
+		return nil, fmt.Errorf("unsupported DOCKER_HOST scheme %q", u.Scheme)
+	}
+
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	dial := func(ctx context.Context) (net.Conn, error) {
+		return dialer.DialContext(ctx, network, address)
+	}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dial(ctx)
+		},
+		MaxIdleConns:    10,
+		IdleConnTimeout: 90 * time.Second,
+	}
+
+	return &dockerClient{
+		dial:       dial,
+		httpClient: &http.Client{Transport: transport},
+		// The host part is ignored by the dialer; it only has to be valid.
+		baseURL: "http://docker/" + dockerAPIVersion,
+	}, nil
+}
+
+// dockerContainerSummary is an entry of GET /containers/json.
+type dockerContainerSummary struct {
+	Id      string
+	Names   []string
+	Image   string
+	State   string
+	Status  string
+	Created int64
+	Labels  map[string]string
+}
+
+// dockerContainerInfo is the subset of GET /containers/{id}/json we use.
+type dockerContainerInfo struct {
+	Id      string
+	Name    string
+	Created string
+	State   struct {
+		Status     string
+		Running    bool
+		ExitCode   int
+		Error      string
+		StartedAt  time.Time
+		FinishedAt time.Time
+	}
+	Config struct {
+		Image  string
+		Labels map[string]string
+	}
+	NetworkSettings struct {
+		IPAddress string
+		Networks  map[string]struct {
+			IPAddress string
+		}
+	}
+}
+
+type dockerContainerConfig struct {
+	Image      string
+	Cmd        []string          `json:",omitempty"`
+	Env        []string          `json:",omitempty"`
+	Labels     map[string]string `json:",omitempty"`
+	User       string            `json:",omitempty"`
+	WorkingDir string            `json:",omitempty"`
+	Tty        bool              `json:",omitempty"`
+	HostConfig dockerHostConfig
+}
+
+type dockerHostConfig struct {
+	NanoCpus      int64             `json:",omitempty"`
+	Memory        int64             `json:",omitempty"`
+	MemorySwap    int64             `json:",omitempty"`
+	PidsLimit     *int64            `json:",omitempty"`
+	StorageOpt    map[string]string `json:",omitempty"`
+	Mounts        []dockerMount     `json:",omitempty"`
+	RestartPolicy struct {
+		Name string `json:",omitempty"`
+	}
+}
+
+// dockerMount is a HostConfig.Mounts entry. A "volume" mount of an empty
+// named volume is first populated from the image's content at Target.
+type dockerMount struct {
+	Type     string
+	Source   string
+	Target   string
+	ReadOnly bool `json:",omitempty"`
+}
+
+// dockerVolume is the subset of GET /volumes/{name} we use.
+type dockerVolume struct {
+	Name       string
+	Driver     string
+	Mountpoint string
+	CreatedAt  string
+	Labels     map[string]string
+}
+
+type dockerExecConfig struct {
+	Cmd          []string
+	Env          []string `json:",omitempty"`
+	User         string   `json:",omitempty"`
+	WorkingDir   string   `json:",omitempty"`
+	AttachStdin  bool
+	AttachStdout bool
+	AttachStderr bool
+	Tty          bool
+}
+
+type dockerExecInfo struct {
+	ID       string
+	Running  bool
+	ExitCode int
+	Pid      int
+}
+
+func (c *dockerClient) containerList(ctx context.Context, all bool, filters map[string][]string) ([]dockerContainerSummary, error) {
+	q := url.Values{}
+	if all {
+		q.Set("all", "1")
+	}
+	if len(filters) > 0 {
+		raw, err := json.Marshal(filters)
+		if err != nil {
+			return nil, err
+		}
+		q.Set("filters", string(raw))
+	}
+	var out []dockerContainerSummary
+	err := c.doJSON(ctx, "container list", http.MethodGet, "/containers/json", q, nil, &out)
+	return out, err
+}
+
+func (c *dockerClient) containerInspect(ctx context.Context, id string) (*dockerContainerInfo, error) {
+	var out dockerContainerInfo
+	if err := c.doJSON(ctx, "container inspect", http.MethodGet, "/containers/"+url.PathEscape(id)+"/json", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+func (c *dockerClient) containerCreate(ctx context.Context, name string, cfg dockerContainerConfig) (string, error) {
+	q := url.Values{}
+	if name != "" {
+		q.Set("name", name)
+	}
+	var out struct{ Id string }
+	if err := c.doJSON(ctx, "container create", http.MethodPost, "/containers/create", q, cfg, &out); err != nil {
+		return "", err
+	}
+	return out.Id, nil
+}
+
+// containerStart is a no-op (304 from the daemon) when already running.
+func (c *dockerClient) containerStart(ctx context.Context, id string) error {
+	return c.doJSON(ctx, "container start", http.MethodPost, "/containers/"+url.PathEscape(id)+"/start", nil, nil, nil)
+}
+
+// containerStop is a no-op (304 from the daemon) when already stopped.
+func (c *dockerClient) containerStop(ctx context.Context, id string) error {
+	q := url.Values{"t": {strconv.Itoa(dockerStopTimeoutSecond)}}
+	return c.doJSON(ctx, "container stop", http.MethodPost, "/containers/"+url.PathEscape(id)+"/stop", q, nil, nil)
+}
+
+func (c *dockerClient) containerRemove(ctx context.Context, id string, force bool) error {
+	q := url.Values{}
+	if force {
+		q.Set("force", "1")
+	}
+	return c.doJSON(ctx, "container remove", http.MethodDelete, "/containers/"+url.PathEscape(id), q, nil, nil)
+}
+
+// volumeCreate creates a named volume; the daemon returns the existing one if
+// the name is taken.
+func (c *dockerClient) volumeCreate(ctx context.Context, name string, labels map[string]string) (*dockerVolume, error) {
+	var out dockerVolume
+	in := map[string]any{"Name": name, "Labels": labels}
+	if err := c.doJSON(ctx, "volume create", http.MethodPost, "/volumes/create", nil, in, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+func (c *dockerClient) volumeInspect(ctx context.Context, name string) (*dockerVolume, error) {
+	var out dockerVolume
+	if err := c.doJSON(ctx, "volume inspect", http.MethodGet, "/volumes/"+url.PathEscape(name), nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+func (c *dockerClient) volumeList(ctx context.Context, filters map[string][]string) ([]dockerVolume, error) {
+	q := url.Values{}
+	if len(filters) > 0 {
+		raw, err := json.Marshal(filters)
+		if err != nil {
+			return nil, err
+		}
+		q.Set("filters", string(raw))
+	}
+	var out struct{ Volumes []dockerVolume }
+	err := c.doJSON(ctx, "volume list", http.MethodGet, "/volumes", q, nil, &out)
+	return out.Volumes, err
+}
+
+// volumeRemove fails with a conflict while any container (even a stopped
+// one) still references the volume.
+func (c *dockerClient) volumeRemove(ctx context.Context, name string) error {
+	return c.doJSON(ctx, "volume remove", http.MethodDelete, "/volumes/"+url.PathEscape(name), nil, nil, nil)
+}
+
+// containerArchive returns a tar archive of path in the container (running
+// or not). Entries are rooted at path's base name.
+func (c *dockerClient) containerArchive(ctx context.Context, id, path string) (io.ReadCloser, error) {
+	q := url.Values{"path": {path}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/containers/"+url.PathEscape(id)+"/archive?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("docker container archive: %w", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		return nil, readDockerError("container archive", resp)
+	}
+	return resp.Body, nil
+}
+
+func (c *dockerClient) execCreate(ctx context.Context, containerID string, cfg dockerExecConfig) (string, error) {
+	var out struct{ Id string }
+	if err := c.doJSON(ctx, "exec create", http.MethodPost, "/containers/"+url.PathEscape(containerID)+"/exec", nil, cfg, &out); err != nil {
+		return "", err
+	}
+	return out.Id, nil
+}
+
+func (c *dockerClient) execInspect(ctx context.Context, execID string) (*dockerExecInfo, error) {
+	var out dockerExecInfo
+	if err := c.doJSON(ctx, "exec inspect", http.MethodGet, "/exec/"+url.PathEscape(execID)+"/json", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// execStartDetached starts an exec without attaching to its streams.
+func (c *dockerClient) execStartDetached(ctx context.Context, execID string) error {
+	return c.doJSON(ctx, "exec start", http.MethodPost, "/exec/"+url.PathEscape(execID)+"/start", nil, map[string]bool{"Detach": true}, nil)
+}
+
+// execResize resizes the exec's TTY inside the container.
+func (c *dockerClient) execResize(ctx context.Context, execID string, rows, cols int) error {
+	q := url.Values{"h": {strconv.Itoa(rows)}, "w": {strconv.Itoa(cols)}}
+	return c.doJSON(ctx, "exec resize", http.MethodPost, "/exec/"+url.PathEscape(execID)+"/resize", q, nil, nil)
+}
+
+// dockerHijackedConn is the raw bidirectional stream of an attached exec.
+// With a TTY it carries raw bytes; without one, output is multiplexed.
+type dockerHijackedConn struct {
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+func (h *dockerHijackedConn) Read(p []byte) (int, error)  { return h.br.Read(p) }
+func (h *dockerHijackedConn) Write(p []byte) (int, error) { return h.conn.Write(p) }
+func (h *dockerHijackedConn) Close() error                { return h.conn.Close() }
+
+// CloseWrite signals EOF on stdin while keeping output readable.
+func (h *dockerHijackedConn) CloseWrite() error {
+	if cw, ok := h.conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// execStart starts an exec and hijacks the connection for stdin/stdout.
+// The returned stream outlives ctx, which only bounds the handshake.
+func (c *dockerClient) execStart(ctx context.Context, execID string, tty bool) (*dockerHijackedConn, error) {
+	body, err := json.Marshal(map[string]bool{"Detach": false, "Tty": tty})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/exec/"+url.PathEscape(execID)+"/start", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "tcp")
+
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("docker exec start: %w", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if err := req.Write(conn); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("docker exec start: %w", err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("docker exec start: %w", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols && resp.StatusCode != http.StatusOK {
+		defer conn.Close()
+		return nil, readDockerError("exec start", resp)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return &dockerHijackedConn{conn: conn, br: br}, nil
+}
+
+// dockerBuildOptions are the POST /build parameters we use.
+type dockerBuildOptions struct {
+	Dockerfile string // path inside the build context
+	Tag        string
+	BuildArgs  map[string]string
+	Target     string
+}
+
+// imageBuild streams buildContext (a tar archive) to the daemon and writes the
+// build's text output to logOut as it arrives.
+func (c *dockerClient) imageBuild(ctx context.Context, buildContext io.Reader, opts dockerBuildOptions, logOut io.Writer) error {
+	q := url.Values{"t": {opts.Tag}, "dockerfile": {opts.Dockerfile}, "rm": {"1"}}
+	if len(opts.BuildArgs) > 0 {
+		raw, err := json.Marshal(opts.BuildArgs)
+		if err != nil {
+			return err
+		}
+		q.Set("buildargs", string(raw))
+	}
+	if opts.Target != "" {
+		q.Set("target", opts.Target)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/build?"+q.Encode(), buildContext)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-tar")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("docker image build: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return readDockerError("image build", resp)
+	}
+
+	return readProgressStream("image build", resp.Body, logOut)
+}
+
+// imagePull pulls ref (e.g. "golang:1.22"), writing progress to logOut.
+func (c *dockerClient) imagePull(ctx context.Context, ref string, logOut io.Writer) error {
+	q := url.Values{"fromImage": {ref}}
+	if !strings.Contains(ref, "@") && !strings.Contains(ref[strings.LastIndex(ref, "/")+1:], ":") {
+		q.Set("tag", "latest")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/images/create?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("docker image pull: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return readDockerError("image pull", resp)
+	}
+	return readProgressStream("image pull", resp.Body, logOut)
+}
+
+// imageExists reports whether ref is present locally.
+func (c *dockerClient) imageExists(ctx context.Context, ref string) (bool, error) {
+	err := c.doJSON(ctx, "image inspect", http.MethodGet, "/images/"+ref+"/json", nil, nil, nil)
+	if isDockerNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// readProgressStream consumes the JSON message stream of a build or pull,
+// copying output lines to logOut (if set) and returning the first error
+// message the daemon reports. Per-layer progress bars are skipped.
+func readProgressStream(op string, body io.Reader, logOut io.Writer) error {
+	dec := json.NewDecoder(body)
+	for {
+		var msg struct {
+			Stream      string `json:"stream"`
+			Status      string `json:"status"`
+			Progress    string `json:"progress"`
+			ID          string `json:"id"`
+			Error       string `json:"error"`
+			ErrorDetail struct {
+				Message string `json:"message"`
+			} `json:"errorDetail"`
+		}
+		if err := dec.Decode(&msg); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("docker %s: reading output: %w", op, err)
+		}
+		if msg.Error != "" || msg.ErrorDetail.Message != "" {
+			return &dockerBuildError{Message: firstNonEmpty(msg.ErrorDetail.Message, msg.Error)}
+		}
+		if logOut == nil || msg.Progress != "" {
+			continue
+		}
+		if msg.Stream != "" {
+			_, _ = io.WriteString(logOut, msg.Stream)
+		} else if msg.Status != "" && msg.ID != "" {
+			_, _ = io.WriteString(logOut, msg.ID+": "+msg.Status+"\n")
+		} else if msg.Status != "" {
+			_, _ = io.WriteString(logOut, msg.Status+"\n")
+		}
+	}
+}
+
+func (c *dockerClient) doJSON(ctx context.Context, op, method, path string, query url.Values, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		raw, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(raw)
+	}
+	target := c.baseURL + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("docker %s: %w", op, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return readDockerError(op, resp)
+	}
+	if out == nil {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("docker %s: decoding response: %w", op, err)
+	}
+	return nil
+}
+
+func readDockerError(op string, resp *http.Response) error {
+	raw, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	var payload struct {
+		Message string `json:"message"`
+	}
+	message := strings.TrimSpace(string(raw))
+	if json.Unmarshal(raw, &payload) == nil && payload.Message != "" {
+		message = payload.Message
+	}
+	if message == "" {
+		message = http.StatusText(resp.StatusCode)
+	}
+	return &DockerAPIError{Op: op, StatusCode: resp.StatusCode, Message: message}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Stream ids in the multiplexed output of a non-TTY exec or attach.
+const (
+	dockerStreamStdin  = 0
+	dockerStreamStdout = 1
+	dockerStreamStderr = 2
+)
+
+// demuxDockerStream splits a non-TTY exec stream into stdout and stderr. Each
+// frame is an 8-byte header (stream id, three zero bytes, big-endian uint32
+// length) followed by the payload.
+func demuxDockerStream(r io.Reader, stdout, stderr io.Writer) error {
+	var header [8]byte
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		size := int64(binary.BigEndian.Uint32(header[4:]))
+		var dst io.Writer
+		switch header[0] {
+		case dockerStreamStdin, dockerStreamStdout:
+			dst = stdout
+		case dockerStreamStderr:
+			dst = stderr
+		default:
+			return fmt.Errorf("docker stream: unknown stream id %d", header[0])
+		}
+		if dst == nil {
+			dst = io.Discard
+		}
+		if _, err := io.CopyN(dst, r, size); err != nil {
+			return err
+		}
+	}
+}
+
+// execRun runs cfg.Cmd in the container without a TTY, feeding it stdin (if
+// not nil) and copying its output to stdout and stderr, and returns the exit
+// code. Cancelling ctx hangs up the stream; the process itself may keep
+// running.
+func (c *dockerClient) execRun(ctx context.Context, containerID string, cfg dockerExecConfig, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	cfg.AttachStdin = stdin != nil
+	cfg.AttachStdout = true
+	cfg.AttachStderr = true
+	cfg.Tty = false
+	execID, err := c.execCreate(ctx, containerID, cfg)
+	if err != nil {
+		return 0, err
+	}
+	stream, err := c.execStart(ctx, execID, false)
+	if err != nil {
+		return 0, err
+	}
+	defer stream.Close()
+	stop := context.AfterFunc(ctx, func() { _ = stream.Close() })
+	defer stop()
+
+	stdinErr := make(chan error, 1)
+	if stdin != nil {
+		go func() {
+			_, err := io.Copy(stream, stdin)
+			stdinErr <- err
+			if err != nil {
+				_ = stream.Close()
+				return
+			}
+			_ = stream.CloseWrite()
+		}()
+	}
+
+	demuxErr := demuxDockerStream(stream, stdout, stderr)
+	// A failed stdin (e.g. an upload over its size limit) is the real cause
+	// of whatever the output stream reports.
+	select {
+	case err := <-stdinErr:
+		if err != nil && ctx.Err() == nil {
+			return 0, err
+		}
+	default:
+	}
+	if demuxErr != nil {
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		return 0, demuxErr
+	}
+	info, err := c.execWait(ctx, execID)
+	if err != nil {
+		return 0, err
+	}
+	return info.ExitCode, nil
+}
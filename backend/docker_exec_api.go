@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultExecTimeout = 60 * time.Second
+	maxExecTimeout     = time.Hour
+	maxExecOutputBytes = 4 << 20
+	maxExecStdinBytes  = 16 << 20
+)
+
+// execRequest is the body of POST /docker/exec and /docker/exec/stream.
+type execRequest struct {
+	Argv []string          `json:"argv"`
+	Env  map[string]string `json:"env"`
+	// Workdir defaults to the container's working directory; relative paths
+	// resolve against /home/developer.
+	Workdir        string `json:"workdir"`
+	Stdin          string `json:"stdin"`
+	TimeoutSeconds int    `json:"timeoutSeconds"`
+}
+
+// execResult reports how a command ended. ExitCode is null if it was killed
+// for running too long or the client went away.
+type execResult struct {
+	ExitCode        *int   `json:"exitCode"`
+	Stdout          string `json:"stdout,omitempty"`
+	Stderr          string `json:"stderr,omitempty"`
+	StdoutTruncated bool   `json:"stdoutTruncated,omitempty"`
+	StderrTruncated bool   `json:"stderrTruncated,omitempty"`
+	TimedOut        bool   `json:"timedOut,omitempty"`
+	DurationMs      int64  `json:"durationMs"`
+	Error           string `json:"error,omitempty"`
+}
+
+// readExecRequest decodes and validates an exec request.
+func readExecRequest(w http.ResponseWriter, r *http.Request) (execRequest, error) {
+	var req execRequest
+	body := http.MaxBytesReader(w, r.Body, maxExecStdinBytes+64*1024)
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		return req, errors.New("invalid json body")
+	}
+	return req, req.validate()
+}
+
+// validate checks req and resolves its working directory in place.
+func (req *execRequest) validate() error {
+	if len(req.Argv) == 0 || req.Argv[0] == "" {
+		return errors.New("argv must name a command")
+	}
+	for k := range req.Env {
+		if k == "" || strings.ContainsAny(k, "=\x00") {
+			return fmt.Errorf("invalid env name %q", k)
+		}
+	}
+	if req.TimeoutSeconds < 0 {
+		return errors.New("timeoutSeconds must not be negative")
+	}
+	if req.Workdir != "" {
+		wd, err := resolveFilePath(req.Workdir)
+		if err != nil {
+			return err
+		}
+		req.Workdir = wd
+	}
+	return nil
+}
+
+func (req execRequest) timeout() time.Duration {
+	if req.TimeoutSeconds == 0 {
+		return defaultExecTimeout
+	}
+	return min(time.Duration(req.TimeoutSeconds)*time.Second, maxExecTimeout)
+}
+
+// execConfig builds the exec for req, tagged with marker so it can be
+// killed.
+func (req execRequest) execConfig(container dockerStatusResponse, marker string) dockerExecConfig {
+	env := make([]string, 0, len(req.Env)+1)
+	for k, v := range req.Env {
+		env = append(env, k+"="+v)
+	}
+	sort.Strings(env)
+	return dockerExecConfig{
+		Cmd:        req.Argv,
+		Env:        append(env, marker),
+		User:       container.RemoteUser,
+		WorkingDir: req.Workdir,
+	}
+}
+
+// runExec runs req in the owner's container, writing its output to stdout
+// and stderr. Commands that time out, or whose caller goes away, are killed.
+// The container isn't idle while the command runs.
+func (m *DockerManager) runExec(ctx context.Context, owner string, container dockerStatusResponse, req execRequest, stdout, stderr io.Writer) execResult {
+	defer m.activity.begin(owner)()
+	marker := execMarkerEnv + "=exec-" + newShellSessionID()
+	ctx, cancel := context.WithTimeout(ctx, req.timeout())
+	defer cancel()
+
+	var stdin io.Reader
+	if req.Stdin != "" {
+		stdin = strings.NewReader(req.Stdin)
+	}
+	started := time.Now()
+	code, err := m.docker.execRun(ctx, container.ContainerId, req.execConfig(container, marker), stdin, stdout, stderr)
+	result := execResult{DurationMs: time.Since(started).Milliseconds()}
+	switch {
+	case err == nil:
+		result.ExitCode = &code
+	case ctx.Err() != nil:
+		result.TimedOut = errors.Is(ctx.Err(), context.DeadlineExceeded)
+		result.Error = "command killed: " + ctx.Err().Error()
+		killCtx, cancelKill := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancelKill()
+		if err := m.docker.killMarked(killCtx, container.ContainerId, marker); err != nil {
+			log.Printf("[exec] killing %s: %v", marker, err)
+		}
+	default:
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// POST /docker/exec
+// {"argv":["make","test"],"env":{"CI":"1"},"workdir":"proj","stdin":"","timeoutSeconds":60}
+//
+// Runs a command without a terminal and returns its exit code and output
+// (each stream capped at 4 MiB). A non-zero exit is still a 200.
+func (m *DockerManager) handleExec(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJson(w, http.StatusMethodNotAllowed, dockerActionResponse{Ok: false, Message: "method not allowed"})
+		return
+	}
+	req, err := readExecRequest(w, r)
+	if err != nil {
+		writeJson(w, http.StatusBadRequest, dockerActionResponse{Ok: false, Message: err.Error()})
+		return
+	}
+	container, ok := m.activeContainer(w, r)
+	if !ok {
+		return
+	}
+
+	stdout := &limitedBuffer{max: maxExecOutputBytes}
+	stderr := &limitedBuffer{max: maxExecOutputBytes}
+	result := m.runExec(r.Context(), currentUser(r).Subject, container, req, stdout, stderr)
+	result.Stdout, result.StdoutTruncated = stdout.String(), stdout.truncated
+	result.Stderr, result.StderrTruncated = stderr.String(), stderr.truncated
+	status := http.StatusOK
+	if result.ExitCode == nil && !result.TimedOut {
+		status = http.StatusInternalServerError
+	}
+	writeJson(w, status, result)
+}
+
+// POST /docker/exec/stream (same body as /docker/exec)
+//
+// Streams the command's output as Server-Sent Events: `stdout` and `stderr`
+// events carrying {"data": "..."} as output arrives, then one `exit` event
+// with the result (without the output).
+func (m *DockerManager) handleExecStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJson(w, http.StatusMethodNotAllowed, dockerActionResponse{Ok: false, Message: "method not allowed"})
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJson(w, http.StatusInternalServerError, dockerActionResponse{Ok: false, Message: "streaming unsupported"})
+		return
+	}
+	req, err := readExecRequest(w, r)
+	if err != nil {
+		writeJson(w, http.StatusBadRequest, dockerActionResponse{Ok: false, Message: err.Error()})
+		return
+	}
+	container, ok := m.activeContainer(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	events := &execEventWriter{w: w, flusher: flusher}
+	stopHeartbeat, heartbeatDone := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(heartbeatDone)
+		heartbeat := time.NewTicker(sseHeartbeatInterval)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case <-heartbeat.C:
+				events.comment("keep-alive")
+			case <-stopHeartbeat:
+				return
+			}
+		}
+	}()
+	result := m.runExec(r.Context(), currentUser(r).Subject, container, req, events.stream("stdout"), events.stream("stderr"))
+	close(stopHeartbeat)
+	// The ResponseWriter must not be touched once we return.
+	<-heartbeatDone
+	events.send("exit", result)
+}
+
+// execEventWriter serializes SSE events from the output streams and the
+// heartbeat.
+type execEventWriter struct {
+	mu      sync.Mutex
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+func (e *execEventWriter) send(event string, payload any) {
+	raw, _ := json.Marshal(payload)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	fmt.Fprintf(e.w, "event: %s\ndata: %s\n\n", event, raw)
+	e.flusher.Flush()
+}
+
+func (e *execEventWriter) comment(text string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	fmt.Fprintf(e.w, ": %s\n\n", text)
+	e.flusher.Flush()
+}
+
+// stream returns a writer that emits each chunk as an event named name.
+func (e *execEventWriter) stream(name string) io.Writer {
+	return writerFunc(func(p []byte) (int, error) {
+		e.send(name, map[string]string{"data": string(p)})
+		return len(p), nil
+	})
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
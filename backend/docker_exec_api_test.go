@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestExecStreamEndsWithExit(t *testing.T) {
+	cfg := testConfig()
+	auth := newTestAuth(t, cfg)
+	m, docker := newTestManager(t, cfg, auth)
+	owner := "alice@example.com"
+	docker.add(managedContainer(owner, "127.0.0.1"))
+	docker.exec = func(cfg dockerExecConfig, stdin io.Reader, stdout, stderr io.Writer) int {
+		fmt.Fprint(stdout, "out")
+		fmt.Fprint(stderr, "err")
+		return 3
+	}
+	srv := httptest.NewServer(auth.require(m.handleExecStream))
+	defer srv.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, srv.URL, strings.NewReader(`{"argv": ["make"]}`))
+	req.Header.Set("Authorization", "Bearer "+loginToken(t, auth, owner))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("got %d %s", resp.StatusCode, body)
+	}
+
+	var events []string
+	for _, ev := range strings.Split(strings.TrimSpace(string(body)), "\n\n") {
+		if !strings.HasPrefix(ev, ":") {
+			events = append(events, ev)
+		}
+	}
+	if len(events) != 3 || events[0] != "event: stdout\ndata: {\"data\":\"out\"}" || events[1] != "event: stderr\ndata: {\"data\":\"err\"}" {
+		t.Fatalf("events:\n%s", body)
+	}
+	if exit := events[2]; !strings.HasPrefix(exit, "event: exit\ndata: {\"exitCode\":3,") {
+		t.Errorf("last event %q, want the exit", exit)
+	}
+}
@@ -0,0 +1,531 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// File browser: every operation runs as an exec of a standard tool (stat,
+// find, cat, mv, rm, tar) inside the owner's container, as its remote user,
+// so it sees exactly what a shell would and obeys the same permissions.
+// Relative paths are resolved against /home/developer.
+const (
+	// fileStatFormat is for GNU stat --printf: raw mode (hex), size, mtime,
+	// owner, name. Records end in NUL, the one byte names can't contain.
+	fileStatFormat = "%f\t%s\t%Y\t%U\t%n\\0"
+
+	maxFileWriteBytes  = 64 << 20
+	maxFileUploadBytes = 1 << 30
+	maxFileStderrBytes = 16 * 1024
+)
+
+type fileEntry struct {
+	Name    string    `json:"name"`
+	Path    string    `json:"path"`
+	Type    string    `json:"type"` // file, dir, symlink or other
+	Size    int64     `json:"size"`
+	Mode    string    `json:"mode"` // permission bits, e.g. "0644"
+	ModTime time.Time `json:"modTime"`
+	Owner   string    `json:"owner"`
+}
+
+type fileListResponse struct {
+	Path    string      `json:"path"`
+	Entries []fileEntry `json:"entries"`
+}
+
+type fileRenameRequest struct {
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Overwrite bool   `json:"overwrite"`
+}
+
+// fileError is a failed file operation with the HTTP status it maps to.
+type fileError struct {
+	Status  int
+	Message string
+}
+
+func (e *fileError) Error() string { return e.Message }
+
+// fileErrorFromStderr classifies a failed command by its error message.
+func fileErrorFromStderr(stderr string, code int) *fileError {
+	msg := strings.TrimSpace(stderr)
+	if i := strings.IndexByte(msg, '\n'); i >= 0 {
+		msg = msg[:i]
+	}
+	if msg == "" {
+		msg = fmt.Sprintf("command exited with code %d", code)
+	}
+	status := http.StatusBadRequest
+	switch lower := strings.ToLower(msg); {
+	case strings.Contains(lower, "no such file"):
+		status = http.StatusNotFound
+	case strings.Contains(lower, "permission denied"), strings.Contains(lower, "operation not permitted"):
+		status = http.StatusForbidden
+	case strings.Contains(lower, "file exists"), strings.Contains(lower, "not empty"):
+		status = http.StatusConflict
+	}
+	return &fileError{Status: status, Message: msg}
+}
+
+// resolveFilePath makes p absolute (relative to the home directory) and clean.
+func resolveFilePath(p string) (string, error) {
+	if strings.ContainsRune(p, 0) {
+		return "", &fileError{Status: http.StatusBadRequest, Message: "invalid path"}
+	}
+	if p == "" {
+		return homeDir, nil
+	}
+	if !path.IsAbs(p) {
+		p = path.Join(homeDir, p)
+	}
+	return path.Clean(p), nil
+}
+
+// parseStatRecord parses one record of fileStatFormat output, without its
+// terminating NUL.
+func parseStatRecord(record string) (fileEntry, bool) {
+	fields := strings.SplitN(record, "\t", 5)
+	if len(fields) != 5 {
+		return fileEntry{}, false
+	}
+	mode, err := strconv.ParseUint(fields[0], 16, 32)
+	if err != nil {
+		return fileEntry{}, false
+	}
+	size, _ := strconv.ParseInt(fields[1], 10, 64)
+	mtime, _ := strconv.ParseInt(fields[2], 10, 64)
+	entry := fileEntry{
+		Name:    path.Base(fields[4]),
+		Path:    fields[4],
+		Size:    size,
+		Mode:    fmt.Sprintf("%04o", mode&0o7777),
+		ModTime: time.Unix(mtime, 0).UTC(),
+		Owner:   fields[3],
+	}
+	switch mode & 0o170000 {
+	case 0o040000:
+		entry.Type = "dir"
+	case 0o100000:
+		entry.Type = "file"
+	case 0o120000:
+		entry.Type = "symlink"
+	default:
+		entry.Type = "other"
+	}
+	return entry, true
+}
+
+// activeContainer resolves the caller's running container, starting it if
+// needed, and counts the request as activity. On failure it writes the error
+// and returns false.
+func (m *DockerManager) activeContainer(w http.ResponseWriter, r *http.Request) (dockerStatusResponse, bool) {
+	owner, ok := m.requireOwner(w, r)
+	if !ok {
+		return dockerStatusResponse{}, false
+	}
+	status, err := m.activeContainerFor(r.Context(), owner)
+	if err != nil {
+		writeJson(w, dockerErrorStatus(err), dockerActionResponse{Ok: false, Message: err.Error()})
+		return status, false
+	}
+	return status, true
+}
+
+// activeContainerFor is activeContainer for callers outside an HTTP handler.
+func (m *DockerManager) activeContainerFor(ctx context.Context, owner string) (dockerStatusResponse, error) {
+	status, err := m.runningContainerFor(ctx, owner)
+	if err != nil {
+		return status, err
+	}
+	m.activity.touch(owner)
+	return status, nil
+}
+
+// fileExec runs argv as the container's remote user. A non-zero exit becomes
+// a *fileError built from stderr.
+func (m *DockerManager) fileExec(ctx context.Context, container dockerStatusResponse, argv []string, stdin io.Reader, stdout io.Writer) error {
+	stderr := &limitedBuffer{max: maxFileStderrBytes}
+	code, err := m.docker.execRun(ctx, container.ContainerId, dockerExecConfig{
+		Cmd:        argv,
+		User:       container.RemoteUser,
+		WorkingDir: homeDir,
+	}, stdin, stdout, stderr)
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		return fileErrorFromStderr(stderr.String(), code)
+	}
+	return nil
+}
+
+// statFile stats p, following a final symlink if follow is set.
+func (m *DockerManager) statFile(ctx context.Context, container dockerStatusResponse, p string, follow bool) (fileEntry, error) {
+	argv := []string{"stat", "--printf", fileStatFormat, "--", p}
+	if follow {
+		argv = []string{"stat", "-L", "--printf", fileStatFormat, "--", p}
+	}
+	var out bytes.Buffer
+	if err := m.fileExec(ctx, container, argv, nil, &out); err != nil {
+		return fileEntry{}, err
+	}
+	entry, ok := parseStatRecord(strings.TrimSuffix(out.String(), "\x00"))
+	if !ok {
+		return fileEntry{}, fmt.Errorf("unexpected stat output for %s", p)
+	}
+	entry.Path = p
+	return entry, nil
+}
+
+// readTextFile reads up to max bytes of the regular file p (following
+// symlinks), reporting whether it was cut short and its full size.
+func (m *DockerManager) readTextFile(ctx context.Context, container dockerStatusResponse, p string, max int) (content string, truncated bool, size int64, err error) {
+	entry, err := m.statFile(ctx, container, p, true)
+	if err != nil {
+		return "", false, 0, err
+	}
+	if entry.Type != "file" {
+		return "", false, 0, &fileError{Status: http.StatusBadRequest, Message: p + " is not a regular file"}
+	}
+	out := &limitedBuffer{max: max}
+	if err := m.fileExec(ctx, container, []string{"cat", "--", p}, nil, out); err != nil {
+		return "", false, 0, err
+	}
+	return out.String(), out.truncated, entry.Size, nil
+}
+
+// writeFile replaces (or creates) p with content; the parent must exist.
+func (m *DockerManager) writeFile(ctx context.Context, container dockerStatusResponse, p string, content io.Reader) error {
+	return m.fileExec(ctx, container, []string{"sh", "-c", `cat > "$1"`, "sh", p}, content, nil)
+}
+
+// requireDir stats p and fails unless it is a directory (after symlinks).
+func (m *DockerManager) requireDir(ctx context.Context, container dockerStatusResponse, p string) error {
+	entry, err := m.statFile(ctx, container, p, true)
+	if err != nil {
+		return err
+	}
+	if entry.Type != "dir" {
+		return &fileError{Status: http.StatusBadRequest, Message: p + " is not a directory"}
+	}
+	return nil
+}
+
+func writeFileError(w http.ResponseWriter, err error) {
+	var fe *fileError
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &fe):
+		writeJson(w, fe.Status, dockerActionResponse{Ok: false, Message: fe.Message})
+	case errors.As(err, &tooLarge):
+		writeJson(w, http.StatusRequestEntityTooLarge, dockerActionResponse{Ok: false, Message: fmt.Sprintf("body exceeds %d bytes", tooLarge.Limit)})
+	default:
+		writeJson(w, http.StatusInternalServerError, dockerActionResponse{Ok: false, Message: err.Error()})
+	}
+}
+
+// GET    /docker/files?path=dir                   lists a directory.
+// DELETE /docker/files?path=p[&recursive=true]    removes a file or directory.
+func (m *DockerManager) handleFiles(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+		writeJson(w, http.StatusMethodNotAllowed, dockerActionResponse{Ok: false, Message: "method not allowed"})
+		return
+	}
+	p, err := resolveFilePath(r.URL.Query().Get("path"))
+	if err != nil {
+		writeFileError(w, err)
+		return
+	}
+	container, ok := m.activeContainer(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		if p == "/" || p == homeDir {
+			writeJson(w, http.StatusBadRequest, dockerActionResponse{Ok: false, Message: "refusing to delete " + p})
+			return
+		}
+		entry, err := m.statFile(r.Context(), container, p, false)
+		if err != nil {
+			writeFileError(w, err)
+			return
+		}
+		argv := []string{"rm", "--", p}
+		if entry.Type == "dir" {
+			argv = []string{"rmdir", "--", p}
+			if recursive, _ := strconv.ParseBool(r.URL.Query().Get("recursive")); recursive {
+				argv = []string{"rm", "-rf", "--", p}
+			}
+		}
+		if err := m.fileExec(r.Context(), container, argv, nil, nil); err != nil {
+			writeFileError(w, err)
+			return
+		}
+		writeJson(w, http.StatusOK, dockerActionResponse{Ok: true, Message: "deleted " + p})
+		return
+	}
+
+	entries, err := m.listDir(r.Context(), container, p)
+	if err != nil {
+		writeFileError(w, err)
+		return
+	}
+	writeJson(w, http.StatusOK, fileListResponse{Path: p, Entries: entries})
+}
+
+// listDir lists directory p, directories first, then by name.
+func (m *DockerManager) listDir(ctx context.Context, container dockerStatusResponse, p string) ([]fileEntry, error) {
+	if err := m.requireDir(ctx, container, p); err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	err := m.fileExec(ctx, container, []string{
+		"find", p, "-mindepth", "1", "-maxdepth", "1", "-exec", "stat", "--printf", fileStatFormat, "--", "{}", "+",
+	}, nil, &out)
+	entries := []fileEntry{}
+	for _, record := range strings.Split(out.String(), "\x00") {
+		if entry, ok := parseStatRecord(record); ok {
+			entries = append(entries, entry)
+		}
+	}
+	// find reports unreadable entries but still lists the rest.
+	if err != nil && len(entries) == 0 {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if (entries[i].Type == "dir") != (entries[j].Type == "dir") {
+			return entries[i].Type == "dir"
+		}
+		return entries[i].Name < entries[j].Name
+	})
+	return entries, nil
+}
+
+// GET /docker/files/stat?path=p
+func (m *DockerManager) handleFileStat(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJson(w, http.StatusMethodNotAllowed, dockerActionResponse{Ok: false, Message: "method not allowed"})
+		return
+	}
+	p, err := resolveFilePath(r.URL.Query().Get("path"))
+	if err != nil {
+		writeFileError(w, err)
+		return
+	}
+	container, ok := m.activeContainer(w, r)
+	if !ok {
+		return
+	}
+	entry, err := m.statFile(r.Context(), container, p, false)
+	if err != nil {
+		writeFileError(w, err)
+		return
+	}
+	writeJson(w, http.StatusOK, entry)
+}
+
+// GET /docker/files/content?path=p[&download=true]  returns the raw bytes.
+// PUT /docker/files/content?path=p                  replaces (or creates) p
+// with the request body; the parent directory must exist.
+func (m *DockerManager) handleFileContent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPut {
+		writeJson(w, http.StatusMethodNotAllowed, dockerActionResponse{Ok: false, Message: "method not allowed"})
+		return
+	}
+	p, err := resolveFilePath(r.URL.Query().Get("path"))
+	if err != nil {
+		writeFileError(w, err)
+		return
+	}
+	container, ok := m.activeContainer(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Method == http.MethodPut {
+		body := http.MaxBytesReader(w, r.Body, maxFileWriteBytes)
+		if err := m.writeFile(r.Context(), container, p, body); err != nil {
+			writeFileError(w, err)
+			return
+		}
+		entry, err := m.statFile(r.Context(), container, p, false)
+		if err != nil {
+			writeFileError(w, err)
+			return
+		}
+		writeJson(w, http.StatusOK, entry)
+		return
+	}
+
+	entry, err := m.statFile(r.Context(), container, p, true)
+	if err != nil {
+		writeFileError(w, err)
+		return
+	}
+	if entry.Type != "file" {
+		writeJson(w, http.StatusBadRequest, dockerActionResponse{Ok: false, Message: p + " is not a regular file"})
+		return
+	}
+	// Never let a browser render container files on the API's origin.
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("Last-Modified", entry.ModTime.Format(http.TimeFormat))
+	if download, _ := strconv.ParseBool(r.URL.Query().Get("download")); download {
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", entry.Name))
+	}
+	m.streamFileOutput(w, r, container, []string{"cat", "--", p})
+}
+
+// GET /docker/files/archive?path=p  downloads p (file or directory) as a tar.
+// PUT /docker/files/archive?path=dir  extracts the uploaded tar into dir;
+// send Content-Encoding: gzip for a .tar.gz.
+func (m *DockerManager) handleFileArchive(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPut {
+		writeJson(w, http.StatusMethodNotAllowed, dockerActionResponse{Ok: false, Message: "method not allowed"})
+		return
+	}
+	p, err := resolveFilePath(r.URL.Query().Get("path"))
+	if err != nil {
+		writeFileError(w, err)
+		return
+	}
+	container, ok := m.activeContainer(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Method == http.MethodPut {
+		if err := m.requireDir(r.Context(), container, p); err != nil {
+			writeFileError(w, err)
+			return
+		}
+		argv := []string{"tar", "-x", "-f", "-", "-C", p}
+		if strings.EqualFold(r.Header.Get("Content-Encoding"), "gzip") {
+			argv = []string{"tar", "-x", "-z", "-f", "-", "-C", p}
+		}
+		body := http.MaxBytesReader(w, r.Body, maxFileUploadBytes)
+		if err := m.fileExec(r.Context(), container, argv, body, nil); err != nil {
+			writeFileError(w, err)
+			return
+		}
+		writeJson(w, http.StatusOK, dockerActionResponse{Ok: true, Message: "extracted into " + p})
+		return
+	}
+
+	entry, err := m.statFile(r.Context(), container, p, false)
+	if err != nil {
+		writeFileError(w, err)
+		return
+	}
+	dir, base := path.Dir(p), path.Base(p)
+	if p == "/" {
+		base, entry.Name = ".", "root"
+	}
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", entry.Name+".tar"))
+	m.streamFileOutput(w, r, container, []string{"tar", "-c", "-f", "-", "-C", dir, "--", base})
+}
+
+// POST /docker/files/rename {"from":"a","to":"b","overwrite":false}
+func (m *DockerManager) handleFileRename(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJson(w, http.StatusMethodNotAllowed, dockerActionResponse{Ok: false, Message: "method not allowed"})
+		return
+	}
+	var req fileRenameRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.From == "" || req.To == "" {
+		writeJson(w, http.StatusBadRequest, dockerActionResponse{Ok: false, Message: `body must be {"from": "...", "to": "..."}`})
+		return
+	}
+	from, err := resolveFilePath(req.From)
+	if err != nil {
+		writeFileError(w, err)
+		return
+	}
+	to, err := resolveFilePath(req.To)
+	if err != nil {
+		writeFileError(w, err)
+		return
+	}
+	container, ok := m.activeContainer(w, r)
+	if !ok {
+		return
+	}
+	script := `if [ -e "$2" ] || [ -L "$2" ]; then echo "$2: File exists" >&2; exit 1; fi; exec mv -- "$1" "$2"`
+	if req.Overwrite {
+		script = `exec mv -f -- "$1" "$2"`
+	}
+	if err := m.fileExec(r.Context(), container, []string{"sh", "-c", script, "sh", from, to}, nil, nil); err != nil {
+		writeFileError(w, err)
+		return
+	}
+	entry, err := m.statFile(r.Context(), container, to, false)
+	if err != nil {
+		writeFileError(w, err)
+		return
+	}
+	writeJson(w, http.StatusOK, entry)
+}
+
+// streamFileOutput writes argv's stdout as the response body. Headers set by
+// the caller are only committed once output arrives, so a command that fails
+// straight away still gets a JSON error.
+func (m *DockerManager) streamFileOutput(w http.ResponseWriter, r *http.Request, container dockerStatusResponse, argv []string) {
+	out := &lazyResponseWriter{w: w}
+	err := m.fileExec(r.Context(), container, argv, nil, out)
+	switch {
+	case err != nil && !out.started:
+		for _, h := range []string{"Content-Type", "Content-Disposition", "Content-Security-Policy", "Last-Modified"} {
+			w.Header().Del(h)
+		}
+		writeFileError(w, err)
+	case err != nil:
+		log.Printf("[files] %s: %v", strings.Join(argv, " "), err)
+	case !out.started:
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// lazyResponseWriter sends the response status on the first write.
+type lazyResponseWriter struct {
+	w       http.ResponseWriter
+	started bool
+}
+
+func (l *lazyResponseWriter) Write(p []byte) (int, error) {
+	l.started = true
+	return l.w.Write(p)
+}
+
+// limitedBuffer keeps the first max bytes written to it and drops the rest.
+type limitedBuffer struct {
+	bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	room := b.max - b.Len()
+	if len(p) > room {
+		b.truncated = true
+	}
+	if room > 0 {
+		b.Buffer.Write(p[:min(len(p), room)])
+	}
+	return len(p), nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"testing"
+)
+
+// TestListDirOddNames lists a directory whose entries have newlines and tabs
+// in their names, which only NUL-terminated stat records keep apart.
+func TestListDirOddNames(t *testing.T) {
+	cfg := testConfig()
+	m, docker := newTestManager(t, cfg, newTestAuth(t, cfg))
+	owner := "alice@example.com"
+	docker.add(managedContainer(owner, "127.0.0.1"))
+	docker.exec = func(cfg dockerExecConfig, stdin io.Reader, stdout, stderr io.Writer) int {
+		if !slices.Contains(cfg.Cmd, "--printf") {
+			t.Errorf("%q doesn't ask stat for NUL-terminated records", cfg.Cmd)
+		}
+		switch cfg.Cmd[0] {
+		case "stat":
+			fmt.Fprint(stdout, "41ed\t4096\t1700000000\tdeveloper\t/home/developer\x00")
+		case "find":
+			fmt.Fprint(stdout,
+				"81a4\t12\t1700000000\tdeveloper\t/home/developer/notes\n41ed\t0\t0\troot\tfake\x00"+
+					"41ed\t4096\t1700000000\tdeveloper\t/home/developer/src\x00"+
+					"a1ff\t4\t1700000000\tdeveloper\t/home/developer/tab\tlink\x00")
+		default:
+			t.Errorf("unexpected command %q", cfg.Cmd)
+			return 1
+		}
+		return 0
+	}
+
+	entries, err := m.listDir(context.Background(), dockerStatusResponse{ContainerId: "id-" + ownerKey(owner)}, homeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []fileEntry{
+		{Name: "src", Path: "/home/developer/src", Type: "dir", Size: 4096, Mode: "0755"},
+		{Name: "notes\n41ed\t0\t0\troot\tfake", Path: "/home/developer/notes\n41ed\t0\t0\troot\tfake", Type: "file", Size: 12, Mode: "0644"},
+		{Name: "tab\tlink", Path: "/home/developer/tab\tlink", Type: "symlink", Size: 4, Mode: "0777"},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("got %d entries: %+v", len(entries), entries)
+	}
+	for i, e := range entries {
+		w := want[i]
+		if e.Name != w.Name || e.Path != w.Path || e.Type != w.Type || e.Size != w.Size || e.Mode != w.Mode || e.Owner != "developer" {
+			t.Errorf("entry %d: got %+v, want %+v", i, e, w)
+		}
+	}
+}
+
+func TestParseStatRecord(t *testing.T) {
+	for _, tc := range []struct {
+		record string
+		ok     bool
+		typ    string
+	}{
+		{"81a4\t12\t1700000000\tdeveloper\t/home/developer/a.txt", true, "file"},
+		{"21b6\t0\t1700000000\troot\t/dev/null", true, "other"},
+		{"", false, ""},
+		{"81a4\t12\t1700000000\tdeveloper", false, ""},
+		{"zz\t12\t1700000000\tdeveloper\t/x", false, ""},
+	} {
+		entry, ok := parseStatRecord(tc.record)
+		if ok != tc.ok || entry.Type != tc.typ {
+			t.Errorf("%q: got %+v, %v", tc.record, entry, ok)
+		}
+	}
+}
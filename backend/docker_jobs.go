@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBuildTimeout = 30 * time.Minute
+	// Finished jobs (and their logs) are kept this long.
+	dockerJobRetention = 24 * time.Hour
+	// Oldest lines are dropped past this many bytes of log.
+	dockerJobMaxLogBytes = 4 << 20
+	sseHeartbeatInterval = 15 * time.Second
+
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+	jobCanceled  = "canceled"
+)
+
+var (
+	errDockerJobRunning  = errors.New("a job is already running")
+	errDockerJobNotFound = errors.New("job not found")
+)
+
+// dockerJob is a long-running container operation (such as a rebuild) whose
+// output is kept line by line so clients can follow it live or read it later.
+type dockerJob struct {
+	id        string
+	owner     string
+	kind      string
+	createdAt time.Time
+	cancel    context.CancelFunc
+
+	mu         sync.Mutex
+	status     string
+	errMsg     string
+	finishedAt time.Time
+	lines      []string
+	firstLine  int // absolute number of lines[0]; earlier lines were trimmed
+	logBytes   int
+	partial    []byte
+	changed    chan struct{} // closed and replaced whenever lines or status change
+}
+
+type dockerJobResponse struct {
+	Id         string     `json:"id"`
+	Kind       string     `json:"kind"`
+	Status     string     `json:"status"`
+	Error      string     `json:"error,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+	Log        *string    `json:"log,omitempty"`
+}
+
+// dockerJobRegistry tracks jobs by id and allows one running job per owner.
+type dockerJobRegistry struct {
+	timeout time.Duration
+
+	mu     sync.Mutex
+	jobs   map[string]*dockerJob
+	active map[string]*dockerJob
+}
+
+func newDockerJobRegistry(timeout time.Duration) *dockerJobRegistry {
+	return &dockerJobRegistry{
+		timeout: timeout,
+		jobs:    make(map[string]*dockerJob),
+		active:  make(map[string]*dockerJob),
+	}
+}
+
+// start runs fn in the background as a new job for owner. If owner already
+// has a running job it is returned along with errDockerJobRunning.
+func (reg *dockerJobRegistry) start(owner, kind string, fn func(ctx context.Context, out io.Writer) error) (*dockerJob, error) {
+	reg.mu.Lock()
+	if running := reg.active[owner]; running != nil {
+		reg.mu.Unlock()
+		return running, errDockerJobRunning
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), reg.timeout)
+	job := &dockerJob{
+		id:        newShellSessionID(),
+		owner:     owner,
+		kind:      kind,
+		createdAt: time.Now(),
+		cancel:    cancel,
+		status:    jobRunning,
+		changed:   make(chan struct{}),
+	}
+	reg.jobs[job.id] = job
+	reg.active[owner] = job
+	reg.mu.Unlock()
+
+	go func() {
+		defer cancel()
+		err := fn(ctx, job)
+		switch {
+		case err == nil:
+			job.finish(jobSucceeded, "")
+		case errors.Is(ctx.Err(), context.Canceled):
+			job.finish(jobCanceled, "canceled")
+		case errors.Is(ctx.Err(), context.DeadlineExceeded):
+			job.finish(jobFailed, fmt.Sprintf("timed out after %s", reg.timeout))
+		default:
+			job.finish(jobFailed, err.Error())
+		}
+		log.Printf("[docker] %s job %s for %s %s", job.kind, job.id, job.owner, job.currentStatus())
+
+		reg.mu.Lock()
+		if reg.active[owner] == job {
+			delete(reg.active, owner)
+		}
+		reg.mu.Unlock()
+		time.AfterFunc(dockerJobRetention, func() {
+			reg.mu.Lock()
+			delete(reg.jobs, job.id)
+			reg.mu.Unlock()
+		})
+	}()
+	return job, nil
+}
+
+// get returns the owner's job; other users' jobs are reported as not found.
+func (reg *dockerJobRegistry) get(owner, id string) (*dockerJob, error) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	job, ok := reg.jobs[id]
+	if !ok || job.owner != owner {
+		return nil, errDockerJobNotFound
+	}
+	return job, nil
+}
+
+func (reg *dockerJobRegistry) listFor(owner string) []*dockerJob {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	var out []*dockerJob
+	for _, job := range reg.jobs {
+		if job.owner == owner {
+			out = append(out, job)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].createdAt.After(out[j].createdAt) })
+	return out
+}
+
+// Write appends output to the job log; complete lines become visible to
+// followers immediately, a trailing partial line when the job finishes.
+func (job *dockerJob) Write(p []byte) (int, error) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	data := append(job.partial, p...)
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+		job.appendLineLocked(strings.TrimRight(string(data[:i]), "\r"))
+		data = data[i+1:]
+	}
+	job.partial = append([]byte(nil), data...)
+	return len(p), nil
+}
+
+// logStep writes one lifecycle line such as "==> building image" to out,
+// which may be nil.
+func logStep(out io.Writer, format string, args ...any) {
+	if out != nil {
+		_, _ = fmt.Fprintf(out, "==> "+format+"\n", args...)
+	}
+}
+
+func (job *dockerJob) appendLineLocked(line string) {
+	job.lines = append(job.lines, line)
+	job.logBytes += len(line) + 1
+	for job.logBytes > dockerJobMaxLogBytes && len(job.lines) > 1 {
+		job.logBytes -= len(job.lines[0]) + 1
+		job.lines = job.lines[1:]
+		job.firstLine++
+	}
+	job.notifyLocked()
+}
+
+func (job *dockerJob) notifyLocked() {
+	close(job.changed)
+	job.changed = make(chan struct{})
+}
+
+func (job *dockerJob) finish(status, errMsg string) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	if len(job.partial) > 0 {
+		job.appendLineLocked(string(job.partial))
+		job.partial = nil
+	}
+	if errMsg != "" {
+		job.appendLineLocked("error: " + errMsg)
+	}
+	job.status = status
+	job.errMsg = errMsg
+	job.finishedAt = time.Now()
+	job.notifyLocked()
+}
+
+func (job *dockerJob) currentStatus() string {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	return job.status
+}
+
+// since returns log lines from absolute line number from on, the number to
+// ask for next, whether the job is over, and a channel closed on the next
+// change.
+func (job *dockerJob) since(from int) ([]string, int, bool, <-chan struct{}) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	if from < job.firstLine {
+		from = job.firstLine
+	}
+	end := job.firstLine + len(job.lines)
+	if from > end {
+		from = end
+	}
+	lines := append([]string(nil), job.lines[from-job.firstLine:]...)
+	return lines, end, job.status != jobRunning, job.changed
+}
+
+func (job *dockerJob) response(withLog bool) dockerJobResponse {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	resp := dockerJobResponse{
+		Id:        job.id,
+		Kind:      job.kind,
+		Status:    job.status,
+		Error:     job.errMsg,
+		CreatedAt: job.createdAt,
+	}
+	if !job.finishedAt.IsZero() {
+		finished := job.finishedAt
+		resp.FinishedAt = &finished
+	}
+	if withLog {
+		text := strings.Join(job.lines, "\n")
+		if len(job.lines) > 0 {
+			text += "\n"
+		}
+		resp.Log = &text
+	}
+	return resp
+}
+
+// GET /docker/jobs
+// Lists the caller's recent jobs (without logs).
+func (m *DockerManager) handleListJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJson(w, http.StatusMethodNotAllowed, dockerActionResponse{Ok: false, Message: "method not allowed"})
+		return
+	}
+	owner, ok := m.requireOwner(w, r)
+	if !ok {
+		return
+	}
+	out := []dockerJobResponse{}
+	for _, job := range m.jobs.listFor(owner) {
+		out = append(out, job.response(false))
+	}
+	writeJson(w, http.StatusOK, map[string]any{"jobs": out})
+}
+
+// GET /docker/jobs/{id}
+// Returns a job's status and its full log so far.
+func (m *DockerManager) handleJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJson(w, http.StatusMethodNotAllowed, dockerActionResponse{Ok: false, Message: "method not allowed"})
+		return
+	}
+	job, ok := m.requireJob(w, r)
+	if !ok {
+		return
+	}
+	writeJson(w, http.StatusOK, job.response(true))
+}
+
+// POST /docker/jobs/{id}/cancel
+func (m *DockerManager) handleCancelJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJson(w, http.StatusMethodNotAllowed, dockerActionResponse{Ok: false, Message: "method not allowed"})
+		return
+	}
+	job, ok := m.requireJob(w, r)
+	if !ok {
+		return
+	}
+	if job.currentStatus() != jobRunning {
+		writeJson(w, http.StatusConflict, dockerActionResponse{Ok: false, Message: "job already finished", Status: job.currentStatus()})
+		return
+	}
+	job.cancel()
+	writeJson(w, http.StatusAccepted, dockerActionResponse{Ok: true, Message: "cancel requested", JobId: job.id})
+}
+
+// GET /docker/jobs/{id}/events
+// Streams a job's log as Server-Sent Events: one "log" event per line with
+// {"line": "..."} (its id is the line number, so Last-Event-ID resumes), then
+// a "done" event with the final status. Lines are JSON-encoded since pull
+// and build progress contains bare carriage returns, which SSE treats as
+// line breaks.
+func (m *DockerManager) handleJobEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJson(w, http.StatusMethodNotAllowed, dockerActionResponse{Ok: false, Message: "method not allowed"})
+		return
+	}
+	job, ok := m.requireJob(w, r)
+	if !ok {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJson(w, http.StatusInternalServerError, dockerActionResponse{Ok: false, Message: "streaming unsupported"})
+		return
+	}
+
+	next := 0
+	if last, err := strconv.Atoi(r.Header.Get("Last-Event-ID")); err == nil {
+		next = last + 1
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(sseHeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		lines, end, done, changed := job.since(next)
+		for i, line := range lines {
+			payload, _ := json.Marshal(map[string]string{"line": line})
+			fmt.Fprintf(w, "id: %d\nevent: log\ndata: %s\n\n", end-len(lines)+i, payload)
+		}
+		next = end
+		if done {
+			resp := job.response(false)
+			payload, _ := json.Marshal(map[string]string{"status": resp.Status, "error": resp.Error})
+			fmt.Fprintf(w, "event: done\ndata: %s\n\n", payload)
+			flusher.Flush()
+			return
+		}
+		flusher.Flush()
+		select {
+		case <-changed:
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (m *DockerManager) requireJob(w http.ResponseWriter, r *http.Request) (*dockerJob, bool) {
+	owner, ok := m.requireOwner(w, r)
+	if !ok {
+		return nil, false
+	}
+	job, err := m.jobs.get(owner, r.PathValue("id"))
+	if err != nil {
+		writeJson(w, http.StatusNotFound, dockerActionResponse{Ok: false, Message: err.Error()})
+		return nil, false
+	}
+	return job, true
+}
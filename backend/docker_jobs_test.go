@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestJobEventsEncodeLines streams a job whose output redraws progress with
+// carriage returns: each line still arrives as one intact log event.
+func TestJobEventsEncodeLines(t *testing.T) {
+	cfg := testConfig()
+	auth := newTestAuth(t, cfg)
+	m, _ := newTestManager(t, cfg, auth)
+	owner := "alice@example.com"
+	job, err := m.jobs.start(owner, "rebuild", func(ctx context.Context, out io.Writer) error {
+		fmt.Fprint(out, "pulling 10%\rpulling 100%\r\n")
+		fmt.Fprint(out, "data: injected\n")
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/docker/jobs/{id}/events", auth.require(m.handleJobEvents))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/docker/jobs/"+job.id+"/events", nil)
+	req.Header.Set("Authorization", "Bearer "+loginToken(t, auth, owner))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	var lines []string
+	for _, ev := range strings.Split(strings.TrimSpace(string(body)), "\n\n") {
+		fields := strings.Split(ev, "\n")
+		if len(fields) != 3 || fields[1] != "event: log" {
+			continue
+		}
+		var payload struct {
+			Line string `json:"line"`
+		}
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(fields[2], "data: ")), &payload); err != nil {
+			t.Fatalf("log event %q: %v", ev, err)
+		}
+		lines = append(lines, payload.Line)
+	}
+	if len(lines) != 2 || lines[0] != "pulling 10%\rpulling 100%" || lines[1] != "data: injected" {
+		t.Errorf("lines %q from:\n%s", lines, body)
+	}
+	if !strings.Contains(string(body), "event: done\ndata: {\"error\":\"\",\"status\":\"succeeded\"}") {
+		t.Errorf("no done event in:\n%s", body)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"gopkg.in/ini.v1"
+)
+
+// resourceLimits caps a dev container. Zero fields mean "no limit" in the
+// defaults and "inherit" in plan/user overrides.
+type resourceLimits struct {
+	CPUs        float64 `json:"cpus,omitempty"`
+	MemoryBytes int64   `json:"memoryBytes,omitempty"`
+	PidsLimit   int64   `json:"pidsLimit,omitempty"`
+	// DiskSize is passed as the "size" storage option; only some storage
+	// drivers support it (e.g. overlay2 on xfs with pquota).
+	DiskSize string `json:"diskSize,omitempty"`
+	// MaxRunning is how many containers one user may run at once.
+	MaxRunning int `json:"maxRunning,omitempty"`
+}
+
+// userLimits are per-user overrides from an INI [user:<sub>] section.
+type userLimits struct {
+	Plan   string
+	Limits resourceLimits
+}
+
+// quotaError is returned when starting a container would exceed a quota.
+type quotaError struct {
+	Message string
+}
+
+func (e *quotaError) Error() string { return e.Message }
+
+// overlay returns l with every non-zero field of o applied on top.
+func (l resourceLimits) overlay(o resourceLimits) resourceLimits {
+	if o.CPUs > 0 {
+		l.CPUs = o.CPUs
+	}
+	if o.MemoryBytes > 0 {
+		l.MemoryBytes = o.MemoryBytes
+	}
+	if o.PidsLimit > 0 {
+		l.PidsLimit = o.PidsLimit
+	}
+	if o.DiskSize != "" {
+		l.DiskSize = o.DiskSize
+	}
+	if o.MaxRunning > 0 {
+		l.MaxRunning = o.MaxRunning
+	}
+	return l
+}
+
+// limitsFor resolves an owner's limits: global defaults, then their plan
+// (from their [user:<sub>] section or DOCKER_DEFAULT_PLAN), then per-user
+// overrides.
+func (m *DockerManager) limitsFor(owner string) resourceLimits {
+	limits := m.cfg.ContainerLimits
+	user := m.cfg.UserLimits[owner]
+	plan := firstNonEmpty(user.Plan, m.cfg.DefaultPlan)
+	if plan != "" {
+		if planLimits, ok := m.cfg.PlanLimits[plan]; ok {
+			limits = limits.overlay(planLimits)
+		} else {
+			log.Printf("[docker] unknown plan %q for %s; using defaults", plan, owner)
+		}
+	}
+	return limits.overlay(user.Limits)
+}
+
+// applyLimits sets the HostConfig fields for limits.
+func applyLimits(hc *dockerHostConfig, limits resourceLimits) {
+	if limits.CPUs > 0 {
+		hc.NanoCpus = int64(limits.CPUs * 1e9)
+	}
+	if limits.MemoryBytes > 0 {
+		hc.Memory = limits.MemoryBytes
+		// Same as Memory: no swap on top of the limit.
+		hc.MemorySwap = limits.MemoryBytes
+	}
+	if limits.PidsLimit > 0 {
+		pids := limits.PidsLimit
+		hc.PidsLimit = &pids
+	}
+	if limits.DiskSize != "" {
+		hc.StorageOpt = map[string]string{"size": limits.DiskSize}
+	}
+}
+
+// startWithinQuota runs start, which creates and/or starts one of owner's
+// containers, if checkRunningQuota allows it. Checks and starts are
+// serialized, so concurrent requests can't all pass the check before any of
+// their containers is running.
+func (m *DockerManager) startWithinQuota(ctx context.Context, owner string, start func() error) error {
+	m.quotaMu.Lock()
+	defer m.quotaMu.Unlock()
+	if err := m.checkRunningQuota(ctx, owner); err != nil {
+		return err
+	}
+	return start()
+}
+
+// checkRunningQuota fails if owner starting one more container would exceed
+// their MaxRunning or the host-wide DOCKER_MAX_RUNNING_CONTAINERS.
+func (m *DockerManager) checkRunningQuota(ctx context.Context, owner string) error {
+	running, err := m.docker.containerList(ctx, false, map[string][]string{
+		"label": {labelManaged + "=true"},
+	})
+	if err != nil {
+		return err
+	}
+	mine := 0
+	for _, c := range running {
+		if c.Labels[labelOwner] == owner {
+			mine++
+		}
+	}
+	if max := m.limitsFor(owner).MaxRunning; max > 0 && mine >= max {
+		return &quotaError{Message: fmt.Sprintf("you already have %d running container(s); the limit is %d", mine, max)}
+	}
+	if max := m.cfg.MaxRunningContainers; max > 0 && len(running) >= max {
+		return &quotaError{Message: fmt.Sprintf("host is at its limit of %d running containers; try again later", max)}
+	}
+	return nil
+}
+
+// readLimitsSection reads limit keys (DOCKER_CPUS, DOCKER_MEMORY, ...) from an
+// INI section; the root section holds the defaults, [plan:<name>] and
+// [user:<sub>] sections use the same keys.
+func readLimitsSection(sec *ini.Section) resourceLimits {
+	return resourceLimits{
+		CPUs:        sec.Key("DOCKER_CPUS").MustFloat64(0),
+		MemoryBytes: mustByteSize(sec.Key("DOCKER_MEMORY").String()),
+		PidsLimit:   sec.Key("DOCKER_PIDS_LIMIT").MustInt64(0),
+		DiskSize:    sec.Key("DOCKER_DISK_SIZE").String(),
+		MaxRunning:  sec.Key("DOCKER_MAX_CONTAINERS_PER_USER").MustInt(0),
+	}
+}
+
+// limitsFromEnv applies limit env vars on top of the INI defaults.
+func limitsFromEnv(base resourceLimits) resourceLimits {
+	var env resourceLimits
+	if v := getEnvOptional("DOCKER_CPUS"); v != "" {
+		env.CPUs, _ = strconv.ParseFloat(v, 64)
+	}
+	env.MemoryBytes = mustByteSize(getEnvOptional("DOCKER_MEMORY"))
+	if v := getEnvOptional("DOCKER_PIDS_LIMIT"); v != "" {
+		env.PidsLimit, _ = strconv.ParseInt(v, 10, 64)
+	}
+	env.DiskSize = getEnvOptional("DOCKER_DISK_SIZE")
+	if v := getEnvOptional("DOCKER_MAX_CONTAINERS_PER_USER"); v != "" {
+		env.MaxRunning, _ = strconv.Atoi(v)
+	}
+	return base.overlay(env)
+}
+
+// mustByteSize parses sizes like "512m", "4g" or plain bytes; invalid input
+// is logged and treated as unset.
+func mustByteSize(raw string) int64 {
+	raw = strings.ToLower(strings.TrimSpace(raw))
+	if raw == "" {
+		return 0
+	}
+	raw = strings.TrimSuffix(raw, "b")
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(raw, "k"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(raw, "m"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(raw, "g"):
+		multiplier = 1 << 30
+	case strings.HasSuffix(raw, "t"):
+		multiplier = 1 << 40
+	}
+	if multiplier > 1 {
+		raw = raw[:len(raw)-1]
+	}
+	n, err := strconv.ParseFloat(raw, 64)
+	if err != nil || n < 0 {
+		log.Printf("ignoring invalid size %q", raw)
+		return 0
+	}
+	return int64(n * float64(multiplier))
+}
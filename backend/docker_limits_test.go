@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestRunningQuotaUnderConcurrentStarts starts several stopped containers at
+// once on a host that allows one more running container.
+func TestRunningQuotaUnderConcurrentStarts(t *testing.T) {
+	cfg := testConfig()
+	cfg.MaxRunningContainers = 2
+	m, docker := newTestManager(t, cfg, newTestAuth(t, cfg))
+	docker.add(managedContainer("running@example.com", "127.0.0.1"))
+	var owners []string
+	for i := range 5 {
+		owner := fmt.Sprintf("user%d@example.com", i)
+		info := managedContainer(owner, "127.0.0.1")
+		info.State.Running, info.State.Status = false, "exited"
+		docker.add(info)
+		owners = append(owners, owner)
+	}
+	// Widen the window between the quota check and the start.
+	docker.before = func(method, path string) {
+		if path == "/containers/json" {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(owners))
+	for i, owner := range owners {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = m.startContainer(context.Background(), owner, "")
+		}()
+	}
+	wg.Wait()
+
+	started := 0
+	for i, err := range errs {
+		var quota *quotaError
+		switch {
+		case err == nil:
+			started++
+		case !errors.As(err, &quota):
+			t.Errorf("%s: %v", owners[i], err)
+		}
+	}
+	if started != 1 {
+		t.Errorf("%d containers started, want 1", started)
+	}
+}
@@ -1,46 +1,142 @@
 package main
 
 import (
-	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 const (
-	defaultContainerName = "dev-environment"
+	containerNamePrefix  = "agent-thing-dev"
 	defaultImageName     = "agent-thing-dev"
 	dockerCommandTimeout = 2 * time.Minute
+
+	// Labels applied to every container we create so we can find (and scope)
+	// them without relying on the name alone.
+	labelManaged = "agent-thing.managed"
+	labelOwner   = "agent-thing.owner"
 )
 
 type DockerManager struct {
-	containerName string
-	imageName     string
+	cfg       *Config
+	auth      *Authenticator
+	docker    *dockerClient
+	sessions  *shellSessionRegistry
+	activity  *activityTracker
+	jobs      *dockerJobRegistry
+	imageName string
+
+	reaperMu  sync.Mutex
+	nextSweep time.Time
+
+	// Held while checking the running quota and starting a container.
+	quotaMu sync.Mutex
+
+	// Bumped per owner to revoke their preview links.
+	previews previewEpochStore
 }
 
 type dockerStatusResponse struct {
 	Status      string `json:"status"`
+	State       string `json:"state,omitempty"`
+	ExitCode    *int   `json:"exitCode,omitempty"`
 	ContainerId string `json:"containerId,omitempty"`
 	Details     string `json:"details,omitempty"`
 	Message     string `json:"message,omitempty"`
+	// Environment template the container was created from.
+	Template string `json:"template,omitempty"`
+	// Set for containers created from a workspace's devcontainer.json.
+	Workspace    string `json:"workspace,omitempty"`
+	RemoteUser   string `json:"remoteUser,omitempty"`
+	ForwardPorts []int  `json:"forwardPorts,omitempty"`
+	// Volume mounted at /home/developer; it outlives the container.
+	HomeVolume string `json:"homeVolume,omitempty"`
+	// Limits that apply to the caller's containers.
+	Limits *resourceLimits `json:"limits,omitempty"`
+	// Idle reaper policy; omitted when the reaper is off.
+	Reaper *reaperStatus `json:"reaper,omitempty"`
 }
 
 type dockerActionResponse struct {
 	Ok      bool   `json:"ok"`
 	Message string `json:"message"`
 	Status  string `json:"status,omitempty"`
+	JobId   string `json:"jobId,omitempty"`
 }
 
-func NewDockerManager() *DockerManager {
+func NewDockerManager(cfg *Config, auth *Authenticator, db *DB) (*DockerManager, error) {
+	client, err := newDockerClient(cfg.DockerHost)
+	if err != nil {
+		return nil, err
+	}
 	return &DockerManager{
-		containerName: defaultContainerName,
-		imageName:     defaultImageName,
+		cfg:       cfg,
+		auth:      auth,
+		docker:    client,
+		sessions:  newShellSessionRegistry(cfg.ShellSessionGrace, cfg.ShellScrollbackBytes),
+		activity:  newActivityTracker(),
+		jobs:      newDockerJobRegistry(cfg.BuildTimeout),
+		imageName: defaultImageName,
+		previews:  newPreviewEpochStore(db),
+	}, nil
+}
+
+// containerNameFor returns the per-user container name.
+func containerNameFor(owner string) string {
+	return containerNamePrefix + "-" + ownerKey(owner)
+}
+
+// ownerKey is a filesystem- and docker-safe key for an owner. The owner (JWT
+// sub) is usually an email, so we keep a readable slug and append a short hash
+// to stay unique after sanitizing.
+func ownerKey(owner string) string {
+	sum := sha256.Sum256([]byte(owner))
+	return ownerSlug(owner) + "-" + hex.EncodeToString(sum[:])[:8]
+}
+
+// ownerSlug reduces an owner id to the characters docker accepts in names.
+func ownerSlug(owner string) string {
+	var b strings.Builder
+	lastDash := false
+	for _, r := range strings.ToLower(owner) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			b.WriteRune(r)
+			lastDash = false
+		case !lastDash && b.Len() > 0:
+			b.WriteByte('-')
+			lastDash = true
+		}
+		if b.Len() >= 32 {
+			break
+		}
+	}
+	slug := strings.Trim(b.String(), "-")
+	if slug == "" {
+		slug = "user"
 	}
+	return slug
+}
+
+// requireOwner returns the caller's identity set by the auth middleware, or
+// writes a 401 and returns false if the handler was mounted without it.
+func (m *DockerManager) requireOwner(w http.ResponseWriter, r *http.Request) (string, bool) {
+	user := currentUser(r)
+	if user == nil {
+		writeJson(w, http.StatusUnauthorized, dockerActionResponse{Ok: false, Message: "unauthorized"})
+		return "", false
+	}
+	return user.Subject, true
 }
 
 func (m *DockerManager) handleStatus(w http.ResponseWriter, r *http.Request) {
@@ -52,7 +148,12 @@ func (m *DockerManager) handleStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	status, err := m.getStatus(r.Context())
+	owner, ok := m.requireOwner(w, r)
+	if !ok {
+		return
+	}
+
+	status, err := m.getStatus(r.Context(), owner)
 	if err != nil {
 		writeJson(w, http.StatusInternalServerError, dockerStatusResponse{
 			Status:  "error",
@@ -61,17 +162,48 @@ func (m *DockerManager) handleStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	status.HomeVolume = homeVolumeFor(owner)
+	limits := m.limitsFor(owner)
+	status.Limits = &limits
+	status.Reaper = m.reaperStatusFor(r.Context(), owner, status.ContainerId)
 	writeJson(w, http.StatusOK, status)
 }
 
+// dockerErrorStatus maps lifecycle errors to HTTP status codes.
+func dockerErrorStatus(err error) int {
+	var qe *quotaError
+	switch {
+	case errors.As(err, &qe):
+		return http.StatusTooManyRequests
+	case errors.Is(err, errTemplateMismatch):
+		return http.StatusConflict
+	case errors.Is(err, errUnknownTemplate):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
 func (m *DockerManager) handleStart(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		writeJson(w, http.StatusMethodNotAllowed, dockerActionResponse{Ok: false, Message: "method not allowed"})
 		return
 	}
+	owner, ok := m.requireOwner(w, r)
+	if !ok {
+		return
+	}
 
-	if err := m.startContainer(r.Context()); err != nil {
-		writeJson(w, http.StatusInternalServerError, dockerActionResponse{Ok: false, Message: err.Error()})
+	req, err := m.readLifecycleRequest(r)
+	if err == nil && req.Workspace != "" {
+		err = errors.New("use /docker/rebuild to create a container from a workspace")
+	}
+	if err != nil {
+		writeJson(w, http.StatusBadRequest, dockerActionResponse{Ok: false, Message: err.Error()})
+		return
+	}
+
+	if err := m.startContainer(r.Context(), owner, req.Template); err != nil {
+		writeJson(w, dockerErrorStatus(err), dockerActionResponse{Ok: false, Message: err.Error()})
 		return
 	}
 
@@ -83,8 +215,12 @@ func (m *DockerManager) handleStop(w http.ResponseWriter, r *http.Request) {
 		writeJson(w, http.StatusMethodNotAllowed, dockerActionResponse{Ok: false, Message: "method not allowed"})
 		return
 	}
+	owner, ok := m.requireOwner(w, r)
+	if !ok {
+		return
+	}
 
-	if err := m.stopContainer(r.Context()); err != nil {
+	if err := m.stopContainer(r.Context(), owner); err != nil {
 		writeJson(w, http.StatusInternalServerError, dockerActionResponse{Ok: false, Message: err.Error()})
 		return
 	}
@@ -92,109 +228,226 @@ func (m *DockerManager) handleStop(w http.ResponseWriter, r *http.Request) {
 	writeJson(w, http.StatusOK, dockerActionResponse{Ok: true, Message: "container stopped"})
 }
 
+// POST /docker/rebuild
+// Starts a rebuild job and returns 202 with its id; follow it with
+// GET /docker/jobs/{id}/events.
 func (m *DockerManager) handleRebuild(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		writeJson(w, http.StatusMethodNotAllowed, dockerActionResponse{Ok: false, Message: "method not allowed"})
 		return
 	}
+	owner, ok := m.requireOwner(w, r)
+	if !ok {
+		return
+	}
 
-	if err := m.rebuildContainer(r.Context()); err != nil {
-		writeJson(w, http.StatusInternalServerError, dockerActionResponse{Ok: false, Message: err.Error()})
+	req, err := m.readLifecycleRequest(r)
+	if err != nil {
+		writeJson(w, http.StatusBadRequest, dockerActionResponse{Ok: false, Message: err.Error()})
+		return
+	}
+
+	job, err := m.jobs.start(owner, "rebuild", func(ctx context.Context, out io.Writer) error {
+		return m.rebuildContainer(ctx, owner, req, out)
+	})
+	if errors.Is(err, errDockerJobRunning) {
+		writeJson(w, http.StatusConflict, dockerActionResponse{Ok: false, Message: "a rebuild is already running", Status: jobRunning, JobId: job.id})
 		return
 	}
 
-	writeJson(w, http.StatusOK, dockerActionResponse{Ok: true, Message: "container rebuilt"})
+	writeJson(w, http.StatusAccepted, dockerActionResponse{Ok: true, Message: "rebuild started", Status: jobRunning, JobId: job.id})
 }
 
-func (m *DockerManager) getStatus(ctx context.Context) (dockerStatusResponse, error) {
-	output, err := m.runDocker(ctx, "ps", "-a", "--filter", fmt.Sprintf("name=^/%s$", m.containerName), "--format", "{{.ID}}|{{.Status}}")
+func (m *DockerManager) getStatus(ctx context.Context, owner string) (dockerStatusResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, dockerCommandTimeout)
+	defer cancel()
+
+	containers, err := m.docker.containerList(ctx, true, map[string][]string{
+		"name":  {fmt.Sprintf("^/%s$", containerNameFor(owner))},
+		"label": {fmt.Sprintf("%s=%s", labelOwner, owner)},
+	})
 	if err != nil {
 		return dockerStatusResponse{}, err
 	}
-
-	trimmed := strings.TrimSpace(output)
-	if trimmed == "" {
+	if len(containers) == 0 {
 		return dockerStatusResponse{Status: "not_found"}, nil
 	}
 
-	parts := strings.SplitN(trimmed, "|", 2)
-	containerId := strings.TrimSpace(parts[0])
-	details := ""
-	if len(parts) > 1 {
-		details = strings.TrimSpace(parts[1])
+	c := containers[0]
+	resp := dockerStatusResponse{
+		Status:      "stopped",
+		State:       c.State,
+		ContainerId: c.Id,
+		Details:     c.Status,
+		// Containers from before templates existed run the default image.
+		Template: firstNonEmpty(c.Labels[labelTemplate], defaultTemplateName),
 	}
-
-	status := "stopped"
-	if strings.HasPrefix(strings.ToLower(details), "up") {
-		status = "running"
+	resp.Workspace = c.Labels[labelWorkspace]
+	resp.RemoteUser = c.Labels[labelRemoteUser]
+	for _, p := range strings.Split(c.Labels[labelPorts], ",") {
+		if port, err := strconv.Atoi(p); err == nil {
+			resp.ForwardPorts = append(resp.ForwardPorts, port)
+		}
 	}
-
-	return dockerStatusResponse{
-		Status:      status,
-		ContainerId: containerId,
-		Details:     details,
-	}, nil
+	if c.State == "running" {
+		resp.Status = "running"
+	} else if info, err := m.docker.containerInspect(ctx, c.Id); err == nil {
+		exitCode := info.State.ExitCode
+		resp.ExitCode = &exitCode
+	}
+	return resp, nil
 }
 
-func (m *DockerManager) startContainer(ctx context.Context) error {
-	status, err := m.getStatus(ctx)
+// startContainer starts the owner's container, creating it from template
+// ("" means the configured default) if it doesn't exist. An existing container
+// built from a different template is an errTemplateMismatch.
+func (m *DockerManager) startContainer(ctx context.Context, owner, template string) error {
+	status, err := m.getStatus(ctx, owner)
 	if err != nil {
 		return err
 	}
+	if template != "" && status.Template != "" && template != status.Template {
+		return fmt.Errorf("%w (current: %s)", errTemplateMismatch, status.Template)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, dockerCommandTimeout)
+	defer cancel()
 
 	switch status.Status {
 	case "running":
 		return nil
 	case "stopped":
-		_, err := m.runDocker(ctx, "start", m.containerName)
-		return err
+		return m.startWithinQuota(ctx, owner, func() error {
+			return m.docker.containerStart(ctx, status.ContainerId)
+		})
 	case "not_found":
-		if err := m.buildImage(ctx); err != nil {
+		tmpl, err := m.template(template)
+		if err != nil {
 			return err
 		}
-		_, err := m.runDocker(ctx, "run", "-d", "--name", m.containerName, m.imageName, "tail", "-f", "/dev/null")
-		return err
+		if err := m.ensureImage(ctx, tmpl, false, nil); err != nil {
+			return err
+		}
+		return m.runContainer(ctx, owner, tmpl)
 	default:
 		return fmt.Errorf("unexpected status: %s", status.Status)
 	}
 }
 
-func (m *DockerManager) stopContainer(ctx context.Context) error {
-	status, err := m.getStatus(ctx)
+func (m *DockerManager) stopContainer(ctx context.Context, owner string) error {
+	status, err := m.getStatus(ctx, owner)
 	if err != nil {
 		return err
 	}
 	if status.Status == "running" {
-		_, err := m.runDocker(ctx, "stop", m.containerName)
-		return err
+		ctx, cancel := context.WithTimeout(ctx, dockerCommandTimeout)
+		defer cancel()
+		return m.docker.containerStop(ctx, status.ContainerId)
 	}
 	return nil
 }
 
-func (m *DockerManager) rebuildContainer(ctx context.Context) error {
-	_, _ = m.runDocker(ctx, "rm", "-f", m.containerName)
+// rebuildContainer replaces the owner's container with one from a freshly
+// built (or pulled) image of the requested template or workspace
+// devcontainer; with neither, the current container's source is reused.
+// Progress goes to out (nil discards it). The caller bounds ctx; builds can
+// take much longer than dockerCommandTimeout.
+func (m *DockerManager) rebuildContainer(ctx context.Context, owner string, req dockerLifecycleRequest, out io.Writer) error {
+	status, err := m.getStatus(ctx, owner)
+	if err != nil {
+		return err
+	}
+	workspace := req.Workspace
+	if workspace == "" && req.Template == "" && status.Template == devcontainerTemplateName {
+		workspace = status.Workspace
+	}
+	if workspace != "" {
+		return m.rebuildFromDevcontainer(ctx, owner, status, workspace, out)
+	}
+	tmpl, err := m.template(firstNonEmpty(req.Template, status.Template))
+	if err != nil {
+		return err
+	}
 
-	if err := m.buildImage(ctx); err != nil {
+	if status.ContainerId != "" {
+		logStep(out, "removing container %s", containerNameFor(owner))
+		if err := m.docker.containerRemove(ctx, status.ContainerId, true); err != nil && !isDockerNotFound(err) {
+			return err
+		}
+	}
+	if err := m.ensureImage(ctx, tmpl, true, out); err != nil {
+		return err
+	}
+
+	logStep(out, "starting container %s from template %s", containerNameFor(owner), tmpl.Name)
+	if err := m.runContainer(ctx, owner, tmpl); err != nil {
 		return err
 	}
+	logStep(out, "container ready")
+	return nil
+}
 
-	_, err := m.runDocker(ctx, "run", "-d", "--name", m.containerName, m.imageName, "tail", "-f", "/dev/null")
+func (m *DockerManager) runContainer(ctx context.Context, owner string, tmpl envTemplate) error {
+	_, err := m.createContainer(ctx, owner, m.templateContainerConfig(tmpl))
 	return err
 }
 
-func (m *DockerManager) buildImage(ctx context.Context) error {
-	projectRootDir, err := findProjectRootDir()
-	if err != nil {
-		return err
+func (m *DockerManager) templateContainerConfig(tmpl envTemplate) dockerContainerConfig {
+	return dockerContainerConfig{
+		Image:  m.imageFor(tmpl),
+		Labels: map[string]string{labelTemplate: tmpl.Name},
 	}
+}
+
+// createContainer creates and starts the owner's container from cfg, within
+// their running quota.
+func (m *DockerManager) createContainer(ctx context.Context, owner string, cfg dockerContainerConfig) (string, error) {
+	var id string
+	err := m.startWithinQuota(ctx, owner, func() error {
+		var err error
+		if id, err = m.prepareContainer(ctx, owner, cfg); err != nil {
+			return err
+		}
+		return m.docker.containerStart(ctx, id)
+	})
+	return id, err
+}
 
-	dockerfilePath := filepath.Join(projectRootDir, "Dockerfile")
-	if _, statErr := os.Stat(dockerfilePath); statErr != nil {
-		return fmt.Errorf("Dockerfile not found at %s; cannot rebuild image", dockerfilePath)
+// prepareContainer creates the owner's container from cfg without starting
+// it, adding the idle command, ownership labels, home volume and resource
+// limits.
+func (m *DockerManager) prepareContainer(ctx context.Context, owner string, cfg dockerContainerConfig) (string, error) {
+	if len(cfg.Cmd) == 0 {
+		cfg.Cmd = []string{"tail", "-f", "/dev/null"}
+	}
+	if cfg.Labels == nil {
+		cfg.Labels = map[string]string{}
 	}
+	cfg.Labels[labelManaged] = "true"
+	cfg.Labels[labelOwner] = owner
+	volume, err := m.ensureHomeVolume(ctx, owner)
+	if err != nil {
+		return "", err
+	}
+	cfg.HostConfig.Mounts = append([]dockerMount{{Type: "volume", Source: volume, Target: homeDir}}, cfg.HostConfig.Mounts...)
+	applyLimits(&cfg.HostConfig, m.limitsFor(owner))
+	return m.docker.containerCreate(ctx, containerNameFor(owner), cfg)
+}
 
-	_, err = m.runDockerWithDir(ctx, projectRootDir, "build", "-t", m.imageName, "-f", dockerfilePath, projectRootDir)
-	return err
+// runningContainerFor returns the status of the owner's container, starting
+// (and if needed creating) it first.
+func (m *DockerManager) runningContainerFor(ctx context.Context, owner string) (dockerStatusResponse, error) {
+	if err := m.startContainer(ctx, owner, ""); err != nil {
+		return dockerStatusResponse{}, err
+	}
+	status, err := m.getStatus(ctx, owner)
+	if err != nil {
+		return status, err
+	}
+	if status.Status != "running" {
+		return status, fmt.Errorf("container is %s", status.Status)
+	}
+	return status, nil
 }
 
 func findProjectRootDir() (string, error) {
@@ -207,33 +460,3 @@ func findProjectRootDir() (string, error) {
 	}
 	return workingDir, nil
 }
-
-func (m *DockerManager) runDocker(ctx context.Context, args ...string) (string, error) {
-	projectRootDir, _ := findProjectRootDir()
-	return m.runDockerWithDir(ctx, projectRootDir, args...)
-}
-
-func (m *DockerManager) runDockerWithDir(ctx context.Context, dir string, args ...string) (string, error) {
-	timeoutCtx, cancel := context.WithTimeout(ctx, dockerCommandTimeout)
-	defer cancel()
-
-	command := exec.CommandContext(timeoutCtx, "docker", args...)
-	if dir != "" {
-		command.Dir = dir
-	}
-
-	var stdout bytes.Buffer
-	var stderr bytes.Buffer
-	command.Stdout = &stdout
-	command.Stderr = &stderr
-
-	if err := command.Run(); err != nil {
-		errorMessage := strings.TrimSpace(stderr.String())
-		if errorMessage == "" {
-			errorMessage = err.Error()
-		}
-		return "", fmt.Errorf("docker %s failed: %s", strings.Join(args, " "), errorMessage)
-	}
-
-	return stdout.String(), nil
-}
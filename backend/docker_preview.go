@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Preview proxy: /preview/{container}/{port}/... forwards HTTP (and WebSocket
+// upgrades) to that port on the container's internal IP. Browsers can't add a
+// bearer header when navigating, so access comes from a preview link: a
+// signed token for one container port, exchanged on first use for a cookie
+// scoped to that preview's path. The owner can also send their access token
+// as a bearer header, but never via the agent_thing_token cookie.
+//
+// Previewed apps are untrusted code. They are served from PREVIEW_BASE_URL
+// when set, an origin that never receives the auth cookie, and always with a
+// CSP sandbox, which gives their pages an opaque origin: the browser treats
+// their requests to the API as cross-site, so it neither attaches the
+// viewer's (SameSite=Lax) cookie nor passes the Origin check.
+const (
+	previewTokenType   = "preview"
+	previewQueryParam  = "preview_token"
+	previewCookieName  = "agent_thing_preview"
+	defaultPreviewTTL  = 8 * time.Hour
+	maxPreviewTTL      = 7 * 24 * time.Hour
+	previewPathPrefix  = "/preview/"
+	previewProxyHeader = "X-Forwarded-Prefix"
+
+	// previewCSP omits allow-same-origin on purpose.
+	previewCSP = "sandbox allow-scripts allow-forms allow-popups allow-modals allow-downloads"
+)
+
+type previewRequest struct {
+	Port       int `json:"port"`
+	TtlSeconds int `json:"ttlSeconds"`
+}
+
+type previewResponse struct {
+	Url       string    `json:"url"`
+	Token     string    `json:"token"`
+	Port      int       `json:"port"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+func previewBasePath(container string, port int) string {
+	return previewPathPrefix + container + "/" + strconv.Itoa(port) + "/"
+}
+
+// POST   /docker/previews  {"port":3000,"ttlSeconds":3600}
+// DELETE /docker/previews  revokes every preview link issued so far.
+//
+// Links name the current container, so they also stop working when the
+// container is rebuilt.
+func (m *DockerManager) handlePreviews(w http.ResponseWriter, r *http.Request) {
+	owner, ok := m.requireOwner(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		var req previewRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJson(w, http.StatusBadRequest, dockerActionResponse{Ok: false, Message: "invalid json body"})
+			return
+		}
+		if req.Port <= 0 || req.Port > 65535 {
+			writeJson(w, http.StatusBadRequest, dockerActionResponse{Ok: false, Message: "port must be between 1 and 65535"})
+			return
+		}
+		status, err := m.getStatus(r.Context(), owner)
+		if err != nil {
+			writeJson(w, http.StatusInternalServerError, dockerActionResponse{Ok: false, Message: err.Error()})
+			return
+		}
+		if status.ContainerId == "" {
+			writeJson(w, http.StatusConflict, dockerActionResponse{Ok: false, Message: "no container; start one first"})
+			return
+		}
+		ttl := defaultPreviewTTL
+		if req.TtlSeconds > 0 {
+			ttl = min(time.Duration(req.TtlSeconds)*time.Second, maxPreviewTTL)
+		}
+		expiresAt := time.Now().Add(ttl)
+		epoch, err := m.previews.epoch(r.Context(), owner)
+		if err != nil {
+			writeJson(w, http.StatusInternalServerError, dockerActionResponse{Ok: false, Message: err.Error()})
+			return
+		}
+		container := containerNameFor(owner)
+		token, err := m.auth.sign(jwt.MapClaims{
+			"typ":   previewTokenType,
+			"ctr":   container,
+			"cid":   status.ContainerId,
+			"port":  req.Port,
+			"own":   owner,
+			"epoch": epoch,
+			"iat":   time.Now().Unix(),
+			"exp":   expiresAt.Unix(),
+		})
+		if err != nil {
+			writeJson(w, http.StatusInternalServerError, dockerActionResponse{Ok: false, Message: err.Error()})
+			return
+		}
+		writeJson(w, http.StatusOK, previewResponse{
+			Url:       firstNonEmpty(m.cfg.PreviewBaseURL, m.cfg.BackendBaseURL) + previewBasePath(container, req.Port) + "?" + previewQueryParam + "=" + url.QueryEscape(token),
+			Token:     token,
+			Port:      req.Port,
+			ExpiresAt: expiresAt,
+		})
+	case http.MethodDelete:
+		if err := m.previews.bump(r.Context(), owner); err != nil {
+			writeJson(w, http.StatusInternalServerError, dockerActionResponse{Ok: false, Message: err.Error()})
+			return
+		}
+		writeJson(w, http.StatusOK, map[string]bool{"revoked": true})
+	default:
+		writeJson(w, http.StatusMethodNotAllowed, dockerActionResponse{Ok: false, Message: "method not allowed"})
+	}
+}
+
+// checkPreviewToken validates a preview token for this container and port.
+func (m *DockerManager) checkPreviewToken(ctx context.Context, raw string, info *dockerContainerInfo, port int) error {
+	claims, err := m.auth.parse(raw)
+	if err != nil {
+		return err
+	}
+	if typ, _ := claims["typ"].(string); typ != previewTokenType {
+		return errors.New("not a preview token")
+	}
+	cid, _ := claims["cid"].(string)
+	own, _ := claims["own"].(string)
+	tokenPort, _ := claims["port"].(float64)
+	epoch, _ := claims["epoch"].(string)
+	switch {
+	case cid != info.Id || own != info.Config.Labels[labelOwner]:
+		return errors.New("preview link is for another container")
+	case int(tokenPort) != port:
+		return errors.New("preview link is for another port")
+	}
+	current, err := m.previews.epoch(ctx, own)
+	if err != nil {
+		return err
+	}
+	if epoch == "" || epoch != current {
+		return errors.New("preview link revoked")
+	}
+	return nil
+}
+
+// containerIP returns the container's address on its first network.
+func containerIP(info *dockerContainerInfo) string {
+	if info.NetworkSettings.IPAddress != "" {
+		return info.NetworkSettings.IPAddress
+	}
+	for _, n := range info.NetworkSettings.Networks {
+		if n.IPAddress != "" {
+			return n.IPAddress
+		}
+	}
+	return ""
+}
+
+// isolatePreviews keeps the preview origin (PREVIEW_BASE_URL) to previews
+// only, and sends previews requested on the API origin over to it.
+func isolatePreviews(cfg *Config, next http.Handler) http.Handler {
+	previewHost := hostOf(cfg.PreviewBaseURL)
+	if previewHost == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		isPreview := strings.HasPrefix(r.URL.Path, previewPathPrefix)
+		onPreviewHost := strings.EqualFold(r.Host, previewHost)
+		switch {
+		case onPreviewHost && !isPreview:
+			http.NotFound(w, r)
+		case !onPreviewHost && isPreview:
+			http.Redirect(w, r, cfg.PreviewBaseURL+r.URL.RequestURI(), http.StatusFound)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// hostOf returns the host[:port] of a base URL, or "" if it has none.
+func hostOf(base string) string {
+	u, err := url.Parse(base)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// /preview/{container}/{port}/{path...}
+func (m *DockerManager) handlePreview(w http.ResponseWriter, r *http.Request) {
+	// Set before anything else so error pages are sandboxed too; the app's
+	// own CSP, if any, is added alongside and can only tighten it.
+	w.Header().Set("Content-Security-Policy", previewCSP)
+
+	name := r.PathValue("container")
+	port, err := strconv.Atoi(r.PathValue("port"))
+	if err != nil || port <= 0 || port > 65535 || !strings.HasPrefix(name, containerNamePrefix+"-") {
+		http.NotFound(w, r)
+		return
+	}
+	base := previewBasePath(name, port)
+	if !strings.HasPrefix(r.URL.Path, base) {
+		target := base
+		if r.URL.RawQuery != "" {
+			target += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, target, http.StatusFound)
+		return
+	}
+
+	info, err := m.docker.containerInspect(r.Context(), name)
+	if err != nil || info.Config.Labels[labelManaged] != "true" {
+		http.NotFound(w, r)
+		return
+	}
+	owner := info.Config.Labels[labelOwner]
+
+	authorized := false
+	if raw, viaCookie := credentialsFromRequest(r); raw != "" && !viaCookie {
+		if user, err := m.auth.verify(r.Context(), raw); err == nil && user.Subject == owner {
+			authorized = true
+		}
+	}
+	if raw := r.URL.Query().Get(previewQueryParam); raw != "" && !authorized {
+		if err := m.checkPreviewToken(r.Context(), raw, info, port); err != nil {
+			http.Error(w, "preview: "+err.Error(), http.StatusForbidden)
+			return
+		}
+		exp, _ := m.auth.parse(raw)
+		expiresAt, _ := exp.GetExpirationTime()
+		// Sandboxed pages count as cross-site, so the cookie has to be
+		// SameSite=None (and therefore Secure; browsers accept that on
+		// http://localhost too) for the app's own assets to load.
+		http.SetCookie(w, &http.Cookie{
+			Name:     previewCookieName,
+			Value:    raw,
+			Path:     base,
+			Expires:  expiresAt.Time,
+			HttpOnly: true,
+			Secure:   true,
+			SameSite: http.SameSiteNoneMode,
+		})
+		if r.Method == http.MethodGet {
+			// Drop the token from the address bar and history.
+			q := r.URL.Query()
+			q.Del(previewQueryParam)
+			target := *r.URL
+			target.RawQuery = q.Encode()
+			http.Redirect(w, r, target.RequestURI(), http.StatusFound)
+			return
+		}
+		authorized = true
+	}
+	if c, err := r.Cookie(previewCookieName); err == nil && !authorized {
+		authorized = m.checkPreviewToken(r.Context(), c.Value, info, port) == nil
+	}
+	if !authorized {
+		http.Error(w, "preview: unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	ip := containerIP(info)
+	if !info.State.Running || ip == "" {
+		http.Error(w, "preview: container is not running", http.StatusBadGateway)
+		return
+	}
+	target := &url.URL{Scheme: "http", Host: ip + ":" + strconv.Itoa(port)}
+
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+			pr.Out.URL.Path = "/" + r.PathValue("path")
+			pr.Out.URL.RawPath = ""
+			q := pr.Out.URL.Query()
+			q.Del(previewQueryParam)
+			pr.Out.URL.RawQuery = q.Encode()
+			pr.SetXForwarded()
+			pr.Out.Header.Set(previewProxyHeader, strings.TrimSuffix(base, "/"))
+			m.stripPreviewCredentials(pr.Out)
+		},
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("[preview] %s port %d: %v", name, port, err)
+			http.Error(w, fmt.Sprintf("preview: nothing is answering on port %d", port), http.StatusBadGateway)
+		},
+	}
+	// Open connections (e.g. a dev server's reload socket) keep the
+	// container from being reaped.
+	defer m.activity.begin(owner)()
+	proxy.ServeHTTP(w, r)
+}
+
+// stripPreviewCredentials keeps our tokens from reaching the proxied app;
+// the app's own Authorization headers and cookies pass through.
+func (m *DockerManager) stripPreviewCredentials(out *http.Request) {
+	if h := out.Header.Get("Authorization"); len(h) > 7 && strings.EqualFold(h[:7], "Bearer ") {
+		if _, err := m.auth.parse(strings.TrimSpace(h[7:])); err == nil {
+			out.Header.Del("Authorization")
+		}
+	}
+	cookies := out.Cookies()
+	out.Header.Del("Cookie")
+	for _, c := range cookies {
+		if c.Name != authCookieName && c.Name != previewCookieName {
+			out.AddCookie(c)
+		}
+	}
+}
+
+// previewEpochStore holds each owner's preview epoch. Links carry the epoch
+// they were issued in, and DELETE /docker/previews moves it on.
+type previewEpochStore interface {
+	epoch(ctx context.Context, owner string) (string, error)
+	bump(ctx context.Context, owner string) error
+}
+
+// newPreviewEpochStore keeps epochs in Postgres when a database is
+// configured. The memory fallback prefixes them with a per-boot nonce, so
+// a restart revokes every link rather than reviving revoked ones.
+func newPreviewEpochStore(db *DB) previewEpochStore {
+	if db == nil {
+		nonce := make([]byte, 8)
+		_, _ = rand.Read(nonce)
+		return &memoryPreviewEpochs{boot: hex.EncodeToString(nonce), epochs: make(map[string]int)}
+	}
+	return &sqlPreviewEpochs{db: db.SQL}
+}
+
+type memoryPreviewEpochs struct {
+	boot   string
+	mu     sync.Mutex
+	epochs map[string]int
+}
+
+func (s *memoryPreviewEpochs) epoch(ctx context.Context, owner string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.boot + "." + strconv.Itoa(s.epochs[owner]), nil
+}
+
+func (s *memoryPreviewEpochs) bump(ctx context.Context, owner string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.epochs[owner]++
+	return nil
+}
+
+type sqlPreviewEpochs struct {
+	db *sql.DB
+}
+
+func (s *sqlPreviewEpochs) epoch(ctx context.Context, owner string) (string, error) {
+	var epoch int64
+	err := s.db.QueryRowContext(ctx, `SELECT epoch FROM preview_epochs WHERE owner = $1`, owner).Scan(&epoch)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return "", err
+	}
+	return strconv.FormatInt(epoch, 10), nil
+}
+
+func (s *sqlPreviewEpochs) bump(ctx context.Context, owner string) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO preview_epochs (owner, epoch, revoked_at) VALUES ($1, 1, now())
+		ON CONFLICT (owner) DO UPDATE SET epoch = preview_epochs.epoch + 1, revoked_at = now()`, owner)
+	return err
+}
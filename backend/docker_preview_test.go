@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// previewTestServer wires a DockerManager to a fake daemon whose container
+// "runs" a web app on 127.0.0.1, behind the same handler chain as main.
+type previewTestServer struct {
+	cfg     *Config
+	auth    *Authenticator
+	manager *DockerManager
+	handler http.Handler
+	appPort string
+
+	mu         sync.Mutex
+	appCookies []string
+}
+
+func newPreviewTestServer(t *testing.T, previewBaseURL string) *previewTestServer {
+	t.Helper()
+	s := &previewTestServer{cfg: testConfig()}
+	s.cfg.PreviewBaseURL = previewBaseURL
+	s.auth = newTestAuth(t, s.cfg)
+	m, docker := newTestManager(t, s.cfg, s.auth)
+	s.manager = m
+
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.appCookies = append(s.appCookies, r.Header.Get("Cookie"))
+		s.mu.Unlock()
+		_, _ = io.WriteString(w, "<html>preview</html>")
+	}))
+	t.Cleanup(app.Close)
+	_, s.appPort, _ = net.SplitHostPort(app.Listener.Addr().String())
+	docker.add(managedContainer("alice@example.com", "127.0.0.1"))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/docker/status", withCors(s.auth.require(m.handleStatus)))
+	mux.HandleFunc("/docker/previews", withCors(s.auth.require(m.handlePreviews)))
+	mux.HandleFunc("/preview/{container}/{port}", m.handlePreview)
+	mux.HandleFunc("/preview/{container}/{port}/{path...}", m.handlePreview)
+	s.handler = corsHandler(s.cfg, isolatePreviews(s.cfg, mux))
+	return s
+}
+
+func (s *previewTestServer) do(req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, req)
+	return rec
+}
+
+// previewLink asks for a preview link to the app as its owner.
+func (s *previewTestServer) previewLink(t *testing.T, ownerToken string) *url.URL {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, s.cfg.BackendBaseURL+"/docker/previews", strings.NewReader(`{"port": `+s.appPort+`}`))
+	req.Header.Set("Authorization", "Bearer "+ownerToken)
+	rec := s.do(req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("POST /docker/previews: %d %s", rec.Code, rec.Body)
+	}
+	var resp previewResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(resp.Url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func assertSandboxed(t *testing.T, rec *httptest.ResponseRecorder) {
+	t.Helper()
+	csp := rec.Header().Get("Content-Security-Policy")
+	if !strings.HasPrefix(csp, "sandbox") || strings.Contains(csp, "allow-same-origin") {
+		t.Errorf("Content-Security-Policy = %q, want a sandbox without allow-same-origin", csp)
+	}
+}
+
+func TestPreviewIgnoresAccessCookie(t *testing.T) {
+	s := newPreviewTestServer(t, "")
+	owner := loginToken(t, s.auth, "alice@example.com")
+
+	req := httptest.NewRequest(http.MethodGet, s.cfg.BackendBaseURL+previewBasePath(containerNameFor("alice@example.com"), 3000), nil)
+	req.AddCookie(&http.Cookie{Name: authCookieName, Value: owner})
+	rec := s.do(req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("preview with only the access cookie: got %d, want 401", rec.Code)
+	}
+	assertSandboxed(t, rec)
+
+	// The owner's bearer header still works.
+	req = httptest.NewRequest(http.MethodGet, s.cfg.BackendBaseURL+previewPathPrefix+containerNameFor("alice@example.com")+"/"+s.appPort+"/", nil)
+	req.Header.Set("Authorization", "Bearer "+owner)
+	if rec := s.do(req); rec.Code != http.StatusOK {
+		t.Fatalf("preview with the owner's bearer token: got %d %s", rec.Code, rec.Body)
+	}
+}
+
+// TestPreviewCannotUseViewerCredentials follows a shared link as another
+// logged-in user and checks that neither the app nor the page it serves can
+// act with that user's login.
+func TestPreviewCannotUseViewerCredentials(t *testing.T) {
+	s := newPreviewTestServer(t, "")
+	link := s.previewLink(t, loginToken(t, s.auth, "alice@example.com"))
+	viewer := &http.Cookie{Name: authCookieName, Value: loginToken(t, s.auth, "bob@example.com")}
+
+	req := httptest.NewRequest(http.MethodGet, link.String(), nil)
+	req.AddCookie(viewer)
+	rec := s.do(req)
+	if rec.Code != http.StatusFound {
+		t.Fatalf("opening the link: got %d %s", rec.Code, rec.Body)
+	}
+	var preview *http.Cookie
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == previewCookieName {
+			preview = c
+		}
+	}
+	if preview == nil {
+		t.Fatal("no preview cookie set")
+	}
+
+	req = httptest.NewRequest(http.MethodGet, s.cfg.BackendBaseURL+rec.Header().Get("Location"), nil)
+	req.AddCookie(viewer)
+	req.AddCookie(preview)
+	rec = s.do(req)
+	if rec.Code != http.StatusOK || rec.Body.String() != "<html>preview</html>" {
+		t.Fatalf("preview page: got %d %q", rec.Code, rec.Body)
+	}
+	assertSandboxed(t, rec)
+	s.mu.Lock()
+	for _, c := range s.appCookies {
+		if strings.Contains(c, authCookieName) || strings.Contains(c, previewCookieName) {
+			t.Errorf("app received our cookies: %q", c)
+		}
+	}
+	s.mu.Unlock()
+
+	// Requests from the sandboxed page carry an opaque origin. Browsers
+	// send the Lax cookie only on top-level navigations from it, and the
+	// API must not accept it for anything the page can read or trigger.
+	for _, tc := range []struct {
+		name    string
+		method  string
+		headers map[string]string
+	}{
+		{"fetch", http.MethodGet, map[string]string{"Origin": "null", "Sec-Fetch-Site": "cross-site"}},
+		{"no-cors", http.MethodGet, map[string]string{"Sec-Fetch-Site": "cross-site"}},
+		{"post", http.MethodPost, map[string]string{"Origin": "null", "Sec-Fetch-Site": "cross-site"}},
+		{"websocket", http.MethodGet, map[string]string{"Origin": "null", "Connection": "Upgrade", "Upgrade": "websocket"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := "/docker/status"
+			if tc.method == http.MethodPost {
+				path = "/docker/previews"
+			}
+			req := httptest.NewRequest(tc.method, s.cfg.BackendBaseURL+path, strings.NewReader(`{"port": 1}`))
+			for k, v := range tc.headers {
+				req.Header.Set(k, v)
+			}
+			req.AddCookie(viewer)
+			if rec := s.do(req); rec.Code != http.StatusForbidden {
+				t.Errorf("got %d, want 403: %s", rec.Code, rec.Body)
+			}
+		})
+	}
+
+	// The app itself still uses the cookie.
+	req = httptest.NewRequest(http.MethodGet, s.cfg.BackendBaseURL+"/docker/status", nil)
+	req.Header.Set("Origin", s.cfg.AppBaseURL)
+	req.Header.Set("Sec-Fetch-Site", "same-site")
+	req.AddCookie(viewer)
+	if rec := s.do(req); rec.Code != http.StatusOK {
+		t.Fatalf("app request: got %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestPreviewBaseURLIsolatesPreviews(t *testing.T) {
+	s := newPreviewTestServer(t, "http://preview.test")
+	owner := loginToken(t, s.auth, "alice@example.com")
+
+	link := s.previewLink(t, owner)
+	if link.Host != "preview.test" {
+		t.Errorf("preview link %s is not on the preview host", link)
+	}
+
+	// The preview host serves nothing but previews, so the access cookie
+	// (scoped to the API host) can't be used there either.
+	req := httptest.NewRequest(http.MethodGet, "http://preview.test/docker/status", nil)
+	req.Header.Set("Authorization", "Bearer "+owner)
+	if rec := s.do(req); rec.Code != http.StatusNotFound {
+		t.Errorf("API on the preview host: got %d, want 404", rec.Code)
+	}
+
+	path := previewBasePath(containerNameFor("alice@example.com"), 3000)
+	req = httptest.NewRequest(http.MethodGet, s.cfg.BackendBaseURL+path+"?a=1", nil)
+	rec := s.do(req)
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "http://preview.test"+path+"?a=1" {
+		t.Errorf("preview on the API host: got %d to %q", rec.Code, rec.Header().Get("Location"))
+	}
+}
+
+func TestPreviewRevocationSurvivesRestart(t *testing.T) {
+	s := newPreviewTestServer(t, "")
+	owner := loginToken(t, s.auth, "alice@example.com")
+	info := managedContainer("alice@example.com", "127.0.0.1")
+	port, _ := strconv.Atoi(s.appPort)
+	ctx := context.Background()
+
+	m := &DockerManager{cfg: s.cfg, auth: s.auth, previews: newPreviewEpochStore(nil)}
+	token := s.previewLink(t, owner).Query().Get(previewQueryParam)
+	if err := s.manager.checkPreviewToken(ctx, token, info, port); err != nil {
+		t.Fatalf("fresh link: %v", err)
+	}
+	// Another process (or this one after a restart) has never seen a
+	// revocation, but must not accept links from before it either.
+	if err := m.checkPreviewToken(ctx, token, info, port); err == nil {
+		t.Error("link accepted after a restart without a database")
+	}
+
+	req := httptest.NewRequest(http.MethodDelete, s.cfg.BackendBaseURL+"/docker/previews", nil)
+	req.Header.Set("Authorization", "Bearer "+owner)
+	if rec := s.do(req); rec.Code != http.StatusOK {
+		t.Fatalf("DELETE /docker/previews: %d %s", rec.Code, rec.Body)
+	}
+	if err := s.manager.checkPreviewToken(ctx, token, info, port); err == nil {
+		t.Error("revoked link still accepted")
+	}
+	if err := s.manager.checkPreviewToken(ctx, s.previewLink(t, owner).Query().Get(previewQueryParam), info, port); err != nil {
+		t.Errorf("link issued after revoking: %v", err)
+	}
+}
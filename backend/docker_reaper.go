@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+const defaultReapInterval = time.Minute
+
+// activityTracker remembers when each owner last used their container, and
+// what is still running there on their behalf.
+type activityTracker struct {
+	mu   sync.Mutex
+	last map[string]time.Time
+	busy map[string]int
+}
+
+func newActivityTracker() *activityTracker {
+	return &activityTracker{last: make(map[string]time.Time), busy: make(map[string]int)}
+}
+
+func (a *activityTracker) touch(owner string) {
+	a.mu.Lock()
+	a.last[owner] = time.Now()
+	a.mu.Unlock()
+}
+
+// begin marks work in flight for owner: an exec, an agent run, an MCP tool
+// call or a proxied preview request. The owner counts as active until the
+// returned done is called.
+func (a *activityTracker) begin(owner string) (done func()) {
+	a.mu.Lock()
+	a.busy[owner]++
+	a.last[owner] = time.Now()
+	a.mu.Unlock()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			if a.busy[owner]--; a.busy[owner] <= 0 {
+				delete(a.busy, owner)
+			}
+			a.last[owner] = time.Now()
+		})
+	}
+}
+
+// lastFor is the owner's last activity, or now while work is in flight.
+func (a *activityTracker) lastFor(owner string) time.Time {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.busy[owner] > 0 {
+		return time.Now()
+	}
+	return a.last[owner]
+}
+
+// reaperStatus is the reaper policy and what it will do next to the caller's
+// container, as reported by /docker/status.
+type reaperStatus struct {
+	IdleStopAfterSeconds   int64      `json:"idleStopAfterSeconds"`
+	RemoveStoppedAfterDays int        `json:"removeStoppedAfterDays"`
+	LastActivityAt         *time.Time `json:"lastActivityAt,omitempty"`
+	// NextReapAt is the earliest time the container will be stopped (if
+	// running) or removed (if stopped) when nothing else happens first.
+	NextReapAt     *time.Time `json:"nextReapAt,omitempty"`
+	NextReapAction string     `json:"nextReapAction,omitempty"`
+	NextSweepAt    *time.Time `json:"nextSweepAt,omitempty"`
+}
+
+func (m *DockerManager) reaperEnabled() bool {
+	return m.cfg.IdleStopAfter > 0 || m.cfg.RemoveStoppedAfterDays > 0
+}
+
+func (m *DockerManager) removeStoppedAfter() time.Duration {
+	return time.Duration(m.cfg.RemoveStoppedAfterDays) * 24 * time.Hour
+}
+
+// startReaper runs the idle reaper in the background if a policy is set.
+func (m *DockerManager) startReaper() {
+	if !m.reaperEnabled() {
+		return
+	}
+	log.Printf("[reaper] stopping containers idle for %s, removing containers stopped for %d day(s), every %s",
+		m.cfg.IdleStopAfter, m.cfg.RemoveStoppedAfterDays, m.cfg.ReapInterval)
+	go func() {
+		ticker := time.NewTicker(m.cfg.ReapInterval)
+		defer ticker.Stop()
+		for {
+			m.setNextSweep(time.Now().Add(m.cfg.ReapInterval))
+			<-ticker.C
+			m.reap(context.Background())
+		}
+	}()
+}
+
+func (m *DockerManager) setNextSweep(t time.Time) {
+	m.reaperMu.Lock()
+	m.nextSweep = t
+	m.reaperMu.Unlock()
+}
+
+// lastActiveAt is the later of the owner's last activity (shell I/O, file
+// requests, execs, agent runs, MCP calls, previews) and the container's
+// start, so a fresh (or just restarted) container gets a full idle period.
+func (m *DockerManager) lastActiveAt(owner string, info *dockerContainerInfo) time.Time {
+	last := m.activity.lastFor(owner)
+	if info.State.StartedAt.After(last) {
+		last = info.State.StartedAt
+	}
+	return last
+}
+
+// reapDeadline returns when and how a container will be reaped, or a zero
+// time if no policy applies to it.
+func (m *DockerManager) reapDeadline(owner string, info *dockerContainerInfo) (time.Time, string) {
+	if info.State.Running {
+		if m.cfg.IdleStopAfter <= 0 {
+			return time.Time{}, ""
+		}
+		return m.lastActiveAt(owner, info).Add(m.cfg.IdleStopAfter), "stop"
+	}
+	if m.cfg.RemoveStoppedAfterDays <= 0 {
+		return time.Time{}, ""
+	}
+	stoppedAt := info.State.FinishedAt
+	if stoppedAt.IsZero() {
+		// Created but never started.
+		stoppedAt, _ = time.Parse(time.RFC3339Nano, info.Created)
+	}
+	return stoppedAt.Add(m.removeStoppedAfter()), "remove"
+}
+
+// reap does one sweep over all managed containers. Home volumes are kept.
+func (m *DockerManager) reap(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, dockerCommandTimeout)
+	defer cancel()
+
+	containers, err := m.docker.containerList(ctx, true, map[string][]string{
+		"label": {labelManaged + "=true"},
+	})
+	if err != nil {
+		log.Printf("[reaper] listing containers failed: %v", err)
+		return
+	}
+	now := time.Now()
+	for _, c := range containers {
+		owner := c.Labels[labelOwner]
+		info, err := m.docker.containerInspect(ctx, c.Id)
+		if err != nil {
+			if !isDockerNotFound(err) {
+				log.Printf("[reaper] inspecting %s failed: %v", c.Id, err)
+			}
+			continue
+		}
+		deadline, action := m.reapDeadline(owner, info)
+		if deadline.IsZero() || now.Before(deadline) {
+			continue
+		}
+		switch action {
+		case "stop":
+			log.Printf("[reaper] stopping %s (%s): idle since %s", info.Name, owner, m.lastActiveAt(owner, info).Format(time.RFC3339))
+			err = m.docker.containerStop(ctx, c.Id)
+		case "remove":
+			log.Printf("[reaper] removing %s (%s): stopped since %s", info.Name, owner, info.State.FinishedAt.Format(time.RFC3339))
+			err = m.docker.containerRemove(ctx, c.Id, false)
+		}
+		if err != nil && !isDockerNotFound(err) {
+			log.Printf("[reaper] %s %s failed: %v", action, c.Id, err)
+		}
+	}
+}
+
+// reaperStatusFor describes the reaper policy for the owner's container.
+func (m *DockerManager) reaperStatusFor(ctx context.Context, owner, containerID string) *reaperStatus {
+	if !m.reaperEnabled() {
+		return nil
+	}
+	rs := &reaperStatus{
+		IdleStopAfterSeconds:   int64(m.cfg.IdleStopAfter / time.Second),
+		RemoveStoppedAfterDays: m.cfg.RemoveStoppedAfterDays,
+	}
+	m.reaperMu.Lock()
+	if !m.nextSweep.IsZero() {
+		next := m.nextSweep
+		rs.NextSweepAt = &next
+	}
+	m.reaperMu.Unlock()
+	if containerID == "" {
+		return rs
+	}
+	info, err := m.docker.containerInspect(ctx, containerID)
+	if err != nil {
+		return rs
+	}
+	if info.State.Running {
+		last := m.lastActiveAt(owner, info)
+		rs.LastActivityAt = &last
+	}
+	if deadline, action := m.reapDeadline(owner, info); !deadline.IsZero() {
+		rs.NextReapAt = &deadline
+		rs.NextReapAction = action
+	}
+	return rs
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReapStopsIdleContainers(t *testing.T) {
+	cfg := testConfig()
+	cfg.IdleStopAfter = 10 * time.Minute
+	m, docker := newTestManager(t, cfg, newTestAuth(t, cfg))
+	docker.add(managedContainer("idle@example.com", "127.0.0.1"))
+	docker.add(managedContainer("busy@example.com", "127.0.0.1"))
+	m.activity.touch("busy@example.com")
+
+	m.reap(context.Background())
+	if docker.running(containerNameFor("idle@example.com")) {
+		t.Error("idle container was not stopped")
+	}
+	if !docker.running(containerNameFor("busy@example.com")) {
+		t.Error("recently used container was stopped")
+	}
+}
+
+// TestReapSkipsInFlightWork runs a sweep while a long request is still
+// being proxied to the container, long after its last other activity.
+func TestReapSkipsInFlightWork(t *testing.T) {
+	cfg := testConfig()
+	cfg.IdleStopAfter = 10 * time.Minute
+	auth := newTestAuth(t, cfg)
+	m, docker := newTestManager(t, cfg, auth)
+	owner := "alice@example.com"
+	docker.add(managedContainer(owner, "127.0.0.1"))
+
+	started, release := make(chan struct{}), make(chan struct{})
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		_, _ = io.WriteString(w, "done")
+	}))
+	defer app.Close()
+	_, port, _ := net.SplitHostPort(app.Listener.Addr().String())
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/preview/{container}/{port}/{path...}", m.handlePreview)
+	req := httptest.NewRequest(http.MethodGet, previewPathPrefix+containerNameFor(owner)+"/"+port+"/slow", nil)
+	req.Header.Set("Authorization", "Bearer "+loginToken(t, auth, owner))
+	served := make(chan int)
+	go func() {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		served <- rec.Code
+	}()
+	<-started
+
+	// Pretend the request began long ago.
+	m.activity.mu.Lock()
+	m.activity.last[owner] = time.Now().Add(-time.Hour)
+	m.activity.mu.Unlock()
+
+	m.reap(context.Background())
+	if !docker.running(containerNameFor(owner)) {
+		t.Fatal("container stopped while a request was in flight")
+	}
+	close(release)
+	if code := <-served; code != http.StatusOK {
+		t.Fatalf("preview request: got %d", code)
+	}
+
+	// Finishing counts as activity too.
+	m.reap(context.Background())
+	if !docker.running(containerNameFor(owner)) {
+		t.Fatal("container stopped right after a request finished")
+	}
+	m.activity.mu.Lock()
+	m.activity.last[owner] = time.Now().Add(-time.Hour)
+	m.activity.mu.Unlock()
+	m.reap(context.Background())
+	if docker.running(containerNameFor(owner)) {
+		t.Error("idle container was not stopped once the request finished")
+	}
+}
+
+func TestActivityBeginNests(t *testing.T) {
+	a := newActivityTracker()
+	doneExec := a.begin("alice")
+	doneRun := a.begin("alice")
+	doneExec()
+	doneExec() // idempotent
+	a.mu.Lock()
+	a.last["alice"] = time.Now().Add(-time.Hour)
+	a.mu.Unlock()
+	if time.Since(a.lastFor("alice")) > time.Second {
+		t.Error("owner idle while an agent run is still in flight")
+	}
+	doneRun()
+	a.mu.Lock()
+	a.last["alice"] = time.Now().Add(-time.Hour)
+	a.mu.Unlock()
+	if time.Since(a.lastFor("alice")) < time.Minute {
+		t.Error("owner still busy after all work finished")
+	}
+}
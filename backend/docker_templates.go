@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+)
+
+const (
+	defaultTemplateName = "default"
+	templateImagePrefix = "agent-thing-env"
+
+	// labelTemplate records which environment template a container runs.
+	labelTemplate = "agent-thing.template"
+)
+
+var (
+	templateNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]{0,62}$`)
+
+	errUnknownTemplate  = errors.New("unknown template")
+	errTemplateMismatch = errors.New("container uses a different template; rebuild to switch")
+)
+
+// envTemplate is a selectable container environment: either a Dockerfile
+// built on demand or a prebuilt image that is pulled.
+type envTemplate struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	// Image is a prebuilt image reference; when set, Dockerfile and Context
+	// are ignored.
+	Image string `json:"image,omitempty"`
+	// Dockerfile is relative to Context, which is relative to the repo root
+	// unless absolute. Defaults: "Dockerfile" in the repo root.
+	Dockerfile string `json:"dockerfile,omitempty"`
+	Context    string `json:"context,omitempty"`
+}
+
+// templates returns the catalog: the built-in "default" (the repo's own
+// Dockerfile) plus every [template:<name>] section, which may override it.
+func (m *DockerManager) templates() []envTemplate {
+	byName := map[string]envTemplate{
+		defaultTemplateName: {Name: defaultTemplateName, Description: "Repository Dockerfile"},
+	}
+	for name, t := range m.cfg.Templates {
+		t.Name = name
+		byName[name] = t
+	}
+	out := make([]envTemplate, 0, len(byName))
+	for _, t := range byName {
+		out = append(out, t)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// template resolves a template by name; "" selects DOCKER_DEFAULT_TEMPLATE.
+func (m *DockerManager) template(name string) (envTemplate, error) {
+	if name == "" {
+		name = m.cfg.DefaultTemplate
+	}
+	for _, t := range m.templates() {
+		if t.Name == name {
+			return t, nil
+		}
+	}
+	return envTemplate{}, fmt.Errorf("%w %q", errUnknownTemplate, name)
+}
+
+// imageFor is the image a template's containers run.
+func (m *DockerManager) imageFor(t envTemplate) string {
+	switch {
+	case t.Image != "":
+		return t.Image
+	case t.Name == defaultTemplateName:
+		return m.imageName
+	default:
+		return templateImagePrefix + "-" + t.Name
+	}
+}
+
+// ensureImage builds a Dockerfile template, or pulls a prebuilt one if it's
+// missing locally (or always, with refresh).
+func (m *DockerManager) ensureImage(ctx context.Context, t envTemplate, refresh bool, out io.Writer) error {
+	if t.Image != "" {
+		if !refresh {
+			exists, err := m.docker.imageExists(ctx, t.Image)
+			if err != nil {
+				return err
+			}
+			if exists {
+				return nil
+			}
+		}
+		logStep(out, "pulling image %s", t.Image)
+		return m.docker.imagePull(ctx, t.Image, out)
+	}
+
+	projectRootDir, err := findProjectRootDir()
+	if err != nil {
+		return err
+	}
+	contextDir := projectRootDir
+	if t.Context != "" {
+		contextDir = t.Context
+		if !filepath.IsAbs(contextDir) {
+			contextDir = filepath.Join(projectRootDir, contextDir)
+		}
+	}
+	dockerfile := firstNonEmpty(t.Dockerfile, "Dockerfile")
+	if _, statErr := os.Stat(filepath.Join(contextDir, dockerfile)); statErr != nil {
+		return fmt.Errorf("Dockerfile not found at %s; cannot build template %q", filepath.Join(contextDir, dockerfile), t.Name)
+	}
+
+	logStep(out, "building image %s", m.imageFor(t))
+	buildContext := tarBuildContext(contextDir, dockerfile)
+	defer buildContext.Close()
+	return m.docker.imageBuild(ctx, buildContext, dockerBuildOptions{
+		Dockerfile: filepath.ToSlash(dockerfile),
+		Tag:        m.imageFor(t),
+	}, out)
+}
+
+// dockerLifecycleRequest is the optional JSON body of /docker/start and
+// /docker/rebuild.
+type dockerLifecycleRequest struct {
+	Template string `json:"template"`
+	// Workspace is a directory under /home/developer whose devcontainer.json
+	// defines the container (rebuild only).
+	Workspace string `json:"workspace"`
+}
+
+// readLifecycleRequest decodes an optional body and validates it.
+func (m *DockerManager) readLifecycleRequest(r *http.Request) (dockerLifecycleRequest, error) {
+	var req dockerLifecycleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		return req, errors.New("invalid request body")
+	}
+	if req.Template != "" {
+		if !templateNamePattern.MatchString(req.Template) {
+			return req, fmt.Errorf("%w %q", errUnknownTemplate, req.Template)
+		}
+		if _, err := m.template(req.Template); err != nil {
+			return req, err
+		}
+	}
+	if req.Workspace != "" {
+		if req.Template != "" {
+			return req, errors.New("choose either a template or a workspace")
+		}
+		ws, err := validWorkspace(req.Workspace)
+		if err != nil {
+			return req, err
+		}
+		req.Workspace = ws
+	}
+	return req, nil
+}
+
+// GET /docker/templates
+// Lists the environment templates a container can be started from.
+func (m *DockerManager) handleListTemplates(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJson(w, http.StatusMethodNotAllowed, dockerActionResponse{Ok: false, Message: "method not allowed"})
+		return
+	}
+	writeJson(w, http.StatusOK, map[string]any{
+		"templates": m.templates(),
+		"default":   m.cfg.DefaultTemplate,
+	})
+}
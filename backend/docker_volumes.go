@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+const (
+	homeVolumePrefix = "agent-thing-home"
+	homeDir          = "/home/developer"
+
+	// labelVolume marks what a managed volume is used for.
+	labelVolume = "agent-thing.volume"
+)
+
+type dockerVolumeResponse struct {
+	Name      string `json:"name"`
+	Kind      string `json:"kind"`
+	MountPath string `json:"mountPath,omitempty"`
+	CreatedAt string `json:"createdAt,omitempty"`
+}
+
+// homeVolumeFor returns the name of the owner's home directory volume.
+func homeVolumeFor(owner string) string {
+	return homeVolumePrefix + "-" + ownerKey(owner)
+}
+
+// ensureHomeVolume creates the owner's home volume if it doesn't exist yet.
+// The first container to mount it copies the image's /home/developer into it.
+func (m *DockerManager) ensureHomeVolume(ctx context.Context, owner string) (string, error) {
+	name := homeVolumeFor(owner)
+	_, err := m.docker.volumeCreate(ctx, name, map[string]string{
+		labelManaged: "true",
+		labelOwner:   owner,
+		labelVolume:  "home",
+	})
+	return name, err
+}
+
+// ownedVolume looks up a volume by name and checks it belongs to owner.
+// Other users' volumes are reported as not found.
+func (m *DockerManager) ownedVolume(ctx context.Context, owner, name string) (*dockerVolume, bool, error) {
+	if !strings.HasPrefix(name, homeVolumePrefix+"-") && !strings.HasPrefix(name, devcontainerVolumePrefix+"-") {
+		return nil, false, nil
+	}
+	vol, err := m.docker.volumeInspect(ctx, name)
+	if isDockerNotFound(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if vol.Labels[labelOwner] != owner {
+		return nil, false, nil
+	}
+	return vol, true, nil
+}
+
+// removeContainerFor force-removes the owner's container, if any, so its
+// volumes can be removed. It returns the container's status beforehand.
+func (m *DockerManager) removeContainerFor(ctx context.Context, owner string) (dockerStatusResponse, error) {
+	status, err := m.getStatus(ctx, owner)
+	if err != nil {
+		return status, err
+	}
+	if status.ContainerId == "" {
+		return status, nil
+	}
+	if err := m.docker.containerRemove(ctx, status.ContainerId, true); err != nil && !isDockerNotFound(err) {
+		return status, err
+	}
+	return status, nil
+}
+
+// resetVolume replaces a volume with an empty one (the home volume is then
+// seeded again from the image). The container is recreated from the same
+// template, and restarted if it was running; a devcontainer-based one falls
+// back to the default template since its workspace may be gone.
+func (m *DockerManager) resetVolume(ctx context.Context, owner string, vol *dockerVolume) error {
+	ctx, cancel := context.WithTimeout(ctx, dockerCommandTimeout)
+	defer cancel()
+
+	previous, err := m.removeContainerFor(ctx, owner)
+	if err != nil {
+		return err
+	}
+	if err := m.docker.volumeRemove(ctx, vol.Name); err != nil && !isDockerNotFound(err) {
+		return err
+	}
+	if _, err := m.docker.volumeCreate(ctx, vol.Name, vol.Labels); err != nil {
+		return err
+	}
+	if previous.Status == "not_found" {
+		return nil
+	}
+	tmpl, err := m.template(previous.Template)
+	if err != nil {
+		if tmpl, err = m.template(""); err != nil {
+			return err
+		}
+	}
+	if previous.Status == "running" {
+		return m.startContainer(ctx, owner, tmpl.Name)
+	}
+	if err := m.ensureImage(ctx, tmpl, false, nil); err != nil {
+		return err
+	}
+	_, err = m.prepareContainer(ctx, owner, m.templateContainerConfig(tmpl))
+	return err
+}
+
+// deleteVolume removes the owner's container and the volume. The next start
+// creates both again from scratch.
+func (m *DockerManager) deleteVolume(ctx context.Context, owner, name string) error {
+	ctx, cancel := context.WithTimeout(ctx, dockerCommandTimeout)
+	defer cancel()
+
+	if _, err := m.removeContainerFor(ctx, owner); err != nil {
+		return err
+	}
+	if err := m.docker.volumeRemove(ctx, name); err != nil && !isDockerNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// GET /docker/volumes
+// Lists the caller's persistent volumes.
+func (m *DockerManager) handleListVolumes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJson(w, http.StatusMethodNotAllowed, dockerActionResponse{Ok: false, Message: "method not allowed"})
+		return
+	}
+	owner, ok := m.requireOwner(w, r)
+	if !ok {
+		return
+	}
+
+	volumes, err := m.docker.volumeList(r.Context(), map[string][]string{
+		"label": {labelManaged + "=true", labelOwner + "=" + owner},
+	})
+	if err != nil {
+		writeJson(w, http.StatusInternalServerError, dockerActionResponse{Ok: false, Message: err.Error()})
+		return
+	}
+	out := []dockerVolumeResponse{}
+	for _, v := range volumes {
+		entry := dockerVolumeResponse{Name: v.Name, Kind: v.Labels[labelVolume], CreatedAt: v.CreatedAt}
+		if entry.Kind == "home" {
+			entry.MountPath = homeDir
+		}
+		out = append(out, entry)
+	}
+	writeJson(w, http.StatusOK, map[string]any{"volumes": out})
+}
+
+// POST /docker/volumes/{name}/reset
+// DELETE /docker/volumes/{name}
+func (m *DockerManager) handleVolume(w http.ResponseWriter, r *http.Request) {
+	reset := strings.HasSuffix(r.URL.Path, "/reset")
+	if (reset && r.Method != http.MethodPost) || (!reset && r.Method != http.MethodDelete) {
+		writeJson(w, http.StatusMethodNotAllowed, dockerActionResponse{Ok: false, Message: "method not allowed"})
+		return
+	}
+	owner, ok := m.requireOwner(w, r)
+	if !ok {
+		return
+	}
+
+	name := r.PathValue("name")
+	vol, found, err := m.ownedVolume(r.Context(), owner, name)
+	if err != nil {
+		writeJson(w, http.StatusInternalServerError, dockerActionResponse{Ok: false, Message: err.Error()})
+		return
+	}
+	if !found {
+		writeJson(w, http.StatusNotFound, dockerActionResponse{Ok: false, Message: "volume not found"})
+		return
+	}
+
+	if reset {
+		if err := m.resetVolume(r.Context(), owner, vol); err != nil {
+			writeJson(w, dockerErrorStatus(err), dockerActionResponse{Ok: false, Message: err.Error()})
+			return
+		}
+		writeJson(w, http.StatusOK, dockerActionResponse{Ok: true, Message: "volume reset"})
+		return
+	}
+	if err := m.deleteVolume(r.Context(), owner, name); err != nil {
+		writeJson(w, http.StatusInternalServerError, dockerActionResponse{Ok: false, Message: err.Error()})
+		return
+	}
+	writeJson(w, http.StatusOK, dockerActionResponse{Ok: true, Message: "volume deleted"})
+}
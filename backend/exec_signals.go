@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// execMarkerEnv tags every process we start in a container, so we can find
+// them again from inside the container: Docker has no API to signal an exec.
+const execMarkerEnv = "AGENT_THING_EXEC"
+
+// Signals clients may send, by name, to the foreground process group.
+var execSignals = map[string]int{
+	"SIGHUP":  1,
+	"SIGINT":  2,
+	"SIGQUIT": 3,
+	"SIGKILL": 9,
+	"SIGTERM": 15,
+	"SIGTSTP": 20,
+}
+
+// signalGroupScript finds a process carrying marker $1 and sends signal $2 to
+// the foreground process group of its terminal (field 8, tpgid, of
+// /proc/<pid>/stat), or to its own process group when it has no terminal.
+// The comm field may contain spaces, so everything up to the last ") " is
+// dropped first; tpgid is then the 6th field and pgrp the 3rd.
+const signalGroupScript = `
+for p in /proc/[0-9]*; do
+  tr '\0' '\n' < "$p/environ" 2>/dev/null | grep -Fqx "$1" || continue
+  stat=$(sed 's/.*) //' "$p/stat" 2>/dev/null) || continue
+  tpgid=$(echo "$stat" | cut -d' ' -f6)
+  [ "$tpgid" -gt 0 ] 2>/dev/null || tpgid=$(echo "$stat" | cut -d' ' -f3)
+  exec kill -"$2" -- "-$tpgid"
+done
+echo "no process found" >&2
+exit 1
+`
+
+// signalMarked delivers a signal to the process group of the exec tagged with
+// marker (an execMarkerEnv=... entry).
+func (c *dockerClient) signalMarked(ctx context.Context, containerID, marker, signal string) error {
+	num, ok := execSignals[signal]
+	if !ok {
+		return fmt.Errorf("unsupported signal %q", signal)
+	}
+	code, err := c.execRunDetached(ctx, containerID, []string{"/bin/sh", "-c", signalGroupScript, "signal", marker, fmt.Sprint(num)})
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		return fmt.Errorf("signal %s not delivered (exit %d)", signal, code)
+	}
+	return nil
+}
+
+// killMarkedScript sends signal $2 to every process whose environment holds
+// marker $1. Children inherit the marker, so this reaches the whole tree
+// without relying on process groups, which non-TTY execs may share.
+const killMarkedScript = `
+for p in /proc/[0-9]*; do
+  tr '\0' '\n' < "$p/environ" 2>/dev/null | grep -Fqx "$1" && kill -"$2" "${p#/proc/}" 2>/dev/null
+done
+exit 0
+`
+
+// killMarked sends SIGKILL to every process tagged with marker.
+func (c *dockerClient) killMarked(ctx context.Context, containerID, marker string) error {
+	_, err := c.execRunDetached(ctx, containerID, []string{"/bin/sh", "-c", killMarkedScript, "kill", marker, fmt.Sprint(execSignals["SIGKILL"])})
+	return err
+}
+
+// execRunDetached runs cmd without attaching and waits for its exit code.
+func (c *dockerClient) execRunDetached(ctx context.Context, containerID string, cmd []string) (int, error) {
+	execID, err := c.execCreate(ctx, containerID, dockerExecConfig{Cmd: cmd})
+	if err != nil {
+		return 0, err
+	}
+	if err := c.execStartDetached(ctx, execID); err != nil {
+		return 0, err
+	}
+	info, err := c.execWait(ctx, execID)
+	if err != nil {
+		return 0, err
+	}
+	return info.ExitCode, nil
+}
+
+// execWait polls until the exec has exited. Its output stream can close a
+// moment before the daemon records the exit code.
+func (c *dockerClient) execWait(ctx context.Context, execID string) (*dockerExecInfo, error) {
+	for {
+		info, err := c.execInspect(ctx, execID)
+		if err != nil {
+			return nil, err
+		}
+		if !info.Running {
+			return info, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, errors.New("timed out waiting for exec to exit")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+// exitStatusFromCode splits a shell-style exit code into code and, for
+// 128+n, the name of the signal that killed the process.
+func exitStatusFromCode(code int) terminalExitMsg {
+	status := terminalExitMsg{Code: &code}
+	if code > 128 {
+		for name, num := range execSignals {
+			if code == 128+num {
+				status.Signal = name
+			}
+		}
+	}
+	return status
+}
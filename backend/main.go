@@ -14,6 +14,9 @@ import (
 const defaultListenAddr = ":18711"
 
 var upgrader = websocket.Upgrader{
+	// Clients that authenticate via a "bearer.<token>" subprotocol also offer
+	// "agent-thing" so the server has a non-secret protocol to echo back.
+	Subprotocols: []string{"agent-thing"},
 	CheckOrigin: func(r *http.Request) bool {
 		// Allow all origins in dev.
 		return true
@@ -35,25 +38,79 @@ func main() {
 		return
 	}
 
-	_, dbErr := ConnectDB(cfg)
+	db, dbErr := ConnectDB(cfg)
 	if dbErr != nil {
 		log.Fatalf("failed to connect db: %v", dbErr)
 	}
+	if maybeRunMCPStdio(cfg, db) {
+		return
+	}
 
-	dockerManager := NewDockerManager()
-	googleAuth := NewGoogleAuthHandler(cfg)
+	auth, err := NewAuthenticator(cfg, newAuthSessionStore(db))
+	if err != nil {
+		log.Fatalf("failed to load jwt keys: %v", err)
+	}
+	dockerManager, err := NewDockerManager(cfg, auth, db)
+	if err != nil {
+		log.Fatalf("failed to init docker client: %v", err)
+	}
+	dockerManager.startReaper()
+	agentService, err := NewAgentService(cfg, dockerManager, db)
+	if err != nil {
+		log.Fatalf("failed to init agent: %v", err)
+	}
+	mcpServer := NewMCPServer(cfg, dockerManager)
+	users := newUserStore(db)
+	userHandler := NewUserHandler(users)
+	oauthHandler := NewOAuthHandler(cfg, users, auth)
 	stripeHandler := NewStripeHandler(cfg)
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/health", handleHealth)
 	mux.HandleFunc("/ws", handleWebSocketTimeStream)
-	mux.HandleFunc("/docker/status", withCors(dockerManager.handleStatus))
-	mux.HandleFunc("/docker/start", withCors(dockerManager.handleStart))
-	mux.HandleFunc("/docker/stop", withCors(dockerManager.handleStop))
-	mux.HandleFunc("/docker/rebuild", withCors(dockerManager.handleRebuild))
-	mux.HandleFunc("/docker/shell", handleDockerShellWS)
-	mux.HandleFunc("/auth/google/login", withCors(googleAuth.handleLogin))
-	mux.HandleFunc("/callback/oauth/google", withCors(googleAuth.handleCallback))
+	mux.HandleFunc("/docker/status", withCors(auth.require(dockerManager.handleStatus)))
+	mux.HandleFunc("/docker/start", withCors(auth.require(dockerManager.handleStart)))
+	mux.HandleFunc("/docker/stop", withCors(auth.require(dockerManager.handleStop)))
+	mux.HandleFunc("/docker/rebuild", withCors(auth.require(dockerManager.handleRebuild)))
+	mux.HandleFunc("/docker/templates", withCors(auth.require(dockerManager.handleListTemplates)))
+	mux.HandleFunc("/docker/jobs", withCors(auth.require(dockerManager.handleListJobs)))
+	mux.HandleFunc("/docker/jobs/{id}", withCors(auth.require(dockerManager.handleJob)))
+	mux.HandleFunc("/docker/jobs/{id}/events", withCors(auth.require(dockerManager.handleJobEvents)))
+	mux.HandleFunc("/docker/jobs/{id}/cancel", withCors(auth.require(dockerManager.handleCancelJob)))
+	mux.HandleFunc("/docker/volumes", withCors(auth.require(dockerManager.handleListVolumes)))
+	mux.HandleFunc("/docker/volumes/{name}", withCors(auth.require(dockerManager.handleVolume)))
+	mux.HandleFunc("/docker/volumes/{name}/reset", withCors(auth.require(dockerManager.handleVolume)))
+	mux.HandleFunc("/docker/exec", withCors(auth.require(dockerManager.handleExec)))
+	mux.HandleFunc("/docker/exec/stream", withCors(auth.require(dockerManager.handleExecStream)))
+	mux.HandleFunc("/docker/files", withCors(auth.require(dockerManager.handleFiles)))
+	mux.HandleFunc("/docker/files/stat", withCors(auth.require(dockerManager.handleFileStat)))
+	mux.HandleFunc("/docker/files/content", withCors(auth.require(dockerManager.handleFileContent)))
+	mux.HandleFunc("/docker/files/rename", withCors(auth.require(dockerManager.handleFileRename)))
+	mux.HandleFunc("/docker/files/archive", withCors(auth.require(dockerManager.handleFileArchive)))
+	mux.HandleFunc("/docker/previews", withCors(auth.require(dockerManager.handlePreviews)))
+	mux.HandleFunc("/preview/{container}/{port}", dockerManager.handlePreview)
+	mux.HandleFunc("/preview/{container}/{port}/{path...}", dockerManager.handlePreview)
+	mux.HandleFunc("/docker/shell", auth.require(dockerManager.handleShellWS))
+	mux.HandleFunc("/docker/terminal", auth.require(dockerManager.handleTerminalWS))
+	mux.HandleFunc("/sessions", withCors(auth.require(dockerManager.handleListSessions)))
+	mux.HandleFunc("/sessions/{id}/recording", withCors(auth.require(dockerManager.handleSessionRecording)))
+	mux.HandleFunc("/sessions/{id}/share", withCors(auth.require(dockerManager.handleSessionShare)))
+	mux.HandleFunc("/agent/runs", withCors(auth.require(agentService.handleRuns)))
+	mux.HandleFunc("/agent/runs/{id}", withCors(auth.require(agentService.handleRun)))
+	mux.HandleFunc("/agent/runs/{id}/cancel", withCors(auth.require(agentService.handleCancelRun)))
+	mux.HandleFunc("/agent/runs/{id}/ws", auth.require(agentService.handleWatchRun))
+	mux.HandleFunc("/agent/runs/{id}/approvals/{approval}", withCors(auth.require(agentService.handleAnswerApproval)))
+	mux.HandleFunc("/agent/approvals", withCors(auth.require(agentService.handleListApprovals)))
+	mux.HandleFunc("/agent/audit", withCors(auth.require(agentService.handleAudit)))
+	mux.HandleFunc("/mcp", withCors(auth.require(mcpServer.handleHTTP)))
+	mux.HandleFunc("/me", withCors(auth.require(userHandler.handleMe)))
+	mux.HandleFunc("/.well-known/jwks.json", withCors(auth.handleJWKS))
+	mux.HandleFunc("/auth/token", withCors(auth.handleExchangeCode))
+	mux.HandleFunc("/auth/refresh", withCors(auth.handleRefresh))
+	mux.HandleFunc("/auth/logout", withCors(auth.handleLogout))
+	mux.HandleFunc("/auth/providers", withCors(oauthHandler.handleListProviders))
+	mux.HandleFunc("/auth/{provider}/login", withCors(oauthHandler.handleLogin))
+	mux.HandleFunc("/callback/oauth/{provider}", withCors(oauthHandler.handleCallback))
 	mux.HandleFunc("/billing/create-checkout-session", withCors(stripeHandler.handleCreateCheckoutSession))
 	// Stripe webhooks (canonical path in prod):
 	mux.HandleFunc("/webhook/stripe", withCors(stripeHandler.handleWebhook))
@@ -61,7 +118,7 @@ func main() {
 	mux.HandleFunc("/billing/webhook", withCors(stripeHandler.handleWebhook))
 
 	log.Printf("Backend listening on %s", listenAddr)
-	if err := http.ListenAndServe(listenAddr, corsHandler(mux)); err != nil {
+	if err := http.ListenAndServe(listenAddr, corsHandler(cfg, isolatePreviews(cfg, mux))); err != nil {
 		log.Fatalf("server exited: %v", err)
 	}
 }
@@ -118,8 +175,8 @@ func withCors(next http.HandlerFunc) http.HandlerFunc {
 		if origin != "" {
 			w.Header().Set("Access-Control-Allow-Origin", origin)
 			w.Header().Set("Vary", "Origin")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-			w.Header().Set("Access-Control-Allow-Methods", "GET,POST,OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", corsAllowHeaders)
+			w.Header().Set("Access-Control-Allow-Methods", "GET,POST,PUT,DELETE,OPTIONS")
 		}
 		if r.Method == http.MethodOptions {
 			w.WriteHeader(http.StatusNoContent)
@@ -129,8 +186,20 @@ func withCors(next http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
-func corsHandler(next http.Handler) http.Handler {
+// corsAllowHeaders are the request headers browsers may send cross-origin.
+const corsAllowHeaders = "Content-Type, Authorization, " + csrfHeaderName
+
+// corsHandler answers CORS for every route. Only our own origins may send
+// cookies (credentials: "include"); cookie-authenticated requests are
+// further checked by Authenticator.require.
+func corsHandler(cfg *Config, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Previewed apps answer CORS (including preflights) themselves.
+		if strings.HasPrefix(r.URL.Path, previewPathPrefix) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
 		origin := r.Header.Get("Origin")
 		if origin == "" {
 			origin = "*"
@@ -139,8 +208,11 @@ func corsHandler(next http.Handler) http.Handler {
 		}
 
 		w.Header().Set("Access-Control-Allow-Origin", origin)
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-		w.Header().Set("Access-Control-Allow-Methods", "GET,POST,OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", corsAllowHeaders)
+		w.Header().Set("Access-Control-Allow-Methods", "GET,POST,PUT,DELETE,OPTIONS")
+		if isOwnOrigin(cfg, origin) {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
 
 		if r.Method == http.MethodOptions {
 			w.WriteHeader(http.StatusNoContent)
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	mcpServerName = "agent-thing"
+
+	// JSON-RPC error codes.
+	mcpParseError     = -32700
+	mcpInvalidRequest = -32600
+	mcpMethodNotFound = -32601
+	mcpInvalidParams  = -32602
+
+	// Bodies carry whole files for write_file.
+	maxMCPMessageBytes = maxFileWriteBytes + 1<<20
+	maxMCPReadBytes    = 4 << 20
+)
+
+// mcpProtocolVersions are the MCP revisions we speak, newest first.
+var mcpProtocolVersions = []string{"2025-03-26", "2024-11-05"}
+
+type mcpRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Id      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type mcpResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Id      json.RawMessage `json:"id"`
+	Result  any             `json:"result,omitempty"`
+	Error   *mcpError       `json:"error,omitempty"`
+}
+
+type mcpError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type mcpTool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	InputSchema json.RawMessage `json:"inputSchema"`
+}
+
+type mcpContent struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type mcpToolResult struct {
+	Content []mcpContent `json:"content"`
+	IsError bool         `json:"isError,omitempty"`
+}
+
+// mcpTools are the container operations offered to MCP clients.
+var mcpTools = []mcpTool{
+	{
+		Name:        "exec",
+		Description: "Run a command (no shell, no terminal) in the dev container. Returns JSON with exitCode, stdout and stderr.",
+		InputSchema: json.RawMessage(`{"type":"object","properties":{` +
+			`"argv":{"type":"array","items":{"type":"string"},"description":"Command and arguments, e.g. [\"sh\",\"-c\",\"make test\"]"},` +
+			`"env":{"type":"object","additionalProperties":{"type":"string"}},` +
+			`"workdir":{"type":"string","description":"Working directory; relative paths are under /home/developer"},` +
+			`"stdin":{"type":"string"},` +
+			`"timeoutSeconds":{"type":"integer","description":"Defaults to 60, at most 3600"}},` +
+			`"required":["argv"]}`),
+	},
+	{
+		Name:        "read_file",
+		Description: "Read a text file from the dev container (up to 4 MiB).",
+		InputSchema: json.RawMessage(`{"type":"object","properties":{` +
+			`"path":{"type":"string","description":"File path; relative paths are under /home/developer"}},` +
+			`"required":["path"]}`),
+	},
+	{
+		Name:        "write_file",
+		Description: "Create or overwrite a file in the dev container. The parent directory must exist.",
+		InputSchema: json.RawMessage(`{"type":"object","properties":{` +
+			`"path":{"type":"string","description":"File path; relative paths are under /home/developer"},` +
+			`"content":{"type":"string","description":"The complete new file content"}},` +
+			`"required":["path","content"]}`),
+	},
+	{
+		Name:        "list_dir",
+		Description: "List a directory in the dev container. Returns JSON entries with name, type, size and mode.",
+		InputSchema: json.RawMessage(`{"type":"object","properties":{` +
+			`"path":{"type":"string","description":"Directory path; defaults to /home/developer"}}}`),
+	},
+	{
+		Name:        "container_status",
+		Description: "Report the dev container's state, template, forwarded ports and limits without starting it.",
+		InputSchema: json.RawMessage(`{"type":"object","properties":{}}`),
+	},
+}
+
+// MCPServer exposes the caller's dev container over the Model Context
+// Protocol. It is stateless; the owner comes from the transport's auth.
+type MCPServer struct {
+	cfg    *Config
+	docker *DockerManager
+}
+
+func NewMCPServer(cfg *Config, docker *DockerManager) *MCPServer {
+	return &MCPServer{cfg: cfg, docker: docker}
+}
+
+// handleMessage answers one JSON-RPC message or batch. It returns nil when
+// nothing needs to be sent back (notifications and responses).
+func (s *MCPServer) handleMessage(ctx context.Context, owner string, raw []byte) []byte {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) > 0 && raw[0] == '[' {
+		var batch []json.RawMessage
+		if err := json.Unmarshal(raw, &batch); err != nil || len(batch) == 0 {
+			return mcpMarshal(mcpErrorResponse(nil, mcpInvalidRequest, "invalid batch"))
+		}
+		var out []*mcpResponse
+		for _, msg := range batch {
+			if resp := s.handleOne(ctx, owner, msg); resp != nil {
+				out = append(out, resp)
+			}
+		}
+		if len(out) == 0 {
+			return nil
+		}
+		return mcpMarshal(out)
+	}
+	if resp := s.handleOne(ctx, owner, raw); resp != nil {
+		return mcpMarshal(resp)
+	}
+	return nil
+}
+
+func (s *MCPServer) handleOne(ctx context.Context, owner string, raw json.RawMessage) *mcpResponse {
+	var req mcpRequest
+	if err := json.Unmarshal(raw, &req); err != nil {
+		return mcpErrorResponse(nil, mcpParseError, "parse error")
+	}
+	if req.JSONRPC != "2.0" {
+		return mcpErrorResponse(req.Id, mcpInvalidRequest, `jsonrpc must be "2.0"`)
+	}
+	if req.Method == "" {
+		// A response to something we sent; we never send requests.
+		return nil
+	}
+	if len(req.Id) == 0 {
+		// Notifications (initialized, cancelled, ...) need no answer.
+		return nil
+	}
+
+	result, rpcErr := s.call(ctx, owner, req)
+	if rpcErr != nil {
+		return &mcpResponse{JSONRPC: "2.0", Id: req.Id, Error: rpcErr}
+	}
+	return &mcpResponse{JSONRPC: "2.0", Id: req.Id, Result: result}
+}
+
+func (s *MCPServer) call(ctx context.Context, owner string, req mcpRequest) (any, *mcpError) {
+	switch req.Method {
+	case "initialize":
+		var params struct {
+			ProtocolVersion string `json:"protocolVersion"`
+		}
+		_ = json.Unmarshal(req.Params, &params)
+		version := mcpProtocolVersions[0]
+		for _, v := range mcpProtocolVersions {
+			if v == params.ProtocolVersion {
+				version = v
+			}
+		}
+		return map[string]any{
+			"protocolVersion": version,
+			"capabilities":    map[string]any{"tools": map[string]any{"listChanged": false}},
+			"serverInfo":      map[string]any{"name": mcpServerName, "version": "1.0.0"},
+			"instructions":    "Tools operate on the caller's dev container; it is started on demand. Relative paths are under /home/developer.",
+		}, nil
+	case "ping":
+		return struct{}{}, nil
+	case "tools/list":
+		return map[string]any{"tools": mcpTools}, nil
+	case "tools/call":
+		var params struct {
+			Name      string          `json:"name"`
+			Arguments json.RawMessage `json:"arguments"`
+		}
+		if err := json.Unmarshal(req.Params, &params); err != nil || params.Name == "" {
+			return nil, &mcpError{Code: mcpInvalidParams, Message: "params must name a tool"}
+		}
+		if len(params.Arguments) == 0 || string(params.Arguments) == "null" {
+			params.Arguments = json.RawMessage("{}")
+		}
+		result, known := s.callTool(ctx, owner, params.Name, params.Arguments)
+		if !known {
+			return nil, &mcpError{Code: mcpInvalidParams, Message: fmt.Sprintf("unknown tool %q", params.Name)}
+		}
+		return result, nil
+	}
+	return nil, &mcpError{Code: mcpMethodNotFound, Message: "method not found: " + req.Method}
+}
+
+// callTool runs a tool. Tool failures are results with isError set, so the
+// client's model sees them; known is false only for unknown tool names.
+func (s *MCPServer) callTool(ctx context.Context, owner, name string, rawArgs json.RawMessage) (result mcpToolResult, known bool) {
+	defer s.docker.activity.begin(owner)()
+	fail := func(err error) (mcpToolResult, bool) {
+		return mcpToolResult{Content: []mcpContent{{Type: "text", Text: err.Error()}}, IsError: true}, true
+	}
+	text := func(s string, isError bool) (mcpToolResult, bool) {
+		return mcpToolResult{Content: []mcpContent{{Type: "text", Text: s}}, IsError: isError}, true
+	}
+	var args struct {
+		Path    string `json:"path"`
+		Content string `json:"content"`
+	}
+
+	switch name {
+	case "container_status":
+		status, err := s.docker.getStatus(ctx, owner)
+		if err != nil {
+			return fail(err)
+		}
+		status.HomeVolume = homeVolumeFor(owner)
+		limits := s.docker.limitsFor(owner)
+		status.Limits = &limits
+		out, _ := json.MarshalIndent(status, "", "  ")
+		return text(string(out), false)
+
+	case "exec":
+		var req execRequest
+		if err := json.Unmarshal(rawArgs, &req); err != nil {
+			return fail(fmt.Errorf("invalid arguments: %w", err))
+		}
+		if err := req.validate(); err != nil {
+			return fail(err)
+		}
+		container, err := s.docker.activeContainerFor(ctx, owner)
+		if err != nil {
+			return fail(err)
+		}
+		stdout := &limitedBuffer{max: maxExecOutputBytes}
+		stderr := &limitedBuffer{max: maxExecOutputBytes}
+		res := s.docker.runExec(ctx, owner, container, req, stdout, stderr)
+		res.Stdout, res.StdoutTruncated = stdout.String(), stdout.truncated
+		res.Stderr, res.StderrTruncated = stderr.String(), stderr.truncated
+		out, _ := json.MarshalIndent(res, "", "  ")
+		return text(string(out), res.ExitCode == nil || *res.ExitCode != 0)
+
+	case "read_file", "write_file", "list_dir":
+		if err := json.Unmarshal(rawArgs, &args); err != nil {
+			return fail(fmt.Errorf("invalid arguments: %w", err))
+		}
+		p, err := resolveFilePath(args.Path)
+		if err != nil {
+			return fail(err)
+		}
+		container, err := s.docker.activeContainerFor(ctx, owner)
+		if err != nil {
+			return fail(err)
+		}
+		switch name {
+		case "read_file":
+			content, truncated, size, err := s.docker.readTextFile(ctx, container, p, maxMCPReadBytes)
+			if err != nil {
+				return fail(err)
+			}
+			if truncated {
+				content += fmt.Sprintf("\n[truncated: showing %d of %d bytes]", len(content), size)
+			}
+			return text(content, false)
+		case "write_file":
+			if err := s.docker.writeFile(ctx, container, p, strings.NewReader(args.Content)); err != nil {
+				return fail(err)
+			}
+			return text(fmt.Sprintf("wrote %d bytes to %s", len(args.Content), p), false)
+		default:
+			entries, err := s.docker.listDir(ctx, container, p)
+			if err != nil {
+				return fail(err)
+			}
+			out, _ := json.MarshalIndent(fileListResponse{Path: p, Entries: entries}, "", "  ")
+			return text(string(out), false)
+		}
+	}
+	return mcpToolResult{}, false
+}
+
+func mcpErrorResponse(id json.RawMessage, code int, message string) *mcpResponse {
+	if len(id) == 0 {
+		id = json.RawMessage("null")
+	}
+	return &mcpResponse{JSONRPC: "2.0", Id: id, Error: &mcpError{Code: code, Message: message}}
+}
+
+func mcpMarshal(v any) []byte {
+	out, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("[mcp] encoding response: %v", err)
+		return nil
+	}
+	return out
+}
+
+// POST /mcp
+//
+// The streamable HTTP transport, without sessions or server-initiated
+// streams: every POST is answered with plain JSON (or 202 when it held only
+// notifications), so GET and DELETE are 405 as the spec allows.
+func (s *MCPServer) handleHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJson(w, http.StatusMethodNotAllowed, dockerActionResponse{Ok: false, Message: "method not allowed"})
+		return
+	}
+	// Guard against DNS rebinding: browsers may only call us from our own app.
+	if origin := r.Header.Get("Origin"); origin != "" && !isOwnOrigin(s.cfg, origin) {
+		writeJson(w, http.StatusForbidden, dockerActionResponse{Ok: false, Message: "origin not allowed"})
+		return
+	}
+	owner, ok := s.docker.requireOwner(w, r)
+	if !ok {
+		return
+	}
+	raw, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxMCPMessageBytes))
+	if err != nil {
+		status := http.StatusBadRequest
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		writeJson(w, status, mcpErrorResponse(nil, mcpParseError, err.Error()))
+		return
+	}
+
+	out := s.handleMessage(r.Context(), owner, raw)
+	if out == nil {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(out)
+}
+
+// maybeRunMCPStdio serves MCP over stdin/stdout when started as
+// `go run ./backend mcp`. The caller authenticates with a backend token in
+// AGENT_THING_TOKEN and is served until that login session ends; logs go to
+// stderr.
+func maybeRunMCPStdio(cfg *Config, db *DB) bool {
+	if len(os.Args) < 2 || os.Args[1] != "mcp" {
+		return false
+	}
+	if db == nil {
+		log.Fatalf("mcp: the stdio transport needs DATABASE_URL to check login sessions")
+	}
+	auth, err := NewAuthenticator(cfg, newAuthSessionStore(db))
+	if err != nil {
+		log.Fatalf("mcp: failed to load jwt keys: %v", err)
+	}
+	user, err := auth.verify(context.Background(), strings.TrimSpace(os.Getenv("AGENT_THING_TOKEN")))
+	if err != nil {
+		log.Fatalf("mcp: AGENT_THING_TOKEN: %v", err)
+	}
+	docker, err := NewDockerManager(cfg, auth, db)
+	if err != nil {
+		log.Fatalf("failed to init docker client: %v", err)
+	}
+	log.Printf("[mcp] serving %s over stdio", user.Subject)
+	alive := func(ctx context.Context) error { return auth.checkSession(ctx, user.SessionId) }
+	if err := NewMCPServer(cfg, docker).serveStdio(context.Background(), user.Subject, alive, os.Stdin, os.Stdout); err != nil {
+		log.Fatalf("mcp: %v", err)
+	}
+	return true
+}
+
+// serveStdio reads newline-delimited JSON-RPC from in until EOF. Requests run
+// concurrently so a long exec doesn't block pings, and
+// notifications/cancelled stops the named request. alive is checked before
+// each message so a logout ends the process.
+func (s *MCPServer) serveStdio(ctx context.Context, owner string, alive func(context.Context) error, in io.Reader, out io.Writer) error {
+	var (
+		writeMu  sync.Mutex
+		mu       sync.Mutex
+		inFlight = make(map[string]context.CancelFunc)
+		wg       sync.WaitGroup
+	)
+	defer wg.Wait()
+
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), maxMCPMessageBytes)
+	for scanner.Scan() {
+		line := append([]byte(nil), scanner.Bytes()...)
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		if err := alive(ctx); err != nil {
+			return fmt.Errorf("AGENT_THING_TOKEN: %w", err)
+		}
+
+		var msg mcpRequest
+		if json.Unmarshal(line, &msg) == nil && msg.Method == "notifications/cancelled" {
+			var params struct {
+				RequestId json.RawMessage `json:"requestId"`
+			}
+			_ = json.Unmarshal(msg.Params, &params)
+			mu.Lock()
+			if cancel := inFlight[string(params.RequestId)]; cancel != nil {
+				cancel()
+			}
+			mu.Unlock()
+			continue
+		}
+
+		reqCtx, cancel := context.WithCancel(ctx)
+		key := string(msg.Id)
+		if key != "" {
+			mu.Lock()
+			inFlight[key] = cancel
+			mu.Unlock()
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer cancel()
+			resp := s.handleMessage(reqCtx, owner, line)
+			if key != "" {
+				mu.Lock()
+				delete(inFlight, key)
+				mu.Unlock()
+			}
+			if resp == nil || reqCtx.Err() != nil {
+				return
+			}
+			writeMu.Lock()
+			defer writeMu.Unlock()
+			if _, err := out.Write(append(resp, '\n')); err != nil {
+				log.Printf("[mcp] write: %v", err)
+			}
+		}()
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestMCP(t *testing.T) (*MCPServer, *Authenticator, *fakeDocker) {
+	t.Helper()
+	cfg := testConfig()
+	auth := newTestAuth(t, cfg)
+	m, docker := newTestManager(t, cfg, auth)
+	docker.add(managedContainer("alice@example.com", "127.0.0.1"))
+	return NewMCPServer(cfg, m), auth, docker
+}
+
+func TestMCPHandleMessage(t *testing.T) {
+	s, _, _ := newTestMCP(t)
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		name string
+		in   string
+		// want maps each response id to its error code, 0 for a result.
+		want map[string]int
+	}{
+		{"ping", `{"jsonrpc":"2.0","id":1,"method":"ping"}`, map[string]int{"1": 0}},
+		{"unknown method", `{"jsonrpc":"2.0","id":1,"method":"resources/list"}`, map[string]int{"1": mcpMethodNotFound}},
+		{"unknown tool", `{"jsonrpc":"2.0","id":1,"method":"tools/call","params":{"name":"rm_rf"}}`, map[string]int{"1": mcpInvalidParams}},
+		{"tool without a name", `{"jsonrpc":"2.0","id":1,"method":"tools/call","params":{}}`, map[string]int{"1": mcpInvalidParams}},
+		{"wrong jsonrpc version", `{"jsonrpc":"1.0","id":"a","method":"ping"}`, map[string]int{`"a"`: mcpInvalidRequest}},
+		{"parse error", `{"jsonrpc":`, map[string]int{"null": mcpParseError}},
+		{"empty batch", `[]`, map[string]int{"null": mcpInvalidRequest}},
+		{"notification", `{"jsonrpc":"2.0","method":"notifications/initialized"}`, nil},
+		{"response", `{"jsonrpc":"2.0","id":7,"result":{}}`, nil},
+		{
+			"batch",
+			`[{"jsonrpc":"2.0","id":1,"method":"ping"},
+			  {"jsonrpc":"2.0","method":"notifications/initialized"},
+			  {"jsonrpc":"2.0","id":"two","method":"tools/list"},
+			  {"jsonrpc":"2.0","id":3,"method":"nope"}]`,
+			map[string]int{"1": 0, `"two"`: 0, "3": mcpMethodNotFound},
+		},
+		{
+			"batch of notifications",
+			`[{"jsonrpc":"2.0","method":"notifications/initialized"},{"jsonrpc":"2.0","method":"notifications/cancelled","params":{"requestId":1}}]`,
+			nil,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			out := s.handleMessage(ctx, "alice@example.com", []byte(tc.in))
+			if tc.want == nil {
+				if out != nil {
+					t.Fatalf("got %s, want no reply", out)
+				}
+				return
+			}
+			var resps []mcpResponse
+			if bytes.HasPrefix(out, []byte("[")) {
+				if err := json.Unmarshal(out, &resps); err != nil {
+					t.Fatalf("%s: %v", out, err)
+				}
+			} else {
+				var resp mcpResponse
+				if err := json.Unmarshal(out, &resp); err != nil {
+					t.Fatalf("%s: %v", out, err)
+				}
+				resps = append(resps, resp)
+			}
+			got := map[string]int{}
+			for _, resp := range resps {
+				code := 0
+				if resp.Error != nil {
+					code = resp.Error.Code
+				} else if resp.Result == nil {
+					t.Errorf("response %s has neither result nor error", resp.Id)
+				}
+				got[string(resp.Id)] = code
+			}
+			if len(got) != len(tc.want) {
+				t.Fatalf("got %s, want ids %v", out, tc.want)
+			}
+			for id, code := range tc.want {
+				if c, ok := got[id]; !ok || c != code {
+					t.Errorf("id %s: got %s", id, out)
+				}
+			}
+		})
+	}
+}
+
+func TestMCPInitializeVersion(t *testing.T) {
+	s, _, _ := newTestMCP(t)
+	for requested, want := range map[string]string{
+		"2025-03-26": "2025-03-26",
+		"2024-11-05": "2024-11-05",
+		"2099-01-01": mcpProtocolVersions[0],
+		"":           mcpProtocolVersions[0],
+	} {
+		out := s.handleMessage(context.Background(), "alice@example.com",
+			[]byte(`{"jsonrpc":"2.0","id":1,"method":"initialize","params":{"protocolVersion":"`+requested+`"}}`))
+		var resp struct {
+			Result struct {
+				ProtocolVersion string         `json:"protocolVersion"`
+				Capabilities    map[string]any `json:"capabilities"`
+			} `json:"result"`
+		}
+		if err := json.Unmarshal(out, &resp); err != nil {
+			t.Fatalf("%s: %v", out, err)
+		}
+		if resp.Result.ProtocolVersion != want || resp.Result.Capabilities["tools"] == nil {
+			t.Errorf("client asking for %q: got %s, want version %s", requested, out, want)
+		}
+	}
+}
+
+func TestMCPHTTPNotificationsAccepted(t *testing.T) {
+	s, auth, _ := newTestMCP(t)
+	srv := httptest.NewServer(auth.require(s.handleHTTP))
+	defer srv.Close()
+	post := func(body string) (*http.Response, []byte) {
+		req, _ := http.NewRequest(http.MethodPost, srv.URL, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+loginToken(t, auth, "alice@example.com"))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		out, _ := io.ReadAll(resp.Body)
+		return resp, out
+	}
+
+	if resp, out := post(`[{"jsonrpc":"2.0","method":"notifications/initialized"}]`); resp.StatusCode != http.StatusAccepted || len(out) != 0 {
+		t.Errorf("notifications: %d %s", resp.StatusCode, out)
+	}
+	if resp, out := post(`{"jsonrpc":"2.0","id":1,"method":"ping"}`); resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("ping: %d %s", resp.StatusCode, out)
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for serveStdio's concurrent writers.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// TestMCPStdioCancel cancels an exec held up in Docker: a later ping is
+// still answered, and the cancelled request never is.
+func TestMCPStdioCancel(t *testing.T) {
+	s, _, docker := newTestMCP(t)
+	blocked, _ := holdFirstExec(t, docker)
+	in, send := io.Pipe()
+	var out syncBuffer
+	served := make(chan error, 1)
+	go func() {
+		served <- s.serveStdio(context.Background(), "alice@example.com", func(context.Context) error { return nil }, in, &out)
+	}()
+	write := func(line string) {
+		t.Helper()
+		if _, err := io.WriteString(send, line+"\n"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(`{"jsonrpc":"2.0","id":"slow","method":"tools/call","params":{"name":"exec","arguments":{"argv":["sleep","60"]}}}`)
+	<-blocked
+	write(`{"jsonrpc":"2.0","method":"notifications/cancelled","params":{"requestId":"slow"}}`)
+	write(`{"jsonrpc":"2.0","id":2,"method":"ping"}`)
+	send.Close()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serveStdio did not return after the cancellation")
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 1 || !strings.Contains(lines[0], `"id":2`) {
+		t.Errorf("output:\n%s\nwant only the ping's response", out.String())
+	}
+}
+
+func TestMCPStdioEndsWithSession(t *testing.T) {
+	s, _, _ := newTestMCP(t)
+	var out syncBuffer
+	in := strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"ping"}` + "\n")
+	err := s.serveStdio(context.Background(), "alice@example.com", func(context.Context) error { return errSessionRevoked }, in, &out)
+	if !errors.Is(err, errSessionRevoked) || out.String() != "" {
+		t.Errorf("err = %v, output %q", err, out.String())
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	asciicastContentType  = "application/x-asciicast"
+	asciicastDefaultCols  = 80
+	asciicastDefaultRows  = 24
+	recordingTimestampFmt = "20060102T150405Z"
+)
+
+var recordingIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// asciicastRecorder writes a shell session in asciicast v2 format: a JSON
+// header line followed by one [elapsed, code, data] event per line.
+// See https://docs.asciinema.org/manual/asciicast/v2/.
+type asciicastRecorder struct {
+	mu      sync.Mutex
+	path    string
+	f       *os.File
+	start   time.Time
+	pending []byte // trailing bytes of an incomplete UTF-8 sequence
+}
+
+func newAsciicastRecorder(path string, start time.Time) (*asciicastRecorder, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o640)
+	if err != nil {
+		return nil, err
+	}
+	header, _ := json.Marshal(map[string]any{
+		"version":   2,
+		"width":     asciicastDefaultCols,
+		"height":    asciicastDefaultRows,
+		"timestamp": start.Unix(),
+		"env":       map[string]string{"TERM": "xterm-256color", "SHELL": "/bin/bash"},
+	})
+	if _, err := f.Write(append(header, '\n')); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return &asciicastRecorder{path: path, f: f, start: start}, nil
+}
+
+// output records terminal output. Events must be valid UTF-8 strings, so a
+// multi-byte character split across reads is held back until it completes.
+func (rec *asciicastRecorder) output(p []byte) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	data := append(rec.pending, p...)
+	cut := len(data)
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				cut = i
+			}
+			break
+		}
+	}
+	rec.pending = append([]byte(nil), data[cut:]...)
+	if cut > 0 {
+		rec.writeEventLocked("o", string(data[:cut]))
+	}
+}
+
+func (rec *asciicastRecorder) resize(cols, rows int) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.writeEventLocked("r", fmt.Sprintf("%dx%d", cols, rows))
+}
+
+func (rec *asciicastRecorder) close() {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.f == nil {
+		return
+	}
+	if len(rec.pending) > 0 {
+		rec.writeEventLocked("o", string(rec.pending))
+		rec.pending = nil
+	}
+	_ = rec.f.Close()
+	rec.f = nil
+}
+
+// discard closes and deletes a recording that never got used.
+func (rec *asciicastRecorder) discard() {
+	rec.close()
+	_ = os.Remove(rec.path)
+}
+
+func (rec *asciicastRecorder) writeEventLocked(code, data string) {
+	if rec.f == nil {
+		return
+	}
+	elapsed := time.Since(rec.start).Seconds()
+	line, err := json.Marshal([]any{elapsed, code, data})
+	if err != nil {
+		return
+	}
+	if _, err := rec.f.Write(append(line, '\n')); err != nil {
+		log.Printf("[shell] recording write failed: %v", err)
+		_ = rec.f.Close()
+		rec.f = nil
+	}
+}
+
+// startRecording attaches a recorder to a freshly created session. Recording
+// failures are logged and never prevent the shell from starting.
+func (m *DockerManager) startRecording(sess *shellSession) {
+	if m.cfg.ShellRecordingDir == "" {
+		return
+	}
+	path := filepath.Join(m.recordingDirFor(sess.owner), recordingIDFor(sess.id, sess.createdAt)+".cast")
+	rec, err := newAsciicastRecorder(path, sess.createdAt)
+	if err != nil {
+		log.Printf("[shell] cannot record session %s: %v", sess.id, err)
+		return
+	}
+	sess.recorder = rec
+}
+
+// recordingDirFor is where an owner's recordings live under the configured root.
+func (m *DockerManager) recordingDirFor(owner string) string {
+	return filepath.Join(m.cfg.ShellRecordingDir, ownerKey(owner))
+}
+
+func recordingIDFor(sessionID string, start time.Time) string {
+	return sessionID + "-" + start.UTC().Format(recordingTimestampFmt)
+}
+
+type sessionListEntry struct {
+	Id          string     `json:"id"`
+	SessionId   string     `json:"sessionId"`
+	Live        bool       `json:"live"`
+	StartedAt   time.Time  `json:"startedAt"`
+	RecordingId string     `json:"recordingId,omitempty"`
+	Size        int64      `json:"size,omitempty"`
+	UpdatedAt   *time.Time `json:"updatedAt,omitempty"`
+}
+
+// GET /sessions
+// Lists the caller's live shell sessions and stored recordings.
+func (m *DockerManager) handleListSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJson(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	owner, ok := m.requireOwner(w, r)
+	if !ok {
+		return
+	}
+
+	entries := []sessionListEntry{}
+	seen := map[string]bool{}
+	for _, sess := range m.sessions.listFor(owner) {
+		e := sessionListEntry{Id: sess.id, SessionId: sess.id, Live: true, StartedAt: sess.createdAt}
+		if sess.recorder != nil {
+			e.RecordingId = recordingIDFor(sess.id, sess.createdAt)
+			seen[e.RecordingId] = true
+		}
+		entries = append(entries, e)
+	}
+
+	if m.cfg.ShellRecordingDir != "" {
+		files, err := os.ReadDir(m.recordingDirFor(owner))
+		if err != nil && !os.IsNotExist(err) {
+			writeJson(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		for _, f := range files {
+			id, isCast := strings.CutSuffix(f.Name(), ".cast")
+			if !isCast || seen[id] {
+				continue
+			}
+			info, err := f.Info()
+			if err != nil {
+				continue
+			}
+			sessionID, stamp := id, ""
+			if i := strings.LastIndex(id, "-"); i > 0 {
+				sessionID, stamp = id[:i], id[i+1:]
+			}
+			started, _ := time.Parse(recordingTimestampFmt, stamp)
+			updated := info.ModTime()
+			entries = append(entries, sessionListEntry{
+				Id:          id,
+				SessionId:   sessionID,
+				StartedAt:   started,
+				RecordingId: id,
+				Size:        info.Size(),
+				UpdatedAt:   &updated,
+			})
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].StartedAt.After(entries[j].StartedAt) })
+	writeJson(w, http.StatusOK, map[string]any{"sessions": entries})
+}
+
+// GET /sessions/{id}/recording
+// Downloads a recording as an asciicast v2 file. {id} is a recordingId from
+// GET /sessions; a live session id resolves to its in-progress recording.
+func (m *DockerManager) handleSessionRecording(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJson(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	owner, ok := m.requireOwner(w, r)
+	if !ok {
+		return
+	}
+	if m.cfg.ShellRecordingDir == "" {
+		writeJson(w, http.StatusNotImplemented, map[string]string{"error": "shell recording not configured"})
+		return
+	}
+
+	id := r.PathValue("id")
+	if !recordingIDPattern.MatchString(id) {
+		writeJson(w, http.StatusBadRequest, map[string]string{"error": "invalid recording id"})
+		return
+	}
+	if sess, ok := m.sessions.get(owner, id); ok && sess.recorder != nil {
+		id = recordingIDFor(sess.id, sess.createdAt)
+	}
+
+	f, err := os.Open(filepath.Join(m.recordingDirFor(owner), id+".cast"))
+	if err != nil {
+		writeJson(w, http.StatusNotFound, map[string]string{"error": "recording not found"})
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		writeJson(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", asciicastContentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.cast"`, id))
+	http.ServeContent(w, r, id+".cast", info.ModTime(), f)
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const (
+	defaultShellSessionGrace    = 5 * time.Minute
+	defaultShellScrollbackBytes = 64 * 1024
+	shellSubscriberQueue        = 256
+)
+
+var (
+	shellSessionIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{8,64}$`)
+
+	errShellSessionNotFound = errors.New("shell session not found")
+	errShellSessionClosed   = errors.New("shell session closed")
+)
+
+// shellSession is an interactive exec in a user's container that outlives any
+// single WebSocket. Output is kept in a ring buffer so a reconnecting client
+// can be brought up to date before live streaming resumes.
+type shellSession struct {
+	id          string
+	owner       string
+	containerID string
+	execID      string
+	createdAt   time.Time
+
+	registry *shellSessionRegistry
+	docker   *dockerClient
+	activity *activityTracker
+	stream   *dockerHijackedConn
+	recorder *asciicastRecorder // nil unless the session is being recorded
+
+	mu          sync.Mutex
+	history     *ringBuffer
+	subscribers map[*shellSubscriber]struct{}
+	shareEpoch  int // bumped to revoke outstanding share links
+	detachTimer *time.Timer
+	closed      bool
+	exit        *terminalExitMsg
+}
+
+// shellSubscriber receives a session's live output. Each has its own queue so
+// one slow viewer can't stall the shell or the others; out is closed when the
+// session ends or the subscriber is dropped.
+type shellSubscriber struct {
+	out      chan []byte
+	isOwner  bool
+	canWrite bool
+	shared   bool // attached through a share link
+}
+
+// shellSessionRegistry tracks live sessions by owner and id. Clients pick
+// the ids, so they're only unique per owner. Sessions without an attached
+// client are kept for the grace period and then hung up.
+type shellSessionRegistry struct {
+	grace      time.Duration
+	scrollback int
+
+	mu       sync.Mutex
+	sessions map[shellSessionKey]*shellSession
+}
+
+type shellSessionKey struct {
+	owner, id string
+}
+
+func newShellSessionRegistry(grace time.Duration, scrollback int) *shellSessionRegistry {
+	return &shellSessionRegistry{
+		grace:      grace,
+		scrollback: scrollback,
+		sessions:   make(map[shellSessionKey]*shellSession),
+	}
+}
+
+func newShellSessionID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// listFor returns the owner's live sessions.
+func (reg *shellSessionRegistry) listFor(owner string) []*shellSession {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	var out []*shellSession
+	for _, sess := range reg.sessions {
+		if sess.owner == owner {
+			out = append(out, sess)
+		}
+	}
+	return out
+}
+
+func (reg *shellSessionRegistry) get(owner, id string) (*shellSession, bool) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	sess, ok := reg.sessions[shellSessionKey{owner, id}]
+	return sess, ok
+}
+
+// add registers sess unless another of the owner's sessions with the same id
+// won the race, in which case that one is returned and sess should be
+// discarded.
+func (reg *shellSessionRegistry) add(sess *shellSession) (*shellSession, bool) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	key := shellSessionKey{sess.owner, sess.id}
+	if existing, ok := reg.sessions[key]; ok {
+		return existing, false
+	}
+	reg.sessions[key] = sess
+	return sess, true
+}
+
+func (reg *shellSessionRegistry) remove(sess *shellSession) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	key := shellSessionKey{sess.owner, sess.id}
+	if reg.sessions[key] == sess {
+		delete(reg.sessions, key)
+	}
+}
+
+// openShellSession reattaches to the caller's session id if it is still alive,
+// or starts a new shell in their container under that id. record only applies
+// to new sessions.
+func (m *DockerManager) openShellSession(ctx context.Context, owner, id string, record bool) (*shellSession, error) {
+	if sess, ok := m.sessions.get(owner, id); ok {
+		return sess, nil
+	}
+
+	container, err := m.runningContainerFor(ctx, owner)
+	if err != nil {
+		return nil, err
+	}
+	containerID := container.ContainerId
+
+	ctx, cancel := context.WithTimeout(ctx, dockerCommandTimeout)
+	defer cancel()
+	execID, err := m.docker.execCreate(ctx, containerID, dockerExecConfig{
+		Cmd:          shellCommand,
+		Env:          []string{"TERM=xterm-256color", shellMarker(id)},
+		User:         container.RemoteUser,
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+		Tty:          true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	stream, err := m.docker.execStart(ctx, execID, true)
+	if err != nil {
+		return nil, err
+	}
+
+	sess := &shellSession{
+		id:          id,
+		owner:       owner,
+		containerID: containerID,
+		execID:      execID,
+		createdAt:   time.Now(),
+		registry:    m.sessions,
+		docker:      m.docker,
+		activity:    m.activity,
+		stream:      stream,
+		history:     newRingBuffer(m.sessions.scrollback),
+		subscribers: make(map[*shellSubscriber]struct{}),
+	}
+	if record || m.cfg.ShellRecordAll {
+		m.startRecording(sess)
+	}
+	registered, ok := m.sessions.add(sess)
+	if !ok {
+		_ = stream.Close()
+		if sess.recorder != nil {
+			sess.recorder.discard()
+		}
+		return registered, nil
+	}
+	go sess.pump()
+	return sess, nil
+}
+
+// joinShellSession subscribes the caller to a session: the one a share token
+// points at if shareToken is set, otherwise their own session sessionID (a
+// fresh id is generated when empty), opened or reattached.
+func (m *DockerManager) joinShellSession(ctx context.Context, owner, sessionID, shareToken string, record bool) (*shellSession, *shellSubscriber, []byte, error) {
+	var (
+		sess     *shellSession
+		canWrite = true
+		err      error
+	)
+	if shareToken != "" {
+		sess, canWrite, err = m.resolveShare(shareToken)
+	} else {
+		if sessionID == "" {
+			sessionID = newShellSessionID()
+		}
+		sess, err = m.openShellSession(ctx, owner, sessionID, record)
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	isOwner := sess.owner == owner
+	sub, replay, err := sess.attach(isOwner, isOwner || canWrite, !isOwner)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return sess, sub, replay, nil
+}
+
+// pump copies exec output into the scrollback and to every subscriber until
+// the shell exits, then records its exit status.
+func (s *shellSession) pump() {
+	buf := make([]byte, 4096)
+	for {
+		n, err := s.stream.Read(buf)
+		if n > 0 {
+			s.activity.touch(s.owner)
+			s.broadcast(buf[:n])
+		}
+		if err != nil {
+			s.recordExit()
+			s.close()
+			return
+		}
+	}
+}
+
+func (s *shellSession) recordExit() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	info, err := s.docker.execWait(ctx, s.execID)
+	if err != nil {
+		log.Printf("[shell] session %s: exit status unavailable: %v", s.id, err)
+		return
+	}
+	status := exitStatusFromCode(info.ExitCode)
+	s.mu.Lock()
+	s.exit = &status
+	s.mu.Unlock()
+}
+
+func (s *shellSession) broadcast(p []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.history.Write(p)
+	if s.recorder != nil {
+		s.recorder.output(p)
+	}
+	if len(s.subscribers) == 0 {
+		return
+	}
+	chunk := append([]byte(nil), p...)
+	for sub := range s.subscribers {
+		select {
+		case sub.out <- chunk:
+		default:
+			// Viewer can't keep up; drop it rather than stall the shell. It
+			// can reattach and catch up from the scrollback.
+			s.dropLocked(sub)
+		}
+	}
+}
+
+// attach adds a subscriber and returns the scrollback to replay first. Only
+// the owner may resize; canWrite controls whether input is forwarded.
+func (s *shellSession) attach(isOwner, canWrite, shared bool) (*shellSubscriber, []byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, nil, errShellSessionClosed
+	}
+	if s.detachTimer != nil {
+		s.detachTimer.Stop()
+		s.detachTimer = nil
+	}
+	sub := &shellSubscriber{
+		out:      make(chan []byte, shellSubscriberQueue),
+		isOwner:  isOwner,
+		canWrite: canWrite,
+		shared:   shared,
+	}
+	s.subscribers[sub] = struct{}{}
+	return sub, s.history.Bytes(), nil
+}
+
+// detach releases sub; with no subscriber left the grace period starts.
+func (s *shellSession) detach(sub *shellSubscriber) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.subscribers[sub]; !ok || s.closed {
+		return
+	}
+	s.dropLocked(sub)
+}
+
+func (s *shellSession) dropLocked(sub *shellSubscriber) {
+	close(sub.out)
+	delete(s.subscribers, sub)
+	if len(s.subscribers) == 0 {
+		s.scheduleExpiryLocked()
+	}
+}
+
+// revokeShares invalidates outstanding share links and disconnects everyone
+// who joined through one.
+func (s *shellSession) revokeShares() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.shareEpoch++
+	for sub := range s.subscribers {
+		if sub.shared {
+			s.dropLocked(sub)
+		}
+	}
+}
+
+func (s *shellSession) currentShareEpoch() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.shareEpoch
+}
+
+func (s *shellSession) scheduleExpiryLocked() {
+	if s.detachTimer != nil {
+		s.detachTimer.Stop()
+	}
+	s.detachTimer = time.AfterFunc(s.registry.grace, func() {
+		s.mu.Lock()
+		idle := len(s.subscribers) == 0
+		s.mu.Unlock()
+		if idle {
+			log.Printf("[shell] session %s expired after %s without a client", s.id, s.registry.grace)
+			s.close()
+		}
+	})
+}
+
+func (s *shellSession) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+func (s *shellSession) write(p []byte) error {
+	s.activity.touch(s.owner)
+	_, err := s.stream.Write(p)
+	return err
+}
+
+// signal delivers a signal (SIGINT, SIGTERM, SIGKILL, SIGHUP, ...) to the
+// shell's foreground process group inside the container.
+func (s *shellSession) signal(name string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return s.docker.signalMarked(ctx, s.containerID, shellMarker(s.id), name)
+}
+
+func shellMarker(sessionID string) string {
+	return execMarkerEnv + "=shell-" + sessionID
+}
+
+// exitStatus describes how the shell ended; Code is null while it runs or if
+// the daemon couldn't tell us.
+func (s *shellSession) exitStatus() terminalExitMsg {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.exit == nil {
+		return terminalExitMsg{}
+	}
+	return *s.exit
+}
+
+func (s *shellSession) resize(rows, cols int) error {
+	if s.recorder != nil {
+		s.recorder.resize(cols, rows)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return s.docker.execResize(ctx, s.execID, rows, cols)
+}
+
+// close hangs up the exec's TTY and drops the session from the registry.
+func (s *shellSession) close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	if s.detachTimer != nil {
+		s.detachTimer.Stop()
+	}
+	for sub := range s.subscribers {
+		close(sub.out)
+		delete(s.subscribers, sub)
+	}
+	s.mu.Unlock()
+
+	_ = s.stream.Close()
+	if s.recorder != nil {
+		s.recorder.close()
+	}
+	s.registry.remove(s)
+}
+
+// ringBuffer keeps the most recent size bytes written to it.
+type ringBuffer struct {
+	buf  []byte
+	next int
+	full bool
+}
+
+func newRingBuffer(size int) *ringBuffer {
+	return &ringBuffer{buf: make([]byte, size)}
+}
+
+func (b *ringBuffer) Write(p []byte) {
+	if len(b.buf) == 0 {
+		return
+	}
+	if len(p) >= len(b.buf) {
+		copy(b.buf, p[len(p)-len(b.buf):])
+		b.next = 0
+		b.full = true
+		return
+	}
+	n := copy(b.buf[b.next:], p)
+	copy(b.buf, p[n:])
+	if b.next+len(p) >= len(b.buf) {
+		b.full = true
+	}
+	b.next = (b.next + len(p)) % len(b.buf)
+}
+
+// Bytes returns a copy of the buffered data, oldest first.
+func (b *ringBuffer) Bytes() []byte {
+	if !b.full {
+		return append([]byte(nil), b.buf[:b.next]...)
+	}
+	out := make([]byte, 0, len(b.buf))
+	out = append(out, b.buf[b.next:]...)
+	return append(out, b.buf[:b.next]...)
+}
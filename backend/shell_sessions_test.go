@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"io"
+	"testing"
+)
+
+// TestShellSessionIDsArePerOwner opens the same client-chosen id as two
+// users: each gets a shell in their own container, and neither can tell the
+// other's exists.
+func TestShellSessionIDsArePerOwner(t *testing.T) {
+	cfg := testConfig()
+	m, docker := newTestManager(t, cfg, newTestAuth(t, cfg))
+	alice, bob := "alice@example.com", "bob@example.com"
+	docker.add(managedContainer(alice, "127.0.0.1"))
+	docker.add(managedContainer(bob, "127.0.0.2"))
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+	docker.exec = func(cfg dockerExecConfig, stdin io.Reader, stdout, stderr io.Writer) int {
+		<-done
+		return 0
+	}
+	ctx := context.Background()
+
+	aliceSess, err := m.openShellSession(ctx, alice, "my-shell-1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobSess, err := m.openShellSession(ctx, bob, "my-shell-1", false)
+	if err != nil {
+		t.Fatalf("second user's open of the same id: %v", err)
+	}
+	if bobSess == aliceSess || bobSess.owner != bob || bobSess.containerID != "id-"+ownerKey(bob) {
+		t.Errorf("bob got %s's session in %s", bobSess.owner, bobSess.containerID)
+	}
+	if again, err := m.openShellSession(ctx, alice, "my-shell-1", false); err != nil || again != aliceSess {
+		t.Errorf("reattach: got %p, %v; want alice's session", again, err)
+	}
+
+	// Ending one leaves the other.
+	aliceSess.close()
+	if _, ok := m.sessions.get(alice, "my-shell-1"); ok {
+		t.Error("closed session still registered")
+	}
+	if sess, ok := m.sessions.get(bob, "my-shell-1"); !ok || sess != bobSess {
+		t.Error("closing alice's session dropped bob's")
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	shareTokenType  = "shell-share"
+	defaultShareTTL = time.Hour
+	maxShareTTL     = 7 * 24 * time.Hour
+	shareQueryParam = "share"
+	shellWsPath     = "/docker/shell"
+)
+
+type shareRequest struct {
+	Write      bool `json:"write"`
+	TtlSeconds int  `json:"ttlSeconds"`
+}
+
+type shareResponse struct {
+	Token     string    `json:"token"`
+	WsUrl     string    `json:"wsUrl"`
+	Write     bool      `json:"write"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// POST   /sessions/{id}/share  {"write":false,"ttlSeconds":3600}
+// DELETE /sessions/{id}/share  revokes every link issued so far.
+//
+// Share links are signed tokens naming the session; any authenticated user
+// holding one can watch the shell live, and type into it if write was granted.
+func (m *DockerManager) handleSessionShare(w http.ResponseWriter, r *http.Request) {
+	owner, ok := m.requireOwner(w, r)
+	if !ok {
+		return
+	}
+	sess, ok := m.sessions.get(owner, r.PathValue("id"))
+	if !ok {
+		writeJson(w, http.StatusNotFound, map[string]string{"error": errShellSessionNotFound.Error()})
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		var req shareRequest
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeJson(w, http.StatusBadRequest, map[string]string{"error": "invalid json body"})
+				return
+			}
+		}
+		ttl := defaultShareTTL
+		if req.TtlSeconds > 0 {
+			ttl = min(time.Duration(req.TtlSeconds)*time.Second, maxShareTTL)
+		}
+		expiresAt := time.Now().Add(ttl)
+		token, err := m.auth.sign(jwt.MapClaims{
+			"typ":   shareTokenType,
+			"sid":   sess.id,
+			"own":   owner,
+			"write": req.Write,
+			"epoch": sess.currentShareEpoch(),
+			"iat":   time.Now().Unix(),
+			"exp":   expiresAt.Unix(),
+		})
+		if err != nil {
+			writeJson(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJson(w, http.StatusOK, shareResponse{
+			Token:     token,
+			WsUrl:     m.shareWsURL(token),
+			Write:     req.Write,
+			ExpiresAt: expiresAt,
+		})
+	case http.MethodDelete:
+		sess.revokeShares()
+		writeJson(w, http.StatusOK, map[string]bool{"revoked": true})
+	default:
+		writeJson(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+	}
+}
+
+// resolveShare validates a share token and returns the session it grants
+// access to and whether the holder may write to it.
+func (m *DockerManager) resolveShare(raw string) (*shellSession, bool, error) {
+	claims, err := m.auth.parse(raw)
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid share link: %w", err)
+	}
+	if typ, _ := claims["typ"].(string); typ != shareTokenType {
+		return nil, false, errors.New("invalid share link")
+	}
+	sid, _ := claims["sid"].(string)
+	own, _ := claims["own"].(string)
+	canWrite, _ := claims["write"].(bool)
+	epoch, _ := claims["epoch"].(float64)
+
+	sess, ok := m.sessions.get(own, sid)
+	if !ok {
+		return nil, false, errShellSessionNotFound
+	}
+	if int(epoch) != sess.currentShareEpoch() {
+		return nil, false, errors.New("share link revoked")
+	}
+	return sess, canWrite, nil
+}
+
+func (m *DockerManager) shareWsURL(token string) string {
+	base := m.cfg.BackendBaseURL
+	switch {
+	case strings.HasPrefix(base, "https://"):
+		base = "wss://" + strings.TrimPrefix(base, "https://")
+	case strings.HasPrefix(base, "http://"):
+		base = "ws://" + strings.TrimPrefix(base, "http://")
+	}
+	return base + shellWsPath + "?" + shareQueryParam + "=" + url.QueryEscape(token)
+}
@@ -2,18 +2,39 @@ package main
 
 import (
 	"encoding/json"
-	"io"
+	"fmt"
 	"log"
 	"net/http"
-	"os/exec"
 
-	"github.com/creack/pty"
 	"github.com/gorilla/websocket"
 )
 
-// handleDockerShellWS opens an interactive shell in the managed docker container
+// shellCommand prefers bash and falls back to sh for minimal images.
+var shellCommand = []string{"/bin/sh", "-c", "if [ -x /bin/bash ]; then exec /bin/bash; else exec /bin/sh; fi"}
+
+// handleShellWS opens an interactive shell in the caller's docker container
 // and bridges stdin/stdout over a WebSocket.
-func handleDockerShellWS(w http.ResponseWriter, r *http.Request) {
+//
+// Clients pass ?session=<id> (8-64 chars of [A-Za-z0-9_-]) to make the shell
+// reattachable: if the socket drops, the shell keeps running for the grace
+// period and a reconnect with the same id replays recent output and resumes.
+// ?record=1 records a new session as an asciicast (see shell_recording.go).
+// ?share=<token> joins someone else's session through a share link
+// (see shell_share.go); input is dropped unless the link grants write.
+// Text frames {"type":"resize","rows":..,"cols":..} and
+// {"type":"signal","signal":"SIGINT"} are control messages.
+func (m *DockerManager) handleShellWS(w http.ResponseWriter, r *http.Request) {
+	owner, ok := m.requireOwner(w, r)
+	if !ok {
+		return
+	}
+
+	sessionID := r.URL.Query().Get("session")
+	if sessionID != "" && !shellSessionIDPattern.MatchString(sessionID) {
+		writeJson(w, http.StatusBadRequest, dockerActionResponse{Ok: false, Message: "invalid session id"})
+		return
+	}
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("shell websocket upgrade failed: %v", err)
@@ -21,80 +42,86 @@ func handleDockerShellWS(w http.ResponseWriter, r *http.Request) {
 	}
 	defer conn.Close()
 
-	dm := NewDockerManager()
-	if err := dm.startContainer(r.Context()); err != nil {
-		_ = conn.WriteMessage(websocket.TextMessage, []byte("Failed to start container: "+err.Error()+"\n"))
+	record := r.URL.Query().Get("record") == "1"
+	sess, sub, replay, err := m.joinShellSession(r.Context(), owner, sessionID, r.URL.Query().Get(shareQueryParam), record)
+	if err != nil {
+		_ = conn.WriteMessage(websocket.TextMessage, []byte("Failed to start shell: "+err.Error()+"\n"))
 		return
 	}
+	// Leaving without detaching would keep the shell alive forever.
+	defer sess.detach(sub)
 
-	// Try bash first, then fallback to sh.
-	cmd := exec.Command("docker", "exec", "-it", dm.containerName, "/bin/bash")
-	ptmx, err := pty.Start(cmd)
-	if err != nil {
-		cmd = exec.Command("docker", "exec", "-it", dm.containerName, "/bin/sh")
-		ptmx, err = pty.Start(cmd)
-		if err != nil {
-			_ = conn.WriteMessage(websocket.TextMessage, []byte("Failed to start shell: "+err.Error()+"\n"))
+	if len(replay) > 0 {
+		if err := conn.WriteMessage(websocket.BinaryMessage, replay); err != nil {
 			return
 		}
 	}
-	defer func() {
-		_ = ptmx.Close()
-		_ = cmd.Process.Kill()
-	}()
 
-	// Stream PTY -> WS
-	done := make(chan struct{})
+	// Stream exec TTY -> WS
 	go func() {
-		defer close(done)
-		buf := make([]byte, 4096)
-		for {
-			n, readErr := ptmx.Read(buf)
-			if n > 0 {
-				// Send raw bytes to the client.
-				if writeErr := conn.WriteMessage(websocket.BinaryMessage, buf[:n]); writeErr != nil {
-					return
-				}
-			}
-			if readErr != nil {
-				if readErr != io.EOF {
-					_ = conn.WriteMessage(websocket.TextMessage, []byte("\n[pty closed]\n"))
-				}
+		for chunk := range sub.out {
+			// Send raw bytes to the client.
+			if writeErr := conn.WriteMessage(websocket.BinaryMessage, chunk); writeErr != nil {
 				return
 			}
 		}
+		// Session ended, we fell behind, or our share link was revoked.
+		notice := "\n[pty closed]\n"
+		if sess.isClosed() {
+			if exit := sess.exitStatus(); exit.Code != nil {
+				notice = fmt.Sprintf("\r\n[process exited with code %d]\r\n", *exit.Code)
+			}
+		}
+		_ = conn.WriteMessage(websocket.TextMessage, []byte(notice))
+		_ = conn.Close()
 	}()
 
-	type resizeMsg struct {
-		Type string `json:"type"`
-		Rows int    `json:"rows"`
-		Cols int    `json:"cols"`
+	type controlMsg struct {
+		Type   string `json:"type"`
+		Rows   int    `json:"rows"`
+		Cols   int    `json:"cols"`
+		Signal string `json:"signal"`
 	}
 
-	// WS -> PTY (also accepts resize control messages)
+	// WS -> exec TTY (also accepts resize control messages)
 	for {
 		messageType, msg, wsErr := conn.ReadMessage()
 		if wsErr != nil {
-			<-done
 			return
 		}
 		// Accept both text and binary frames; forward bytes as-is.
 		switch messageType {
 		case websocket.TextMessage:
-			// Try to parse resize control message.
+			// Try to parse resize/signal control messages.
 			if len(msg) > 0 && msg[0] == '{' {
-				var rm resizeMsg
-				if err := json.Unmarshal(msg, &rm); err == nil && rm.Type == "resize" && rm.Rows > 0 && rm.Cols > 0 {
-					_ = pty.Setsize(ptmx, &pty.Winsize{
-						Rows: uint16(rm.Rows),
-						Cols: uint16(rm.Cols),
-					})
-					continue
+				var cm controlMsg
+				if err := json.Unmarshal(msg, &cm); err == nil {
+					switch {
+					case cm.Type == "resize" && cm.Rows > 0 && cm.Cols > 0:
+						// Viewers follow the owner's terminal size.
+						if sub.isOwner {
+							if err := sess.resize(cm.Rows, cm.Cols); err != nil {
+								log.Printf("shell resize failed: %v", err)
+							}
+						}
+						continue
+					case cm.Type == "signal" && cm.Signal != "":
+						if sub.canWrite {
+							if err := sess.signal(cm.Signal); err != nil {
+								log.Printf("shell signal failed: %v", err)
+							}
+						}
+						continue
+					}
 				}
 			}
-			_, _ = ptmx.Write(msg)
+			if sub.canWrite {
+				_ = sess.write(msg)
+			}
 		case websocket.BinaryMessage:
-			_, _ = ptmx.Write(msg)
+			if sub.canWrite {
+				_ = sess.write(msg)
+			}
 		}
 	}
 }
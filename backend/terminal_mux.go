@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// Terminal protocol v1 (/docker/terminal, subprotocol "agent-thing.v1").
+//
+// Several shells share one WebSocket. Every message is a binary frame:
+//
+//	byte  0     frame type (below)
+//	bytes 1..4  channel id, uint32 big-endian; 0 for connection-level frames
+//	bytes 5..   payload: raw bytes for input/output, JSON for everything else
+//
+// Client -> server:
+//
+//	open   {"session":"<id>","share":"<token>","record":false,"rows":24,"cols":80}
+//	       on a channel id the client picks (non-zero, not in use). Either
+//	       session (own shell, created or reattached) or share is used.
+//	       The shell starts in the background; other frames for the
+//	       channel are refused until opened (or error) arrives, except
+//	       close, which abandons the open.
+//	input  raw bytes for the shell's TTY
+//	resize {"rows":24,"cols":80}
+//	signal {"signal":"SIGINT"}
+//	close  {"terminate":false}; terminate also ends the shell (owner only)
+//
+// Server -> client:
+//
+//	hello  {"version":1} on channel 0, once after the upgrade
+//	opened {"session":"<id>","write":true,"owner":true}
+//	output raw bytes (scrollback replay first, then live)
+//	exit   {"code":0,"signal":"SIGTERM"}; the shell ended, channel is gone
+//	error  {"message":"..."}; on channel 0 for connection-level problems
+//
+// Unlike the legacy /docker/shell protocol nothing is sniffed from the
+// payload, so pasted JSON is just input.
+const (
+	terminalProtocolVersion = 1
+	terminalSubprotocol     = "agent-thing.v1"
+	terminalFrameHeaderSize = 5
+)
+
+const (
+	frameHello  byte = 0x01
+	frameOpen   byte = 0x02
+	frameOpened byte = 0x03
+	frameInput  byte = 0x04
+	frameOutput byte = 0x05
+	frameResize byte = 0x06
+	frameSignal byte = 0x07
+	frameClose  byte = 0x08
+	frameExit   byte = 0x09
+	frameError  byte = 0x0a
+)
+
+var terminalUpgrader = websocket.Upgrader{
+	Subprotocols: []string{terminalSubprotocol},
+	CheckOrigin:  upgrader.CheckOrigin,
+}
+
+type terminalOpenMsg struct {
+	Session string `json:"session"`
+	Share   string `json:"share"`
+	Record  bool   `json:"record"`
+	Rows    int    `json:"rows"`
+	Cols    int    `json:"cols"`
+}
+
+type terminalResizeMsg struct {
+	Rows int `json:"rows"`
+	Cols int `json:"cols"`
+}
+
+type terminalSignalMsg struct {
+	Signal string `json:"signal"`
+}
+
+type terminalCloseMsg struct {
+	Terminate bool `json:"terminate"`
+}
+
+type terminalExitMsg struct {
+	Code   *int   `json:"code"`
+	Signal string `json:"signal,omitempty"`
+}
+
+// terminalConn is one multiplexed WebSocket and the channels open on it.
+type terminalConn struct {
+	m     *DockerManager
+	owner string
+	conn  *websocket.Conn
+
+	writeMu sync.Mutex
+
+	mu       sync.Mutex
+	channels map[uint32]*terminalChannel
+}
+
+type terminalChannel struct {
+	id   uint32
+	sess *shellSession
+	sub  *shellSubscriber
+
+	// cancel is set while the channel is opening and sess is still nil.
+	cancel context.CancelFunc
+}
+
+// handleTerminalWS serves the multiplexed terminal protocol described above.
+func (m *DockerManager) handleTerminalWS(w http.ResponseWriter, r *http.Request) {
+	owner, ok := m.requireOwner(w, r)
+	if !ok {
+		return
+	}
+	conn, err := terminalUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("terminal websocket upgrade failed: %v", err)
+		return
+	}
+	defer conn.Close()
+	if conn.Subprotocol() != terminalSubprotocol {
+		_ = conn.WriteMessage(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseProtocolError, "subprotocol "+terminalSubprotocol+" required"))
+		return
+	}
+
+	tc := &terminalConn{m: m, owner: owner, conn: conn, channels: make(map[uint32]*terminalChannel)}
+	defer tc.closeAll()
+
+	if err := tc.sendJSON(frameHello, 0, map[string]int{"version": terminalProtocolVersion}); err != nil {
+		return
+	}
+
+	for {
+		messageType, msg, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if messageType != websocket.BinaryMessage || len(msg) < terminalFrameHeaderSize {
+			tc.sendError(0, "malformed frame")
+			continue
+		}
+		frameType := msg[0]
+		channelID := binary.BigEndian.Uint32(msg[1:terminalFrameHeaderSize])
+		payload := msg[terminalFrameHeaderSize:]
+		if err := tc.dispatch(r, frameType, channelID, payload); err != nil {
+			tc.sendError(channelID, err.Error())
+		}
+	}
+}
+
+func (tc *terminalConn) dispatch(r *http.Request, frameType byte, channelID uint32, payload []byte) error {
+	if frameType == frameOpen {
+		return tc.open(r, channelID, payload)
+	}
+
+	tc.mu.Lock()
+	ch := tc.channels[channelID]
+	if ch != nil && ch.sess == nil && frameType == frameClose {
+		delete(tc.channels, channelID)
+		ch.cancel()
+		tc.mu.Unlock()
+		return nil
+	}
+	tc.mu.Unlock()
+	if ch == nil {
+		return fmt.Errorf("unknown channel %d", channelID)
+	}
+	if ch.sess == nil {
+		return fmt.Errorf("channel %d is still opening", channelID)
+	}
+
+	switch frameType {
+	case frameInput:
+		if !ch.sub.canWrite {
+			return errors.New("read-only channel")
+		}
+		return ch.sess.write(payload)
+	case frameResize:
+		var msg terminalResizeMsg
+		if err := json.Unmarshal(payload, &msg); err != nil || msg.Rows <= 0 || msg.Cols <= 0 {
+			return errors.New("invalid resize")
+		}
+		if !ch.sub.isOwner {
+			// Viewers follow the owner's terminal size.
+			return nil
+		}
+		return ch.sess.resize(msg.Rows, msg.Cols)
+	case frameSignal:
+		var msg terminalSignalMsg
+		if err := json.Unmarshal(payload, &msg); err != nil {
+			return errors.New("invalid signal")
+		}
+		if !ch.sub.canWrite {
+			return errors.New("read-only channel")
+		}
+		return ch.sess.signal(msg.Signal)
+	case frameClose:
+		var msg terminalCloseMsg
+		if len(payload) > 0 {
+			if err := json.Unmarshal(payload, &msg); err != nil {
+				return errors.New("invalid close")
+			}
+		}
+		tc.mu.Lock()
+		delete(tc.channels, channelID)
+		tc.mu.Unlock()
+		ch.sess.detach(ch.sub)
+		if msg.Terminate && ch.sub.isOwner {
+			ch.sess.close()
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown frame type 0x%02x", frameType)
+	}
+}
+
+func (tc *terminalConn) open(r *http.Request, channelID uint32, payload []byte) error {
+	if channelID == 0 {
+		return errors.New("channel 0 is reserved")
+	}
+	var msg terminalOpenMsg
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		return errors.New("invalid open")
+	}
+	if msg.Session != "" && !shellSessionIDPattern.MatchString(msg.Session) {
+		return errors.New("invalid session id")
+	}
+
+	// Reserve the id while the shell starts; a close frame cancels it.
+	ctx, cancel := context.WithCancel(r.Context())
+	pending := &terminalChannel{id: channelID, cancel: cancel}
+	tc.mu.Lock()
+	_, inUse := tc.channels[channelID]
+	if !inUse {
+		tc.channels[channelID] = pending
+	}
+	tc.mu.Unlock()
+	if inUse {
+		cancel()
+		return fmt.Errorf("channel %d already open", channelID)
+	}
+
+	// Starting a container and a shell takes a while; don't hold up the
+	// other channels' input meanwhile.
+	go tc.start(ctx, pending, msg)
+	return nil
+}
+
+// start joins the session for a reserved channel and sends its opened or
+// error frame.
+func (tc *terminalConn) start(ctx context.Context, pending *terminalChannel, msg terminalOpenMsg) {
+	defer pending.cancel()
+	sess, sub, replay, err := tc.m.joinShellSession(ctx, tc.owner, msg.Session, msg.Share, msg.Record)
+
+	ch := &terminalChannel{id: pending.id, sess: sess, sub: sub}
+	tc.mu.Lock()
+	current := tc.channels[pending.id] == pending
+	if current {
+		if err != nil {
+			delete(tc.channels, pending.id)
+		} else {
+			tc.channels[pending.id] = ch
+		}
+	}
+	tc.mu.Unlock()
+	if err != nil {
+		if current {
+			tc.sendError(pending.id, err.Error())
+		}
+		return
+	}
+	if !current {
+		// Closed by the client, or the connection went away.
+		sess.detach(sub)
+		return
+	}
+
+	if sub.isOwner && msg.Rows > 0 && msg.Cols > 0 {
+		if err := sess.resize(msg.Rows, msg.Cols); err != nil {
+			log.Printf("terminal resize failed: %v", err)
+		}
+	}
+	if err := tc.sendJSON(frameOpened, ch.id, map[string]any{
+		"session": sess.id,
+		"write":   sub.canWrite,
+		"owner":   sub.isOwner,
+	}); err != nil {
+		return
+	}
+	if len(replay) > 0 {
+		_ = tc.send(frameOutput, ch.id, replay)
+	}
+	tc.forward(ch)
+}
+
+// forward streams a channel's output until its subscription ends.
+func (tc *terminalConn) forward(ch *terminalChannel) {
+	for chunk := range ch.sub.out {
+		if err := tc.send(frameOutput, ch.id, chunk); err != nil {
+			return
+		}
+	}
+
+	tc.mu.Lock()
+	current := tc.channels[ch.id] == ch
+	if current {
+		delete(tc.channels, ch.id)
+	}
+	tc.mu.Unlock()
+	if !current {
+		// Closed by the client.
+		return
+	}
+	if ch.sess.isClosed() {
+		_ = tc.sendJSON(frameExit, ch.id, ch.sess.exitStatus())
+		return
+	}
+	tc.sendError(ch.id, "detached from session")
+}
+
+func (tc *terminalConn) closeAll() {
+	tc.mu.Lock()
+	channels := tc.channels
+	tc.channels = map[uint32]*terminalChannel{}
+	tc.mu.Unlock()
+	for _, ch := range channels {
+		if ch.sess == nil {
+			ch.cancel()
+			continue
+		}
+		ch.sess.detach(ch.sub)
+	}
+}
+
+func (tc *terminalConn) send(frameType byte, channelID uint32, payload []byte) error {
+	frame := make([]byte, terminalFrameHeaderSize+len(payload))
+	frame[0] = frameType
+	binary.BigEndian.PutUint32(frame[1:terminalFrameHeaderSize], channelID)
+	copy(frame[terminalFrameHeaderSize:], payload)
+
+	tc.writeMu.Lock()
+	defer tc.writeMu.Unlock()
+	return tc.conn.WriteMessage(websocket.BinaryMessage, frame)
+}
+
+func (tc *terminalConn) sendJSON(frameType byte, channelID uint32, v any) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return tc.send(frameType, channelID, payload)
+}
+
+func (tc *terminalConn) sendError(channelID uint32, message string) {
+	_ = tc.sendJSON(frameError, channelID, map[string]string{"message": message})
+}
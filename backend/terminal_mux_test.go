@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type terminalFrame struct {
+	typ     byte
+	channel uint32
+	payload string
+}
+
+// dialTerminal connects to the multiplexed terminal as owner and reads the
+// hello frame.
+func dialTerminal(t *testing.T, m *DockerManager, auth *Authenticator, owner string) *websocket.Conn {
+	t.Helper()
+	srv := httptest.NewServer(auth.require(m.handleTerminalWS))
+	t.Cleanup(srv.Close)
+	header := http.Header{"Authorization": {"Bearer " + loginToken(t, auth, owner)}}
+	dialer := websocket.Dialer{Subprotocols: []string{terminalSubprotocol}}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	if f := readFrame(t, conn); f.typ != frameHello {
+		t.Fatalf("first frame %+v, want hello", f)
+	}
+	return conn
+}
+
+func sendFrame(t *testing.T, conn *websocket.Conn, typ byte, channel uint32, payload any) {
+	t.Helper()
+	data, ok := payload.([]byte)
+	if !ok {
+		data, _ = json.Marshal(payload)
+	}
+	frame := append([]byte{typ, 0, 0, 0, 0}, data...)
+	binary.BigEndian.PutUint32(frame[1:terminalFrameHeaderSize], channel)
+	if err := conn.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFrame(t *testing.T, conn *websocket.Conn) terminalFrame {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("reading frame: %v", err)
+	}
+	return terminalFrame{msg[0], binary.BigEndian.Uint32(msg[1:terminalFrameHeaderSize]), string(msg[terminalFrameHeaderSize:])}
+}
+
+// readUntil reads frames until one matches typ and channel.
+func readUntil(t *testing.T, conn *websocket.Conn, typ byte, channel uint32) terminalFrame {
+	t.Helper()
+	for {
+		if f := readFrame(t, conn); f.typ == typ && f.channel == channel {
+			return f
+		}
+	}
+}
+
+// holdFirstExec holds up the first exec create until release is called, so
+// the shell being opened with it stays pending. blocked is closed once it
+// has arrived.
+func holdFirstExec(t *testing.T, docker *fakeDocker) (blocked <-chan struct{}, release func()) {
+	var held atomic.Bool
+	arrived, done := make(chan struct{}), make(chan struct{})
+	release = sync.OnceFunc(func() { close(done) })
+	t.Cleanup(release)
+	docker.before = func(method, path string) {
+		if strings.HasSuffix(path, "/exec") && held.CompareAndSwap(false, true) {
+			close(arrived)
+			<-done
+		}
+	}
+	return arrived, release
+}
+
+// TestTerminalOpenDoesNotBlockOtherChannels holds up the Docker calls of one
+// channel's open and checks the other channels keep working meanwhile.
+func TestTerminalOpenDoesNotBlockOtherChannels(t *testing.T) {
+	cfg := testConfig()
+	auth := newTestAuth(t, cfg)
+	m, docker := newTestManager(t, cfg, auth)
+	owner := "alice@example.com"
+	docker.add(managedContainer(owner, "127.0.0.1"))
+
+	// Shells echo their input until the test ends.
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+	docker.exec = func(cfg dockerExecConfig, stdin io.Reader, stdout, stderr io.Writer) int {
+		go func() { _, _ = io.Copy(stdout, stdin) }()
+		<-done
+		return 0
+	}
+	blocked, release := holdFirstExec(t, docker)
+
+	conn := dialTerminal(t, m, auth, owner)
+	sendFrame(t, conn, frameOpen, 1, terminalOpenMsg{Session: "slow-shell"})
+	<-blocked
+
+	sendFrame(t, conn, frameInput, 1, []byte("early"))
+	if f := readFrame(t, conn); f.typ != frameError || f.channel != 1 || !strings.Contains(f.payload, "still opening") {
+		t.Errorf("input while opening: got %+v", f)
+	}
+	sendFrame(t, conn, frameOpen, 2, terminalOpenMsg{Session: "fast-shell"})
+	if f := readFrame(t, conn); f.typ != frameOpened || f.channel != 2 {
+		t.Fatalf("second open while the first is pending: got %+v", f)
+	}
+	sendFrame(t, conn, frameInput, 2, []byte("hi"))
+	if f := readUntil(t, conn, frameOutput, 2); f.payload != "hi" {
+		t.Errorf("output on channel 2: %q", f.payload)
+	}
+	sendFrame(t, conn, frameOpen, 1, terminalOpenMsg{Session: "another-shell"})
+	if f := readFrame(t, conn); f.typ != frameError || f.channel != 1 {
+		t.Errorf("reusing a pending channel id: got %+v", f)
+	}
+
+	release()
+	if f := readUntil(t, conn, frameOpened, 1); !strings.Contains(f.payload, `"session":"slow-shell"`) {
+		t.Errorf("opened: %s", f.payload)
+	}
+}
+
+// TestTerminalCloseWhileOpening abandons an open before the shell is up.
+func TestTerminalCloseWhileOpening(t *testing.T) {
+	cfg := testConfig()
+	auth := newTestAuth(t, cfg)
+	m, docker := newTestManager(t, cfg, auth)
+	owner := "alice@example.com"
+	docker.add(managedContainer(owner, "127.0.0.1"))
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+	docker.exec = func(cfg dockerExecConfig, stdin io.Reader, stdout, stderr io.Writer) int {
+		<-done
+		return 0
+	}
+	blocked, release := holdFirstExec(t, docker)
+
+	conn := dialTerminal(t, m, auth, owner)
+	sendFrame(t, conn, frameOpen, 1, terminalOpenMsg{Session: "abandoned-shell"})
+	<-blocked
+	sendFrame(t, conn, frameClose, 1, terminalCloseMsg{})
+	sendFrame(t, conn, frameOpen, 2, terminalOpenMsg{Session: "other-shell"})
+	if f := readFrame(t, conn); f.typ != frameOpened || f.channel != 2 {
+		t.Fatalf("got %+v, want channel 2 opened", f)
+	}
+	release()
+
+	// The abandoned open neither reports back nor keeps a subscriber.
+	sendFrame(t, conn, frameInput, 1, []byte("x"))
+	for {
+		f := readFrame(t, conn)
+		if f.channel != 1 {
+			continue
+		}
+		if f.typ != frameError || !strings.Contains(f.payload, "unknown channel") {
+			t.Fatalf("channel 1 after close: got %+v", f)
+		}
+		break
+	}
+	if sess, ok := m.sessions.get(owner, "abandoned-shell"); ok {
+		sess.mu.Lock()
+		defer sess.mu.Unlock()
+		if len(sess.subscribers) > 0 {
+			t.Error("abandoned open is still attached")
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testConfig is a Config good enough for handlers under test: HS256 tokens,
+// in-memory stores and a Docker host that tests point at a fakeDocker.
+func testConfig() *Config {
+	return &Config{
+		AppBaseURL:           "http://app.test",
+		BackendBaseURL:       "http://api.test",
+		JwtSecret:            "test-secret",
+		AccessTokenTTL:       15 * time.Minute,
+		RefreshTokenTTL:      24 * time.Hour,
+		ShellSessionGrace:    time.Minute,
+		ShellScrollbackBytes: 1 << 16,
+		BuildTimeout:         time.Minute,
+	}
+}
+
+func newTestAuth(t *testing.T, cfg *Config) *Authenticator {
+	t.Helper()
+	auth, err := NewAuthenticator(cfg, newAuthSessionStore(nil))
+	if err != nil {
+		t.Fatalf("NewAuthenticator: %v", err)
+	}
+	return auth
+}
+
+// loginToken starts a session for subject and returns its access token.
+func loginToken(t *testing.T, auth *Authenticator, subject string) string {
+	t.Helper()
+	tokens, err := auth.startSession(context.Background(), subject, 1, "test")
+	if err != nil {
+		t.Fatalf("startSession: %v", err)
+	}
+	return tokens.Token
+}
+
+// fakeDocker is a minimal Docker Engine API holding containers in memory.
+// Execs run exec, which gets the command and its attached streams.
+type fakeDocker struct {
+	mu         sync.Mutex
+	containers map[string]*dockerContainerInfo
+	execs      map[string]*fakeExec
+	calls      []string
+
+	exec func(cfg dockerExecConfig, stdin io.Reader, stdout, stderr io.Writer) int
+	// before, if set, sees every request first and may hold it up.
+	before func(method, path string)
+}
+
+type fakeExec struct {
+	cfg      dockerExecConfig
+	running  bool
+	exitCode int
+}
+
+func newFakeDocker(t *testing.T) (*fakeDocker, *httptest.Server) {
+	t.Helper()
+	d := &fakeDocker{containers: map[string]*dockerContainerInfo{}, execs: map[string]*fakeExec{}}
+	srv := httptest.NewServer(d)
+	t.Cleanup(srv.Close)
+	return d, srv
+}
+
+func (d *fakeDocker) add(info *dockerContainerInfo) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.containers[strings.TrimPrefix(info.Name, "/")] = info
+}
+
+func (d *fakeDocker) running(name string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c, ok := d.containers[name]
+	return ok && c.State.Running
+}
+
+func (d *fakeDocker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/"+dockerAPIVersion)
+	if d.before != nil {
+		d.before(r.Method, path)
+	}
+	if rest, ok := strings.CutPrefix(path, "/exec/"); ok {
+		d.serveExec(w, r, rest)
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.calls = append(d.calls, r.Method+" "+path)
+
+	if path == "/containers/json" && r.Method == http.MethodGet {
+		var filters map[string][]string
+		_ = json.Unmarshal([]byte(r.URL.Query().Get("filters")), &filters)
+		list := []dockerContainerSummary{}
+		all := r.URL.Query().Get("all") == "1"
+	containers:
+		for name, c := range d.containers {
+			if !all && !c.State.Running {
+				continue containers
+			}
+			for _, label := range filters["label"] {
+				k, v, hasValue := strings.Cut(label, "=")
+				if got, ok := c.Config.Labels[k]; !ok || hasValue && got != v {
+					continue containers
+				}
+			}
+			state := "exited"
+			if c.State.Running {
+				state = "running"
+			}
+			list = append(list, dockerContainerSummary{Id: c.Id, Names: []string{"/" + name}, State: state, Labels: c.Config.Labels})
+		}
+		_ = json.NewEncoder(w).Encode(list)
+		return
+	}
+	rest, ok := strings.CutPrefix(path, "/containers/")
+	if !ok {
+		http.Error(w, `{"message":"not implemented"}`, http.StatusNotImplemented)
+		return
+	}
+	name, action, _ := strings.Cut(rest, "/")
+	c, ok := d.containers[name]
+	for _, other := range d.containers {
+		if !ok && other.Id == name {
+			c, ok = other, true
+		}
+	}
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(map[string]string{"message": "No such container: " + name})
+		return
+	}
+	switch {
+	case action == "json" && r.Method == http.MethodGet:
+		_ = json.NewEncoder(w).Encode(c)
+	case action == "exec" && r.Method == http.MethodPost:
+		var cfg dockerExecConfig
+		_ = json.NewDecoder(r.Body).Decode(&cfg)
+		id := fmt.Sprintf("exec-%d", len(d.execs)+1)
+		d.execs[id] = &fakeExec{cfg: cfg}
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(map[string]string{"Id": id})
+	case action == "start" && r.Method == http.MethodPost:
+		c.State.Running = true
+		c.State.Status = "running"
+		c.State.StartedAt = time.Now()
+		w.WriteHeader(http.StatusNoContent)
+	case action == "stop" && r.Method == http.MethodPost:
+		c.State.Running = false
+		c.State.Status = "exited"
+		c.State.FinishedAt = time.Now()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, `{"message":"not implemented"}`, http.StatusNotImplemented)
+	}
+}
+
+// serveExec answers /exec/{id}/start by hijacking the connection and
+// running d.exec on it, and /exec/{id}/json with the result.
+func (d *fakeDocker) serveExec(w http.ResponseWriter, r *http.Request, rest string) {
+	id, action, _ := strings.Cut(rest, "/")
+	d.mu.Lock()
+	d.calls = append(d.calls, r.Method+" /exec/"+rest)
+	e, ok := d.execs[id]
+	d.mu.Unlock()
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(map[string]string{"message": "No such exec instance: " + id})
+		return
+	}
+	switch action {
+	case "json":
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		_ = json.NewEncoder(w).Encode(dockerExecInfo{ID: id, Running: e.running, ExitCode: e.exitCode})
+	case "start":
+		var opts struct{ Detach bool }
+		_ = json.NewDecoder(r.Body).Decode(&opts)
+		run := func(stdin io.Reader, stdout, stderr io.Writer) {
+			d.mu.Lock()
+			e.running = true
+			d.mu.Unlock()
+			code := 0
+			if d.exec != nil {
+				code = d.exec(e.cfg, stdin, stdout, stderr)
+			}
+			d.mu.Lock()
+			e.running, e.exitCode = false, code
+			d.mu.Unlock()
+		}
+		if opts.Detach {
+			run(strings.NewReader(""), io.Discard, io.Discard)
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		conn, buf, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = buf.WriteString("HTTP/1.1 101 UPGRADED\r\nContent-Type: application/vnd.docker.raw-stream\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n")
+		_ = buf.Flush()
+		var stdin io.Reader = strings.NewReader("")
+		if e.cfg.AttachStdin {
+			stdin = buf
+		}
+		var mu sync.Mutex
+		stream := func(id byte) io.Writer {
+			if e.cfg.Tty {
+				return conn
+			}
+			return writerFunc(func(p []byte) (int, error) {
+				mu.Lock()
+				defer mu.Unlock()
+				header := []byte{id, 0, 0, 0, 0, 0, 0, 0}
+				binary.BigEndian.PutUint32(header[4:], uint32(len(p)))
+				if _, err := conn.Write(append(header, p...)); err != nil {
+					return 0, err
+				}
+				return len(p), nil
+			})
+		}
+		run(stdin, stream(dockerStreamStdout), stream(dockerStreamStderr))
+	default:
+		http.Error(w, `{"message":"not implemented"}`, http.StatusNotImplemented)
+	}
+}
+
+// newTestManager returns a DockerManager talking to a fakeDocker.
+func newTestManager(t *testing.T, cfg *Config, auth *Authenticator) (*DockerManager, *fakeDocker) {
+	t.Helper()
+	d, srv := newFakeDocker(t)
+	cfg.DockerHost = "tcp://" + srv.Listener.Addr().String()
+	m, err := NewDockerManager(cfg, auth, nil)
+	if err != nil {
+		t.Fatalf("NewDockerManager: %v", err)
+	}
+	return m, d
+}
+
+// managedContainer is a running container owned by owner.
+func managedContainer(owner, ip string) *dockerContainerInfo {
+	info := &dockerContainerInfo{Id: "id-" + ownerKey(owner), Name: "/" + containerNameFor(owner)}
+	info.State.Running = true
+	info.State.Status = "running"
+	info.State.StartedAt = time.Now().Add(-time.Hour)
+	info.Config.Labels = map[string]string{labelManaged: "true", labelOwner: owner}
+	info.NetworkSettings.IPAddress = ip
+	return info
+}
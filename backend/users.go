@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errUserNotFound = errors.New("user not found")
+
+// appUser is a person who has logged in. Containers and other resources are
+// still keyed by Email, which is the JWT subject.
+type appUser struct {
+	Id          int64     `json:"id"`
+	Email       string    `json:"email"`
+	Name        string    `json:"name"`
+	Picture     string    `json:"picture,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+	LastLoginAt time.Time `json:"lastLoginAt"`
+
+	// Identities is filled in by GET /me only.
+	Identities []userIdentity `json:"identities,omitempty"`
+}
+
+// userIdentity links a provider account to a user; a user logging in
+// through several providers has one per provider.
+type userIdentity struct {
+	Provider    string    `json:"provider"`
+	Subject     string    `json:"subject"`
+	UserId      int64     `json:"-"`
+	Email       string    `json:"email"`
+	CreatedAt   time.Time `json:"createdAt"`
+	LastLoginAt time.Time `json:"lastLoginAt"`
+}
+
+// userStore is the repository for users.
+type userStore interface {
+	// upsertIdentity records a login. A new identity joins the user with
+	// the same email (the subject everything is keyed by) or creates one;
+	// either way the user's profile and last login time are refreshed.
+	upsertIdentity(ctx context.Context, ident externalIdentity) (appUser, error)
+	userByID(ctx context.Context, id int64) (appUser, error)
+	userByEmail(ctx context.Context, email string) (appUser, error)
+	identitiesFor(ctx context.Context, userID int64) ([]userIdentity, error)
+}
+
+// newUserStore uses Postgres when a database is configured and falls back to
+// memory (users are forgotten on restart) otherwise.
+func newUserStore(db *DB) userStore {
+	if db == nil {
+		return newMemoryUserStore()
+	}
+	return &sqlUserStore{db: db.SQL}
+}
+
+type memoryUserStore struct {
+	mu         sync.Mutex
+	users      []appUser // index is id-1
+	identities []userIdentity
+}
+
+func newMemoryUserStore() *memoryUserStore {
+	return &memoryUserStore{}
+}
+
+func (s *memoryUserStore) upsertIdentity(ctx context.Context, ident externalIdentity) (appUser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().UTC()
+	idx := slices.IndexFunc(s.identities, func(i userIdentity) bool {
+		return i.Provider == ident.Provider && i.Subject == ident.Subject
+	})
+	var userID int64
+	if idx >= 0 {
+		s.identities[idx].Email, s.identities[idx].LastLoginAt = ident.Email, now
+		userID = s.identities[idx].UserId
+	} else {
+		if u := s.latestByEmail(ident.Email); u != nil {
+			userID = u.Id
+		} else {
+			userID = int64(len(s.users) + 1)
+			s.users = append(s.users, appUser{Id: userID, Email: ident.Email, CreatedAt: now})
+		}
+		s.identities = append(s.identities, userIdentity{
+			Provider:    ident.Provider,
+			Subject:     ident.Subject,
+			UserId:      userID,
+			Email:       ident.Email,
+			CreatedAt:   now,
+			LastLoginAt: now,
+		})
+	}
+	u := &s.users[userID-1]
+	u.Email, u.LastLoginAt = ident.Email, now
+	u.Name = firstNonEmpty(ident.Name, u.Name)
+	u.Picture = firstNonEmpty(ident.Picture, u.Picture)
+	return *u, nil
+}
+
+func (s *memoryUserStore) userByID(ctx context.Context, id int64) (appUser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if id < 1 || id > int64(len(s.users)) {
+		return appUser{}, errUserNotFound
+	}
+	return s.users[id-1], nil
+}
+
+func (s *memoryUserStore) userByEmail(ctx context.Context, email string) (appUser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	found := s.latestByEmail(email)
+	if found == nil {
+		return appUser{}, errUserNotFound
+	}
+	return *found, nil
+}
+
+// latestByEmail picks the most recent login if an address moved between
+// users. Callers hold mu.
+func (s *memoryUserStore) latestByEmail(email string) *appUser {
+	var found *appUser
+	for i, u := range s.users {
+		if strings.EqualFold(u.Email, email) && (found == nil || u.LastLoginAt.After(found.LastLoginAt)) {
+			found = &s.users[i]
+		}
+	}
+	return found
+}
+
+func (s *memoryUserStore) identitiesFor(ctx context.Context, userID int64) ([]userIdentity, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []userIdentity
+	for _, i := range s.identities {
+		if i.UserId == userID {
+			out = append(out, i)
+		}
+	}
+	return out, nil
+}
+
+type sqlUserStore struct {
+	db *sql.DB
+}
+
+const userColumns = `id, email, name, picture, created_at, last_login_at`
+
+func scanUser(row interface{ Scan(...any) error }) (appUser, error) {
+	var u appUser
+	err := row.Scan(&u.Id, &u.Email, &u.Name, &u.Picture, &u.CreatedAt, &u.LastLoginAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return u, errUserNotFound
+	}
+	return u, err
+}
+
+func (s *sqlUserStore) upsertIdentity(ctx context.Context, ident externalIdentity) (appUser, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return appUser{}, err
+	}
+	defer tx.Rollback()
+
+	var userID int64
+	err = tx.QueryRowContext(ctx,
+		`UPDATE user_identities SET email = $3, last_login_at = now()
+		 WHERE provider = $1 AND subject = $2 RETURNING user_id`,
+		ident.Provider, ident.Subject, ident.Email).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = tx.QueryRowContext(ctx,
+			`SELECT id FROM users WHERE lower(email) = lower($1) ORDER BY last_login_at DESC LIMIT 1`,
+			ident.Email).Scan(&userID)
+		if errors.Is(err, sql.ErrNoRows) {
+			err = tx.QueryRowContext(ctx, `INSERT INTO users (email) VALUES ($1) RETURNING id`, ident.Email).Scan(&userID)
+		}
+		if err != nil {
+			return appUser{}, err
+		}
+		_, err = tx.ExecContext(ctx,
+			`INSERT INTO user_identities (provider, subject, user_id, email) VALUES ($1, $2, $3, $4)`,
+			ident.Provider, ident.Subject, userID, ident.Email)
+	}
+	if err != nil {
+		return appUser{}, err
+	}
+
+	user, err := scanUser(tx.QueryRowContext(ctx,
+		`UPDATE users SET email = $2, name = COALESCE(NULLIF($3, ''), name),
+		 picture = COALESCE(NULLIF($4, ''), picture), last_login_at = now()
+		 WHERE id = $1 RETURNING `+userColumns,
+		userID, ident.Email, ident.Name, ident.Picture))
+	if err != nil {
+		return appUser{}, err
+	}
+	return user, tx.Commit()
+}
+
+func (s *sqlUserStore) userByID(ctx context.Context, id int64) (appUser, error) {
+	return scanUser(s.db.QueryRowContext(ctx, `SELECT `+userColumns+` FROM users WHERE id = $1`, id))
+}
+
+func (s *sqlUserStore) userByEmail(ctx context.Context, email string) (appUser, error) {
+	return scanUser(s.db.QueryRowContext(ctx,
+		`SELECT `+userColumns+` FROM users WHERE lower(email) = lower($1) ORDER BY last_login_at DESC LIMIT 1`, email))
+}
+
+func (s *sqlUserStore) identitiesFor(ctx context.Context, userID int64) ([]userIdentity, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT provider, subject, user_id, email, created_at, last_login_at
+		 FROM user_identities WHERE user_id = $1 ORDER BY created_at`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []userIdentity
+	for rows.Next() {
+		var i userIdentity
+		if err := rows.Scan(&i.Provider, &i.Subject, &i.UserId, &i.Email, &i.CreatedAt, &i.LastLoginAt); err != nil {
+			return nil, err
+		}
+		out = append(out, i)
+	}
+	return out, rows.Err()
+}
+
+// UserHandler serves the caller's own user record.
+type UserHandler struct {
+	users userStore
+}
+
+func NewUserHandler(users userStore) *UserHandler {
+	return &UserHandler{users: users}
+}
+
+// lookup finds the caller's record: by the token's uid claim, or by email
+// for tokens issued before users were stored.
+func (h *UserHandler) lookup(ctx context.Context, user *authUser) (appUser, error) {
+	if user.UserId != 0 {
+		return h.users.userByID(ctx, user.UserId)
+	}
+	return h.users.userByEmail(ctx, user.Subject)
+}
+
+// GET /me
+func (h *UserHandler) handleMe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJson(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	user := currentUser(r)
+	if user == nil {
+		writeJson(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+	record, err := h.lookup(r.Context(), user)
+	if err == nil {
+		record.Identities, err = h.users.identitiesFor(r.Context(), record.Id)
+	}
+	switch {
+	case errors.Is(err, errUserNotFound):
+		writeJson(w, http.StatusNotFound, map[string]string{"error": "no user record; log in again"})
+	case err != nil:
+		writeJson(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	default:
+		writeJson(w, http.StatusOK, record)
+	}
+}
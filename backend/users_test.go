@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMemoryUserStoreUpsertIdentity(t *testing.T) {
+	ctx := context.Background()
+	s := newMemoryUserStore()
+	github := externalIdentity{Provider: "github", Subject: "42", Email: "alice@example.com", Name: "Alice", Picture: "https://img/a.png"}
+
+	first, err := s.upsertIdentity(ctx, github)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Id != 1 || first.Email != "alice@example.com" || first.Name != "Alice" || first.Picture != "https://img/a.png" {
+		t.Fatalf("first login: %+v", first)
+	}
+
+	// A repeat login bumps the last login of the user and the identity.
+	earlier := time.Now().UTC().Add(-time.Hour)
+	s.users[0].LastLoginAt, s.identities[0].LastLoginAt = earlier, earlier
+	again, err := s.upsertIdentity(ctx, github)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Id != first.Id || !again.LastLoginAt.After(earlier) || !again.CreatedAt.Equal(first.CreatedAt) {
+		t.Errorf("repeat login: %+v", again)
+	}
+	if idents, _ := s.identitiesFor(ctx, first.Id); len(idents) != 1 || !idents[0].LastLoginAt.After(earlier) {
+		t.Errorf("identities after a repeat login: %+v", idents)
+	}
+
+	// Another provider with the same address joins the same user, and its
+	// missing name and picture leave the stored ones alone.
+	google, err := s.upsertIdentity(ctx, externalIdentity{Provider: "google", Subject: "g-1", Email: "Alice@Example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if google.Id != first.Id || google.Name != "Alice" || google.Picture != "https://img/a.png" {
+		t.Errorf("second provider: %+v", google)
+	}
+	if idents, _ := s.identitiesFor(ctx, first.Id); len(idents) != 2 {
+		t.Errorf("identities: %+v", idents)
+	}
+
+	// A new name does replace the old one.
+	github.Name = "Alice Liddell"
+	if u, _ := s.upsertIdentity(ctx, github); u.Name != "Alice Liddell" || u.Picture != "https://img/a.png" {
+		t.Errorf("renamed: %+v", u)
+	}
+
+	// Someone else gets their own user.
+	bob, err := s.upsertIdentity(ctx, externalIdentity{Provider: "github", Subject: "43", Email: "bob@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bob.Id == first.Id {
+		t.Errorf("bob joined alice's user")
+	}
+}
+
+func TestHandleMe(t *testing.T) {
+	ctx := context.Background()
+	auth := newTestAuth(t, testConfig())
+	users := newMemoryUserStore()
+	alice, err := users.upsertIdentity(ctx, externalIdentity{Provider: "github", Subject: "42", Email: "alice@example.com", Name: "Alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := auth.require(NewUserHandler(users).handleMe)
+	get := func(subject string, uid int64) (int, appUser) {
+		t.Helper()
+		tokens, err := auth.startSession(ctx, subject, uid, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest(http.MethodGet, "/me", nil)
+		req.Header.Set("Authorization", "Bearer "+tokens.Token)
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		var out appUser
+		_ = json.Unmarshal(rec.Body.Bytes(), &out)
+		return rec.Code, out
+	}
+
+	if code, me := get("alice@example.com", alice.Id); code != http.StatusOK || me.Id != alice.Id || len(me.Identities) != 1 || me.Identities[0].Provider != "github" {
+		t.Errorf("by uid: %d %+v", code, me)
+	}
+	// Tokens from before users were stored carry no uid.
+	if code, me := get("alice@example.com", 0); code != http.StatusOK || me.Id != alice.Id || me.Name != "Alice" {
+		t.Errorf("by email: %d %+v", code, me)
+	}
+	if code, _ := get("carol@example.com", 0); code != http.StatusNotFound {
+		t.Errorf("unknown user: %d", code)
+	}
+}
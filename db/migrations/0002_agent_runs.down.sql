@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS agent_run_events;
+DROP TABLE IF EXISTS agent_runs;
@@ -0,0 +1,14 @@
+-- Who approved or denied which agent command.
+CREATE TABLE IF NOT EXISTS agent_audit_log (
+  id BIGSERIAL PRIMARY KEY,
+  owner TEXT NOT NULL,
+  run_id TEXT NOT NULL,
+  tool TEXT NOT NULL,
+  command TEXT NOT NULL,
+  decision TEXT NOT NULL,
+  decided_by TEXT NOT NULL,
+  rule TEXT NOT NULL DEFAULT '',
+  reason TEXT NOT NULL DEFAULT '',
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS agent_audit_log_owner_idx ON agent_audit_log (owner, id DESC);
@@ -0,0 +1,5 @@
+-- Users who never logged in with Google are left with a NULL google_sub.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS google_sub TEXT UNIQUE;
+UPDATE users u SET google_sub = i.subject
+FROM user_identities i WHERE i.user_id = u.id AND i.provider = 'google';
+DROP TABLE IF EXISTS user_identities;
@@ -0,0 +1,18 @@
+-- Login identities from any configured provider; a user can have one per
+-- provider. Google account ids move here from users.google_sub.
+CREATE TABLE IF NOT EXISTS user_identities (
+  provider TEXT NOT NULL,
+  subject TEXT NOT NULL,
+  user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  email TEXT NOT NULL DEFAULT '',
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  last_login_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  PRIMARY KEY (provider, subject)
+);
+CREATE INDEX IF NOT EXISTS user_identities_user_idx ON user_identities (user_id);
+
+INSERT INTO user_identities (provider, subject, user_id, email, created_at, last_login_at)
+SELECT 'google', google_sub, id, email, created_at, last_login_at FROM users
+ON CONFLICT DO NOTHING;
+
+ALTER TABLE users DROP COLUMN IF EXISTS google_sub;
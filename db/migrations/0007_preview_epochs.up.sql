@@ -0,0 +1,7 @@
+-- Preview link revocations: links carry the owner's epoch at issue time and
+-- stop working once DELETE /docker/previews moves it on.
+CREATE TABLE IF NOT EXISTS preview_epochs (
+  owner TEXT PRIMARY KEY,
+  epoch BIGINT NOT NULL DEFAULT 0,
+  revoked_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
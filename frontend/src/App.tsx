@@ -59,13 +59,22 @@ function App() {
   )
 
   const shellWsUrl = useMemo(() => {
+    // One shell session per tab; sessionStorage survives reloads so the backend
+    // can reattach us to the still-running shell.
+    let sessionId = sessionStorage.getItem('shell_session_id')
+    if (!sessionId) {
+      sessionId = crypto.randomUUID()
+      sessionStorage.setItem('shell_session_id', sessionId)
+    }
+    const query = `?session=${encodeURIComponent(sessionId)}`
+
     const hostname = window.location.hostname
     const isLocalhost = hostname === 'localhost' || hostname === '127.0.0.1'
     if (isLocalhost) {
-      return `ws://${hostname}:18711/docker/shell`
+      return `ws://${hostname}:18711/docker/shell${query}`
     }
     const protocol = window.location.protocol === 'https:' ? 'wss' : 'ws'
-    return `${protocol}://${window.location.host}/docker/shell`
+    return `${protocol}://${window.location.host}/docker/shell${query}`
   }, [])
 
   return (
@@ -0,0 +1,49 @@
+// Access tokens live for minutes; the refresh token sits in an HttpOnly
+// cookie scoped to the backend's /auth path, so every call here sends
+// credentials.
+
+// tokenExpiresAt reads the exp claim (in ms) without verifying the token.
+export function tokenExpiresAt(token: string): number | null {
+  try {
+    const payload = JSON.parse(atob(token.split('.')[1].replace(/-/g, '+').replace(/_/g, '/'))) as { exp?: number }
+    return typeof payload.exp === 'number' ? payload.exp * 1000 : null
+  } catch {
+    return null
+  }
+}
+
+// exchangeLoginCode trades the one-time code from the login redirect for an
+// access token (the backend sets the refresh cookie at the same time).
+export async function exchangeLoginCode(backendBaseUrl: string, code: string): Promise<string | null> {
+  const response = await fetch(`${backendBaseUrl}/auth/token`, {
+    method: 'POST',
+    credentials: 'include',
+    headers: { 'Content-Type': 'application/json' },
+    body: JSON.stringify({ code }),
+  })
+  if (!response.ok) return null
+  const data = (await response.json()) as { token: string }
+  return data.token
+}
+
+// refreshAccessToken trades the refresh cookie for a new access token. It
+// returns null when the session is gone and the user must log in again.
+export async function refreshAccessToken(backendBaseUrl: string): Promise<string | null> {
+  for (let attempt = 0; attempt < 2; attempt++) {
+    const response = await fetch(`${backendBaseUrl}/auth/refresh`, { method: 'POST', credentials: 'include' })
+    if (response.ok) {
+      const data = (await response.json()) as { token: string }
+      return data.token
+    }
+    // 409: another tab rotated the cookie at the same moment; the browser
+    // already holds the new one, so try again.
+    if (response.status !== 409) return null
+    await new Promise((resolve) => setTimeout(resolve, 1000))
+  }
+  return null
+}
+
+// logout revokes the session on the backend (and clears the cookie).
+export async function logout(backendBaseUrl: string): Promise<void> {
+  await fetch(`${backendBaseUrl}/auth/logout`, { method: 'POST', credentials: 'include' }).catch(() => undefined)
+}
@@ -1,6 +1,7 @@
 import { useCallback, useEffect, useRef, useState } from 'react'
 import './TerminalPane.css'
 import { loadLibtmtWasm, writeString, type LibtmtInstance } from '../terminal/libtmt/libtmt'
+import { shellSubprotocols } from '../terminal/shellAuth'
 
 type CanvasTerminalPaneProps = {
   wsUrl: string
@@ -369,7 +370,7 @@ export function CanvasTerminalPane({
       if (cancelled) return
 
       setStatus('connecting')
-      const ws = new WebSocket(wsUrl)
+      const ws = new WebSocket(wsUrl, shellSubprotocols())
       wsRef.current = ws
       ws.binaryType = 'arraybuffer'
 
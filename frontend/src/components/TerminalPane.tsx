@@ -1,5 +1,6 @@
 import { useCallback, useEffect, useRef, useState } from 'react'
 import './TerminalPane.css'
+import { shellSubprotocols } from '../terminal/shellAuth'
 
 type TerminalPaneProps = {
   wsUrl: string
@@ -219,7 +220,7 @@ export function TerminalPane({ wsUrl, isActive, onActiveChange }: TerminalPanePr
     setDisplay('')
     emuRef.current = { lines: [''], row: 0, col: 0, escBuf: '' }
 
-    const ws = new WebSocket(wsUrl)
+    const ws = new WebSocket(wsUrl, shellSubprotocols())
     wsRef.current = ws
     ws.binaryType = 'arraybuffer'
 
@@ -1,4 +1,5 @@
 import { useCallback, useEffect, useMemo, useState } from 'react'
+import { exchangeLoginCode, logout, refreshAccessToken, tokenExpiresAt } from '../auth/session'
 import './TopNav.css'
 
 export type DockerStatus = 'unknown' | 'not_found' | 'running' | 'stopped' | 'error'
@@ -8,12 +9,25 @@ type DockerStatusResponse = {
   containerId?: string
   details?: string
   message?: string
+  template?: string
+}
+
+type DockerTemplate = {
+  name: string
+  description?: string
 }
 
 type DockerActionResponse = {
   ok: boolean
   message: string
   status?: DockerStatus
+  jobId?: string
+}
+
+type LoginProvider = {
+  name: string
+  displayName: string
+  loginUrl: string
 }
 
 type TopNavProps = {
@@ -32,6 +46,10 @@ export function TopNav({ onDockerStatusChange, onOpenShell }: TopNavProps) {
   const [lastMessage, setLastMessage] = useState<string>('')
   const [authToken, setAuthToken] = useState<string | null>(() => localStorage.getItem('auth_token'))
   const [isAccountOpen, setIsAccountOpen] = useState(false)
+  const [loginProviders, setLoginProviders] = useState<LoginProvider[]>([])
+  const [isLoginMenuOpen, setIsLoginMenuOpen] = useState(false)
+  const [templates, setTemplates] = useState<DockerTemplate[]>([])
+  const [selectedTemplate, setSelectedTemplate] = useState<string>('')
 
   const backendBaseUrl = useMemo(() => {
     const envBackendBaseUrl = import.meta.env.VITE_BACKEND_BASE_URL as string | undefined
@@ -49,22 +67,50 @@ export function TopNav({ onDockerStatusChange, onOpenShell }: TopNavProps) {
     return `${protocol}://${window.location.host}`
   }, [])
 
+  const authHeaders = useMemo<Record<string, string>>(
+    () => (authToken ? { Authorization: `Bearer ${authToken}` } : {}),
+    [authToken],
+  )
+
   const refreshStatus = useCallback(async () => {
     try {
-      const response = await fetch(`${backendBaseUrl}/docker/status`)
+      const response = await fetch(`${backendBaseUrl}/docker/status`, { headers: authHeaders })
       const data = (await response.json()) as DockerStatusResponse
       setDockerStatus(data.status)
-      setStatusDetails(data.details ?? data.message ?? '')
+      const details = data.details ?? data.message ?? ''
+      setStatusDetails(data.template ? `${details} [${data.template}]` : details)
+      if (data.template) {
+        setSelectedTemplate(data.template)
+      }
     } catch (error) {
       setDockerStatus('error')
       setStatusDetails(String(error))
     }
-  }, [backendBaseUrl])
+  }, [backendBaseUrl, authHeaders])
 
   useEffect(() => {
     refreshStatus()
   }, [refreshStatus])
 
+  useEffect(() => {
+    if (!authToken) return
+    fetch(`${backendBaseUrl}/docker/templates`, { headers: authHeaders })
+      .then((response) => response.json())
+      .then((data: { templates: DockerTemplate[]; default: string }) => {
+        setTemplates(data.templates)
+        setSelectedTemplate((current) => current || data.default)
+      })
+      .catch(() => setTemplates([]))
+  }, [backendBaseUrl, authHeaders, authToken])
+
+  useEffect(() => {
+    if (authToken) return
+    fetch(`${backendBaseUrl}/auth/providers`)
+      .then((response) => response.json())
+      .then((data: LoginProvider[]) => setLoginProviders(data))
+      .catch(() => setLoginProviders([]))
+  }, [backendBaseUrl, authToken])
+
   useEffect(() => {
     onDockerStatusChange?.({
       status: dockerStatus,
@@ -73,39 +119,85 @@ export function TopNav({ onDockerStatusChange, onOpenShell }: TopNavProps) {
     })
   }, [dockerStatus, statusDetails, lastMessage, onDockerStatusChange])
 
-  // If callback returns a token as query param, store it and clean URL.
+  // The login redirect carries a one-time code; exchange it for a token and
+  // drop it from the URL.
   useEffect(() => {
-    if (import.meta.env.DEV) {
-      // eslint-disable-next-line no-console
-      console.log('[auth] TopNav mounted; href=', window.location.href)
-      // eslint-disable-next-line no-console
-      console.log('[auth] initial localStorage auth_token len=', (localStorage.getItem('auth_token') || '').length)
-    }
     const params = new URLSearchParams(window.location.search)
-    const tokenFromUrl = params.get('token')
-    if (tokenFromUrl) {
-      if (import.meta.env.DEV) {
-        // eslint-disable-next-line no-console
-        console.log('[auth] token found in URL, storing to localStorage; len=', tokenFromUrl.length)
-      }
-      localStorage.setItem('auth_token', tokenFromUrl)
-      setAuthToken(tokenFromUrl)
-      params.delete('token')
-      const newSearch = params.toString()
-      const newUrl = `${window.location.pathname}${newSearch ? `?${newSearch}` : ''}${window.location.hash}`
-      window.history.replaceState({}, '', newUrl)
-    } else if (import.meta.env.DEV) {
-      // eslint-disable-next-line no-console
-      console.log('[auth] no token in URL on load')
-    }
-  }, [])
+    const code = params.get('login_code')
+    if (!code) return
+    params.delete('login_code')
+    const newSearch = params.toString()
+    const newUrl = `${window.location.pathname}${newSearch ? `?${newSearch}` : ''}${window.location.hash}`
+    window.history.replaceState({}, '', newUrl)
+    exchangeLoginCode(backendBaseUrl, code)
+      .then((token) => {
+        if (token) {
+          localStorage.setItem('auth_token', token)
+          setAuthToken(token)
+        } else {
+          setLastMessage('login failed; please try again')
+        }
+      })
+      .catch((error) => setLastMessage(String(error)))
+  }, [backendBaseUrl])
 
+  // Renew the access token a minute before it expires; if the session is
+  // gone (logged out elsewhere, revoked), drop back to logged out.
   useEffect(() => {
-    if (import.meta.env.DEV) {
-      // eslint-disable-next-line no-console
-      console.log('[auth] authToken state changed; present=', Boolean(authToken), 'len=', authToken?.length ?? 0)
-    }
-  }, [authToken])
+    if (!authToken) return
+    const expiresAt = tokenExpiresAt(authToken)
+    if (expiresAt === null) return
+    const timer = window.setTimeout(
+      async () => {
+        const token = await refreshAccessToken(backendBaseUrl).catch(() => null)
+        if (token) {
+          localStorage.setItem('auth_token', token)
+        } else {
+          localStorage.removeItem('auth_token')
+        }
+        setAuthToken(token)
+      },
+      Math.max(0, expiresAt - Date.now() - 60_000),
+    )
+    return () => window.clearTimeout(timer)
+  }, [authToken, backendBaseUrl])
+
+  // Follows a rebuild job's Server-Sent Events, showing the latest log line.
+  const followJob = useCallback(
+    async (jobId: string) => {
+      const response = await fetch(`${backendBaseUrl}/docker/jobs/${jobId}/events`, { headers: authHeaders })
+      if (!response.ok || !response.body) {
+        setLastMessage(`unable to follow job ${jobId}`)
+        return
+      }
+      const reader = response.body.pipeThrough(new TextDecoderStream()).getReader()
+      let buffered = ''
+      for (;;) {
+        const { value, done } = await reader.read()
+        if (done) return
+        buffered += value
+        let end = buffered.indexOf('\n\n')
+        while (end >= 0) {
+          const event = buffered.slice(0, end)
+          buffered = buffered.slice(end + 2)
+          end = buffered.indexOf('\n\n')
+          const name = /^event: (.*)$/m.exec(event)?.[1]
+          const data = /^data: (.*)$/m.exec(event)?.[1] ?? ''
+          if (name === 'log') {
+            const { line } = JSON.parse(data) as { line: string }
+            // Progress output redraws the line with carriage returns; show the latest state.
+            const latest = line.split('\r').filter((part) => part.trim() !== '').pop()
+            if (latest) setLastMessage(latest)
+          } else if (name === 'done') {
+            const result = JSON.parse(data) as { status: string; error?: string }
+            setLastMessage(result.error ? `rebuild ${result.status}: ${result.error}` : `rebuild ${result.status}`)
+            return
+          }
+        }
+      }
+    },
+    [backendBaseUrl, authHeaders],
+  )
 
   const runAction = useCallback(
     async (action: 'start' | 'stop' | 'rebuild') => {
@@ -114,10 +206,14 @@ export function TopNav({ onDockerStatusChange, onOpenShell }: TopNavProps) {
       try {
         const response = await fetch(`${backendBaseUrl}/docker/${action}`, {
           method: 'POST',
-          headers: { 'Content-Type': 'application/json' },
+          headers: { 'Content-Type': 'application/json', ...authHeaders },
+          body: action === 'stop' || !selectedTemplate ? undefined : JSON.stringify({ template: selectedTemplate }),
         })
         const data = (await response.json()) as DockerActionResponse
         setLastMessage(data.message)
+        if (data.jobId) {
+          await followJob(data.jobId)
+        }
       } catch (error) {
         setLastMessage(String(error))
       } finally {
@@ -125,23 +221,28 @@ export function TopNav({ onDockerStatusChange, onOpenShell }: TopNavProps) {
         await refreshStatus()
       }
     },
-    [backendBaseUrl, refreshStatus],
+    [backendBaseUrl, refreshStatus, authHeaders, followJob, selectedTemplate],
   )
 
-  const googleLoginUrl = useMemo(() => {
-    const rt = encodeURIComponent(window.location.origin)
-    return `${backendBaseUrl}/auth/google/login?return_to=${rt}`
-  }, [backendBaseUrl])
+  const loginUrlFor = useCallback(
+    (provider: LoginProvider) => {
+      const rt = encodeURIComponent(window.location.origin)
+      return `${backendBaseUrl}${provider.loginUrl}?return_to=${rt}`
+    },
+    [backendBaseUrl],
+  )
 
+  // With a single provider, log in right away; otherwise let the user pick.
   const handleLogin = () => {
-    window.location.href = googleLoginUrl
-  }
-
-  const handleSignup = () => {
-    window.location.href = googleLoginUrl
+    if (loginProviders.length === 1) {
+      window.location.href = loginUrlFor(loginProviders[0])
+      return
+    }
+    setIsLoginMenuOpen((v) => !v)
   }
 
   const handleLogout = () => {
+    void logout(backendBaseUrl)
     localStorage.removeItem('auth_token')
     setAuthToken(null)
     setIsAccountOpen(false)
@@ -151,6 +252,20 @@ export function TopNav({ onDockerStatusChange, onOpenShell }: TopNavProps) {
     <nav className='top-nav'>
       <div className='top-nav__title'>Agent Thing</div>
       <div className='top-nav__controls'>
+        {templates.length > 1 && (
+          <select
+            value={selectedTemplate}
+            onChange={(e) => setSelectedTemplate(e.target.value)}
+            disabled={isBusy}
+            title='Environment template'
+          >
+            {templates.map((t) => (
+              <option key={t.name} value={t.name} title={t.description}>
+                {t.name}
+              </option>
+            ))}
+          </select>
+        )}
         <button onClick={() => runAction('start')} disabled={isBusy}>
           Start
         </button>
@@ -171,10 +286,31 @@ export function TopNav({ onDockerStatusChange, onOpenShell }: TopNavProps) {
         <div className='top-nav__auth'>
           {!authToken ? (
             <>
-              <button className='top-nav__auth-btn' onClick={handleLogin} disabled={isBusy}>
-                Log in
-              </button>
-              <button className='top-nav__auth-btn top-nav__auth-btn--primary' onClick={handleSignup} disabled={isBusy}>
+              <div className='top-nav__account'>
+                <button
+                  className='top-nav__auth-btn'
+                  onClick={handleLogin}
+                  disabled={isBusy || loginProviders.length === 0}
+                  aria-expanded={isLoginMenuOpen}
+                  aria-haspopup='menu'
+                >
+                  Log in
+                </button>
+                {isLoginMenuOpen && (
+                  <div className='top-nav__account-menu' role='menu'>
+                    {loginProviders.map((provider) => (
+                      <a role='menuitem' key={provider.name} href={loginUrlFor(provider)} className='top-nav__account-link'>
+                        {provider.displayName}
+                      </a>
+                    ))}
+                  </div>
+                )}
+              </div>
+              <button
+                className='top-nav__auth-btn top-nav__auth-btn--primary'
+                onClick={handleLogin}
+                disabled={isBusy || loginProviders.length === 0}
+              >
                 Sign up
               </button>
             </>
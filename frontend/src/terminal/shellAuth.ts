@@ -0,0 +1,7 @@
+// Browsers can't set an Authorization header on WebSocket upgrades, so the
+// token travels as a "bearer.<token>" subprotocol. The backend echoes back
+// "agent-thing", which must therefore be offered too.
+export function shellSubprotocols(): string[] {
+  const token = localStorage.getItem('auth_token')
+  return token ? ['agent-thing', `bearer.${token}`] : ['agent-thing']
+}
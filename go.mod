@@ -4,12 +4,12 @@ go 1.25.1
 
 require (
 	github.com/air-verse/air v1.63.0
-	github.com/creack/pty v1.1.24
 	github.com/golang-jwt/jwt/v5 v5.3.0
 	github.com/golang-migrate/migrate/v4 v4.19.0
 	github.com/gorilla/websocket v1.5.3
 	github.com/jackc/pgx/v5 v5.7.4
 	github.com/joho/godotenv v1.5.1
+	github.com/moby/patternmatcher v0.6.1
 	github.com/stripe/stripe-go/v83 v83.0.0
 	golang.org/x/oauth2 v0.30.0
 	gopkg.in/ini.v1 v1.67.0